@@ -0,0 +1,385 @@
+/*
+Package audit implements the audit log of the relay : an append-only log, with one entry per round (its ID, whether it
+was an open/closed-slots request, the owner of the slot, the missing participants, a hash of the decoded cell, and the
+results of the disruption/equivocation checks).
+Each entry contains the hash of the previous one, so that an entry cannot be modified, removed or inserted without
+changing all the following hashes; every few rounds, the relay signs the hash of the last entry with its private key.
+
+The log is a sequence of JSON entries. It starts with a header entry holding the public key of the relay; a new header
+starts a new chain (e.g., when the relay restarts the protocol), so that the same file can be appended
+to by several sessions. Verify replays the chains and checks the hashes and signatures.
+
+AddRound does not block on the writer : the entries are buffered, and written (hashed, encoded and signed) by a
+goroutine, so that the relay does not do any I/O while it processes the rounds. Flush waits until they are written.
+
+Limitation : the rounds after the last signature of a chain are not protected. Anyone who can write the file can
+truncate it after the last signature (or remove whole chains at the end of the file), and Verify cannot detect it; the
+unsigned rounds which remain are listed in Report.UnsignedRounds. Only the rounds covered by a signature can be trusted.
+*/
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"gopkg.in/dedis/kyber.v2"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
+)
+
+// the types of entries
+const (
+	ENTRY_HEADER = iota
+	ENTRY_ROUND
+	ENTRY_SIGNATURE
+)
+
+// the results of an integrity check
+const (
+	CHECK_DISABLED = iota
+	CHECK_PASSED
+	CHECK_FAILED
+)
+
+// Entry is one entry of the audit log
+type Entry struct {
+	Type int
+	Time int64 //in ms since the epoch
+
+	//ENTRY_ROUND
+	RoundID         int32  `json:",omitempty"`
+	OpenClosed      bool   `json:",omitempty"`
+	OwnerSlot       int    `json:",omitempty"` //-1 if unknown
+	MissingClients  []int  `json:",omitempty"` //set if the round timed out
+	MissingTrustees []int  `json:",omitempty"`
+	CellHash        []byte `json:",omitempty"` //hash of the decoded cell, nil if it was not decoded
+	Disruption      int    `json:",omitempty"` //CHECK_*
+	Equivocation    int    `json:",omitempty"` //CHECK_*
+
+	//ENTRY_HEADER
+	PublicKey []byte `json:",omitempty"`
+
+	//ENTRY_SIGNATURE : signature of PrevHash
+	Signature []byte `json:",omitempty"`
+
+	PrevHash []byte `json:",omitempty"` //Hash of the previous entry, nil for a header
+	Hash     []byte //hash of all the above fields
+}
+
+// digest computes the hash of all the fields of the entry, except Hash
+func (e *Entry) digest() []byte {
+	buf := new(bytes.Buffer)
+	writeInt := func(i int64) {
+		binary.Write(buf, binary.BigEndian, i)
+	}
+	writeBytes := func(b []byte) {
+		writeInt(int64(len(b)))
+		buf.Write(b)
+	}
+	writeInts := func(ints []int) {
+		writeInt(int64(len(ints)))
+		for _, v := range ints {
+			writeInt(int64(v))
+		}
+	}
+
+	writeInt(int64(e.Type))
+	writeInt(e.Time)
+	writeInt(int64(e.RoundID))
+	if e.OpenClosed {
+		writeInt(1)
+	} else {
+		writeInt(0)
+	}
+	writeInt(int64(e.OwnerSlot))
+	writeInts(e.MissingClients)
+	writeInts(e.MissingTrustees)
+	writeBytes(e.CellHash)
+	writeInt(int64(e.Disruption))
+	writeInt(int64(e.Equivocation))
+	writeBytes(e.PublicKey)
+	writeBytes(e.Signature)
+	writeBytes(e.PrevHash)
+
+	h := sha256.Sum256(buf.Bytes())
+	return h[:]
+}
+
+// HashCell returns the hash stored in the entries for a decoded cell
+func HashCell(cell []byte) []byte {
+	h := sha256.Sum256(cell)
+	return h[:]
+}
+
+// Log is the writing end of an audit log
+type Log struct {
+	sync.Mutex
+	cond    *sync.Cond //signalled when entries are added, written, or when the log is closed
+	pending []*Entry   //the rounds not yet given to the writer
+	writing bool       //true while the writer writes a batch of rounds
+	err     error      //the first error of the writer; the following rounds are dropped
+	closed  bool
+	done    chan bool //closed when the writer stops
+
+	//only used by the writer goroutine (and by Close once it stopped)
+	w              io.Writer
+	encoder        *json.Encoder
+	privateKey     kyber.Scalar
+	lastHash       []byte
+	signInterval   int //sign after this number of round entries
+	unsignedRounds int
+}
+
+// NewLog starts a new chain in w, signed with privateKey every signInterval rounds
+func NewLog(w io.Writer, privateKey kyber.Scalar, publicKey kyber.Point, signInterval int) (*Log, error) {
+	if signInterval < 1 {
+		return nil, errors.New("Audit log : cannot sign every " + strconv.Itoa(signInterval) + " rounds")
+	}
+	pk, err := publicKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		w:            w,
+		encoder:      json.NewEncoder(w),
+		privateKey:   privateKey,
+		signInterval: signInterval,
+		done:         make(chan bool),
+	}
+	l.cond = sync.NewCond(l)
+	if err := l.append(&Entry{Type: ENTRY_HEADER, PublicKey: pk}); err != nil {
+		return nil, err
+	}
+	go l.writer()
+	return l, nil
+}
+
+// now returns the time stored in the entries
+func now() int64 {
+	return time.Now().UnixNano() / 1e6
+}
+
+// append chains the entry to the previous one, and writes it. Keeps the time of the entry if it is already set.
+func (l *Log) append(e *Entry) error {
+	if e.Time == 0 {
+		e.Time = now()
+	}
+	e.PrevHash = l.lastHash
+	e.Hash = e.digest()
+	if err := l.encoder.Encode(e); err != nil {
+		return err
+	}
+	l.lastHash = e.Hash
+	return nil
+}
+
+// AddRound queues the entry of a round, which is written (and signed if needed) by the writer goroutine. It does not
+// block on the I/O; it returns the error of the writer if a previous round could not be written.
+func (l *Log) AddRound(e *Entry) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return errors.New("Audit log : the log is closed")
+	}
+	if l.err != nil {
+		return l.err
+	}
+	e.Type = ENTRY_ROUND
+	e.Time = now()
+	l.pending = append(l.pending, e)
+	l.cond.Broadcast()
+	return nil
+}
+
+// writer writes the queued rounds, until the log is closed and all of them are written
+func (l *Log) writer() {
+	defer close(l.done)
+
+	l.Lock()
+	defer l.Unlock()
+	for {
+		for len(l.pending) == 0 && !l.closed {
+			l.cond.Wait()
+		}
+		if len(l.pending) == 0 {
+			return
+		}
+		entries := l.pending
+		l.pending = nil
+		if l.err != nil {
+			l.cond.Broadcast()
+			continue
+		}
+
+		l.writing = true
+		l.Unlock()
+		err := l.writeRounds(entries)
+		l.Lock()
+		l.writing = false
+		if err != nil {
+			l.err = err
+		}
+		l.cond.Broadcast()
+	}
+}
+
+// writeRounds appends the entries of some rounds, and signs the chain when needed
+func (l *Log) writeRounds(entries []*Entry) error {
+	for _, e := range entries {
+		if err := l.append(e); err != nil {
+			return err
+		}
+		l.unsignedRounds++
+		if l.unsignedRounds >= l.signInterval {
+			if err := l.sign(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush waits until all the queued rounds are written, and returns the error of the writer, if any
+func (l *Log) Flush() error {
+	l.Lock()
+	defer l.Unlock()
+
+	for len(l.pending) > 0 || l.writing {
+		l.cond.Wait()
+	}
+	return l.err
+}
+
+// sign appends a signature of the last entry
+func (l *Log) sign() error {
+	sig, err := schnorr.Sign(config.CryptoSuite, l.privateKey, l.lastHash)
+	if err != nil {
+		return err
+	}
+	if err := l.append(&Entry{Type: ENTRY_SIGNATURE, Signature: sig}); err != nil {
+		return err
+	}
+	l.unsignedRounds = 0
+	return nil
+}
+
+// Close waits until the queued rounds are written, signs the last rounds, if needed, and closes the underlying writer
+// if it is an io.Closer. Can be called several times.
+func (l *Log) Close() error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.cond.Broadcast()
+	l.Unlock()
+
+	//the writer stops once it wrote the pending rounds; we are then the only one using the chain
+	<-l.done
+	err := l.err
+	if err == nil && l.unsignedRounds > 0 {
+		err = l.sign()
+	}
+	if c, ok := l.w.(io.Closer); ok {
+		if err2 := c.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Report is the result of the verification of an audit log
+type Report struct {
+	Chains         int           //number of chains (i.e., of headers)
+	Rounds         int           //number of round entries
+	SignedRounds   int           //number of round entries covered by a signature
+	PublicKeys     []kyber.Point //the key of each chain
+	FailedRounds   []int32       //rounds which timed out or failed a check
+	UnsignedRounds []int32       //rounds at the end of a chain not covered by a signature (e.g., the relay crashed); they can be removed without trace
+}
+
+// Verify replays the audit log read from r. It returns an error if an entry was modified, removed or inserted, or if a
+// signature is invalid. If publicKey is not nil, all the chains must be signed with it. Verify cannot detect that the log
+// was truncated after the last signature (see the package documentation).
+func Verify(r io.Reader, publicKey kyber.Point) (*Report, error) {
+	report := new(Report)
+	decoder := json.NewDecoder(r)
+
+	var chainKey kyber.Point
+	var lastHash []byte
+	unsigned := make([]int32, 0)
+
+	endChain := func() {
+		report.UnsignedRounds = append(report.UnsignedRounds, unsigned...)
+		unsigned = make([]int32, 0)
+	}
+
+	for n := 0; ; n++ {
+		e := new(Entry)
+		if err := decoder.Decode(e); err == io.EOF {
+			break
+		} else if err != nil {
+			return report, errors.New("Audit log : cannot decode entry " + strconv.Itoa(n) + ", " + err.Error())
+		}
+
+		if !bytes.Equal(e.Hash, e.digest()) {
+			return report, errors.New("Audit log : entry " + strconv.Itoa(n) + " has been modified")
+		}
+
+		if e.Type == ENTRY_HEADER {
+			if e.PrevHash != nil {
+				return report, errors.New("Audit log : header " + strconv.Itoa(n) + " is chained to a previous entry")
+			}
+			endChain()
+			chainKey = config.CryptoSuite.Point()
+			if err := chainKey.UnmarshalBinary(e.PublicKey); err != nil {
+				return report, errors.New("Audit log : header " + strconv.Itoa(n) + " has an invalid public key, " + err.Error())
+			}
+			if publicKey != nil && !publicKey.Equal(chainKey) {
+				return report, errors.New("Audit log : header " + strconv.Itoa(n) + " has not the expected public key")
+			}
+			report.Chains++
+			report.PublicKeys = append(report.PublicKeys, chainKey)
+			lastHash = e.Hash
+			continue
+		}
+
+		if chainKey == nil {
+			return report, errors.New("Audit log : entry " + strconv.Itoa(n) + " comes before any header")
+		}
+		if !bytes.Equal(e.PrevHash, lastHash) {
+			return report, errors.New("Audit log : entry " + strconv.Itoa(n) + " is not chained to the previous entry")
+		}
+
+		switch e.Type {
+		case ENTRY_ROUND:
+			report.Rounds++
+			unsigned = append(unsigned, e.RoundID)
+			if len(e.MissingClients) > 0 || len(e.MissingTrustees) > 0 || e.Disruption == CHECK_FAILED || e.Equivocation == CHECK_FAILED {
+				report.FailedRounds = append(report.FailedRounds, e.RoundID)
+			}
+		case ENTRY_SIGNATURE:
+			if err := schnorr.Verify(config.CryptoSuite, chainKey, e.PrevHash, e.Signature); err != nil {
+				return report, errors.New("Audit log : signature " + strconv.Itoa(n) + " is invalid, " + err.Error())
+			}
+			report.SignedRounds += len(unsigned)
+			unsigned = make([]int32, 0)
+		default:
+			return report, errors.New("Audit log : entry " + strconv.Itoa(n) + " has an unknown type " + strconv.Itoa(e.Type))
+		}
+		lastHash = e.Hash
+	}
+	endChain()
+
+	return report, nil
+}
@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+)
+
+func TestAuditLog(t *testing.T) {
+
+	pub, priv := crypto.NewKeyPair()
+	buf := new(bytes.Buffer)
+
+	l, err := NewLog(buf, priv, pub, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLog(buf, priv, pub, 0); err == nil {
+		t.Error("Should not be able to sign every 0 rounds")
+	}
+
+	l.AddRound(&Entry{RoundID: 1, OwnerSlot: 0, CellHash: HashCell([]byte{1, 2, 3})})
+	l.AddRound(&Entry{RoundID: 2, OpenClosed: true, OwnerSlot: 1, CellHash: HashCell([]byte{4})})
+	l.AddRound(&Entry{RoundID: 3, OwnerSlot: -1, MissingClients: []int{1}})
+	if err := l.Flush(); err != nil {
+		t.Fatal("Should write the rounds,", err)
+	}
+
+	// before Close, the last round is not signed
+	report, err := Verify(bytes.NewReader(buf.Bytes()), pub)
+	if err != nil {
+		t.Error("Should verify the log,", err)
+	}
+	if report.Chains != 1 || report.Rounds != 3 || report.SignedRounds != 2 {
+		t.Error("Wrong report", report)
+	}
+	if len(report.UnsignedRounds) != 1 || report.UnsignedRounds[0] != 3 {
+		t.Error("Round 3 should not be signed", report.UnsignedRounds)
+	}
+	if len(report.FailedRounds) != 1 || report.FailedRounds[0] != 3 {
+		t.Error("Round 3 should have failed", report.FailedRounds)
+	}
+
+	l.Close()
+	l.Close()
+	if err := l.AddRound(&Entry{RoundID: 4}); err == nil {
+		t.Error("Should not be able to add a round to a closed log")
+	}
+
+	report, err = Verify(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Error("Should verify the log,", err)
+	}
+	if report.SignedRounds != 3 || len(report.UnsignedRounds) != 0 {
+		t.Error("All rounds should be signed after Close", report)
+	}
+
+	// a second session appends a new chain, with another key
+	pub2, priv2 := crypto.NewKeyPair()
+	l2, _ := NewLog(buf, priv2, pub2, 10)
+	l2.AddRound(&Entry{RoundID: 1, Disruption: CHECK_FAILED})
+	l2.Close()
+
+	report, err = Verify(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Error("Should verify the log,", err)
+	}
+	if report.Chains != 2 || report.Rounds != 4 || report.SignedRounds != 4 || len(report.FailedRounds) != 2 {
+		t.Error("Wrong report", report)
+	}
+	if _, err := Verify(bytes.NewReader(buf.Bytes()), pub); err == nil {
+		t.Error("The second chain is not signed with the expected key")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	// modifying an entry
+	modified := make([]string, len(lines))
+	copy(modified, lines)
+	modified[2] = strings.Replace(modified[2], `"OpenClosed":true`, `"OpenClosed":false`, 1)
+	if modified[2] == lines[2] {
+		t.Fatal("The test did not modify the entry")
+	}
+	if _, err := Verify(strings.NewReader(strings.Join(modified, "\n")), nil); err == nil {
+		t.Error("Should detect a modified entry")
+	}
+
+	// removing an entry
+	removed := append(append([]string{}, lines[:2]...), lines[3:]...)
+	if _, err := Verify(strings.NewReader(strings.Join(removed, "\n")), nil); err == nil {
+		t.Error("Should detect a removed entry")
+	}
+
+	// removing the end of the log after the last signature cannot be detected
+	l3, _ := NewLog(buf, priv, pub, 1)
+	l3.AddRound(&Entry{RoundID: 1})
+	l3.Flush()
+	signedLen := buf.Len()
+	l3.AddRound(&Entry{RoundID: 2})
+	l3.Flush()
+	if report, err := Verify(bytes.NewReader(buf.Bytes()[:signedLen]), nil); err != nil || len(report.UnsignedRounds) != 0 {
+		t.Error("A log truncated after a signature looks valid,", report, err)
+	}
+	l3.Close()
+
+	// entries without header
+	if _, err := Verify(strings.NewReader(strings.Join(lines[1:], "\n")), nil); err == nil {
+		t.Error("Should detect a missing header")
+	}
+}
+
+// failingWriter accepts n writes, then fails
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestAuditLogWriteError(t *testing.T) {
+
+	pub, priv := crypto.NewKeyPair()
+	l, err := NewLog(&failingWriter{n: 1}, priv, pub, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AddRound does not wait for the writer, the error is reported later
+	if err := l.AddRound(&Entry{RoundID: 1}); err != nil {
+		t.Error("AddRound should not wait for the writer, but", err)
+	}
+	if err := l.Flush(); err == nil {
+		t.Error("Flush should report the error of the writer")
+	}
+	if err := l.AddRound(&Entry{RoundID: 2}); err == nil {
+		t.Error("AddRound should report the error of the writer")
+	}
+	if err := l.Close(); err == nil {
+		t.Error("Close should report the error of the writer")
+	}
+}
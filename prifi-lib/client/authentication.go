@@ -0,0 +1,55 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+/*
+Authentication of the messages (see prifi-lib/net/authenticator.go). Once EnableAuthentication is called, the messages
+we send are authenticated with our key, and ReceivedMessage only accepts the messages authenticated by the relay,
+whose key we learn in ALL_ALL_PARAMETERS. A later ALL_ALL_PARAMETERS (e.g., a resync) must come from the same relay.
+REL_ALL_RESUME comes from the standby relay, whose key the relay announces in ALL_ALL_PARAMETERS : we only accept it if
+it is authenticated by this key, which is then used for the rest of the session. Without an announced standby relay,
+no one can take over the session.
+The messages which are not wrapped in a net.AUTHENTICATED_MESSAGE are local calls, or the UDP downstream cells, which
+carry their own signature.
+*/
+
+// EnableAuthentication authenticates all the messages we send from now on
+func (p *PriFiLibClientInstance) EnableAuthentication() {
+	p.messageSender.SetAuthenticator(p.clientState.authenticator)
+}
+
+// authenticate returns an error if the message is not authenticated by the relay
+func (p *PriFiLibClientInstance) authenticate(msg net.AUTHENTICATED_MESSAGE) error {
+	auth := p.clientState.authenticator
+	relayKey := auth.PeerKey(net.PEER_RELAY, 0)
+
+	switch typedMsg := msg.Msg.(type) {
+	case net.ALL_ALL_PARAMETERS:
+		if typedMsg.RelayPk == nil {
+			return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : received parameters without the key of the relay")
+		}
+		if relayKey != nil && !relayKey.Equal(typedMsg.RelayPk) {
+			return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : received parameters from another relay")
+		}
+		return auth.Open(msg, typedMsg.RelayPk)
+	case net.REL_ALL_RESUME:
+		standbyKey := p.clientState.StandbyRelayPublicKey
+		if standbyKey == nil {
+			return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : received a resume, but the relay announced no standby relay")
+		}
+		if typedMsg.RelayPk == nil || !standbyKey.Equal(typedMsg.RelayPk) {
+			return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : received a resume from another relay than the announced standby")
+		}
+		return auth.Open(msg, standbyKey)
+	}
+
+	if relayKey == nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : received a message, but the key of the relay is unknown")
+	}
+	return auth.Open(msg, relayKey)
+}
@@ -12,16 +12,19 @@ package client
  * - REL_CLI_TELL_TRUSTEES_PK - the trustee's identities. We react by sending our identity + ephemeral identity
  * - REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG - the shuffle from the trustees. We do some check, if they pass, we can communicate. We send the first round to the relay.
  * - REL_CLI_DOWNSTREAM_DATA - the data from the relay, for one round. We react by finishing the round (sending our data to the relay)
+ * - REL_ALL_RESUME - a standby relay took over the session. We keep our slot, and restart at the given round
  *
  * local functions :
  *
  * ProcessDownStreamData() <- is called by Received_REL_CLI_DOWNSTREAM_DATA; it handles the raw data received
  * SendUpstreamData() <- it is called at the end of ProcessDownStreamData(). Hence, after getting some data down, we send some data up.
  *
+ * The messages are authenticated with the PriFi keys (see authentication.go).
  * TODO : traffic need to be encrypted
  */
 
 import (
+	"context"
 	"errors"
 	"strconv"
 
@@ -39,6 +42,7 @@ import (
 	"github.com/dedis/prifi/prifi-lib/utils"
 	"github.com/dedis/prifi/utils"
 	"math/rand"
+	"os"
 	"time"
 )
 
@@ -49,6 +53,9 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_SHUTDOWN(msg net.ALL_ALL_SHUTD
 
 	p.stateMachine.ChangeState("SHUTDOWN")
 
+	//stop all go-routines we created
+	p.Stop()
+
 	return nil
 }
 
@@ -66,6 +73,8 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	dcNetType := msg.StringValueOrElse("DCNetType", "not initialized")
 	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
 	equivProtection := msg.BoolValueOrElse("EquivocationProtectionEnabled", false)
+	udpFECGroupSize := msg.IntValueOrElse("UDPFECGroupSize", 0)
+	pcapReplayDownstream := msg.BoolValueOrElse("PCAPReplayDownstream", false)
 
 	//sanity checks
 	if clientID < -1 {
@@ -80,6 +89,12 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	if payloadSize < 1 {
 		return errors.New("PayloadSize cannot be 0")
 	}
+	if udpFECGroupSize < 0 {
+		return errors.New("UDPFECGroupSize cannot be negative")
+	}
+	if err := p.checkTrustees(msg.TrusteesPks, nTrustees); err != nil {
+		return err
+	}
 
 	switch dcNetType {
 	case "Verifiable":
@@ -95,17 +110,36 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	p.clientState.PayloadSize = payloadSize
 	p.clientState.UseUDP = useUDP
 	p.clientState.TrusteePublicKey = make([]kyber.Point, nTrustees)
+	p.clientState.RelayPublicKey = msg.RelayPk
+	p.clientState.StandbyRelayPublicKey = msg.StandbyRelayPk
+	p.clientState.authenticator.SetPeerKey(net.PEER_RELAY, 0, msg.RelayPk)
 	p.clientState.sharedSecrets = make([]kyber.Point, nTrustees)
 	p.clientState.RoundNo = int32(0)
 	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
+	p.clientState.NackedRounds = make(map[int32]bool)
+	p.clientState.DataHistory = make(map[int32][]byte)
+	p.clientState.blameInProgress = false
 	p.clientState.MessageHistory = config.CryptoSuite.XOF([]byte("init")) //any non-nil, non-empty, constant array
 	p.clientState.DisruptionProtectionEnabled = disruptionProtection
 	p.clientState.EquivocationProtectionEnabled = equivProtection
+	p.clientState.UDPFECGroupSize = udpFECGroupSize
+	p.clientState.fecDecoder = net.NewFECDecoder(udpFECGroupSize)
+	p.clientState.fecStatistics = prifilog.NewFECStatistics()
+	p.clientState.fecRecoveredSinceNack = 0
+	p.clientState.pcapReplay.Downstream = pcapReplayDownstream
+	p.clientState.pcapReplay.downstreamLog = utils.NewPCAPLog()
 
 	//we know our client number, if needed, parse the pcap for replay
 	if p.clientState.pcapReplay.Enabled {
 		p.clientState.pcapReplay.PCAPFile = p.clientState.pcapReplay.PCAPFolder + "client" + strconv.Itoa(clientID) + ".pcap"
-		packets, err := utils.ParsePCAP(p.clientState.pcapReplay.PCAPFile, p.clientState.PayloadSize)
+		if _, err := os.Stat(p.clientState.pcapReplay.PCAPFile); os.IsNotExist(err) {
+			p.clientState.pcapReplay.PCAPFile += "ng"
+		}
+		options := p.clientState.pcapReplay.Options
+		if options.Seed != 0 {
+			options.Seed += int64(clientID)
+		}
+		packets, err := utils.ParsePCAPWithOptions(p.clientState.pcapReplay.PCAPFile, p.clientState.PayloadSize, options)
 		if err != nil {
 			log.Lvl2("Client", clientID, "Requested PCAP Replay, but could not parse;", err)
 		}
@@ -121,13 +155,15 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 
 	//if by chance we had a broadcast-listener goroutine, kill it
 	if p.clientState.StartStopReceiveBroadcast != nil {
-		p.clientState.StartStopReceiveBroadcast <- false
+		p.clientState.stopBroadcastListener()
 	}
 	p.clientState.StartStopReceiveBroadcast = make(chan bool, 10)
+	var listenerCtx context.Context
+	listenerCtx, p.clientState.stopBroadcastListener = context.WithCancel(p.ctx)
 
-	//start the broadcast-listener goroutine
+	//start the broadcast-listener goroutine; it stops with listenerCtx, even if it is blocked on the socket
 	if useUDP {
-		go p.messageSender.MessageSender.ClientSubscribeToBroadcast(p.clientState.ID, p.ReceivedMessage, p.clientState.StartStopReceiveBroadcast)
+		go p.messageSender.MessageSender.ClientSubscribeToBroadcast(listenerCtx, p.clientState.ID, p.ReceivedMessage, p.clientState.StartStopReceiveBroadcast)
 	}
 
 	log.Lvl2("Client " + strconv.Itoa(p.clientState.ID) + " has been initialized by message. ")
@@ -153,17 +189,123 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_DOWNSTREAM_DATA(msg net.REL_CL
 		p.clientState.pcapReplay.time0 = uint64(MsTimeStampNow())
 	}
 
-	//check if it is in-order
-	if msg.RoundID == p.clientState.RoundNo {
-		//process downstream data
-		return p.ProcessDownStreamData(msg)
-	} else if msg.RoundID < p.clientState.RoundNo {
+	if msg.RoundID < p.clientState.RoundNo {
 		log.Lvl3("Client " + strconv.Itoa(p.clientState.ID) + " : Received a REL_CLI_DOWNSTREAM_DATA for round " + strconv.Itoa(int(msg.RoundID)) + " but we are in round " + strconv.Itoa(int(p.clientState.RoundNo)) + ", discarding.")
-	} else if msg.RoundID > p.clientState.RoundNo {
-		log.Lvl3("Client "+strconv.Itoa(p.clientState.ID)+" : Skipping from round", p.clientState.RoundNo, "to round", msg.RoundID)
-		p.clientState.RoundNo = msg.RoundID
-		return p.ProcessDownStreamData(msg)
+		return nil
+	}
+
+	if msg.RoundID > p.clientState.RoundNo {
+		//with UDP, the missing rounds were probably lost; buffer this one and ask for a retransmission
+		if p.clientState.UseUDP {
+			p.clientState.BufferedRoundData[msg.RoundID] = msg
+			if msg.RoundID-p.clientState.RoundNo <= MAX_BUFFERED_DOWNSTREAM_ROUNDS {
+				p.clientState.pipelineStatistics.AddBuffered()
+				//while we wait, prepare the pads of this round, so we answer it right after the missing ones
+				p.clientState.DCNet.PrecomputePads(msg.RoundID)
+				return p.sendDownstreamNack(msg.RoundID)
+			}
+
+			//too many rounds are missing, give up on them and continue from the oldest buffered round
+			for roundID := range p.clientState.BufferedRoundData {
+				if roundID < msg.RoundID {
+					msg = p.clientState.BufferedRoundData[roundID]
+				}
+			}
+		}
+		p.skipToRound(msg.RoundID)
+	}
+
+	p.clientState.BufferedRoundData[msg.RoundID] = msg
+	return p.processBufferedRounds()
+}
+
+// processBufferedRounds processes, in order, the current round and all the following rounds we already received.
+// It stops at the first missing round, or when a round changes our state (e.g., a resync).
+func (p *PriFiLibClientInstance) processBufferedRounds() error {
+	processed := 0
+	defer func() {
+		p.clientState.pipelineStatistics.AddProcessed(processed)
+		p.clientState.pipelineStatistics.ReportWithInfo("client-" + strconv.Itoa(p.clientState.ID))
+	}()
+
+	for p.stateMachine.State() == "READY" {
+		msg, buffered := p.clientState.BufferedRoundData[p.clientState.RoundNo]
+		if !buffered {
+			return nil
+		}
+		if err := p.ProcessDownStreamData(msg); err != nil {
+			return err
+		}
+		processed++
+	}
+	return nil
+}
+
+// skipToRound gives up on the rounds between the current round and roundID, which will never be processed
+func (p *PriFiLibClientInstance) skipToRound(roundID int32) {
+	log.Lvl3("Client "+strconv.Itoa(p.clientState.ID)+" : Skipping from round", p.clientState.RoundNo, "to round", roundID)
+	p.clientState.pipelineStatistics.AddSkipped(int(roundID - p.clientState.RoundNo))
+
+	for r := range p.clientState.BufferedRoundData {
+		if r < roundID {
+			delete(p.clientState.BufferedRoundData, r)
+		}
+	}
+	for r := range p.clientState.NackedRounds {
+		if r < roundID {
+			delete(p.clientState.NackedRounds, r)
+		}
+	}
+	p.clientState.RoundNo = roundID
+}
+
+// downstreamAuthenticated returns true if the downstream cell is signed by the relay (verified by "verify"), or if the
+// relay did not tell us its public key. Otherwise, the cell is counted and should be dropped.
+func (p *PriFiLibClientInstance) downstreamAuthenticated(verify func(kyber.Point) error) bool {
+	if p.clientState.RelayPublicKey == nil {
+		return true
 	}
+	if err := verify(p.clientState.RelayPublicKey); err != nil {
+		p.clientState.UnauthenticatedCells++
+		log.Lvl1("Client", p.clientState.ID, ": dropping,", err, "(", p.clientState.UnauthenticatedCells, "unauthenticated cells so far)")
+		return false
+	}
+	return true
+}
+
+// sendDownstreamNack asks the relay to retransmit (over TCP) every round between the current round and "upToRoundID"
+// that we did not receive, buffer, or already asked for.
+func (p *PriFiLibClientInstance) sendDownstreamNack(upToRoundID int32) error {
+
+	missingRounds := make([]int32, 0)
+	for roundID := p.clientState.RoundNo; roundID < upToRoundID; roundID++ {
+		if _, buffered := p.clientState.BufferedRoundData[roundID]; buffered {
+			continue
+		}
+		if p.clientState.NackedRounds[roundID] {
+			continue
+		}
+		//with FEC, we might still rebuild this round once the parity arrives
+		if p.clientState.UDPFECGroupSize > 0 && p.clientState.fecDecoder.MayRecover(roundID) {
+			continue
+		}
+		p.clientState.NackedRounds[roundID] = true
+		missingRounds = append(missingRounds, roundID)
+	}
+
+	if len(missingRounds) == 0 {
+		return nil
+	}
+
+	log.Lvl2("Client", p.clientState.ID, ": missing downstream rounds", missingRounds, ", asking for retransmission.")
+
+	toSend := &net.CLI_REL_DOWNSTREAM_NACK{
+		ClientID:     p.clientState.ID,
+		RoundIDs:     missingRounds,
+		FECRecovered: p.clientState.fecRecoveredSinceNack,
+	}
+	p.clientState.fecRecoveredSinceNack = 0
+	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
 
 	return nil
 }
@@ -179,9 +321,60 @@ SOCKS/VPN data, or if we're running latency tests, we send a "ping" message to c
 */
 func (p *PriFiLibClientInstance) Received_REL_CLI_UDP_DOWNSTREAM_DATA(msg net.REL_CLI_DOWNSTREAM_DATA_UDP) error {
 
+	if p.clientState.UDPFECGroupSize > 0 {
+		if msg.FECParityGroupSize > 0 {
+			return p.receivedFECParity(msg)
+		}
+		p.clientState.fecDecoder.AddRound(msg.REL_CLI_DOWNSTREAM_DATA)
+	}
+
 	return p.Received_REL_CLI_DOWNSTREAM_DATA(msg.REL_CLI_DOWNSTREAM_DATA)
 }
 
+// receivedFECParity rebuilds the lost round of a group, if possible, and asks for the retransmission of the
+// rounds that could not be rebuilt (e.g., when two or more rounds of the group were lost).
+func (p *PriFiLibClientInstance) receivedFECParity(msg net.REL_CLI_DOWNSTREAM_DATA_UDP) error {
+
+	p.clientState.fecStatistics.AddParityPacket(int64(len(msg.Data)))
+
+	recovered, lost, err := p.clientState.fecDecoder.AddParity(msg)
+	if err != nil {
+		log.Error("Client", p.clientState.ID, ": could not process FEC parity,", err)
+	}
+
+	//rounds we already processed (e.g., received via a retransmission) are not losses anymore
+	if recovered != nil && recovered.RoundID < p.clientState.RoundNo {
+		recovered = nil
+		lost = 0
+	}
+
+	if recovered != nil {
+		log.Lvl2("Client", p.clientState.ID, ": rebuilt lost round", recovered.RoundID, "from FEC parity")
+		p.clientState.fecStatistics.AddRecovered(1)
+		p.clientState.fecRecoveredSinceNack++
+	} else if lost > 0 {
+		log.Lvl2("Client", p.clientState.ID, ":", lost, "rounds lost in group starting at round", msg.RoundID, ", cannot rebuild them")
+		p.clientState.fecStatistics.AddUnrecoverable(lost)
+	}
+	p.clientState.fecStatistics.ReportWithInfo("client-" + strconv.Itoa(p.clientState.ID))
+
+	if recovered != nil {
+		return p.Received_REL_CLI_DOWNSTREAM_DATA(*recovered)
+	}
+
+	//ask for the rounds that FEC could not rebuild, including the lost ones at the end of the group
+	upToRoundID := msg.RoundID + int32(msg.FECParityGroupSize)
+	if p.clientState.RoundNo > upToRoundID {
+		upToRoundID = p.clientState.RoundNo
+	}
+	for roundID := range p.clientState.BufferedRoundData {
+		if roundID > upToRoundID {
+			upToRoundID = roundID
+		}
+	}
+	return p.sendDownstreamNack(upToRoundID)
+}
+
 /*
 ProcessDownStreamData handles the downstream data. After determining if the data is for us (this is not done yet), we test if it's a
 latency-test message, test if the resync flag is on (which triggers a re-setup).
@@ -197,9 +390,13 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 
 	//if it's just one byte, no data
 	if len(msg.Data) > 1 {
+		p.clientState.BytesReceived += int64(len(msg.Data))
+
+		//test if it is a packet of the capture replayed by the relay
+		isReplayedPacket := p.clientState.pcapReplay.Downstream && p.receivedReplayedPackets(msg.Data)
 
 		//pass the data to the VPN/SOCKS5 proxy, if enabled
-		if p.clientState.DataOutputEnabled {
+		if p.clientState.DataOutputEnabled && !isReplayedPacket {
 			p.clientState.DataFromDCNet <- msg.Data
 		}
 		//test if it is the answer from our ping (for latency test)
@@ -208,31 +405,35 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 			actionFunction := func(roundRec int32, roundDiff int32, timeDiff int64) {
 				log.Lvl3("Measured latency is", timeDiff, ", for client", p.clientState.ID, ", roundDiff", roundDiff, ", received on round", msg.RoundID)
 				p.clientState.timeStatistics["measured-latency"].AddTime(timeDiff)
-				p.clientState.timeStatistics["measured-latency"].ReportWithInfo("measured-latency")
+				p.clientState.timeStatistics["measured-latency"].ReportWithInfo("measured-latency-client-" + strconv.Itoa(p.clientState.ID))
 			}
 			prifilog.DecodeLatencyMessages(msg.Data, p.clientState.ID, msg.RoundID, actionFunction)
 		}
+		//test if it is the echo of one of our cells, which was disrupted
+		if p.clientState.DisruptionProtectionEnabled {
+			p.checkEchoedCell(msg.Data)
+		}
 	}
 
 	//test if we have latency test to send
 	now := time.Now()
-	if p.clientState.LatencyTest.DoLatencyTests && p.clientState.ID == 0 && now.After(p.clientState.LatencyTest.NextLatencyTest) {
-		log.Lvl1("Client 0 wants to send a latency test")
+	if p.clientState.LatencyTest.IsProbing(p.clientState.ID) && !p.clientState.upstreamPaused && now.After(p.clientState.LatencyTest.NextLatencyTest) {
+		log.Lvl2("Client", p.clientState.ID, "wants to send a latency test")
 		newLatTest := &prifilog.LatencyTestToSend{
 			CreatedAt: now,
 		}
 		p.clientState.LatencyTest.LatencyTestsToSend = append(p.clientState.LatencyTest.LatencyTestsToSend, newLatTest)
 		p.clientState.LatencyTest.NextLatencyTest = now.Add(p.clientState.LatencyTest.LatencyTestsInterval)
-		p.clientState.LatencyTest.NextLatencyTest = p.clientState.LatencyTest.NextLatencyTest.Add(time.Duration(rand.Intn(1000)) * time.Millisecond)
+		//up to half an interval of jitter, so that the clients do not probe in the same rounds
+		jitter := time.Duration(rand.Int63n(int64(p.clientState.LatencyTest.LatencyTestsInterval)/2 + 1))
+		p.clientState.LatencyTest.NextLatencyTest = p.clientState.LatencyTest.NextLatencyTest.Add(jitter)
 	}
 
 	//if the flag "Resync" is on, we cannot write data up, but need to resend the keys instead
 	if msg.FlagResync == true {
 
 		log.Lvl1("Client ", p.clientState.ID, "Relay wants to resync, going to state BEFORE_INIT ")
-		p.stateMachine.ChangeState("BEFORE_INIT")
-
-		//TODO : regenerate ephemeral keys ?
+		p.resync()
 
 		return nil
 
@@ -270,6 +471,8 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 
 	//clean old buffered messages
 	delete(p.clientState.BufferedRoundData, int32(p.clientState.RoundNo-1))
+	delete(p.clientState.BufferedRoundData, int32(p.clientState.RoundNo))
+	delete(p.clientState.NackedRounds, int32(p.clientState.RoundNo))
 
 	t := timing.StopMeasure("round-processing")
 	timeMs := t.Nanoseconds() / 1e6
@@ -281,16 +484,45 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 	p.clientState.timeStatistics["round-processing"].AddTime(timeMs)
 	p.clientState.timeStatistics["round-processing"].ReportWithInfo("round-processing")
 
-	//now we will be expecting next message. Except if we already received and buffered it !
-	if msg, hasAMessage := p.clientState.BufferedRoundData[int32(p.clientState.RoundNo)]; hasAMessage {
-		p.Received_REL_CLI_DOWNSTREAM_DATA(msg)
-	}
+	//replace the pads we just used
+	p.padsConsumed()
 
 	return nil
 }
 
-// WantsToTransmit returns true if [we have a latency message to send] OR [we have data to send]
+// receivedReplayedPackets measures the delay of the packets replayed by the relay in "data" (relatively to the
+// beginning of round 1, as the relay does upstream), and returns false if "data" is not a replayed packet
+func (p *PriFiLibClientInstance) receivedReplayedPackets(data []byte) bool {
+	return utils.DecodePCAPMetaMessages(data, func(ID uint32, timestamp uint64, frag bool) {
+		now := MsTimeStampNow() - int64(p.clientState.pcapReplay.time0)
+		diff := now - int64(timestamp)
+
+		log.Lvl2("Client", p.clientState.ID, "got a downstream PCAP meta-message (id", ID, ",frag", frag, ") at", now, ", delay since original is", diff, "ms")
+		p.clientState.timeStatistics["pcap-delay"].AddTime(diff)
+		p.clientState.pcapReplay.downstreamLog.ReceivedPcap(ID, frag, timestamp, p.clientState.pcapReplay.time0, uint32(len(data)))
+	})
+}
+
+// WantsToTransmit returns true if our transmission policy reserves a slot, knowing if some data is waiting
 func (p *PriFiLibClientInstance) WantsToTransmit() bool {
+	if p.clientState.pendingBlame != nil {
+		//a blame must be sent whatever the policy (see disruption.go)
+		return true
+	}
+	hasData := p.hasDataToSend()
+	reserve := p.clientState.transmissionPolicy.ReserveSlot(time.Now(), hasData)
+	p.clientState.schedulesStatistics.AddReservation(reserve, hasData)
+	log.Lvl3("WantToSend", reserve, "(has data :", hasData, ", policy", p.clientState.transmissionPolicy.Name()+")")
+	return reserve
+}
+
+// hasDataToSend returns true if [we have a latency message to send] OR [we have data to send]
+func (p *PriFiLibClientInstance) hasDataToSend() bool {
+
+	//while paused, the data waits (see status.go)
+	if p.clientState.upstreamPaused {
+		return false
+	}
 
 	//we have some pcap to send
 	if p.clientState.pcapReplay.Enabled && len(p.clientState.pcapReplay.Packets) > 0 && p.clientState.pcapReplay.currentPacket < len(p.clientState.pcapReplay.Packets) {
@@ -312,26 +544,13 @@ func (p *PriFiLibClientInstance) WantsToTransmit() bool {
 		return true
 	}
 
-	// if we transmitted in the last second, keep reserving (but don't do this with pcaps)
-	if !p.clientState.pcapReplay.Enabled {
-		now := time.Now()
-		//if we transmitted in the last second, keep reserving slots
-		if now.Before(p.clientState.LastWantToSend.Add(5 * time.Second)) {
-			log.Lvl3("WantToSend < 5 sec,  true")
-			return true
-		}
-	}
-
 	// otherwise, poll the channel
 	select {
 	case myData := <-p.clientState.DataForDCNet:
-		p.clientState.LastWantToSend = time.Now()
 		p.clientState.NextDataForDCNet = &myData
-		log.Lvl3("WantToSend has data, true")
 		return true
 
 	default:
-		log.Lvl3("WantToSend           false")
 		return false
 	}
 }
@@ -358,13 +577,24 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 	if ownerSlotID == p.clientState.MySlot {
 		slotOwner = true
 	}
+	hasData := false
 	if slotOwner {
 
-		//this data has already been polled out of the DataForDCNet chan, so send it first
-		//this is non-nil when OpenClosedSlot is true, and that it had to poll data out
-		if p.clientState.NextDataForDCNet != nil {
+		if p.clientState.pendingBlame != nil {
+			//our blame goes first, in our slot, so that the relay does not learn who blames (see disruption.go)
+			upstreamCellContent = p.clientState.pendingBlame
+			p.clientState.pendingBlame = nil
+			hasData = true
+		} else if p.clientState.upstreamPaused {
+			//only cover traffic, the data waits until we resume (see status.go)
+			upstreamCellContent = make([]byte, actualPayloadSize)
+
+			//this data has already been polled out of the DataForDCNet chan, so send it first
+			//this is non-nil when OpenClosedSlot is true, and that it had to poll data out
+		} else if p.clientState.NextDataForDCNet != nil {
 			upstreamCellContent = *p.clientState.NextDataForDCNet
 			p.clientState.NextDataForDCNet = nil
+			hasData = true
 		} else {
 
 			//if there are some pcap packets to replay
@@ -399,6 +629,7 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 				}
 
 				upstreamCellContent = payload
+				hasData = len(payload) > 0
 			} else {
 
 				select {
@@ -406,6 +637,7 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 				//either select data from the data we have to send, if any
 				case myData := <-p.clientState.DataForDCNet:
 					upstreamCellContent = myData
+					hasData = true
 
 				//or, if we have nothing to send, and we are doing Latency tests, embed a pre-crafted message that we will recognize later on
 				default:
@@ -423,14 +655,17 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 
 						p.clientState.LatencyTest.LatencyTestsToSend = outMsgs
 						upstreamCellContent = bytes
+						hasData = true
 					}
 				}
 			}
+		}
 
-			//content := make([]byte, len(upstreamCellContent))
-			//copy(content[:], upstreamCellContent[:])
-			//p.clientState.DataHistory[p.clientState.RoundNo] = content
+		if hasData {
+			p.clientState.BytesSent += int64(len(upstreamCellContent))
 		}
+		p.clientState.schedulesStatistics.AddOwnSlot(hasData)
+		p.clientState.schedulesStatistics.ReportWithInfo("client-" + strconv.Itoa(p.clientState.ID) + ", policy " + p.clientState.transmissionPolicy.Name())
 	}
 
 	//produce the next upstream cell
@@ -439,6 +674,9 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 		hmac = p.computeHmac256(upstreamCellContent)
 	}
 	payload := append(hmac, upstreamCellContent...)
+	if slotOwner {
+		p.recordOwnCell(p.clientState.RoundNo, payload)
+	}
 	upstreamCell := p.clientState.DCNet.EncodeForRound(p.clientState.RoundNo, slotOwner, payload)
 
 	//send the data to the relay
@@ -453,25 +691,51 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 	return nil
 }
 
+// computeHmac256 returns the HMAC of the cells we send in our slot, keyed with the secret we share anonymously with the
+// relay (see deriveMACKey)
 func (p *PriFiLibClientInstance) computeHmac256(message []byte) []byte {
-	key := []byte("client-secret" + strconv.Itoa(p.clientState.ID))
-	h := hmac.New(sha256.New, key)
+	h := hmac.New(sha256.New, p.clientState.macKey)
 	h.Write(message)
 	return h.Sum(nil)
 }
 
+/*
+resync drops the state of the current configuration : the DC-net, our slot and the ephemeral key it was recognized
+with, and the rounds in flight. We wait in BEFORE_INIT for the parameters of the relay (which may change, e.g., the
+payload size or the trustees); then, we rejoin with a fresh ephemeral key pair (see Received_REL_CLI_TELL_TRUSTEES_PK),
+and recognize our new slot after the shuffle, as when we connected.
+*/
+func (p *PriFiLibClientInstance) resync() {
+	p.stopPadPrecomputation()
+	p.clientState.DCNet = nil
+	p.clientState.MySlot = -1
+	p.clientState.EphemeralPublicKey = nil
+	p.clientState.ephemeralPrivateKey = nil
+	p.clientState.shuffleBase = nil
+	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
+	p.clientState.NackedRounds = make(map[int32]bool)
+	p.clientState.DataHistory = make(map[int32][]byte)
+	p.clientState.blameInProgress = false
+	p.clientState.pendingBlame = nil
+	p.clientState.macKey = nil
+	p.clientState.fecDecoder = net.NewFECDecoder(p.clientState.UDPFECGroupSize)
+
+	p.stateMachine.ChangeState("BEFORE_INIT")
+	p.clientState.resyncInProgress = true //the relay will send us the new parameters
+}
+
 /*
 Received_REL_CLI_TELL_TRUSTEES_PK handles REL_CLI_TELL_TRUSTEES_PK messages. These are sent when we connect.
 The relay sends us a pack of public key which correspond to the set of pre-agreed trustees.
-Of course, there should be check on those public keys (each client need to trust one), but for now we assume those public keys belong indeed to the trustees,
-and that clients have agreed on the set of trustees.
+Those public keys must include enough of the trustees we pinned (see pinning.go, checked on ALL_ALL_PARAMETERS); if we
+did not pin any trustee, we assume those public keys belong indeed to the trustees, and that clients have agreed on the set of trustees.
 Once we receive this message, we need to reply with our Public Key (Used to derive DC-net secrets), and our Ephemeral Public Key (used for the Shuffle protocol)
 */
 func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks []kyber.Point) error {
 
-	//sanity check
-	if len(trusteesPks) < 1 {
-		e := "Client " + strconv.Itoa(p.clientState.ID) + " : len(msg.Pks) must be >= 1"
+	//sanity check (the keys were checked with the parameters, see checkTrustees)
+	if len(trusteesPks) != p.clientState.nTrustees {
+		e := "Client " + strconv.Itoa(p.clientState.ID) + " : len(msg.Pks) must be == nTrustees"
 		log.Error(e)
 		return errors.New(e)
 	}
@@ -484,12 +748,19 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks [
 		p.clientState.sharedSecrets[i] = config.CryptoSuite.Point().Mul(p.clientState.privateKey, trusteesPks[i])
 	}
 
-	p.clientState.DCNet = dcnet.NewDCNetEntity(p.clientState.ID,
-		dcnet.DCNET_CLIENT, p.clientState.PayloadSize, p.clientState.EquivocationProtectionEnabled, p.clientState.sharedSecrets)
-
-	//then, generate our ephemeral keys (used for shuffling)
+	//generate our ephemeral keys (used for shuffling); they are fresh in each session (and after each resync), and
+	//seed our pads with the shared secrets, so that the pads never repeat even if our long-term key pair does
 	p.clientState.EphemeralPublicKey, p.clientState.ephemeralPrivateKey = crypto.NewKeyPair()
 
+	p.clientState.DCNet = dcnet.NewDCNetEntity(p.clientState.ID,
+		dcnet.DCNET_CLIENT, p.clientState.PayloadSize, p.clientState.EquivocationProtectionEnabled, p.clientState.sharedSecrets,
+		dcnet.SameSessionKeys(p.clientState.EphemeralPublicKey, p.clientState.nTrustees))
+	if p.clientState.DisruptionProtectionEnabled {
+		//we may have to reveal our pads during a blame (see disruption.go)
+		p.clientState.DCNet.KeepPadHistory(p.padHistoryRounds())
+	}
+	p.startPadPrecomputation(p.clientState.DCNet)
+
 	//send the keys to the relay
 	toSend := &net.CLI_REL_TELL_PK_AND_EPH_PK{
 		ClientID: p.clientState.ID,
@@ -527,8 +798,19 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 
 	//prepare for commmunication
 	p.clientState.MySlot = mySlot
+	p.clientState.shuffleBase = msg.Base
 	p.clientState.RoundNo = int32(0)
+	p.clientState.DataHistory = make(map[int32][]byte)
+	p.clientState.blameInProgress = false
+	p.clientState.pendingBlame = nil
+	if p.clientState.DisruptionProtectionEnabled {
+		if err := p.deriveMACKey(msg); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
 	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
+	p.clientState.NackedRounds = make(map[int32]bool)
 
 	//if by chance we had a broadcast-listener goroutine, kill it
 	if p.clientState.UseUDP {
@@ -543,8 +825,47 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 
 	//change state
 	p.stateMachine.ChangeState("READY")
+	p.clientState.resyncInProgress = false
 	log.Lvl3("Client", p.clientState.ID, "ready to communicate.")
 
+	p.sendBlankFirstCell()
+
+	return nil
+}
+
+/*
+Received_REL_ALL_RESUME handles REL_ALL_RESUME messages. They are sent by a standby relay which took over the session
+of the failed relay. We keep our keys, slot and DC-net, skip the rounds until RoundID, and send a blank cell for it, like
+after the shuffle. We refuse if we already sent a cell for this round (then, the relay restarts the protocol).
+*/
+func (p *PriFiLibClientInstance) Received_REL_ALL_RESUME(msg net.REL_ALL_RESUME) error {
+
+	if !p.clientState.DCNet.CanEncodeForRound(msg.RoundID) {
+		e := "Client " + strconv.Itoa(p.clientState.ID) + " : cannot resume at round " + strconv.Itoa(int(msg.RoundID)) + ", already sent a cell for it"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	//the downstream data of the previous relay will never be completed, and the new relay signs with its own key
+	//(the standby key, see authentication.go); it has no standby itself until it sends new parameters
+	p.clientState.RelayPublicKey = msg.RelayPk
+	p.clientState.StandbyRelayPublicKey = nil
+	p.clientState.authenticator.SetPeerKey(net.PEER_RELAY, 0, msg.RelayPk)
+	p.clientState.RoundNo = msg.RoundID
+	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
+	p.clientState.NackedRounds = make(map[int32]bool)
+	p.clientState.fecDecoder = net.NewFECDecoder(p.clientState.UDPFECGroupSize)
+
+	log.Lvl1("Client " + strconv.Itoa(p.clientState.ID) + " : resumed with a new relay at round " + strconv.Itoa(int(msg.RoundID)))
+
+	p.sendBlankFirstCell()
+
+	return nil
+}
+
+// sendBlankFirstCell sends the cell of the first round, for which there is no downstream data
+func (p *PriFiLibClientInstance) sendBlankFirstCell() {
+
 	//produce a blank cell (we could embed data, but let's keep the code simple, one wasted message is not much)
 	data := make([]byte, p.clientState.PayloadSize)
 	slotOwner := false
@@ -561,7 +882,10 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 		slotOwner = true // we need one guy that takes the responsability for this first slot
 	}
 
-	upstreamCell := p.clientState.DCNet.EncodeForRound(0, slotOwner, data)
+	if slotOwner {
+		p.recordOwnCell(p.clientState.RoundNo, data)
+	}
+	upstreamCell := p.clientState.DCNet.EncodeForRound(p.clientState.RoundNo, slotOwner, data)
 
 	//send the data to the relay
 	toSend := &net.CLI_REL_UPSTREAM_DATA{
@@ -572,6 +896,4 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
 
 	p.clientState.RoundNo++
-
-	return nil
 }
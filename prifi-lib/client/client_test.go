@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/config"
@@ -13,6 +14,10 @@ import (
 	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"gopkg.in/dedis/kyber.v2"
 	"gopkg.in/dedis/onet.v2/log"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -39,7 +44,7 @@ func (t *TestMessageSender) SendToRelay(msg interface{}) error {
 func (t *TestMessageSender) BroadcastToAllClients(msg interface{}) error {
 	return errors.New("Clients should never sent to other clients")
 }
-func (t *TestMessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+func (t *TestMessageSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
 	return nil
 }
 
@@ -368,6 +373,7 @@ func TestClient(t *testing.T) {
 		DoLatencyTests:       true,
 		LatencyTestsInterval: time.Second * 0,
 		NextLatencyTest:      time.Now(),
+		ProbingClients:       []int{clientID},
 	}
 	dataDown = []byte{100, 101, 102}
 
@@ -403,10 +409,32 @@ func TestClient(t *testing.T) {
 		t.Error("Client sent a payload with a wrong size")
 	}
 
+	//a standby relay takes over; we cannot resume at a round we already sent
+	if err := client.ReceivedMessage(net.REL_ALL_RESUME{RoundID: 5}); err == nil {
+		t.Error("Client should not resume at round 5, it already sent a cell for it")
+	}
+	if len(sentToRelay) > 0 {
+		t.Error("should not have sent anything")
+	}
+	if err := client.ReceivedMessage(net.REL_ALL_RESUME{RoundID: 1006}); err != nil {
+		t.Error("Client should be able to resume at round 1006, but", err)
+	}
+	if cs.RoundNo != int32(1007) {
+		t.Error("should be in round 1007, not", cs.RoundNo)
+	}
+	if len(sentToRelay) == 0 {
+		t.Error("Client should have sent a CLI_REL_UPSTREAM_DATA to the relay")
+	}
+	resumeMsg := sentToRelay[0].(*net.CLI_REL_UPSTREAM_DATA)
+	sentToRelay = make([]interface{}, 0)
+	if resumeMsg.RoundID != int32(1006) {
+		t.Error("Client sent a wrong RoundID", resumeMsg.RoundID)
+	}
+
 	//Receive some data down with FlagResync = true
 	dataDown = []byte{100, 101, 102}
 	msg13 := net.REL_CLI_DOWNSTREAM_DATA{
-		RoundID:    6,
+		RoundID:    1007,
 		Data:       dataDown,
 		FlagResync: true, //should stop the client
 	}
@@ -414,8 +442,8 @@ func TestClient(t *testing.T) {
 	if err != nil {
 		t.Error("Client should be able to receive this data")
 	}
-	if cs.RoundNo != int32(6) {
-		t.Error("should still be in round 6", cs.RoundNo)
+	if cs.RoundNo != int32(1007) {
+		t.Error("should still be in round 1007", cs.RoundNo)
 	}
 	if len(sentToRelay) > 0 {
 		t.Error("should not have sent anything")
@@ -424,6 +452,18 @@ func TestClient(t *testing.T) {
 		t.Error("Should be in state BEFORE_INIT", client.stateMachine.State())
 	}
 
+	//data of the previous configuration, still in flight, is dropped until the relay sends the new parameters
+	msg14 := net.REL_CLI_DOWNSTREAM_DATA{
+		RoundID: 1008,
+		Data:    dataDown,
+	}
+	if err := client.ReceivedMessage(msg14); err != nil {
+		t.Error("Client should drop this data silently, but", err)
+	}
+	if len(sentToRelay) > 0 {
+		t.Error("should not have sent anything")
+	}
+
 	randomMsg := &net.CLI_REL_TELL_PK_AND_EPH_PK{}
 	if err := client.ReceivedMessage(randomMsg); err == nil {
 		t.Error("Should not accept this CLI_REL_TELL_PK_AND_EPH_PK message")
@@ -602,6 +642,8 @@ func TestDisruptionClient(t *testing.T) {
 		trusteesPubKeys[i], trusteesPrivKeys[i] = crypto.NewKeyPair()
 	}
 	msg.TrusteesPks = trusteesPubKeys
+	relayPub, relayPriv := crypto.NewKeyPair()
+	msg.RelayPk = relayPub
 
 	if err := client.ReceivedMessage(*msg); err != nil {
 		t.Error("Client should be able to receive this message:", err)
@@ -648,6 +690,7 @@ func TestDisruptionClient(t *testing.T) {
 	}
 	toSend5, _ := n.RelayView.VerifySigsAndSendToClients(trusteesPubKeys)
 	parsed5 := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
+	macKey := relayKeySlot(t, parsed5, relayPriv, 0)
 
 	//should receive a Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG
 	err4 := client.ReceivedMessage(*parsed5)
@@ -686,8 +729,9 @@ func TestDisruptionClient(t *testing.T) {
 	sharedSecrets_t2 := make([]kyber.Point, 1)
 	sharedSecrets_t2[0] = cs.sharedSecrets[1]
 
-	t1 := dcnet.NewDCNetEntity(1, dcnet.DCNET_TRUSTEE, upCellSize, true, sharedSecrets_t1)
-	t2 := dcnet.NewDCNetEntity(2, dcnet.DCNET_TRUSTEE, upCellSize, true, sharedSecrets_t2)
+	sessionKeys := []kyber.Point{cs.EphemeralPublicKey}
+	t1 := dcnet.NewDCNetEntity(1, dcnet.DCNET_TRUSTEE, upCellSize, true, sharedSecrets_t1, sessionKeys)
+	t2 := dcnet.NewDCNetEntity(2, dcnet.DCNET_TRUSTEE, upCellSize, true, sharedSecrets_t2, sessionKeys)
 
 	x := t1.TrusteeEncodeForRound(0)
 
@@ -706,7 +750,7 @@ func TestDisruptionClient(t *testing.T) {
 	hmac := dcNetDecoded[0:32]
 	data := dcNetDecoded[32:]
 
-	success := relay.ValidateHmac256(data, hmac, clientID)
+	success := relay.ValidateHmac256(data, hmac, macKey)
 	if !success {
 		t.Error("HMAC should be valid")
 	}
@@ -741,7 +785,7 @@ func TestDisruptionClient(t *testing.T) {
 	hmac = dcNetDecoded[0:32]
 	data = dcNetDecoded[32:]
 
-	success = relay.ValidateHmac256(data, hmac, clientID)
+	success = relay.ValidateHmac256(data, hmac, macKey)
 	if !success {
 		t.Error("HMAC should be valid")
 	}
@@ -780,18 +824,1749 @@ func TestDisruptionClient(t *testing.T) {
 	hmac = dcNetDecoded[0:32]
 	data = dcNetDecoded[32:]
 
-	success = relay.ValidateHmac256(data, hmac, clientID)
+	success = relay.ValidateHmac256(data, hmac, macKey)
 	if success {
 		t.Error("HMAC should not be valid")
 	}
 	//re-bitflip to original
 	data[len(data)-1] = 0
 
-	//should fail, wrong client ID
-	success = relay.ValidateHmac256(data, hmac, clientID+1)
+	//should fail, wrong key (e.g., of another slot)
+	success = relay.ValidateHmac256(data, hmac, []byte("another key"))
 	if success {
 		t.Error("HMAC should not be valid")
 	}
 
 	t.SkipNow() //we started a goroutine, let's kill everything, we're good
 }
+
+// relayKeySlot gives the client the relay's key on the base of the shuffle, as the relay does (see relay/disruption.go),
+// and returns the key of the HMACs of the slot
+func relayKeySlot(t *testing.T, msg *net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG, relayPriv kyber.Scalar, slot int) []byte {
+	base := config.CryptoSuite.Point().Base()
+	msg.RelayBasePk = config.CryptoSuite.Point().Mul(relayPriv, msg.Base)
+	msg.RelayBaseProof = crypto.ProveDLEQ(relayPriv, base, msg.Base, msg.NIZKContext())
+	key, err := config.CryptoSuite.Point().Mul(relayPriv, msg.EphPks[slot]).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestClientDownstreamNack(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("UseUDP", true)
+	msg.Add("DCNetType", "Simple")
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.NackedRounds == nil {
+		t.Error("should have instanciated NackedRounds")
+	}
+
+	//skip the shuffle, we only test the downstream path
+	sentToRelay = make([]interface{}, 0)
+	client.stateMachine.ChangeState("READY")
+
+	//round 3 arrives, but we are in round 0 : we should buffer it and NACK 0,1,2
+	msg3 := net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: net.REL_CLI_DOWNSTREAM_DATA{
+		RoundID:     3,
+		OwnershipID: 1,
+		Data:        make([]byte, 1),
+	}}
+	if err := client.ReceivedMessage(msg3); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.RoundNo != 0 {
+		t.Error("Client should still be in round 0, but is in round", cs.RoundNo)
+	}
+	if _, found := cs.BufferedRoundData[3]; !found {
+		t.Error("Client should have buffered round 3")
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent one NACK, sent", len(sentToRelay), "messages")
+	}
+	nack := sentToRelay[0].(*net.CLI_REL_DOWNSTREAM_NACK)
+	if nack.ClientID != 0 {
+		t.Error("NACK has the wrong ClientID")
+	}
+	if len(nack.RoundIDs) != 3 || nack.RoundIDs[0] != 0 || nack.RoundIDs[1] != 1 || nack.RoundIDs[2] != 2 {
+		t.Error("NACK should contain rounds 0, 1, 2, but contains", nack.RoundIDs)
+	}
+
+	//round 4 arrives : rounds 0,1,2 were already NACKed, we should not send anything
+	sentToRelay = make([]interface{}, 0)
+	msg4 := msg3
+	msg4.RoundID = 4
+	if err := client.ReceivedMessage(msg4); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(sentToRelay) != 0 {
+		t.Error("Client should not NACK the same rounds twice")
+	}
+
+	//the retransmission of round 0 arrives over TCP; the client processes it and answers
+	msg0 := net.REL_CLI_DOWNSTREAM_DATA{
+		RoundID:     0,
+		OwnershipID: 1,
+		Data:        make([]byte, 1),
+	}
+	if err := client.ReceivedMessage(msg0); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.RoundNo != 1 {
+		t.Error("Client should be in round 1, but is in round", cs.RoundNo)
+	}
+	if cs.NackedRounds[0] {
+		t.Error("Round 0 should not be marked as NACKed anymore")
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent its upstream cipher")
+	}
+	if _, ok := sentToRelay[0].(*net.CLI_REL_UPSTREAM_DATA); !ok {
+		t.Error("Client should have sent a CLI_REL_UPSTREAM_DATA")
+	}
+}
+
+func TestClientFECRecovery(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("UseUDP", true)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("UDPFECGroupSize", 2)
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.UDPFECGroupSize != 2 || cs.fecDecoder == nil {
+		t.Error("FEC should be enabled")
+	}
+
+	sentToRelay = make([]interface{}, 0)
+	client.stateMachine.ChangeState("READY")
+
+	//the relay encodes rounds 0 and 1, round 0 is lost
+	encoder := net.NewFECEncoder(2)
+	msg0 := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 0, OwnershipID: 1, Data: make([]byte, 1)}
+	msg1 := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, OwnershipID: 2, Data: make([]byte, 1)}
+	encoder.AddRound(msg0)
+	parity := encoder.AddRound(msg1)
+
+	if err := client.ReceivedMessage(net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: msg1}); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(sentToRelay) != 0 {
+		t.Error("Client should wait for the parity instead of sending a NACK")
+	}
+
+	//the parity arrives, the client rebuilds round 0 and processes rounds 0 and 1
+	if err := client.ReceivedMessage(*parity); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.RoundNo != 2 {
+		t.Error("Client should be in round 2, but is in round", cs.RoundNo)
+	}
+	recovered, unrecoverable := cs.fecStatistics.Recovered()
+	if recovered != 1 || unrecoverable != 0 {
+		t.Error("Client should have recovered exactly one round")
+	}
+	for _, m := range sentToRelay {
+		if _, isNack := m.(*net.CLI_REL_DOWNSTREAM_NACK); isNack {
+			t.Error("Client should not have sent a NACK")
+		}
+	}
+
+	sentToRelay = make([]interface{}, 0)
+
+	//rounds 2 and 3 are lost, the parity cannot rebuild them : the NACK also tells the relay about round 0
+	msg2 := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 2, OwnershipID: 0, Data: make([]byte, 1)}
+	msg3 := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 3, OwnershipID: 1, Data: make([]byte, 1)}
+	msg4 := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 4, OwnershipID: 2, Data: make([]byte, 1)}
+	encoder.AddRound(msg2)
+	parity2 := encoder.AddRound(msg3)
+	if err := client.ReceivedMessage(net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: msg4}); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if err := client.ReceivedMessage(*parity2); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent a NACK")
+	}
+	nack, isNack := sentToRelay[0].(*net.CLI_REL_DOWNSTREAM_NACK)
+	if !isNack || len(nack.RoundIDs) != 2 || nack.FECRecovered != 1 {
+		t.Error("Client should NACK rounds 2 and 3, and report the round it rebuilt, but sent", sentToRelay[0])
+	}
+	if cs.fecRecoveredSinceNack != 0 {
+		t.Error("Client should report each rebuilt round only once")
+	}
+}
+
+func TestClientFECTwoLossesInGroup(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("UseUDP", true)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("UDPFECGroupSize", 3)
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+
+	sentToRelay = make([]interface{}, 0)
+	client.stateMachine.ChangeState("READY")
+
+	//the relay encodes rounds 0, 1 and 2; rounds 0 and 2 are lost
+	encoder := net.NewFECEncoder(3)
+	var parity *net.REL_CLI_DOWNSTREAM_DATA_UDP
+	for r := int32(0); r < 3; r++ {
+		parity = encoder.AddRound(net.REL_CLI_DOWNSTREAM_DATA{RoundID: r, OwnershipID: int(r), Data: make([]byte, 1)})
+	}
+	msg1 := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, OwnershipID: 1, Data: make([]byte, 1)}
+	if err := client.ReceivedMessage(net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: msg1}); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(sentToRelay) != 0 {
+		t.Error("Client should wait for the parity instead of sending a NACK")
+	}
+
+	//the parity cannot rebuild two rounds : the client falls back to a NACK for both, including the last one of the group
+	if err := client.ReceivedMessage(*parity); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.RoundNo != 0 {
+		t.Error("Client should still wait for round 0, but is in round", cs.RoundNo)
+	}
+	recovered, unrecoverable := cs.fecStatistics.Recovered()
+	if recovered != 0 || unrecoverable != 2 {
+		t.Error("Client should not have rebuilt any of the two lost rounds, but rebuilt", recovered, "and lost", unrecoverable)
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent a NACK")
+	}
+	nack, isNack := sentToRelay[0].(*net.CLI_REL_DOWNSTREAM_NACK)
+	if !isNack || len(nack.RoundIDs) != 2 || nack.RoundIDs[0] != 0 || nack.RoundIDs[1] != 2 || nack.FECRecovered != 0 {
+		t.Error("Client should NACK rounds 0 and 2, but sent", sentToRelay[0])
+	}
+}
+
+func TestClientDownstreamSignature(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	relayPub, relayPriv := crypto.NewKeyPair()
+	_, attackerPriv := crypto.NewKeyPair()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("UseUDP", true)
+	msg.Add("DCNetType", "Simple")
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+	msg.RelayPk = relayPub
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.RelayPublicKey == nil || !cs.RelayPublicKey.Equal(relayPub) {
+		t.Error("Client should have stored the public key of the relay")
+	}
+
+	sentToRelay = make([]interface{}, 0)
+	client.stateMachine.ChangeState("READY")
+
+	//someone injects an unsigned cell, and a cell signed with another key : both are dropped
+	injected := net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: net.REL_CLI_DOWNSTREAM_DATA{
+		RoundID:     0,
+		OwnershipID: 1,
+		Data:        make([]byte, 1),
+		FlagResync:  true,
+	}}
+	if err := client.ReceivedMessage(injected); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if err := injected.Sign(attackerPriv); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ReceivedMessage(injected.REL_CLI_DOWNSTREAM_DATA); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.UnauthenticatedCells != 2 {
+		t.Error("Client should have dropped 2 cells, dropped", cs.UnauthenticatedCells)
+	}
+	if cs.RoundNo != 0 || len(sentToRelay) != 0 || client.stateMachine.State() != "READY" {
+		t.Error("Client should not have processed the injected cells")
+	}
+
+	//the cell of the relay is processed
+	msg0 := net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: net.REL_CLI_DOWNSTREAM_DATA{
+		RoundID:     0,
+		OwnershipID: 1,
+		Data:        make([]byte, 1),
+	}}
+	if err := msg0.Sign(relayPriv); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ReceivedMessage(msg0); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.UnauthenticatedCells != 2 {
+		t.Error("Client should not have dropped the cell of the relay")
+	}
+	if cs.RoundNo != 1 {
+		t.Error("Client should be in round 1, but is in round", cs.RoundNo)
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent its upstream cipher")
+	}
+	if _, ok := sentToRelay[0].(*net.CLI_REL_UPSTREAM_DATA); !ok {
+		t.Error("Client should have sent a CLI_REL_UPSTREAM_DATA")
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	client.EnableAuthentication()
+	cs := client.clientState
+
+	relayPub, relayPriv := crypto.NewKeyPair()
+	standbyPub, standbyPriv := crypto.NewKeyPair()
+	attackerPub, attackerPriv := crypto.NewKeyPair()
+	relay := net.NewAuthenticator(relayPriv)
+	standby := net.NewAuthenticator(standbyPriv)
+	attacker := net.NewAuthenticator(attackerPriv)
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeClientID", 1)
+	msg.Add("UseUDP", false)
+	msg.Add("DCNetType", "Simple")
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+	msg.RelayPk = relayPub
+	msg.StandbyRelayPk = standbyPub
+
+	//someone sends the parameters in the name of the relay
+	forged, _ := attacker.Seal(net.PEER_CLIENT, 1, *msg)
+	if err := client.ReceivedMessage(*forged); err == nil {
+		t.Error("Client should not accept parameters which are not authenticated by the relay")
+	}
+	if client.stateMachine.State() != "BEFORE_INIT" || len(sentToRelay) != 0 {
+		t.Error("Client should have dropped the forged parameters")
+	}
+
+	sealed, _ := relay.Seal(net.PEER_CLIENT, 1, *msg)
+	if err := client.ReceivedMessage(*sealed); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.ID != 1 || cs.RelayPublicKey == nil || !cs.RelayPublicKey.Equal(relayPub) {
+		t.Error("Client should have been initialized by the relay")
+	}
+
+	//our keys are MACed with the key we share with the relay
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent its public key")
+	}
+	sent, ok := sentToRelay[0].(*net.AUTHENTICATED_MESSAGE)
+	if !ok {
+		t.Fatal("The messages to the relay should be authenticated")
+	}
+	tellPk := sent.Msg.(*net.CLI_REL_TELL_PK_AND_EPH_PK)
+	if tellPk.ClientID != 1 || !tellPk.Pk.Equal(cs.PublicKey) {
+		t.Error("Client sent a wrong CLI_REL_TELL_PK_AND_EPH_PK")
+	}
+	if err := relay.Open(*sent, cs.PublicKey); err != nil || len(sent.MAC) == 0 {
+		t.Error("The key should be MACed with the key of the client,", err)
+	}
+	if err := relay.Open(*sent, attackerPub); err == nil {
+		t.Error("The message should not be authenticated by another key")
+	}
+
+	//another relay cannot re-initialize us, nor talk to us
+	other := new(net.ALL_ALL_PARAMETERS)
+	other.ForceParams = true
+	other.Add("NextFreeClientID", 2)
+	other.RelayPk = attackerPub
+	forged, _ = attacker.Seal(net.PEER_CLIENT, 1, *other)
+	if err := client.ReceivedMessage(*forged); err == nil {
+		t.Error("Client should not accept parameters from another relay")
+	}
+	forged, _ = attacker.Seal(net.PEER_CLIENT, 1, net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG{})
+	if err := client.ReceivedMessage(*forged); err == nil {
+		t.Error("Client should not accept a message from another relay")
+	}
+	forged, _ = attacker.Seal(net.PEER_CLIENT, 1, net.ALL_ALL_SHUTDOWN{})
+	if err := client.ReceivedMessage(*forged); err == nil {
+		t.Error("Client should not accept a shutdown from another relay")
+	}
+	if cs.ID != 1 || client.stateMachine.State() != "EPH_KEYS_SENT" || len(sentToRelay) != 1 {
+		t.Error("Client should have dropped the forged messages")
+	}
+
+	//only the standby relay announced by the relay can take over the session
+	if cs.StandbyRelayPublicKey == nil || !cs.StandbyRelayPublicKey.Equal(standbyPub) {
+		t.Error("Client should know the standby relay announced in the parameters")
+	}
+	forged, _ = attacker.Seal(net.PEER_CLIENT, 1, net.REL_ALL_RESUME{RoundID: 1000, RelayPk: attackerPub})
+	if err := client.authenticate(*forged); err == nil {
+		t.Error("Client should not accept a resume from a relay which is not the announced standby")
+	}
+	forged, _ = attacker.Seal(net.PEER_CLIENT, 1, net.REL_ALL_RESUME{RoundID: 1000, RelayPk: standbyPub})
+	if err := client.authenticate(*forged); err == nil {
+		t.Error("Client should not accept a resume in the name of the standby relay")
+	}
+	resume, _ := standby.Seal(net.PEER_CLIENT, 1, net.REL_ALL_RESUME{RoundID: 1000, RelayPk: standbyPub})
+	if err := client.authenticate(*resume); err != nil {
+		t.Error("Client should accept a resume from the announced standby relay, but", err)
+	}
+	cs.StandbyRelayPublicKey = nil
+	if err := client.authenticate(*resume); err == nil {
+		t.Error("Client should not accept a resume if the relay announced no standby relay")
+	}
+	if !cs.RelayPublicKey.Equal(relayPub) {
+		t.Error("Client should still be talking to the relay")
+	}
+}
+
+func TestClientPinnedTrustees(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	nTrustees := 2
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	otherTrustee, _ := crypto.NewKeyPair()
+
+	//invalid pinning
+	if err := client.SetPinnedTrustees(trusteesPubKeys, -1); err == nil {
+		t.Error("Client should not accept a negative number of pinned trustees")
+	}
+	if err := client.SetPinnedTrustees(trusteesPubKeys, 3); err == nil {
+		t.Error("Client should not require more trustees than it pins")
+	}
+	duplicated := []kyber.Point{trusteesPubKeys[0], trusteesPubKeys[0]}
+	if err := client.SetPinnedTrustees(duplicated, 2); err == nil {
+		t.Error("Client should count a key pinned twice once")
+	}
+
+	//we require both trustees, but the relay replaced one of them
+	if err := client.SetPinnedTrustees(trusteesPubKeys, 2); err != nil {
+		t.Error(err)
+	}
+
+	params := func(trustees []kyber.Point) net.ALL_ALL_PARAMETERS {
+		msg := new(net.ALL_ALL_PARAMETERS)
+		msg.ForceParams = true
+		msg.Add("NClients", 3)
+		msg.Add("NTrustees", len(trustees))
+		msg.Add("PayloadSize", 1500)
+		msg.Add("NextFreeClientID", 1)
+		msg.Add("UseUDP", false)
+		msg.Add("DCNetType", "Simple")
+		msg.TrusteesPks = trustees
+		return *msg
+	}
+
+	if err := client.ReceivedMessage(params([]kyber.Point{trusteesPubKeys[0], otherTrustee})); err == nil {
+		t.Error("Client should refuse a set of trustees without enough pinned trustees")
+	}
+	if client.stateMachine.State() != "BEFORE_INIT" || len(sentToRelay) != 0 {
+		t.Error("Client should not have joined")
+	}
+
+	//a pinned trustee listed twice, by us or by the relay, is still one trustee
+	if err := client.SetPinnedTrustees(append(duplicated, trusteesPubKeys[1]), 2); err != nil {
+		t.Error(err)
+	}
+	if len(cs.PinnedTrusteesPks) != 2 {
+		t.Error("Client should have pinned 2 distinct trustees, not", len(cs.PinnedTrusteesPks))
+	}
+	if err := client.ReceivedMessage(params([]kyber.Point{trusteesPubKeys[0], otherTrustee})); err == nil {
+		t.Error("Client should refuse a set of trustees without enough distinct pinned trustees")
+	}
+	if err := client.ReceivedMessage(params([]kyber.Point{trusteesPubKeys[0], trusteesPubKeys[0]})); err == nil {
+		t.Error("Client should not count a pinned trustee listed twice by the relay twice")
+	}
+	if client.stateMachine.State() != "BEFORE_INIT" || len(sentToRelay) != 0 {
+		t.Error("Client should not have joined")
+	}
+
+	//even without pinning, a key listed twice by the relay, or a list that does not match NTrustees, is refused
+	if err := client.SetPinnedTrustees(nil, 0); err != nil {
+		t.Error(err)
+	}
+	if err := client.ReceivedMessage(params([]kyber.Point{trusteesPubKeys[0], trusteesPubKeys[0], otherTrustee})); err == nil {
+		t.Error("Client should refuse a trustee key listed twice")
+	}
+	tooMany := params([]kyber.Point{trusteesPubKeys[0], trusteesPubKeys[1], otherTrustee})
+	tooMany.Add("NTrustees", 2)
+	if err := client.ReceivedMessage(tooMany); err == nil {
+		t.Error("Client should refuse more trustee keys than trustees")
+	}
+	tooFew := params([]kyber.Point{trusteesPubKeys[0]})
+	tooFew.Add("NTrustees", 2)
+	if err := client.ReceivedMessage(tooFew); err == nil {
+		t.Error("Client should refuse fewer trustee keys than trustees")
+	}
+	if client.stateMachine.State() != "BEFORE_INIT" || len(sentToRelay) != 0 {
+		t.Error("Client should not have joined")
+	}
+
+	//one pinned trustee is enough
+	if err := client.SetPinnedTrustees(trusteesPubKeys, 1); err != nil {
+		t.Error(err)
+	}
+	if err := client.ReceivedMessage(params([]kyber.Point{trusteesPubKeys[0], otherTrustee})); err != nil {
+		t.Error("Client should accept a set of trustees with enough pinned trustees:", err)
+	}
+	if cs.ID != 1 || client.stateMachine.State() != "EPH_KEYS_SENT" || len(sentToRelay) != 1 {
+		t.Error("Client should have joined")
+	}
+}
+
+func TestClientKeyPair(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	pub, priv := crypto.NewKeyPair()
+	otherPub, _ := crypto.NewKeyPair()
+	if err := client.SetKeyPair(otherPub, priv); err == nil {
+		t.Error("Client should not accept a public key which does not match the private key")
+	}
+	if err := client.SetKeyPair(pub, priv); err != nil {
+		t.Error(err)
+	}
+	if !cs.PublicKey.Equal(pub) || !cs.privateKey.Equal(priv) {
+		t.Error("Client should use the given key pair")
+	}
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("NClients", 2)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("UseUDP", false)
+	msg.Add("DCNetType", "Simple")
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	msg.TrusteesPks = []kyber.Point{trusteePub}
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+
+	//we tell the key pair we were given, and our DC-net secrets are computed with it
+	if len(sentToRelay) != 1 || !sentToRelay[0].(*net.CLI_REL_TELL_PK_AND_EPH_PK).Pk.Equal(pub) {
+		t.Fatal("Client did not send the given public key")
+	}
+	if !cs.sharedSecrets[0].Equal(config.CryptoSuite.Point().Mul(trusteePriv, pub)) {
+		t.Error("Client should share its DC-net secret with the trustee using the given key pair")
+	}
+
+	//a new session with the same key pair (e.g., after a restart) : same shared secret, but the pads must differ
+	sentToRelay = make([]interface{}, 0)
+	client2 := NewClient(false, false, in, out, false, "./", msw)
+	cs2 := client2.clientState
+	if err := client2.SetKeyPair(pub, priv); err != nil {
+		t.Error(err)
+	}
+	if err := client2.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client did not send its keys in the second session")
+	}
+	ephPk := sentToRelay[0].(*net.CLI_REL_TELL_PK_AND_EPH_PK).EphPk
+	if !cs2.sharedSecrets[0].Equal(cs.sharedSecrets[0]) || ephPk.Equal(cs.EphemeralPublicKey) {
+		t.Error("Client should share the same secret in both sessions, with a fresh ephemeral key")
+	}
+	for roundID := int32(0); roundID < 3; roundID++ {
+		if bytes.Equal(cs.DCNet.EncodeForRound(roundID, false, nil), cs2.DCNet.EncodeForRound(roundID, false, nil)) {
+			t.Error("Client used the same pads in round", roundID, "of two sessions with the same key pair")
+		}
+	}
+
+	//the trustee seeds its pads with the ephemeral key the client announced
+	trusteeDCNet := dcnet.NewDCNetEntity(0, dcnet.DCNET_TRUSTEE, cs2.PayloadSize, false, []kyber.Point{cs2.sharedSecrets[0]}, []kyber.Point{ephPk})
+	if !bytes.Equal(trusteeDCNet.TrusteeEncodeForRound(3), cs2.DCNet.EncodeForRound(3, false, nil)) {
+		t.Error("Client and trustee should draw the same pads")
+	}
+
+	//once we joined, our key pair cannot change
+	newPub, newPriv := crypto.NewKeyPair()
+	if err := client.SetKeyPair(newPub, newPriv); err == nil {
+		t.Error("Client should not change its key pair once initialized")
+	}
+}
+
+func TestClientDisruptionBlame(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	clientID := 0
+	nTrustees := 2
+	upCellSize := 200 //the blame takes 76 bytes, after the HMAC
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", upCellSize)
+	msg.Add("NextFreeClientID", clientID)
+	msg.Add("UseUDP", false)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("DisruptionProtectionEnabled", true)
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	trusteesPrivKeys := make([]kyber.Scalar, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], trusteesPrivKeys[i] = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+	relayPub, relayPriv := crypto.NewKeyPair()
+	msg.RelayPk = relayPub
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	sentToRelay = make([]interface{}, 0)
+
+	//neff shuffle
+	n := new(scheduler.NeffShuffle)
+	n.Init()
+	n.RelayView.Init(nTrustees)
+	trustees := make([]*scheduler.NeffShuffle, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trustees[i] = new(scheduler.NeffShuffle)
+		trustees[i].Init()
+		trustees[i].TrusteeView.Init(i, trusteesPrivKeys[i], trusteesPubKeys[i])
+	}
+	n.RelayView.AddClient(cs.EphemeralPublicKey)
+	isDone := false
+	i := 0
+	for !isDone {
+		toSend, _, _ := n.RelayView.SendToNextTrustee()
+		parsed := toSend.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+		toSend2, _ := trustees[i].TrusteeView.ReceivedShuffleFromRelay(parsed.Base, parsed.EphPks, false, make([]byte, 1))
+		parsed2 := toSend2.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+		isDone, _ = n.RelayView.ReceivedShuffleFromTrustee(parsed2.NewBase, parsed2.NewEphPks, parsed2.Proof)
+		i++
+	}
+	toSend3, _ := n.RelayView.SendTranscript()
+	parsed3 := toSend3.(*net.REL_TRU_TELL_TRANSCRIPT)
+	for j := 0; j < nTrustees; j++ {
+		toSend4, _ := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
+		parsed4 := toSend4.(*net.TRU_REL_SHUFFLE_SIG)
+		n.RelayView.ReceivedSignatureFromTrustee(parsed4.TrusteeID, parsed4.Sig)
+	}
+	toSend5, _ := n.RelayView.VerifySigsAndSendToClients(trusteesPubKeys)
+	parsed5 := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
+
+	//the key of our HMACs is only accepted with a valid proof that the relay computed it with its private key
+	_, otherPriv := crypto.NewKeyPair()
+	relayKeySlot(t, parsed5, otherPriv, 0)
+	if err := client.ReceivedMessage(*parsed5); err == nil {
+		t.Error("Client should refuse a key on the base of the shuffle which is not the relay's")
+	}
+	macKey := relayKeySlot(t, parsed5, relayPriv, 0)
+	if err := client.ReceivedMessage(*parsed5); err != nil {
+		t.Error("Should be able to receive this message,", err)
+	}
+	if !bytes.Equal(cs.macKey, macKey) {
+		t.Error("Client should key its HMACs with the key the relay computes for its slot")
+	}
+	sentToRelay = make([]interface{}, 0)
+
+	//we own the only slot, so we keep what we sent in round 0
+	sent, found := cs.DataHistory[0]
+	if !found || len(sent) != upCellSize {
+		t.Fatal("Client should keep the cleartext of its slot")
+	}
+
+	//a report of a round whose output is what we sent does not start a blame
+	if err := client.ReceivedMessage(net.REL_CLI_DISRUPTED_ROUND{RoundID: 0, Data: sent}); err != nil {
+		t.Error(err)
+	}
+	if len(sentToRelay) != 0 {
+		t.Error("Client should not blame a round which was not disrupted")
+	}
+
+	//a bit we sent as 1 was flipped : blaming it would reveal that we own the slot (see disruption.go)
+	disrupted := make([]byte, len(sent))
+	copy(disrupted, sent)
+	for k := 0; k < 32; k++ {
+		if sent[k] != 0 {
+			disrupted[k] &= sent[k] - 1 //clears the lowest bit set
+			break
+		}
+	}
+	if err := client.ReceivedMessage(net.REL_CLI_DISRUPTED_ROUND{RoundID: 0, Data: disrupted}); err != nil {
+		t.Error(err)
+	}
+	if cs.blameInProgress || len(sentToRelay) != 0 {
+		t.Error("Client should not blame a bit it sent as 1")
+	}
+
+	//a disruptor flipped bit 322 (in the data, after the HMAC), which we sent as 0
+	copy(disrupted, sent)
+	disrupted[40] ^= 1 << 2
+	if err := client.ReceivedMessage(net.REL_CLI_DISRUPTED_ROUND{RoundID: 0, Data: disrupted}); err != nil {
+		t.Error(err)
+	}
+	if len(sentToRelay) != 0 || cs.pendingBlame == nil {
+		t.Fatal("Client should keep its blame for its next slot, not send it as a message")
+	}
+
+	//the blame is sent in our next slot, as data
+	if err := client.ReceivedMessage(net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, OwnershipID: 0, Data: make([]byte, 10)}); err != nil {
+		t.Error(err)
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent its cell of round 1")
+	}
+	upstream := sentToRelay[0].(*net.CLI_REL_UPSTREAM_DATA)
+	sentToRelay = make([]interface{}, 0)
+	cell := dcnet.DCNetCipherFromBytes(upstream.Data).Payload
+	for j := 0; j < nTrustees; j++ {
+		trusteeDCNet := dcnet.NewDCNetEntity(j, dcnet.DCNET_TRUSTEE, upCellSize, false, []kyber.Point{cs.sharedSecrets[j]}, []kyber.Point{cs.EphemeralPublicKey})
+		trusteeDCNet.TrusteeEncodeForRound(0)
+		pad := dcnet.DCNetCipherFromBytes(trusteeDCNet.TrusteeEncodeForRound(1)).Payload
+		for k := range cell {
+			cell[k] ^= pad[k]
+		}
+	}
+	if !relay.ValidateHmac256(cell[32:], cell[0:32], macKey) {
+		t.Error("The cell carrying the blame should have a valid HMAC")
+	}
+	blame, isBlame := net.DisruptionBlameFromCell(cell[32:])
+	if !isBlame || cs.pendingBlame != nil {
+		t.Fatal("Client should have sent its blame in its slot")
+	}
+	if blame.RoundID != 0 || blame.BitPos != 322 {
+		t.Error("Client blamed the wrong round or bit", blame.RoundID, blame.BitPos)
+	}
+	if err := crypto.VerifyDL(blame.NIZK, parsed5.Base, parsed5.EphPks[cs.MySlot], blame.NIZKContext()); err != nil {
+		t.Error("The blame should prove the ownership of the slot,", err)
+	}
+	wrongBlame := blame
+	wrongBlame.BitPos = 43
+	if err := crypto.VerifyDL(blame.NIZK, parsed5.Base, parsed5.EphPks[cs.MySlot], wrongBlame.NIZKContext()); err == nil {
+		t.Error("The proof of the blame should be bound to the bit")
+	}
+
+	//we blame only once
+	if err := client.ReceivedMessage(net.REL_CLI_DISRUPTED_ROUND{RoundID: 0, Data: disrupted}); err != nil {
+		t.Error(err)
+	}
+	if len(sentToRelay) != 0 {
+		t.Error("Client should not blame twice")
+	}
+
+	//the relay asks for the bits of our pads
+	if err := client.ReceivedMessage(net.REL_ALL_DISRUPTION_REVEAL{RoundID: 0, BitPos: blame.BitPos}); err != nil {
+		t.Error(err)
+	}
+	if client.stateMachine.State() != "BLAMING" {
+		t.Error("Client should be blaming")
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent a CLI_REL_DISRUPTION_REVEAL")
+	}
+	reveal := sentToRelay[0].(*net.CLI_REL_DISRUPTION_REVEAL)
+	sentToRelay = make([]interface{}, 0)
+	if reveal.ClientID != clientID || len(reveal.Bits) != nTrustees {
+		t.Error("Client should reveal one bit per trustee")
+	}
+	for j := 0; j < nTrustees; j++ {
+		if reveal.Bits[j] != dcnet.PadBit(cs.sharedSecrets[j], cs.EphemeralPublicKey, upCellSize, 0, blame.BitPos) {
+			t.Error("Client revealed a bit which differs from the pad of trustee", j)
+		}
+	}
+	if err := client.ReceivedMessage(net.REL_ALL_DISRUPTION_REVEAL{RoundID: 5, BitPos: 0}); err == nil {
+		t.Error("Client should not reveal the bits of a round it did not send")
+	}
+
+	//the downstream data is dropped during the blame
+	if err := client.ReceivedMessage(net.REL_CLI_DOWNSTREAM_DATA{RoundID: 2, Data: make([]byte, 10)}); err != nil {
+		t.Error(err)
+	}
+	if len(sentToRelay) != 0 || cs.RoundNo != 2 {
+		t.Error("Client should not process the downstream data during the blame")
+	}
+
+	//the relay asks for the secret we share with trustee 1
+	if err := client.ReceivedMessage(net.REL_ALL_DISRUPTION_SECRET{UserID: 1}); err != nil {
+		t.Error(err)
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have sent a CLI_REL_DISRUPTION_SECRET")
+	}
+	secret := sentToRelay[0].(*net.CLI_REL_DISRUPTION_SECRET)
+	if !secret.Secret.Equal(cs.sharedSecrets[1]) {
+		t.Error("Client revealed the wrong secret")
+	}
+	base := config.CryptoSuite.Point().Base()
+	if err := crypto.VerifyDLEQ(secret.NIZK, base, cs.PublicKey, trusteesPubKeys[1], secret.Secret, secret.NIZKContext()); err != nil {
+		t.Error("The secret should come with a valid proof,", err)
+	}
+	if err := client.ReceivedMessage(net.REL_ALL_DISRUPTION_SECRET{UserID: nTrustees}); err == nil {
+		t.Error("Client should not reveal the secret of an unknown trustee")
+	}
+	sentToRelay = make([]interface{}, 0)
+
+	//the relay resyncs during the blame : a forged resync is dropped, a signed one ends the blame
+	resyncCell := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 2, Data: make([]byte, 10), FlagResync: true}
+	if err := client.ReceivedMessage(resyncCell); err != nil {
+		t.Error(err)
+	}
+	if client.stateMachine.State() != "BLAMING" {
+		t.Error("Client should not resync on an unauthenticated cell")
+	}
+	if err := resyncCell.Sign(relayPriv); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ReceivedMessage(resyncCell); err != nil {
+		t.Error(err)
+	}
+	if client.stateMachine.State() != "BEFORE_INIT" || cs.blameInProgress || cs.shuffleBase != nil || cs.macKey != nil {
+		t.Error("Client should abandon the blame and wait for the new parameters, but is in state", client.stateMachine.State())
+	}
+
+	//if we missed the FlagResync, the new parameters end the blame
+	client.stateMachine.ChangeState("BLAMING")
+	cs.blameInProgress = true
+	cs.shuffleBase = parsed5.Base
+	msg.RelayPk = relayPub
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if client.stateMachine.State() != "EPH_KEYS_SENT" || cs.blameInProgress || cs.shuffleBase != nil {
+		t.Error("Client should abandon the blame and rejoin with the new parameters, but is in state", client.stateMachine.State())
+	}
+	if len(sentToRelay) != 1 {
+		t.Error("Client should have sent its new keys to the relay")
+	}
+}
+
+/**
+ * In-memory network between a relay, several clients and a simulated trustee. The messages are queued, and delivered
+ * one by one by the test : the instances are never called from each other's handlers.
+ */
+type testDelivery struct {
+	to  string
+	id  int
+	msg interface{}
+}
+
+type testNetwork struct {
+	sync.Mutex
+	queue []testDelivery
+}
+
+func (n *testNetwork) push(to string, id int, msg interface{}) error {
+	n.Lock()
+	defer n.Unlock()
+
+	//like on the wire, the receiver gets a copy of the message as it was when sent
+	if params, ok := msg.(*net.ALL_ALL_PARAMETERS); ok {
+		c := *params
+		c.ParamsInt = make(map[string]int)
+		c.ParamsStr = make(map[string]string)
+		c.ParamsBool = make(map[string]bool)
+		for k, v := range params.ParamsInt {
+			c.ParamsInt[k] = v
+		}
+		for k, v := range params.ParamsStr {
+			c.ParamsStr[k] = v
+		}
+		for k, v := range params.ParamsBool {
+			c.ParamsBool[k] = v
+		}
+		msg = c
+	} else if v := reflect.ValueOf(msg); v.Kind() == reflect.Ptr {
+		msg = v.Elem().Interface()
+	}
+	n.queue = append(n.queue, testDelivery{to, id, msg})
+	return nil
+}
+
+func (n *testNetwork) pop() (testDelivery, bool) {
+	n.Lock()
+	defer n.Unlock()
+	if len(n.queue) == 0 {
+		return testDelivery{}, false
+	}
+	d := n.queue[0]
+	n.queue = n.queue[1:]
+	return d, true
+}
+
+type testRelaySender struct {
+	n *testNetwork
+}
+
+func (s *testRelaySender) SendToClient(i int, msg interface{}) error {
+	return s.n.push("client", i, msg)
+}
+func (s *testRelaySender) SendToTrustee(i int, msg interface{}) error {
+	return s.n.push("trustee", i, msg)
+}
+func (s *testRelaySender) SendToRelay(msg interface{}) error {
+	return errors.New("The relay should never send to itself")
+}
+func (s *testRelaySender) BroadcastToAllClients(msg interface{}) error {
+	return errors.New("The relay should not broadcast without UDP")
+}
+func (s *testRelaySender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+	return nil
+}
+
+type testClientSender struct {
+	n  *testNetwork
+	id int
+}
+
+func (s *testClientSender) SendToClient(i int, msg interface{}) error {
+	return errors.New("Clients should never sent to other clients")
+}
+func (s *testClientSender) SendToTrustee(i int, msg interface{}) error {
+	return errors.New("Clients should never sent to other trustees")
+}
+func (s *testClientSender) SendToRelay(msg interface{}) error {
+	return s.n.push("relay", s.id, msg)
+}
+func (s *testClientSender) BroadcastToAllClients(msg interface{}) error {
+	return errors.New("Clients should never sent to other clients")
+}
+func (s *testClientSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+	return nil
+}
+
+// testTrustee answers the relay like a trustee, and sends the ciphers of the rounds below maxRound
+type testTrustee struct {
+	pub         kyber.Point
+	priv        kyber.Scalar
+	payloadSize int
+	disruption  bool
+	clientPks   []kyber.Point
+	neff        *scheduler.NeffShuffle
+	dcNet       *dcnet.DCNetEntity
+	nextRound   int32
+	maxRound    int32
+}
+
+func (tr *testTrustee) received(msg interface{}) []interface{} {
+	switch typedMsg := msg.(type) {
+	case net.ALL_ALL_PARAMETERS:
+		tr.payloadSize = typedMsg.IntValueOrElse("PayloadSize", tr.payloadSize)
+		tr.disruption = typedMsg.BoolValueOrElse("DisruptionProtectionEnabled", false)
+		tr.neff = new(scheduler.NeffShuffle)
+		tr.neff.Init()
+		tr.neff.TrusteeView.Init(0, tr.priv, tr.pub)
+		tr.dcNet = nil
+		tr.nextRound = 0
+		return []interface{}{net.TRU_REL_TELL_PK{TrusteeID: 0, Pk: tr.pub}}
+	case net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE:
+		secrets := make([]kyber.Point, len(typedMsg.Pks))
+		for i := range typedMsg.Pks {
+			secrets[i] = config.CryptoSuite.Point().Mul(tr.priv, typedMsg.Pks[i])
+		}
+		tr.dcNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_TRUSTEE, tr.payloadSize, false, secrets, typedMsg.ClientsEphPks)
+		if tr.disruption {
+			tr.dcNet.KeepPadHistory(net.DISRUPTION_HISTORY_ROUNDS + len(typedMsg.Pks))
+		}
+		tr.clientPks = typedMsg.Pks
+		toSend, _ := tr.neff.TrusteeView.ReceivedShuffleFromRelay(typedMsg.Base, typedMsg.EphPks, false, make([]byte, 1))
+		return []interface{}{*toSend.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)}
+	case net.REL_TRU_TELL_TRANSCRIPT:
+		toSend, _ := tr.neff.TrusteeView.ReceivedTranscriptFromRelay(typedMsg.Bases, typedMsg.GetKeys(), typedMsg.GetProofs())
+		return []interface{}{*toSend.(*net.TRU_REL_SHUFFLE_SIG)}
+	case net.REL_ALL_DISRUPTION_REVEAL:
+		bits, err := tr.dcNet.RevealBits(typedMsg.RoundID, typedMsg.BitPos)
+		if err != nil {
+			return nil
+		}
+		return []interface{}{net.TRU_REL_DISRUPTION_REVEAL{TrusteeID: 0, Bits: bits}}
+	case net.REL_ALL_DISRUPTION_SECRET:
+		toSend := net.TRU_REL_DISRUPTION_SECRET{Secret: config.CryptoSuite.Point().Mul(tr.priv, tr.clientPks[typedMsg.UserID])}
+		toSend.NIZK = crypto.ProveDLEQ(tr.priv, config.CryptoSuite.Point().Base(), tr.clientPks[typedMsg.UserID], toSend.NIZKContext())
+		return []interface{}{toSend}
+	}
+	return nil
+}
+
+// ciphersUpTo returns the ciphers of the rounds up to roundID which we did not send yet
+func (tr *testTrustee) ciphersUpTo(roundID int32) []interface{} {
+	ciphers := make([]interface{}, 0)
+	for tr.dcNet != nil && tr.nextRound <= roundID && tr.nextRound < tr.maxRound {
+		ciphers = append(ciphers, net.TRU_REL_DC_CIPHER{RoundID: tr.nextRound, TrusteeID: 0, Data: tr.dcNet.TrusteeEncodeForRound(tr.nextRound)})
+		tr.nextRound++
+	}
+	return ciphers
+}
+
+func TestClientResync(t *testing.T) {
+
+	nClients := 3
+	n := new(testNetwork)
+
+	timeoutHandler := func(clients, trustees []int) { t.Error("Relay should not time out", clients, trustees) }
+	r := relay.NewRelay(false, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 1), timeoutHandler, newTestMessageSenderWrapper(&testRelaySender{n}))
+
+	clients := make([]*PriFiLibClientInstance, nClients)
+	for i := range clients {
+		clients[i] = NewClient(false, false, make(chan []byte, 6), make(chan []byte, 3), false, "./", newTestMessageSenderWrapper(&testClientSender{n, i}))
+	}
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	trustee := &testTrustee{pub: trusteePub, priv: trusteePriv, maxRound: 3}
+
+	//the keys each client sent to join, and its cells of round 0 (blank : only its pads) in each configuration
+	joins := make([][]net.CLI_REL_TELL_PK_AND_EPH_PK, nClients)
+	firstCells := make([][][]byte, nClients)
+
+	deliverAll := func() {
+		for steps := 0; steps < 10000; steps++ {
+			d, ok := n.pop()
+			if !ok {
+				return
+			}
+			var err error
+			switch d.to {
+			case "relay":
+				switch typedMsg := d.msg.(type) {
+				case net.CLI_REL_TELL_PK_AND_EPH_PK:
+					joins[d.id] = append(joins[d.id], typedMsg)
+				case net.CLI_REL_UPSTREAM_DATA:
+					if typedMsg.RoundID == 0 {
+						firstCells[d.id] = append(firstCells[d.id], dcnet.DCNetCipherFromBytes(typedMsg.Data).Payload)
+					}
+					for _, cipher := range trustee.ciphersUpTo(typedMsg.RoundID) {
+						if err := r.ReceivedMessage(cipher); err != nil {
+							t.Error("Relay should accept the cipher, but", err)
+						}
+					}
+				}
+				err = r.ReceivedMessage(d.msg)
+			case "client":
+				err = clients[d.id].ReceivedMessage(d.msg)
+			case "trustee":
+				for _, answer := range trustee.received(d.msg) {
+					n.push("relay", -1, answer)
+				}
+			}
+			if err != nil {
+				t.Error("Could not deliver", reflect.TypeOf(d.msg), "to", d.to, d.id, ":", err)
+			}
+		}
+		t.Fatal("The messages kept flowing")
+	}
+
+	params := new(net.ALL_ALL_PARAMETERS)
+	params.ForceParams = true
+	params.Add("StartNow", true)
+	params.Add("NClients", nClients)
+	params.Add("NTrustees", 1)
+	params.Add("PayloadSize", 100)
+	params.Add("DownstreamCellSize", 1000)
+	params.Add("WindowSize", 1)
+	params.Add("UseUDP", false)
+	params.Add("UseDummyDataDown", false)
+	params.Add("ExperimentRoundLimit", -1)
+	params.Add("DCNetType", "Simple")
+	params.Add("UseOpenClosedSlots", false)
+	params.Add("DisruptionProtectionEnabled", false)
+	params.Add("RelayProcessingLoopSleepTime", 0)
+	params.Add("RelayRoundTimeOut", 3600*1000)
+	params.Add("RelayTrusteeCacheLowBound", 0)
+	params.Add("RelayTrusteeCacheHighBound", 0)
+	if err := r.ReceivedMessage(*params); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+
+	//setup, then the rounds for which the trustee has ciphers
+	deliverAll()
+	for i, c := range clients {
+		if c.stateMachine.State() != "READY" || c.clientState.RoundNo < 3 {
+			t.Fatal("Client", i, "should be communicating, is in", c.stateMachine.State(), "round", c.clientState.RoundNo)
+		}
+	}
+
+	//the relay resyncs after round 3, with a new payload size
+	resync := net.ALL_REL_RESYNC{RoundID: 3}
+	resync.Params.Add("PayloadSize", 200)
+	if err := r.ReceivedMessage(resync); err != nil {
+		t.Fatal("Relay should accept this resync, but", err)
+	}
+	trustee.maxRound = 4
+	for _, cipher := range trustee.ciphersUpTo(3) {
+		n.push("relay", -1, cipher)
+	}
+	deliverAll()
+
+	slots := make(map[int]bool)
+	for i, c := range clients {
+		cs := c.clientState
+		if c.stateMachine.State() != "READY" {
+			t.Error("Client", i, "should communicate again after the resync, is in", c.stateMachine.State())
+		}
+		if cs.PayloadSize != 200 || cs.DCNet == nil {
+			t.Error("Client", i, "should use the parameters of the resync")
+		}
+		if cs.RoundNo < 4 {
+			t.Error("Client", i, "should have communicated in the new configuration, is in round", cs.RoundNo)
+		}
+		if len(joins[i]) != 2 {
+			t.Fatal("Client", i, "should have rejoined once, joined", len(joins[i]), "times")
+		}
+		if !joins[i][1].Pk.Equal(joins[i][0].Pk) || joins[i][1].EphPk.Equal(joins[i][0].EphPk) {
+			t.Error("Client", i, "should rejoin with the same key, but a fresh ephemeral key")
+		}
+		if !joins[i][1].EphPk.Equal(cs.EphemeralPublicKey) {
+			t.Error("Client", i, "should use the ephemeral key it rejoined with")
+		}
+		if len(firstCells[i]) != 2 || bytes.Equal(firstCells[i][1][:100], firstCells[i][0]) {
+			t.Error("Client", i, "should not repeat the pads of round 0 after the resync")
+		}
+		if cs.MySlot < 0 || cs.MySlot >= nClients || slots[cs.MySlot] {
+			t.Error("Client", i, "did not recognize a slot of its own, got", cs.MySlot)
+		}
+		slots[cs.MySlot] = true
+	}
+
+	r.Stop()
+}
+
+func TestClientDisruptionBlameEndToEnd(t *testing.T) {
+	//the disruptor flips a bit of the slot of another client; then, it reveals its pads honestly, or lies about them
+	for _, lying := range []bool{false, true} {
+		testDisruptionBlameEndToEnd(t, lying)
+	}
+}
+
+func testDisruptionBlameEndToEnd(t *testing.T, lying bool) {
+
+	nClients := 3
+	n := new(testNetwork)
+
+	timeoutHandler := func(clients, trustees []int) { t.Error("Relay should not time out", clients, trustees) }
+	r := relay.NewRelay(false, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 1), timeoutHandler, newTestMessageSenderWrapper(&testRelaySender{n}))
+
+	clients := make([]*PriFiLibClientInstance, nClients)
+	for i := range clients {
+		clients[i] = NewClient(false, false, make(chan []byte, 6), make(chan []byte, 3), false, "./", newTestMessageSenderWrapper(&testClientSender{n, i}))
+	}
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	trustee := &testTrustee{pub: trusteePub, priv: trusteePriv, maxRound: 3 + int32(nClients)}
+
+	//the disruptor flips bit 322 (in the data, after the HMAC) of its cipher of round 2, owned by another client
+	disruptedRound := int32(2)
+	disruptor := -1
+	owners := make(map[int32]int)
+	disruptedRoundsReported := 0
+	secretsAsked := 0
+	joins := make([]int, nClients)
+
+	deliverAll := func() {
+		for steps := 0; steps < 10000; steps++ {
+			d, ok := n.pop()
+			if !ok {
+				return
+			}
+			var err error
+			switch d.to {
+			case "relay":
+				switch typedMsg := d.msg.(type) {
+				case net.CLI_REL_TELL_PK_AND_EPH_PK:
+					joins[d.id]++
+				case net.CLI_REL_DISRUPTION_BLAME:
+					t.Error("The blame should not be sent as a message, which would tell who blames")
+				case net.CLI_REL_UPSTREAM_DATA:
+					if joins[d.id] == 1 && typedMsg.RoundID == disruptedRound && disruptor == -1 && clients[d.id].clientState.MySlot != owners[disruptedRound] {
+						disruptor = d.id
+						typedMsg.Data[8+40] ^= 1 << 2 //the cipher starts with an 8-bytes header
+					}
+					for _, cipher := range trustee.ciphersUpTo(typedMsg.RoundID) {
+						if err := r.ReceivedMessage(cipher); err != nil {
+							t.Error("Relay should accept the cipher, but", err)
+						}
+					}
+				case net.CLI_REL_DISRUPTION_REVEAL:
+					if lying && d.id == disruptor {
+						//the disruptor pretends that its pads explain its cipher
+						typedMsg.Bits[0] ^= 1
+					}
+				}
+				err = r.ReceivedMessage(d.msg)
+			case "client":
+				switch typedMsg := d.msg.(type) {
+				case net.REL_CLI_DOWNSTREAM_DATA:
+					owners[typedMsg.RoundID] = typedMsg.OwnershipID
+				case net.REL_CLI_DISRUPTED_ROUND:
+					disruptedRoundsReported++
+				case net.REL_ALL_DISRUPTION_SECRET:
+					secretsAsked++
+				}
+				err = clients[d.id].ReceivedMessage(d.msg)
+			case "trustee":
+				for _, answer := range trustee.received(d.msg) {
+					n.push("relay", -1, answer)
+				}
+			}
+			if err != nil {
+				t.Error("Could not deliver", reflect.TypeOf(d.msg), "to", d.to, d.id, ":", err)
+			}
+		}
+		t.Fatal("The messages kept flowing")
+	}
+
+	params := new(net.ALL_ALL_PARAMETERS)
+	params.ForceParams = true
+	params.Add("StartNow", true)
+	params.Add("NClients", nClients)
+	params.Add("NTrustees", 1)
+	params.Add("PayloadSize", 200)
+	params.Add("DownstreamCellSize", 1000)
+	params.Add("WindowSize", 1)
+	params.Add("UseUDP", false)
+	params.Add("UseDummyDataDown", false)
+	params.Add("ExperimentRoundLimit", -1)
+	params.Add("DCNetType", "Simple")
+	params.Add("UseOpenClosedSlots", false)
+	params.Add("DisruptionProtectionEnabled", true)
+	params.Add("RelayProcessingLoopSleepTime", 0)
+	params.Add("RelayRoundTimeOut", 3600*1000)
+	params.Add("RelayTrusteeCacheLowBound", 0)
+	params.Add("RelayTrusteeCacheHighBound", 0)
+	if err := r.ReceivedMessage(*params); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+
+	//setup, the disrupted round, the blame in the next slot of its owner, the reveals, then the resync and a new setup
+	deliverAll()
+
+	if disruptor == -1 {
+		t.Fatal("The disruptor did not get to flip a bit")
+	}
+	if disruptedRoundsReported != nClients {
+		t.Error("Relay should have reported the disrupted round to all clients, reported", disruptedRoundsReported, "times")
+	}
+	if lying && secretsAsked != 1 {
+		t.Error("Relay should have asked the disruptor its secret, asked", secretsAsked, "clients")
+	}
+	if !lying && secretsAsked != 0 {
+		t.Error("Relay should not ask for secrets when the pads are consistent")
+	}
+	disruptors := r.Disruptors()
+	if len(disruptors) != 1 || disruptors[0] != "client "+strconv.Itoa(disruptor) {
+		t.Error("Relay should have found that client", disruptor, "disrupted the round, but found", disruptors)
+	}
+	for i, c := range clients {
+		if joins[i] != 2 {
+			t.Error("Client", i, "should have rejoined once after the blame, joined", joins[i], "times")
+		}
+		if c.stateMachine.State() != "READY" || c.clientState.blameInProgress {
+			t.Error("Client", i, "should communicate again after the blame, is in", c.stateMachine.State())
+		}
+	}
+
+	r.Stop()
+}
+
+func TestClientPipeline(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("UseUDP", true)
+	msg.Add("DCNetType", "Simple")
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+
+	//skip the shuffle, we only test the downstream path
+	sentToRelay = make([]interface{}, 0)
+	client.stateMachine.ChangeState("READY")
+
+	downstream := func(roundID int32) net.REL_CLI_DOWNSTREAM_DATA_UDP {
+		return net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: net.REL_CLI_DOWNSTREAM_DATA{
+			RoundID:     roundID,
+			OwnershipID: 1,
+			Data:        make([]byte, 1),
+		}}
+	}
+
+	//rounds 2, 1 and 3 arrive before round 0 : they are buffered, and their pads are prepared
+	for _, roundID := range []int32{2, 1, 3} {
+		if err := client.ReceivedMessage(downstream(roundID)); err != nil {
+			t.Error("Client should be able to receive this message:", err)
+		}
+	}
+	if cs.RoundNo != 0 {
+		t.Error("Client should still be in round 0, but is in round", cs.RoundNo)
+	}
+	if len(cs.BufferedRoundData) != 3 {
+		t.Error("Client should have buffered 3 rounds, buffered", len(cs.BufferedRoundData))
+	}
+	if cs.DCNet.PrecomputedRounds() != 4 {
+		t.Error("Client should have precomputed the pads of rounds 0 to 3, has", cs.DCNet.PrecomputedRounds())
+	}
+
+	//round 0 arrives : the client answers it, and all the buffered rounds
+	sentToRelay = make([]interface{}, 0)
+	if err := client.ReceivedMessage(downstream(0)); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.RoundNo != 4 {
+		t.Error("Client should be in round 4, but is in round", cs.RoundNo)
+	}
+	if len(cs.BufferedRoundData) != 0 || cs.DCNet.PrecomputedRounds() != 0 {
+		t.Error("Client should have consumed the buffered rounds and their pads")
+	}
+	if len(sentToRelay) != 4 {
+		t.Fatal("Client should have sent 4 upstream ciphers, sent", len(sentToRelay))
+	}
+	for i, m := range sentToRelay {
+		up, ok := m.(*net.CLI_REL_UPSTREAM_DATA)
+		if !ok || up.RoundID != int32(i) {
+			t.Error("Client should have answered the rounds in order, message", i, "is", m)
+		}
+	}
+	if cs.pipelineStatistics.Skipped() != 0 {
+		t.Error("Client should not have skipped any round")
+	}
+
+	//a round far ahead arrives : the client gives up on the rounds in between, and counts them
+	sentToRelay = make([]interface{}, 0)
+	farRound := cs.RoundNo + MAX_BUFFERED_DOWNSTREAM_ROUNDS + 1
+	if err := client.ReceivedMessage(downstream(farRound)); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.RoundNo != farRound+1 {
+		t.Error("Client should be in round", farRound+1, ", but is in round", cs.RoundNo)
+	}
+	if cs.pipelineStatistics.Skipped() != MAX_BUFFERED_DOWNSTREAM_ROUNDS+1 {
+		t.Error("Client should have skipped", MAX_BUFFERED_DOWNSTREAM_ROUNDS+1, "rounds, skipped", cs.pipelineStatistics.Skipped())
+	}
+	if len(sentToRelay) != 1 {
+		t.Error("Client should have answered the far round only, sent", len(sentToRelay))
+	}
+}
+
+func TestClientPadPrecomputation(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	defer client.Stop()
+	cs := client.clientState
+
+	for _, bad := range []int{-1, MAX_PRECOMPUTED_ROUNDS + 1} {
+		if err := client.SetPadPrecomputation(bad); err == nil {
+			t.Error("Client should not precompute the pads of", bad, "rounds")
+		}
+	}
+	nRounds := 5
+	if err := client.SetPadPrecomputation(nRounds); err != nil {
+		t.Error("Client should accept to precompute the pads of", nRounds, "rounds, but", err)
+	}
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	payloadSize := 100
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("DCNetType", "Simple")
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.stopPrecomputingPads == nil {
+		t.Fatal("Client should precompute the pads of its DC-net")
+	}
+
+	//the goroutine fills the pads of the next rounds
+	padsReady := func() bool {
+		for i := 0; i < 100; i++ {
+			if cs.DCNet.PrecomputedRounds() == nRounds {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !padsReady() {
+		t.Error("Client should have precomputed the pads of", nRounds, "rounds, has", cs.DCNet.PrecomputedRounds())
+	}
+
+	//skip the shuffle, we only test the downstream path
+	sentToRelay = make([]interface{}, 0)
+	client.stateMachine.ChangeState("READY")
+
+	//the ciphers do not depend on the precomputation, even when skipping rounds
+	reference := dcnet.NewDCNetEntity(0, dcnet.DCNET_CLIENT, payloadSize, false, cs.sharedSecrets, dcnet.SameSessionKeys(cs.EphemeralPublicKey, nTrustees))
+	for _, roundID := range []int32{0, 1, 4, 12} {
+		down := net.REL_CLI_DOWNSTREAM_DATA{RoundID: roundID, OwnershipID: 1, Data: make([]byte, 1)}
+		if err := client.ReceivedMessage(down); err != nil {
+			t.Error("Client should be able to receive this message:", err)
+		}
+		if len(sentToRelay) != 1 {
+			t.Fatal("Client should have sent its upstream cipher for round", roundID)
+		}
+		up := sentToRelay[0].(*net.CLI_REL_UPSTREAM_DATA)
+		sentToRelay = make([]interface{}, 0)
+		if up.RoundID != roundID || !bytes.Equal(up.Data, reference.EncodeForRound(roundID, false, nil)) {
+			t.Error("Client sent a wrong cipher for round", roundID)
+		}
+		if !padsReady() {
+			t.Error("Client should have replaced the pads used in round", roundID)
+		}
+	}
+
+	//a resync stops the precomputation, with the DC-net
+	resync := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 13, OwnershipID: 1, Data: make([]byte, 1), FlagResync: true}
+	if err := client.ReceivedMessage(resync); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if cs.stopPrecomputingPads != nil || cs.padsUsed != nil {
+		t.Error("Client should have stopped precomputing pads")
+	}
+}
+
+func TestClientStatus(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, false, in, out, false, "./", msw)
+	cs := client.clientState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 100)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("DCNetType", "Simple")
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+
+	//skip the shuffle, we own slot 1
+	sentToRelay = make([]interface{}, 0)
+	client.stateMachine.ChangeState("READY")
+	cs.MySlot = 1
+
+	status := client.Status()
+	if status.State != "READY" || status.Slot != 1 || status.Round != 0 || status.UpstreamPaused {
+		t.Error("Client reported a wrong status", status)
+	}
+	if status.LatencyMs != -1 || status.BytesSent != 0 || status.BytesReceived != 0 {
+		t.Error("Client should not have any traffic yet, but reported", status)
+	}
+
+	//while paused, the client answers the rounds, but its data waits
+	client.PauseUpstream(true)
+	in <- []byte{1, 2, 3}
+	down := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 0, OwnershipID: 1, Data: make([]byte, 10)}
+	if err := client.ReceivedMessage(down); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(sentToRelay) != 1 {
+		t.Error("Client should have sent its upstream cipher while paused, sent", len(sentToRelay))
+	}
+	if len(in) != 1 {
+		t.Error("Client should not have sent its data while paused")
+	}
+	status = client.Status()
+	if !status.UpstreamPaused || status.Round != 1 || status.BytesSent != 0 || status.BytesReceived != 10 {
+		t.Error("Client reported a wrong status while paused", status)
+	}
+
+	//once resumed, the data is sent in our next slot
+	client.PauseUpstream(false)
+	down.RoundID = 1
+	if err := client.ReceivedMessage(down); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(in) != 0 {
+		t.Error("Client should have sent its data once resumed")
+	}
+	status = client.Status()
+	if status.UpstreamPaused || status.Round != 2 || status.BytesSent != 3 || status.BytesReceived != 20 {
+		t.Error("Client reported a wrong status once resumed", status)
+	}
+}
+
+func TestClientDownstreamPCAPReplay(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	in := make(chan []byte, 6)
+	out := make(chan []byte, 3)
+
+	client := NewClient(false, true, in, out, false, "./", msw)
+	cs := client.clientState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nTrustees := 2
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("PayloadSize", 100)
+	msg.Add("NextFreeClientID", 0)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("PCAPReplayDownstream", true)
+
+	trusteesPubKeys := make([]kyber.Point, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trusteesPubKeys[i], _ = crypto.NewKeyPair()
+	}
+	msg.TrusteesPks = trusteesPubKeys
+
+	if err := client.ReceivedMessage(*msg); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if !cs.pcapReplay.Downstream {
+		t.Error("Client should know that the relay replays a capture downstream")
+	}
+	client.stateMachine.ChangeState("READY")
+	cs.MySlot = 1
+
+	//two packets replayed by the relay in one cell (pattern, ID, time in the capture, flags), padded
+	cell := make([]byte, 60)
+	for i := 0; i < 2; i++ {
+		meta := cell[i*15 : (i+1)*15]
+		binary.BigEndian.PutUint16(meta[0:2], 21845)
+		binary.BigEndian.PutUint32(meta[2:6], uint32(i))
+		binary.BigEndian.PutUint64(meta[6:14], 0)
+		meta[14] = 1
+	}
+	down := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 0, OwnershipID: 1, Data: cell}
+	if err := client.ReceivedMessage(down); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(out) != 0 {
+		t.Error("Client should not pass the replayed packets to the SOCKS/VPN output")
+	}
+	if _, _, n := cs.timeStatistics["pcap-delay"].TimeStatistics(); n != "2" {
+		t.Error("Client should have measured the delay of 2 replayed packets, measured", n)
+	}
+
+	//other data goes to the output as usual
+	down.RoundID = 1
+	down.Data = []byte{1, 2, 3}
+	if err := client.ReceivedMessage(down); err != nil {
+		t.Error("Client should be able to receive this message:", err)
+	}
+	if len(out) != 1 {
+		t.Error("Client should pass the data which is not a replayed packet to the output")
+	}
+}
+
+// testBlockingListenerSender listens to the broadcast like the UDP one : it blocks until its context is cancelled
+type testBlockingListenerSender struct {
+	TestMessageSender
+}
+
+func (s *testBlockingListenerSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+	<-ctx.Done()
+	return nil
+}
+
+func TestClientStopReleasesGoroutines(t *testing.T) {
+
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		msw := newTestMessageSenderWrapper(new(testBlockingListenerSender))
+		sentToRelay = make([]interface{}, 0)
+		client := NewClient(false, false, make(chan []byte, 6), make(chan []byte, 3), false, "./", msw)
+
+		msg := new(net.ALL_ALL_PARAMETERS)
+		msg.ForceParams = true
+		msg.Add("NClients", 3)
+		msg.Add("NTrustees", 1)
+		msg.Add("PayloadSize", 1500)
+		msg.Add("NextFreeClientID", 0)
+		msg.Add("UseUDP", true)
+		msg.Add("DCNetType", "Simple")
+		trusteePub, _ := crypto.NewKeyPair()
+		msg.TrusteesPks = []kyber.Point{trusteePub}
+
+		//each set of parameters starts a broadcast listener, which replaces the previous one
+		for j := 0; j < 2; j++ {
+			if err := client.ReceivedMessage(*msg); err != nil {
+				t.Error("Client should be able to receive this message:", err)
+			}
+		}
+		client.Stop()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > baseline {
+		t.Error("Goroutines leaked after stopping the clients :", runtime.NumGoroutine(), "running, baseline was", baseline)
+	}
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/kyber.v2"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+/*
+Disruption blame, on the client side. When the disruption protection is enabled, each cell starts with an HMAC of its
+content, keyed with a secret shared by the owner of the slot and the relay (see deriveMACKey), and we keep the
+cleartext of the cells we sent in our slot during the last DISRUPTION_HISTORY_ROUNDS rounds (DataHistory). If the
+output of one of those rounds differs from what we sent, a disruptor flipped some bits; we notice it when :
+ - the relay sends us the output of a round whose HMAC was wrong (REL_CLI_DISRUPTED_ROUND), or
+ - the downstream data echoes one of our latency messages, corrupted.
+Then, we pick a bit we sent as 0 and which was output as 1, and blame it with a CLI_REL_DISRUPTION_BLAME, which contains
+a NIZK that we own the slot : we know the ephemeral private key of our slot, i.e., the x such that x * shuffleBase is the
+key of the slot. The blame is sent in our next slot, like data (see SendUpstreamData) : the relay learns that the owner
+of the slot blames, but not who it is.
+The relay then asks everyone to reveal the bits of their pads at this position (REL_ALL_DISRUPTION_REVEAL). Our bit is
+0, so our cipher is the XOR of our pads there, as the ciphers of the other honest clients and trustees : the relay finds
+the disruptor, whose cipher differs, without learning that we own the slot (if a 1 was flipped to a 0, our cipher and
+the disruptor's would both differ, so we do not blame). If a client and a trustee reveal different bits for their
+pad, the relay asks them their shared secret (REL_ALL_DISRUPTION_SECRET), with a NIZK that it is the right one, and
+replays their pad to find out who lied. Our pads are kept in the DC-net during the history (see KeepPadHistory).
+*/
+
+// DISRUPTION_HISTORY_ROUNDS is the number of rounds for which we keep the cleartext of our cells
+const DISRUPTION_HISTORY_ROUNDS = net.DISRUPTION_HISTORY_ROUNDS
+
+// padHistoryRounds returns the number of rounds for which we keep our pads : a blame is sent in the next slot of the
+// blamer, which comes back after at most nClients rounds (with the round-robin schedule), then we reveal our pads
+func (p *PriFiLibClientInstance) padHistoryRounds() int {
+	return DISRUPTION_HISTORY_ROUNDS + p.clientState.nClients
+}
+
+// deriveMACKey computes the key of the HMAC of our cells, ephemeralPrivateKey * RelayBasePk : the relay computes it
+// from the key of our slot (its private key times ephemeralPrivateKey * Base), without knowing who owns the slot. The
+// NIZK proves that RelayBasePk is the relay's private key times Base; otherwise, the relay could pick RelayBasePk so that
+// it can compute the key of each client from its ephemeral public key, and recognize the owner of a slot by its HMAC
+func (p *PriFiLibClientInstance) deriveMACKey(msg net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) error {
+	if p.clientState.RelayPublicKey == nil || msg.RelayBasePk == nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot key our HMACs without the keys of the relay")
+	}
+	base := config.CryptoSuite.Point().Base()
+	if err := crypto.VerifyDLEQ(msg.RelayBaseProof, base, p.clientState.RelayPublicKey, msg.Base, msg.RelayBasePk, msg.NIZKContext()); err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : the relay's key on the base of the shuffle is invalid, " + err.Error())
+	}
+
+	key, err := config.CryptoSuite.Point().Mul(p.clientState.ephemeralPrivateKey, msg.RelayBasePk).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.clientState.macKey = key
+	return nil
+}
+
+// recordOwnCell keeps the cleartext we sent in our slot, padded as in the DC-net, and forgets the oldest rounds
+func (p *PriFiLibClientInstance) recordOwnCell(roundID int32, payload []byte) {
+	if !p.clientState.DisruptionProtectionEnabled {
+		return
+	}
+	cleartext := make([]byte, p.clientState.PayloadSize)
+	copy(cleartext, payload)
+	p.clientState.DataHistory[roundID] = cleartext
+	delete(p.clientState.DataHistory, roundID-DISRUPTION_HISTORY_ROUNDS)
+}
+
+// flippedBit returns the position of the first bit which we sent as 0, and which was output as 1, or -1
+func flippedBit(sent, output []byte) int {
+	for i := 0; i < len(sent) && i < len(output); i++ {
+		if flipped := ^sent[i] & output[i]; flipped != 0 {
+			for j := uint(0); j < 8; j++ {
+				if flipped&(1<<j) != 0 {
+					return 8*i + int(j)
+				}
+			}
+		}
+	}
+	return -1
+}
+
+/*
+Received_REL_CLI_DISRUPTED_ROUND handles REL_CLI_DISRUPTED_ROUND messages. The relay sends the output of a round which
+failed the disruption check to all clients; if we owned the slot of this round, we start a blame.
+*/
+func (p *PriFiLibClientInstance) Received_REL_CLI_DISRUPTED_ROUND(msg net.REL_CLI_DISRUPTED_ROUND) error {
+	sent, found := p.clientState.DataHistory[msg.RoundID]
+	if !found {
+		//not our slot, or too old
+		return nil
+	}
+
+	bitPos := flippedBit(sent, msg.Data)
+	if bitPos == -1 {
+		log.Lvl2("Client", p.clientState.ID, ": the relay reports round", msg.RoundID, "as disrupted, but its output is what we sent")
+		return nil
+	}
+	return p.startBlame(msg.RoundID, bitPos)
+}
+
+// checkEchoedCell starts a blame if the downstream data echoes one of our latency messages, but corrupted
+func (p *PriFiLibClientInstance) checkEchoedCell(data []byte) {
+	roundID, isOurs := prifilog.LatencyMessageOrigin(data, p.clientState.ID)
+	if !isOurs {
+		return
+	}
+	sent, found := p.clientState.DataHistory[roundID]
+	if !found {
+		return
+	}
+
+	//the relay echoes the cell without its HMAC
+	bitPos := flippedBit(sent[32:], data)
+	if bitPos == -1 {
+		return
+	}
+	if err := p.startBlame(roundID, bitPos+8*32); err != nil {
+		log.Error(err)
+	}
+}
+
+// startBlame queues a CLI_REL_DISRUPTION_BLAME for the given bit, sent in our next slot (see SendUpstreamData), unless
+// we already started a blame. With equivocation, the cipher of the owner of the slot is not the XOR of its pads, so the
+// relay could not find the disruptor without learning who owns the slot : blames are not supported
+func (p *PriFiLibClientInstance) startBlame(roundID int32, bitPos int) error {
+	if p.clientState.blameInProgress {
+		return nil
+	}
+	if p.clientState.EquivocationProtectionEnabled {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot blame round " + strconv.Itoa(int(roundID)) + ", blames are not supported with equivocation protection")
+	}
+	if p.clientState.shuffleBase == nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot blame, we do not know the base of the shuffle")
+	}
+
+	log.Error("Client", p.clientState.ID, ": round", roundID, "was disrupted (bit", bitPos, "was flipped), starting a blame")
+
+	blame := &net.CLI_REL_DISRUPTION_BLAME{
+		RoundID: roundID,
+		BitPos:  bitPos,
+	}
+	blame.NIZK = crypto.ProveDL(p.clientState.ephemeralPrivateKey, p.clientState.shuffleBase, blame.NIZKContext())
+	cell := blame.ToCell()
+	if len(cell) > p.clientState.PayloadSize-32 {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot blame, the blame (" + strconv.Itoa(len(cell)) + " bytes) does not fit in a cell")
+	}
+	p.clientState.pendingBlame = cell
+	p.clientState.blameInProgress = true
+
+	return nil
+}
+
+/*
+Received_REL_ALL_DISRUPTION_REVEAL handles REL_ALL_DISRUPTION_REVEAL messages. The communication stops, and we send
+the bit at BitPos of the pad we share with each trustee, in the disrupted round.
+*/
+func (p *PriFiLibClientInstance) Received_REL_ALL_DISRUPTION_REVEAL(msg net.REL_ALL_DISRUPTION_REVEAL) error {
+	if msg.RoundID < 0 || msg.RoundID >= p.clientState.RoundNo {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot reveal the bits of round " + strconv.Itoa(int(msg.RoundID)) + ", we did not send it")
+	}
+	if msg.BitPos < 0 || msg.BitPos >= 8*p.clientState.PayloadSize {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot reveal bit " + strconv.Itoa(msg.BitPos) + ", out of the payload")
+	}
+
+	p.stateMachine.ChangeState("BLAMING")
+
+	bits, err := p.clientState.DCNet.RevealBits(msg.RoundID, msg.BitPos)
+	if err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot reveal the bits of round " + strconv.Itoa(int(msg.RoundID)) + ", " + err.Error())
+	}
+	toSend := &net.CLI_REL_DISRUPTION_REVEAL{
+		ClientID: p.clientState.ID,
+		Bits:     bits,
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "Revealed bits")
+
+	return nil
+}
+
+/*
+Received_REL_ALL_DISRUPTION_SECRET handles REL_ALL_DISRUPTION_SECRET messages. We send the secret we share with the
+trustee UserID, with a NIZK that it is our private key times the public key of the trustee.
+*/
+func (p *PriFiLibClientInstance) Received_REL_ALL_DISRUPTION_SECRET(msg net.REL_ALL_DISRUPTION_SECRET) error {
+	if msg.UserID < 0 || msg.UserID >= len(p.clientState.sharedSecrets) {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot reveal the secret shared with trustee " + strconv.Itoa(msg.UserID))
+	}
+
+	base := config.CryptoSuite.Point().Base()
+	toSend := &net.CLI_REL_DISRUPTION_SECRET{
+		Secret: p.clientState.sharedSecrets[msg.UserID],
+	}
+	toSend.NIZK = crypto.ProveDLEQ(p.clientState.privateKey, base, p.clientState.TrusteePublicKey[msg.UserID], toSend.NIZKContext())
+	p.messageSender.SendToRelayWithLog(toSend, "Sent secret to relay")
+
+	return nil
+}
+
+// ignoredWhileBlaming returns true if we are blaming : the rounds in flight are dropped, until the relay resyncs
+func (p *PriFiLibClientInstance) ignoredWhileBlaming(msgName string) bool {
+	if p.stateMachine.State() != "BLAMING" {
+		return false
+	}
+	log.Lvl3("Client", p.clientState.ID, ": dropping", msgName, "during the blame")
+	return true
+}
+
+// resyncedWhileBlaming returns true if we are blaming and the downstream cell is an authenticated resync (verified by
+// "verify") : the blame is abandoned, and we wait for the new parameters
+func (p *PriFiLibClientInstance) resyncedWhileBlaming(flagResync bool, verify func(kyber.Point) error) bool {
+	if p.stateMachine.State() != "BLAMING" || !flagResync || !p.downstreamAuthenticated(verify) {
+		return false
+	}
+	log.Lvl1("Client", p.clientState.ID, ": the relay resyncs during the blame, going to state BEFORE_INIT")
+	p.resync()
+	return true
+}
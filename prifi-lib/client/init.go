@@ -12,16 +12,19 @@ package client
  * - REL_CLI_TELL_TRUSTEES_PK - the trustee's identities. We react by sending our identity + ephemeral identity
  * - REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG - the shuffle from the trustees. We do some check, if they pass, we can communicate. We send the first round to the relay.
  * - REL_CLI_DOWNSTREAM_DATA - the data from the relay, for one round. We react by finishing the round (sending our data to the relay)
+ * - REL_CLI_DISRUPTED_ROUND, REL_ALL_DISRUPTION_REVEAL, REL_ALL_DISRUPTION_SECRET - the steps of a disruption blame (see disruption.go)
  *
  * local functions :
  *
- * ProcessDownStreamData() <- is called by Received_REL_CLI_DOWNSTREAM_DATA; it handles the raw data received
+ * ProcessDownStreamData() <- is called by Received_REL_CLI_DOWNSTREAM_DATA, for each round we can process in order; it handles the raw data received
  * SendUpstreamData() <- it is called at the end of ProcessDownStreamData(). Hence, after getting some data down, we send some data up.
  *
+ * The messages are authenticated with the PriFi keys (see authentication.go).
  * TODO : traffic need to be encrypted
  */
 
 import (
+	"context"
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
@@ -32,9 +35,18 @@ import (
 	"gopkg.in/dedis/onet.v2/log"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
+// MAX_BUFFERED_DOWNSTREAM_ROUNDS is how far after the current round we buffer the rounds received ahead of time (e.g.,
+// while waiting for the retransmission of a missing round), and precompute their pads. When exceeded, we give up and
+// skip the missing rounds.
+const MAX_BUFFERED_DOWNSTREAM_ROUNDS = 10
+
+// DEFAULT_LATENCY_TESTS_INTERVAL is the interval between the latency tests of a client (plus up to half of it, at random)
+const DEFAULT_LATENCY_TESTS_INTERVAL = 2 * time.Second
+
 // ClientState contains the mutable state of the client.
 type ClientState struct {
 	DCNet                         *dcnet.DCNetEntity
@@ -56,19 +68,52 @@ type ClientState struct {
 	PublicKey                     kyber.Point
 	sharedSecrets                 []kyber.Point
 	TrusteePublicKey              []kyber.Point
+	PinnedTrusteesPks             []kyber.Point      // the trustees we trust, see pinning.go
+	MinPinnedTrustees             int                // if > 0, the relay's trustees must include this number of pinned trustees
+	RelayPublicKey                kyber.Point        // if not nil, we drop the downstream cells not signed with it
+	StandbyRelayPublicKey         kyber.Point        // if not nil, the only relay we accept a resume from
+	UnauthenticatedCells          int                // number of downstream cells dropped because of their signature
+	authenticator                 *net.Authenticator // verifies the messages of the relay, see authentication.go
 	UseSocksProxy                 bool
 	UseUDP                        bool
 	MessageHistory                kyber.XOF
 	StartStopReceiveBroadcast     chan bool
+	stopBroadcastListener         context.CancelFunc // stops the broadcast-listener goroutine, if any
 	timeStatistics                map[string]*prifilog.TimeStatistics
 	pcapReplay                    *PCAPReplayer
 	DisruptionProtectionEnabled   bool
-	LastWantToSend                time.Time
+	transmissionPolicy            TransmissionPolicy // decides when we reserve slots (see transmission_policy.go)
+	schedulesStatistics           *prifilog.SchedulesStatistics
 	EquivocationProtectionEnabled bool
+	UDPFECGroupSize               int // if > 0, the relay broadcasts a FEC parity packet every UDPFECGroupSize rounds
+	fecDecoder                    *net.FECDecoder
+	fecStatistics                 *prifilog.FECStatistics
+	fecRecoveredSinceNack         int // the rounds rebuilt from the FEC parity, reported to the relay with our next NACK
+	pipelineStatistics            *prifilog.PipelineStatistics
+	resyncInProgress              bool             // true from the relay's resync until we communicate again
+	DataHistory                   map[int32][]byte // the cleartext we sent in our slot, in the last rounds (see disruption.go)
+	shuffleBase                   kyber.Point      // the key of our slot is ephemeralPrivateKey * shuffleBase
+	blameInProgress               bool             // true once we queued a CLI_REL_DISRUPTION_BLAME
+	pendingBlame                  []byte           // the blame to send in our next slot, if any
+	macKey                        []byte           // the key of the HMAC of our cells, shared with the relay (see deriveMACKey)
+
+	//pads precomputation (see pad_precomputation.go)
+	PadPrecomputationRounds int                // if > 0, a goroutine keeps the pads of the next rounds ready
+	padsUsed                chan bool          // wakes up this goroutine after each round
+	stopPrecomputingPads    context.CancelFunc // stops this goroutine, nil if none
+
+	//status (see status.go)
+	BytesSent      int64 // the data we sent in our slots
+	BytesReceived  int64 // the downstream data we received
+	upstreamPaused bool  // if true, we only send cover traffic
 
 	//concurrent stuff
 	RoundNo           int32
 	BufferedRoundData map[int32]net.REL_CLI_DOWNSTREAM_DATA
+	NackedRounds      map[int32]bool // rounds for which we already asked a retransmission
+
+	// sync
+	processingLock sync.Mutex // downstream data can arrive both via UDP and TCP (retransmissions)
 }
 
 // PCAPReplayer handles the data needed to replay some .pcap file
@@ -76,9 +121,12 @@ type PCAPReplayer struct {
 	Enabled       bool
 	PCAPFolder    string
 	PCAPFile      string
+	Options       utils.PCAPReplayOptions
 	Packets       []utils.Packet
 	currentPacket int
 	time0         uint64
+	Downstream    bool           // the relay replays a capture downstream (see prifi-lib/relay/pcap_replay.go)
+	downstreamLog *utils.PCAPLog // the delays of the packets it replays
 }
 
 // PriFiLibInstance contains the mutable state of a PriFi entity.
@@ -86,6 +134,8 @@ type PriFiLibClientInstance struct {
 	messageSender *net.MessageSenderWrapper
 	clientState   *ClientState
 	stateMachine  *utils.StateMachine
+	ctx           context.Context //owns all the goroutines and timers of this client; cancelled by Stop()
+	cancel        context.CancelFunc
 }
 
 // NewClient creates a new PriFi client entity state.
@@ -95,10 +145,11 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 
 	//instantiates the static stuff
 	clientState.PublicKey, clientState.privateKey = crypto.NewKeyPair()
+	clientState.authenticator = net.NewAuthenticator(clientState.privateKey)
 	//clientState.StartStopReceiveBroadcast = make(chan bool) //this should stay nil, !=nil -> we have a listener goroutine active
 	clientState.LatencyTest = &prifilog.LatencyTests{
 		DoLatencyTests:       doLatencyTest,
-		LatencyTestsInterval: 2 * time.Second,
+		LatencyTestsInterval: DEFAULT_LATENCY_TESTS_INTERVAL,
 		NextLatencyTest:      time.Now(),
 		LatencyTestsToSend:   make([]*prifilog.LatencyTestToSend, 0),
 	}
@@ -106,11 +157,17 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 	clientState.timeStatistics["latency-msg-stayed-in-buffer"] = prifilog.NewTimeStatistics()
 	clientState.timeStatistics["measured-latency"] = prifilog.NewTimeStatistics()
 	clientState.timeStatistics["round-processing"] = prifilog.NewTimeStatistics()
+	clientState.timeStatistics["pcap-delay"] = prifilog.NewTimeStatistics()
 	clientState.DataForDCNet = dataForDCNet
 	clientState.NextDataForDCNet = nil
 	clientState.DataFromDCNet = dataFromDCNet
 	clientState.DataOutputEnabled = dataOutputEnabled
-	clientState.LastWantToSend = time.Now()
+	clientState.transmissionPolicy = &LingerTransmissionPolicy{Linger: DEFAULT_LINGER_TIME}
+	if doReplayPcap {
+		clientState.transmissionPolicy = &LingerTransmissionPolicy{Linger: 0} // the pcap dictates when we send
+	}
+	clientState.schedulesStatistics = prifilog.NewSchedulesStatistics()
+	clientState.pipelineStatistics = prifilog.NewPipelineStatistics()
 	clientState.pcapReplay = &PCAPReplayer{
 		Enabled:    doReplayPcap,
 		PCAPFolder: pcapFolder,
@@ -132,43 +189,143 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 	}
 	sm.Init(states, logFn, errFn)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	prifi := PriFiLibClientInstance{
 		messageSender: msgSender,
 		clientState:   clientState,
 		stateMachine:  sm,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 
 	return &prifi
 }
 
+// Stop cancels the context of this client, which stops all the goroutines and timers it started, including the
+// broadcast-listener goroutine. Can be called several times.
+func (p *PriFiLibClientInstance) Stop() {
+	p.cancel()
+}
+
+// SetKeyPair replaces our long-term key pair (used for the DC-net secrets and the authentication), e.g., with a key
+// pair loaded from a file, so that we keep the same identity across restarts. It must be called before joining.
+func (p *PriFiLibClientInstance) SetKeyPair(publicKey kyber.Point, privateKey kyber.Scalar) error {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
+	if !crypto.IsKeyPair(publicKey, privateKey) {
+		return errors.New("Client : the public key does not match the private key")
+	}
+	if p.stateMachine.State() != "BEFORE_INIT" {
+		return errors.New("Client : cannot change the key pair in state " + p.stateMachine.State())
+	}
+	p.clientState.PublicKey = publicKey
+	p.clientState.privateKey = privateKey
+	p.clientState.authenticator.SetPrivateKey(privateKey)
+	return nil
+}
+
+// SetLatencyTests sets the interval between our latency tests (plus up to half of it, at random), and the clients
+// which send latency tests (only client 0 if empty). A probing client is not anonymous towards the relay, see
+// prifilog.LatencyTests. It does nothing if the latency tests are disabled.
+func (p *PriFiLibClientInstance) SetLatencyTests(interval time.Duration, probingClients []int) error {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
+	if interval <= 0 {
+		return errors.New("Client : the interval between latency tests must be positive")
+	}
+	p.clientState.LatencyTest.LatencyTestsInterval = interval
+	p.clientState.LatencyTest.ProbingClients = probingClients
+	return nil
+}
+
+// SetPCAPReplayOptions tells which packets of our capture we replay, and how (see utils.PCAPReplayOptions). A non-zero
+// seed is added to our ID, so that the clients have different, but reproducible, offsets. It takes effect when we
+// receive the parameters of the relay.
+func (p *PriFiLibClientInstance) SetPCAPReplayOptions(options utils.PCAPReplayOptions) error {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
+	if options.TimeScale < 0 {
+		return errors.New("Client : the PCAP time scale cannot be negative")
+	}
+	p.clientState.pcapReplay.Options = options
+	return nil
+}
+
 // ReceivedMessage must be called when a PriFi host receives a message.
 // It takes care to call the correct message handler function.
 func (p *PriFiLibClientInstance) ReceivedMessage(msg interface{}) error {
 
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
 	var err error
 
+	//the messages from the network are authenticated, the others are local calls
+	if authenticated, ok := msg.(net.AUTHENTICATED_MESSAGE); ok {
+		if err := p.authenticate(authenticated); err != nil {
+			return err
+		}
+		msg = authenticated.Msg
+	}
+
 	switch typedMsg := msg.(type) {
 	case net.ALL_ALL_PARAMETERS:
+		if typedMsg.ForceParams && (p.stateMachine.State() == "READY" || p.stateMachine.State() == "BLAMING") {
+			//the relay resyncs, but we missed the FlagResync
+			p.resync()
+		}
 		if typedMsg.ForceParams || p.stateMachine.AssertState("BEFORE_INIT") {
 			err = p.Received_ALL_ALL_PARAMETERS(typedMsg)
 		}
 	case net.ALL_ALL_SHUTDOWN:
 		err = p.Received_ALL_ALL_SHUTDOWN(typedMsg)
 	case net.REL_CLI_DOWNSTREAM_DATA:
-		if p.stateMachine.AssertState("READY") {
+		if !p.ignoredDuringResync("REL_CLI_DOWNSTREAM_DATA") && !p.resyncedWhileBlaming(typedMsg.FlagResync, typedMsg.VerifySignature) && !p.ignoredWhileBlaming("REL_CLI_DOWNSTREAM_DATA") && p.stateMachine.AssertState("READY") && p.downstreamAuthenticated(typedMsg.VerifySignature) {
 			err = p.Received_REL_CLI_DOWNSTREAM_DATA(typedMsg)
 		}
 	case net.REL_CLI_DOWNSTREAM_DATA_UDP:
-		if p.stateMachine.AssertState("READY") {
+		if !p.ignoredDuringResync("REL_CLI_DOWNSTREAM_DATA_UDP") && !p.resyncedWhileBlaming(typedMsg.FlagResync, typedMsg.VerifySignature) && !p.ignoredWhileBlaming("REL_CLI_DOWNSTREAM_DATA_UDP") && p.stateMachine.AssertState("READY") && p.downstreamAuthenticated(typedMsg.VerifySignature) {
 			err = p.Received_REL_CLI_UDP_DOWNSTREAM_DATA(typedMsg)
 		}
+	case net.REL_ALL_RESUME:
+		if p.stateMachine.State() != "READY" {
+			//we have no session to resume (e.g., we restarted); the relay will restart the protocol
+			err = errors.New("Client : cannot resume a session in state " + p.stateMachine.State())
+		} else {
+			err = p.Received_REL_ALL_RESUME(typedMsg)
+		}
 	case net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG:
 		if p.stateMachine.AssertState("EPH_KEYS_SENT") {
 			err = p.Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(typedMsg)
 		}
+	case net.REL_CLI_DISRUPTED_ROUND:
+		if !p.ignoredWhileBlaming("REL_CLI_DISRUPTED_ROUND") && p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_DISRUPTED_ROUND(typedMsg)
+		}
+	case net.REL_ALL_DISRUPTION_REVEAL:
+		if p.stateMachine.AssertStateOrState("READY", "BLAMING") {
+			err = p.Received_REL_ALL_DISRUPTION_REVEAL(typedMsg)
+		}
+	case net.REL_ALL_DISRUPTION_SECRET:
+		if p.stateMachine.AssertState("BLAMING") {
+			err = p.Received_REL_ALL_DISRUPTION_SECRET(typedMsg)
+		}
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
 
 	return err
 }
+
+// ignoredDuringResync returns true if the relay is resyncing and we are not communicating yet : the downstream
+// data is a leftover of the previous configuration, and should be dropped
+func (p *PriFiLibClientInstance) ignoredDuringResync(msgName string) bool {
+	if !p.clientState.resyncInProgress || p.stateMachine.State() == "READY" {
+		return false
+	}
+	log.Lvl3("Client", p.clientState.ID, ": dropping", msgName, "from the configuration before the resync")
+	return true
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+// MAX_PRECOMPUTED_ROUNDS bounds the number of rounds whose pads we keep ready, as each takes nTrustees * PayloadSize bytes
+const MAX_PRECOMPUTED_ROUNDS = 100
+
+/*
+Like the trustees, which run ahead of the relay, a client can compute its DC-net pads before the downstream cells
+arrive. A goroutine keeps the pads of the next PadPrecomputationRounds rounds ready; answering a downstream cell is then
+a single XOR, instead of running the PRNGs on the critical path of the round. After each round, the goroutine is woken
+up to replace the pads used. The pads of skipped rounds are discarded by the DC-net, and the goroutine stops with the
+DC-net it fills (on a resync, on new parameters, or when the client stops).
+*/
+
+// SetPadPrecomputation sets the number of rounds whose pads we compute in advance (0 disables the precomputation).
+// It takes effect immediately if we are already in a DC-net, otherwise once we join one.
+func (p *PriFiLibClientInstance) SetPadPrecomputation(nRounds int) error {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
+	if nRounds < 0 || nRounds > MAX_PRECOMPUTED_ROUNDS {
+		return errors.New("Client : can precompute the pads of 0 to " + strconv.Itoa(MAX_PRECOMPUTED_ROUNDS) + " rounds, not " + strconv.Itoa(nRounds))
+	}
+	p.clientState.PadPrecomputationRounds = nRounds
+	if p.clientState.DCNet != nil {
+		p.startPadPrecomputation(p.clientState.DCNet)
+	}
+	return nil
+}
+
+// startPadPrecomputation stops precomputing the pads of our previous DC-net, if any, and starts the goroutine filling
+// the pads of "dcNet", if enabled.
+func (p *PriFiLibClientInstance) startPadPrecomputation(dcNet *dcnet.DCNetEntity) {
+	p.stopPadPrecomputation()
+
+	if p.clientState.PadPrecomputationRounds == 0 {
+		return
+	}
+	var ctx context.Context
+	ctx, p.clientState.stopPrecomputingPads = context.WithCancel(p.ctx)
+	p.clientState.padsUsed = make(chan bool, 1)
+
+	go precomputePads(ctx, dcNet, p.clientState.PadPrecomputationRounds, p.clientState.padsUsed, p.clientState.ID)
+}
+
+// stopPadPrecomputation stops the goroutine filling the pads of our DC-net, if any.
+func (p *PriFiLibClientInstance) stopPadPrecomputation() {
+	if p.clientState.stopPrecomputingPads != nil {
+		p.clientState.stopPrecomputingPads()
+		p.clientState.stopPrecomputingPads = nil
+	}
+	p.clientState.padsUsed = nil
+}
+
+// padsConsumed wakes up the goroutine filling the pads, if any, after we encoded a round. It never blocks.
+func (p *PriFiLibClientInstance) padsConsumed() {
+	select {
+	case p.clientState.padsUsed <- true:
+	default:
+	}
+}
+
+// precomputePads keeps the pads of the next nRounds rounds of "dcNet" ready, until "ctx" is cancelled.
+func precomputePads(ctx context.Context, dcNet *dcnet.DCNetEntity, nRounds int, padsUsed chan bool, clientID int) {
+	log.Lvl2("Client", clientID, ": precomputing the pads of the next", nRounds, "rounds")
+	for {
+		dcNet.PrecomputePadsAhead(nRounds)
+
+		select {
+		case <-ctx.Done():
+			log.Lvl2("Client", clientID, ": stopped precomputing pads")
+			return
+		case <-padsUsed:
+		}
+	}
+}
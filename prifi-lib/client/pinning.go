@@ -0,0 +1,92 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+
+	"gopkg.in/dedis/kyber.v2"
+)
+
+/*
+Trustee public-key pinning. The relay tells us the public keys of the trustees, with which we compute our DC-net
+secrets; a malicious relay could send its own keys, play all the trustees, and de-anonymize us. Hence, a client can
+pin the keys of the trustees it trusts (see SetPinnedTrustees) : it refuses the parameters of the relay unless they
+contain at least MinPinnedTrustees of them.
+*/
+
+// SetPinnedTrustees sets the public keys of the trustees we trust, and the number of them which must be part of the
+// protocol. If minPinned is 0, we accept any set of trustees. A key pinned twice counts once.
+func (p *PriFiLibClientInstance) SetPinnedTrustees(pinned []kyber.Point, minPinned int) error {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
+	pinned = distinctKeys(pinned)
+	if minPinned < 0 {
+		return errors.New("Client : the number of pinned trustees cannot be negative")
+	}
+	if minPinned > len(pinned) {
+		return errors.New("Client : requires " + strconv.Itoa(minPinned) + " pinned trustees, but only " + strconv.Itoa(len(pinned)) + " are pinned")
+	}
+	p.clientState.PinnedTrusteesPks = pinned
+	p.clientState.MinPinnedTrustees = minPinned
+	return nil
+}
+
+// checkTrustees returns an error if the relay does not give one distinct key per trustee : with a key listed twice, we
+// would share the same secret twice, and those two pads would cancel out (e.g., [pinned, pinned, relay's key] leaves
+// only the pad of the relay). Then, it checks the pinned trustees
+func (p *PriFiLibClientInstance) checkTrustees(trusteesPks []kyber.Point, nTrustees int) error {
+	if len(trusteesPks) != nTrustees {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : the relay gives " + strconv.Itoa(len(trusteesPks)) +
+			" trustee keys for " + strconv.Itoa(nTrustees) + " trustees; refusing to join")
+	}
+	if len(distinctKeys(trusteesPks)) != nTrustees {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : the relay gives a nil or duplicate trustee key; refusing to join")
+	}
+	return p.checkPinnedTrustees(trusteesPks)
+}
+
+// checkPinnedTrustees returns an error if the trustees given by the relay do not include enough pinned trustees
+func (p *PriFiLibClientInstance) checkPinnedTrustees(trusteesPks []kyber.Point) error {
+	if p.clientState.MinPinnedTrustees == 0 {
+		return nil
+	}
+
+	found := 0
+	for _, pinned := range p.clientState.PinnedTrusteesPks {
+		for _, pk := range trusteesPks {
+			if pk != nil && pk.Equal(pinned) {
+				found++
+				break
+			}
+		}
+	}
+
+	if found < p.clientState.MinPinnedTrustees {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : the relay's " + strconv.Itoa(len(trusteesPks)) +
+			" trustees include " + strconv.Itoa(found) + " pinned trustees, but at least " + strconv.Itoa(p.clientState.MinPinnedTrustees) +
+			" are required; refusing to join")
+	}
+	return nil
+}
+
+// distinctKeys returns the non-nil keys, without duplicates
+func distinctKeys(keys []kyber.Point) []kyber.Point {
+	distinct := make([]kyber.Point, 0, len(keys))
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		duplicate := false
+		for _, other := range distinct {
+			if other.Equal(key) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			distinct = append(distinct, key)
+		}
+	}
+	return distinct
+}
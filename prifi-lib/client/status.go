@@ -0,0 +1,53 @@
+package client
+
+import (
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+/*
+The status of a client can be read at any time, e.g., by a local status API, and the user can pause the upstream
+transmission. While paused, we still send a DC-net cipher in every round (the others would time out otherwise), but
+only cover traffic : our slots are empty, we reserve slots only if the transmission policy sends cover traffic, and the
+data of the SOCKS/VPN waits in DataForDCNet until we resume.
+*/
+
+// ClientStatus is a snapshot of the state of a client
+type ClientStatus struct {
+	State          string  // the state of the state machine (e.g., READY)
+	ID             int     // our ID in the protocol
+	Slot           int     // our slot, -1 if we do not have one yet
+	Round          int32   // the round we wait for
+	BytesSent      int64   // the data we sent in our slots (not counting the cover traffic)
+	BytesReceived  int64   // the downstream data we received (the whole broadcast, not only ours)
+	LatencyMs      float64 // the mean round-trip latency of our latency tests, -1 if none
+	UpstreamPaused bool    // if true, we only send cover traffic
+}
+
+// Status returns a snapshot of our state
+func (p *PriFiLibClientInstance) Status() ClientStatus {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
+	latency, _ := p.clientState.timeStatistics["measured-latency"].Mean()
+	return ClientStatus{
+		State:          p.stateMachine.State(),
+		ID:             p.clientState.ID,
+		Slot:           p.clientState.MySlot,
+		Round:          p.clientState.RoundNo,
+		BytesSent:      p.clientState.BytesSent,
+		BytesReceived:  p.clientState.BytesReceived,
+		LatencyMs:      latency,
+		UpstreamPaused: p.clientState.upstreamPaused,
+	}
+}
+
+// PauseUpstream pauses (or resumes) our upstream transmission : while paused, we only send cover traffic
+func (p *PriFiLibClientInstance) PauseUpstream(paused bool) {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+
+	if paused != p.clientState.upstreamPaused {
+		log.Lvl1("Client", p.clientState.ID, ": upstream transmission paused :", paused)
+	}
+	p.clientState.upstreamPaused = paused
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+//DEFAULT_LINGER_TIME is how long the "Linger" policy keeps reserving slots after some data (the historical behavior)
+const DEFAULT_LINGER_TIME = 5 * time.Second
+
+/*
+A TransmissionPolicy decides, at each open/closed (OC) schedule, if the client reserves a slot. It is told if some data
+is waiting (upstream data, latency-test messages or pcap packets); a slot reserved without data is cover traffic, and
+wastes the bandwidth of the group, while not reserving when data is waiting delays it to a later schedule.
+The effect of the policy is recorded in the schedule statistics of the client.
+*/
+type TransmissionPolicy interface {
+	//Name returns the name of the policy, for the logs and statistics
+	Name() string
+
+	//ReserveSlot is called at each OC schedule, and returns true if we reserve a slot
+	ReserveSlot(now time.Time, hasData bool) bool
+}
+
+//SetTransmissionPolicy replaces the policy deciding when we reserve slots (by default, "Linger")
+func (p *PriFiLibClientInstance) SetTransmissionPolicy(policy TransmissionPolicy) {
+	p.clientState.processingLock.Lock()
+	defer p.clientState.processingLock.Unlock()
+	p.clientState.transmissionPolicy = policy
+}
+
+//NewTransmissionPolicy returns the policy with the given name ("Linger", "OnDemand", "ConstantRate" or "TokenBucket").
+//periodMs is the linger time, the period of the cover traffic, or the time to earn a token, respectively; burst is the
+//size of the token bucket
+func NewTransmissionPolicy(name string, periodMs, burst int) (TransmissionPolicy, error) {
+	period := time.Duration(periodMs) * time.Millisecond
+	switch name {
+	case "", "Linger":
+		if periodMs <= 0 {
+			period = DEFAULT_LINGER_TIME
+		}
+		return &LingerTransmissionPolicy{Linger: period}, nil
+	case "OnDemand":
+		return &LingerTransmissionPolicy{Linger: 0}, nil
+	case "ConstantRate":
+		if periodMs <= 0 {
+			return nil, errors.New("ConstantRate transmission policy needs a positive period")
+		}
+		return &ConstantRateTransmissionPolicy{Period: period}, nil
+	case "TokenBucket":
+		if periodMs <= 0 || burst < 1 {
+			return nil, errors.New("TokenBucket transmission policy needs a positive period and burst")
+		}
+		return NewTokenBucketTransmissionPolicy(period, burst), nil
+	}
+	return nil, errors.New("Unknown TransmissionPolicy " + name)
+}
+
+/*
+LingerTransmissionPolicy reserves a slot when some data is waiting, and keeps reserving for Linger after that, hoping
+that more data follows. The historical behavior lingers 5 seconds; with Linger = 0, we reserve only when data is
+waiting ("OnDemand"), which wastes no slot but gives no cover to bursty clients.
+*/
+type LingerTransmissionPolicy struct {
+	Linger   time.Duration
+	lastData time.Time
+}
+
+//Name returns "Linger", or "OnDemand" without linger time
+func (l *LingerTransmissionPolicy) Name() string {
+	if l.Linger == 0 {
+		return "OnDemand"
+	}
+	return "Linger"
+}
+
+//ReserveSlot returns true if some data is waiting, or was waiting less than Linger ago
+func (l *LingerTransmissionPolicy) ReserveSlot(now time.Time, hasData bool) bool {
+	if hasData {
+		l.lastData = now
+		return true
+	}
+	return now.Before(l.lastData.Add(l.Linger))
+}
+
+/*
+ConstantRateTransmissionPolicy reserves one slot every Period, whether some data is waiting or not : the pattern of
+our reservations does not depend on our activity. The data waits for the next reserved slot.
+*/
+type ConstantRateTransmissionPolicy struct {
+	Period      time.Duration
+	nextReserve time.Time
+}
+
+//Name returns "ConstantRate"
+func (c *ConstantRateTransmissionPolicy) Name() string {
+	return "ConstantRate"
+}
+
+//ReserveSlot returns true if the last reservation is at least Period old
+func (c *ConstantRateTransmissionPolicy) ReserveSlot(now time.Time, hasData bool) bool {
+	if now.Before(c.nextReserve) {
+		return false
+	}
+	c.nextReserve = now.Add(c.Period)
+	return true
+}
+
+/*
+TokenBucketTransmissionPolicy reserves a slot only when some data is waiting, and when it has a token. It earns one
+token every Period, up to Burst tokens : a burst of data gets Burst slots at once, then one slot per Period.
+*/
+type TokenBucketTransmissionPolicy struct {
+	Period     time.Duration
+	Burst      int
+	tokens     int
+	lastRefill time.Time
+}
+
+//NewTokenBucketTransmissionPolicy returns a TokenBucketTransmissionPolicy with a full bucket
+func NewTokenBucketTransmissionPolicy(period time.Duration, burst int) *TokenBucketTransmissionPolicy {
+	return &TokenBucketTransmissionPolicy{
+		Period: period,
+		Burst:  burst,
+		tokens: burst,
+	}
+}
+
+//Name returns "TokenBucket"
+func (b *TokenBucketTransmissionPolicy) Name() string {
+	return "TokenBucket"
+}
+
+//ReserveSlot returns true if some data is waiting, and spends a token for it
+func (b *TokenBucketTransmissionPolicy) ReserveSlot(now time.Time, hasData bool) bool {
+	if b.lastRefill.IsZero() {
+		b.lastRefill = now
+	}
+	if earned := int(now.Sub(b.lastRefill) / b.Period); earned > 0 {
+		b.tokens += earned
+		b.lastRefill = b.lastRefill.Add(time.Duration(earned) * b.Period)
+		if b.tokens >= b.Burst {
+			b.tokens = b.Burst
+			b.lastRefill = now
+		}
+	}
+
+	if !hasData || b.tokens == 0 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransmissionPolicies(test *testing.T) {
+
+	t0 := time.Now()
+	ms := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Millisecond) }
+
+	//default policy : reserve with data, and linger 5 seconds after it
+	linger, err := NewTransmissionPolicy("", 0, 0)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if linger.Name() != "Linger" {
+		test.Error("Default policy should be Linger, is", linger.Name())
+	}
+	if linger.ReserveSlot(ms(0), false) {
+		test.Error("Linger policy should not reserve before any data")
+	}
+	if !linger.ReserveSlot(ms(0), true) {
+		test.Error("Linger policy should reserve when data is waiting")
+	}
+	if !linger.ReserveSlot(ms(4999), false) {
+		test.Error("Linger policy should keep reserving after some data")
+	}
+	if linger.ReserveSlot(ms(5000), false) {
+		test.Error("Linger policy should stop reserving", DEFAULT_LINGER_TIME, "after the data")
+	}
+
+	//on demand : only with data
+	onDemand, err := NewTransmissionPolicy("OnDemand", 1000, 0)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !onDemand.ReserveSlot(ms(0), true) || onDemand.ReserveSlot(ms(1), false) {
+		test.Error("OnDemand policy should reserve exactly when data is waiting")
+	}
+
+	//constant rate : one slot per period, whatever the data
+	constant, err := NewTransmissionPolicy("ConstantRate", 100, 0)
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := []bool{true, false, false, true, false, true}
+	for i, when := range []int{0, 50, 99, 100, 150, 250} {
+		if constant.ReserveSlot(ms(when), i%2 == 0) != expected[i] {
+			test.Error("ConstantRate policy, schedule at", when, "ms : expected", expected[i])
+		}
+	}
+
+	//token bucket : bursts of 2 slots, then one slot per 100 ms
+	bucket, err := NewTransmissionPolicy("TokenBucket", 100, 2)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if bucket.ReserveSlot(ms(0), false) {
+		test.Error("TokenBucket policy should not reserve without data")
+	}
+	if !bucket.ReserveSlot(ms(0), true) || !bucket.ReserveSlot(ms(1), true) {
+		test.Error("TokenBucket policy should allow a burst of 2 slots")
+	}
+	if bucket.ReserveSlot(ms(2), true) {
+		test.Error("TokenBucket policy should defer the data when the bucket is empty")
+	}
+	if !bucket.ReserveSlot(ms(100), true) || bucket.ReserveSlot(ms(150), true) {
+		test.Error("TokenBucket policy should earn one token per period")
+	}
+	if !bucket.ReserveSlot(ms(1000), true) || !bucket.ReserveSlot(ms(1000), true) || bucket.ReserveSlot(ms(1000), true) {
+		test.Error("TokenBucket policy should not earn more than 2 tokens")
+	}
+
+	for _, bad := range []string{"Unknown", "ConstantRate", "TokenBucket"} {
+		if _, err := NewTransmissionPolicy(bad, 0, 0); err == nil {
+			test.Error("Should not accept the policy", bad, "without parameters")
+		}
+	}
+}
@@ -16,3 +16,25 @@ func NewKeyPair() (kyber.Point, kyber.Scalar) {
 
 	return pub, priv
 }
+
+/**
+ * derives a public, private key pair from a secret seed; the same seed always gives the same key pair
+ */
+func DeriveKeyPair(seed []byte) (kyber.Point, kyber.Scalar) {
+
+	xof := config.CryptoSuite.XOF(append([]byte("prifi-long-term-key"), seed...))
+	priv := config.CryptoSuite.Scalar().Pick(xof)
+	pub := config.CryptoSuite.Point().Mul(priv, nil)
+
+	return pub, priv
+}
+
+/**
+ * returns true if pub is the public key of priv
+ */
+func IsKeyPair(pub kyber.Point, priv kyber.Scalar) bool {
+	if pub == nil || priv == nil {
+		return false
+	}
+	return config.CryptoSuite.Point().Mul(priv, nil).Equal(pub)
+}
@@ -0,0 +1,31 @@
+package crypto
+
+import (
+	"testing"
+)
+
+func TestKeyPair(t *testing.T) {
+
+	pub, priv := NewKeyPair()
+	if !IsKeyPair(pub, priv) {
+		t.Error("NewKeyPair should give a valid key pair")
+	}
+	otherPub, otherPriv := NewKeyPair()
+	if IsKeyPair(otherPub, priv) || IsKeyPair(pub, otherPriv) || IsKeyPair(nil, priv) || IsKeyPair(pub, nil) {
+		t.Error("IsKeyPair should only accept a public key with its private key")
+	}
+
+	//the derived key pair only depends on the seed
+	pub1, priv1 := DeriveKeyPair([]byte("seed"))
+	pub2, priv2 := DeriveKeyPair([]byte("seed"))
+	pub3, _ := DeriveKeyPair([]byte("another seed"))
+	if !IsKeyPair(pub1, priv1) {
+		t.Error("DeriveKeyPair should give a valid key pair")
+	}
+	if !pub1.Equal(pub2) || !priv1.Equal(priv2) {
+		t.Error("DeriveKeyPair should give the same key pair for the same seed")
+	}
+	if pub1.Equal(pub3) {
+		t.Error("DeriveKeyPair should give different key pairs for different seeds")
+	}
+}
@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"errors"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"gopkg.in/dedis/kyber.v2"
+)
+
+/**
+ * Non-interactive zero-knowledge proofs (Chaum-Pedersen, with the Fiat-Shamir heuristic) that we know x such that
+ * P_i = x * B_i for all the given bases B_i. With one base, it proves the knowledge of a private key (e.g., the
+ * ephemeral key of our slot); with two bases, that two points have the same discrete logarithm (e.g., that a shared
+ * secret is our private key times the public key of a peer). The context binds the proof to a message, e.g., a blame.
+ */
+
+// ProveDL proves that we know x such that P = x * base
+func ProveDL(x kyber.Scalar, base kyber.Point, context []byte) []byte {
+	return proveEqualDL(x, []kyber.Point{base}, context)
+}
+
+// VerifyDL verifies a proof from ProveDL
+func VerifyDL(proof []byte, base, P kyber.Point, context []byte) error {
+	return verifyEqualDL(proof, []kyber.Point{base}, []kyber.Point{P}, context)
+}
+
+// ProveDLEQ proves that we know x such that P = x * base1 and Q = x * base2
+func ProveDLEQ(x kyber.Scalar, base1, base2 kyber.Point, context []byte) []byte {
+	return proveEqualDL(x, []kyber.Point{base1, base2}, context)
+}
+
+// VerifyDLEQ verifies a proof from ProveDLEQ
+func VerifyDLEQ(proof []byte, base1, P, base2, Q kyber.Point, context []byte) error {
+	return verifyEqualDL(proof, []kyber.Point{base1, base2}, []kyber.Point{P, Q}, context)
+}
+
+// proveEqualDL returns c || r, with v random, V_i = v * B_i, c = H(context, B_i, x * B_i, V_i) and r = v - c * x
+func proveEqualDL(x kyber.Scalar, bases []kyber.Point, context []byte) []byte {
+	suite := config.CryptoSuite
+
+	publics := make([]kyber.Point, len(bases))
+	commitments := make([]kyber.Point, len(bases))
+	v := suite.Scalar().Pick(suite.RandomStream())
+	for i, base := range bases {
+		publics[i] = suite.Point().Mul(x, base)
+		commitments[i] = suite.Point().Mul(v, base)
+	}
+
+	c := challenge(bases, publics, commitments, context)
+	r := suite.Scalar().Sub(v, suite.Scalar().Mul(c, x))
+
+	cBytes, err := c.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	rBytes, err := r.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return append(cBytes, rBytes...)
+}
+
+// verifyEqualDL recomputes V_i = r * B_i + c * P_i, and checks the challenge
+func verifyEqualDL(proof []byte, bases, publics []kyber.Point, context []byte) error {
+	suite := config.CryptoSuite
+
+	scalarLen := suite.ScalarLen()
+	if len(proof) != 2*scalarLen {
+		return errors.New("NIZK has a wrong size")
+	}
+	for i := range bases {
+		if bases[i] == nil || publics[i] == nil {
+			return errors.New("NIZK cannot be verified without its points")
+		}
+	}
+	c := suite.Scalar()
+	if err := c.UnmarshalBinary(proof[:scalarLen]); err != nil {
+		return err
+	}
+	r := suite.Scalar()
+	if err := r.UnmarshalBinary(proof[scalarLen:]); err != nil {
+		return err
+	}
+
+	commitments := make([]kyber.Point, len(bases))
+	for i, base := range bases {
+		commitments[i] = suite.Point().Add(suite.Point().Mul(r, base), suite.Point().Mul(c, publics[i]))
+	}
+
+	if !c.Equal(challenge(bases, publics, commitments, context)) {
+		return errors.New("NIZK is invalid")
+	}
+	return nil
+}
+
+// challenge hashes the statement and the commitments into a scalar
+func challenge(bases, publics, commitments []kyber.Point, context []byte) kyber.Scalar {
+	suite := config.CryptoSuite
+
+	h := suite.Hash()
+	h.Write([]byte("prifi-nizk"))
+	h.Write(context)
+	for i := range bases {
+		for _, p := range []kyber.Point{bases[i], publics[i], commitments[i]} {
+			b, err := p.MarshalBinary()
+			if err != nil {
+				panic(err)
+			}
+			h.Write(b)
+		}
+	}
+	return suite.Scalar().Pick(suite.XOF(h.Sum(nil)))
+}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+)
+
+func TestNIZK(t *testing.T) {
+
+	base := config.CryptoSuite.Point().Base()
+	otherBase, _ := NewKeyPair()
+	pub, priv := NewKeyPair()
+	context := []byte("round 3")
+
+	//knowledge of a private key
+	proof := ProveDL(priv, otherBase, context)
+	P := config.CryptoSuite.Point().Mul(priv, otherBase)
+	if err := VerifyDL(proof, otherBase, P, context); err != nil {
+		t.Error("NIZK should be valid,", err)
+	}
+	if err := VerifyDL(proof, otherBase, P, []byte("round 4")); err == nil {
+		t.Error("NIZK should be bound to its context")
+	}
+	if err := VerifyDL(proof, base, pub, context); err == nil {
+		t.Error("NIZK should be bound to its base")
+	}
+	if err := VerifyDL(proof[1:], otherBase, P, context); err == nil {
+		t.Error("NIZK with a wrong size should be invalid")
+	}
+
+	//equality of discrete logarithms, e.g., a shared secret
+	peerPub, _ := NewKeyPair()
+	secret := config.CryptoSuite.Point().Mul(priv, peerPub)
+	proof = ProveDLEQ(priv, base, peerPub, context)
+	if err := VerifyDLEQ(proof, base, pub, peerPub, secret, context); err != nil {
+		t.Error("NIZK should be valid,", err)
+	}
+	wrongSecret, _ := NewKeyPair()
+	if err := VerifyDLEQ(proof, base, pub, peerPub, wrongSecret, context); err == nil {
+		t.Error("NIZK should not prove a wrong secret")
+	}
+	if err := VerifyDLEQ(proof, base, pub, peerPub, nil, context); err == nil {
+		t.Error("NIZK should not be valid without its points")
+	}
+}
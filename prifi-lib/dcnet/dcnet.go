@@ -1,12 +1,14 @@
 package dcnet
 
 import (
+	"errors"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"gopkg.in/dedis/kyber.v2"
 	"gopkg.in/dedis/kyber.v2/suites"
 	"gopkg.in/dedis/onet.v2/log"
 	"strconv"
+	"sync"
 )
 
 // Relay, Trustee or Client
@@ -33,9 +35,19 @@ type DCNetEntity struct {
 
 	cryptoSuite  suites.Suite
 	sharedKeys   []kyber.Point // keys shared with other DC-net members
-	sharedPRNGs  []kyber.XOF   // PRNGs shared with other DC-net members (seeded with sharedKeys)
+	sessionKeys  []kyber.Point // the ephemeral public key of the client of each pair, fresh in each session
+	sharedPRNGs  []kyber.XOF   // PRNGs shared with other DC-net members (seeded with sharedKeys and sessionKeys)
 	currentRound int32
 
+	//the pads of the rounds currentRound, currentRound+1, ..., computed in advance (see PrecomputePads)
+	precomputedPads [][][]byte
+	padsLock        sync.Mutex // protects the PRNGs, currentRound, precomputedPads and padHistory, as a goroutine may precompute pads
+
+	//the states of the PRNGs before the pads of the last rounds, to reveal those pads in a blame (see KeepPadHistory)
+	padHistory       map[int32][]kyber.XOF // nil if we keep no history
+	padHistoryRounds int32
+	oldestPadRound   int32 // the oldest round which may be in padHistory
+
 	//Used by the relay
 	DCNetRoundDecoder *DCNetRoundDecoder //nil if unused
 
@@ -54,13 +66,17 @@ type DCNetRoundDecoder struct {
 	equivClientContribs      [][]byte
 }
 
-// Used by clients, trustees
+// Used by clients, trustees. The PRNG shared with the i-th peer is seeded with sharedKeys[i] and sessionKeys[i], the
+// ephemeral public key of the client of this pair : the long-term keys (hence the shared keys) are kept across
+// sessions, and the rounds restart at 0 in each session, so without a fresh session key the pads would repeat, and
+// XORing the ciphers of a client from two sessions would reveal whether it owned the slot.
 func NewDCNetEntity(
 	entityID int,
 	entity DCNET_ENTITY,
 	PayloadSize int,
 	equivocationProtection bool,
-	sharedKeys []kyber.Point) *DCNetEntity {
+	sharedKeys []kyber.Point,
+	sessionKeys []kyber.Point) *DCNetEntity {
 
 	e := new(DCNetEntity)
 	e.EntityID = entityID
@@ -80,20 +96,21 @@ func NewDCNetEntity(
 
 	// if the node participates in the DC-net
 	if entity != DCNET_RELAY {
+		if len(sessionKeys) != len(sharedKeys) {
+			panic("DCNet: " + strconv.Itoa(len(sharedKeys)) + " shared keys, but " + strconv.Itoa(len(sessionKeys)) + " session keys")
+		}
 		e.sharedKeys = sharedKeys
+		e.sessionKeys = sessionKeys
 
-		// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
+		// Use the provided shared secrets and session keys to seed a pseudorandom DC-nets ciphers shared with each peer.
 		e.sharedPRNGs = make([]kyber.XOF, len(sharedKeys))
 		for i := range sharedKeys {
 			e.verbosePrint("key", i, ":", sharedKeys[i])
-			seed, err := sharedKeys[i].MarshalBinary()
-			if err != nil {
-				log.Fatal("Could not extract data from shared key", err)
-			}
-			e.sharedPRNGs[i] = e.cryptoSuite.XOF(seed)
+			e.sharedPRNGs[i] = e.cryptoSuite.XOF(padSeed(sharedKeys[i], sessionKeys[i]))
 		}
 	} else {
 		e.sharedKeys = make([]kyber.Point, 0)
+		e.sessionKeys = make([]kyber.Point, 0)
 		e.sharedPRNGs = make([]kyber.XOF, 0)
 	}
 
@@ -117,6 +134,48 @@ func NewDCNetEntity(
 	return e
 }
 
+// padSeed returns the seed of the PRNG of a pair : the shared key, followed by the session key (both have a fixed length)
+func padSeed(sharedKey, sessionKey kyber.Point) []byte {
+	seed, err := sharedKey.MarshalBinary()
+	if err != nil {
+		log.Fatal("Could not extract data from shared key", err)
+	}
+	session, err := sessionKey.MarshalBinary()
+	if err != nil {
+		log.Fatal("Could not extract data from session key", err)
+	}
+	return append(seed, session...)
+}
+
+// PadBit returns the bit bitPos of the pad of round roundID of the pair seeded with sharedKey and sessionKey. It replays
+// the PRNG from round 0 : the relay only does it to check a secret revealed in a blame, the members of the DC-net keep
+// the states of their PRNGs instead (see KeepPadHistory)
+func PadBit(sharedKey, sessionKey kyber.Point, payloadSize int, roundID int32, bitPos int) int {
+	prng := config.CryptoSuite.XOF(padSeed(sharedKey, sessionKey))
+	pad := make([]byte, payloadSize)
+	for r := int32(0); r <= roundID; r++ {
+		for k := range pad {
+			pad[k] = 0
+		}
+		prng.XORKeyStream(pad, pad)
+	}
+	return padBit(pad, bitPos)
+}
+
+// padBit returns the bit bitPos of the pad
+func padBit(pad []byte, bitPos int) int {
+	return int(pad[bitPos/8]>>uint(bitPos%8)) & 1
+}
+
+// SameSessionKeys returns n times the session key "key", e.g., the ephemeral public key of a client for each trustee
+func SameSessionKeys(key kyber.Point, n int) []kyber.Point {
+	keys := make([]kyber.Point, n)
+	for i := range keys {
+		keys[i] = key
+	}
+	return keys
+}
+
 func (e *DCNetEntity) verbosePrint(info ...interface{}) {
 	if !e.verbose {
 		return
@@ -147,6 +206,9 @@ func (e *DCNetEntity) TrusteeEncodeForRound(roundID int32) []byte {
 // Encodes "Payload" in the correct round. Will skip PRNG material if the round is in the future,
 // and crash if the round is in the past or the Payload is too long
 func (e *DCNetEntity) EncodeForRound(roundID int32, slotOwner bool, payload []byte) []byte {
+	e.padsLock.Lock()
+	defer e.padsLock.Unlock()
+
 	if len(payload) > e.DCNetPayloadSize {
 		panic("DCNet: cannot encode Payload of length " + strconv.Itoa(int(len(payload))) + " max length is " + strconv.Itoa(len(payload)))
 	}
@@ -159,11 +221,8 @@ func (e *DCNetEntity) EncodeForRound(roundID int32, slotOwner bool, payload []by
 		//discard crypto material
 		log.Lvl4("DCNet: Discarding round", e.currentRound)
 
-		// consume the PRNGs
-		for i := range e.sharedPRNGs {
-			dummy := make([]byte, e.DCNetPayloadSize)
-			e.sharedPRNGs[i].XORKeyStream(dummy, dummy)
-		}
+		// consume the PRNGs (or the pads precomputed for this round)
+		e.nextPads()
 
 		e.currentRound++
 	}
@@ -175,6 +234,7 @@ func (e *DCNetEntity) EncodeForRound(roundID int32, slotOwner bool, payload []by
 		c = e.trusteeEncode()
 	}
 	e.currentRound++
+	e.forgetOldPads()
 
 	e.verbosePrint("r[", roundID, "]:\n", c.Payload)
 	e.verbosePrint("r[", roundID, "]: equiv\n", c.EquivocationProtectionTag)
@@ -182,6 +242,79 @@ func (e *DCNetEntity) EncodeForRound(roundID int32, slotOwner bool, payload []by
 	return c.ToBytes()
 }
 
+// Returns true if we can encode for this round, i.e., if we did not encode this round (or a later one) already
+func (e *DCNetEntity) CanEncodeForRound(roundID int32) bool {
+	e.padsLock.Lock()
+	defer e.padsLock.Unlock()
+	return roundID >= e.currentRound
+}
+
+// PrecomputePads computes in advance the pads of the rounds up to roundID (included), so that encoding those rounds
+// is only a XOR. The caller bounds roundID, as the pads of each round are kept in memory until the round is encoded
+func (e *DCNetEntity) PrecomputePads(roundID int32) {
+	for e.precomputeOneRound(func() bool { return e.currentRound+int32(len(e.precomputedPads)) <= roundID }) {
+	}
+}
+
+// PrecomputePadsAhead computes in advance the pads of the next nRounds rounds (those we will encode next), if they
+// are not ready already. Rounds skipped by EncodeForRound discard their pads, so the pads are never reused
+func (e *DCNetEntity) PrecomputePadsAhead(nRounds int) {
+	for e.precomputeOneRound(func() bool { return len(e.precomputedPads) < nRounds }) {
+	}
+}
+
+// precomputeOneRound computes the pads of the next round not precomputed yet, if "wanted" returns true (called with
+// the lock held). One round at a time, so that EncodeForRound never waits long for a concurrent precomputation.
+// Returns true if it computed some pads
+func (e *DCNetEntity) precomputeOneRound(wanted func() bool) bool {
+	e.padsLock.Lock()
+	defer e.padsLock.Unlock()
+
+	if !wanted() {
+		return false
+	}
+	e.precomputedPads = append(e.precomputedPads, e.computePads())
+	return true
+}
+
+// PrecomputedRounds returns the number of rounds whose pads are already computed
+func (e *DCNetEntity) PrecomputedRounds() int {
+	e.padsLock.Lock()
+	defer e.padsLock.Unlock()
+	return len(e.precomputedPads)
+}
+
+// nextPads returns the pads shared with each DC-net member for the round currentRound
+func (e *DCNetEntity) nextPads() [][]byte {
+	if len(e.precomputedPads) > 0 {
+		p_ij := e.precomputedPads[0]
+		e.precomputedPads[0] = nil
+		e.precomputedPads = e.precomputedPads[1:]
+		return p_ij
+	}
+	return e.computePads()
+}
+
+// computePads draws the pads of the next round from the PRNGs shared with each DC-net member
+func (e *DCNetEntity) computePads() [][]byte {
+	if e.padHistory != nil {
+		//the next round is the one after the rounds encoded and precomputed
+		roundID := e.currentRound + int32(len(e.precomputedPads))
+		states := make([]kyber.XOF, len(e.sharedPRNGs))
+		for i := range states {
+			states[i] = e.sharedPRNGs[i].Clone()
+		}
+		e.padHistory[roundID] = states
+	}
+
+	p_ij := make([][]byte, len(e.sharedPRNGs))
+	for i := range p_ij {
+		p_ij[i] = make([]byte, e.DCNetPayloadSize)
+		e.sharedPRNGs[i].XORKeyStream(p_ij[i], p_ij[i])
+	}
+	return p_ij
+}
+
 // Adds `newdata` into the sponge representing the received downstream data
 func (e *DCNetEntity) UpdateReceivedMessageHistory(newData []byte) {
 	if e.EquivocationProtectionEnabled {
@@ -203,11 +336,7 @@ func (e *DCNetEntity) clientEncode(slotOwner bool, payload []byte) *DCNetCipher
 	c.Payload = payload
 
 	// prepare the pads
-	p_ij := make([][]byte, len(e.sharedPRNGs))
-	for i := range p_ij {
-		p_ij[i] = make([]byte, e.DCNetPayloadSize)
-		e.sharedPRNGs[i].XORKeyStream(p_ij[i], p_ij[i])
-	}
+	p_ij := e.nextPads()
 
 	// if the equivocation protection is enabled, encrypt the Payload, and add the tag
 	if e.EquivocationProtectionEnabled {
@@ -234,11 +363,7 @@ func (e *DCNetEntity) trusteeEncode() *DCNetCipher {
 	c.Payload = make([]byte, e.DCNetPayloadSize)
 
 	// prepare the pads
-	p_ij := make([][]byte, len(e.sharedPRNGs))
-	for i := range p_ij {
-		p_ij[i] = make([]byte, e.DCNetPayloadSize)
-		e.sharedPRNGs[i].XORKeyStream(p_ij[i], p_ij[i])
-	}
+	p_ij := e.nextPads()
 
 	// DC-net encrypt the Payload
 	for i := range p_ij {
@@ -315,3 +440,50 @@ func (e *DCNetEntity) DecodeCell() []byte {
 
 	return decoded
 }
+
+// KeepPadHistory keeps the states of the PRNGs before the pads of the last "rounds" rounds encoded (and of the rounds
+// precomputed), so that RevealBits regenerates the pads of one of those rounds without replaying the PRNGs from round 0.
+// A state is much smaller than the pads of a round. It must be called before the first round is encoded
+func (e *DCNetEntity) KeepPadHistory(rounds int) {
+	e.padsLock.Lock()
+	defer e.padsLock.Unlock()
+
+	e.padHistory = make(map[int32][]kyber.XOF)
+	e.padHistoryRounds = int32(rounds)
+	e.oldestPadRound = e.currentRound
+}
+
+// forgetOldPads drops the states of the PRNGs of the rounds before the last padHistoryRounds rounds encoded
+func (e *DCNetEntity) forgetOldPads() {
+	if e.padHistory == nil {
+		return
+	}
+	for ; e.oldestPadRound < e.currentRound-e.padHistoryRounds; e.oldestPadRound++ {
+		delete(e.padHistory, e.oldestPadRound)
+	}
+}
+
+// RevealBits is used in a blame : it returns, for each DC-net member we share a key with (by index), the bit bitPos
+// of the pad we share with it in round roundID. The pads are regenerated from the states of the PRNGs kept for this
+// round (see KeepPadHistory), so it does not change the state of the encoding; it fails if the round is not kept.
+func (e *DCNetEntity) RevealBits(roundID int32, bitPos int) (map[int]int, error) {
+	if bitPos < 0 || bitPos >= 8*e.DCNetPayloadSize {
+		return nil, errors.New("DCNet: cannot reveal bit " + strconv.Itoa(bitPos) + ", the payload has " + strconv.Itoa(8*e.DCNetPayloadSize) + " bits")
+	}
+
+	e.padsLock.Lock()
+	defer e.padsLock.Unlock()
+
+	states, found := e.padHistory[roundID]
+	if !found {
+		return nil, errors.New("DCNet: cannot reveal the pads of round " + strconv.Itoa(int(roundID)) + ", they are not in the history")
+	}
+
+	bits := make(map[int]int)
+	for i := range states {
+		pad := make([]byte, e.DCNetPayloadSize)
+		states[i].Clone().XORKeyStream(pad, pad)
+		bits[i] = padBit(pad, bitPos)
+	}
+	return bits, nil
+}
@@ -20,6 +20,7 @@ type TestNode struct {
 	privKey       kyber.Scalar
 	peerKeys      []kyber.Point
 	sharedSecrets []kyber.Point
+	sessionKeys   []kyber.Point
 	History       kyber.XOF
 	DCNetEntity   *DCNetEntity
 }
@@ -63,13 +64,15 @@ func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, dcNetMessage
 
 	relay := new(TestNode)
 	relay.name = "Relay"
-	relay.DCNetEntity = NewDCNetEntity(0, DCNET_RELAY, dcNetMessageSize, equivocationProtectionEnabled, nil)
+	relay.DCNetEntity = NewDCNetEntity(0, DCNET_RELAY, dcNetMessageSize, equivocationProtectionEnabled, nil, nil)
 
-	// Create tables of the clients' and the trustees' public session keys
+	// Create tables of the clients' and the trustees' public session keys, and of the clients' ephemeral keys
 	clientsKeys := make([]kyber.Point, nclients)
+	clientsEphKeys := make([]kyber.Point, nclients)
 	trusteesKeys := make([]kyber.Point, ntrustees)
 	for i := range clients {
 		clientsKeys[i] = clients[i].pubKey
+		clientsEphKeys[i] = config.CryptoSuite.Point().Pick(rand)
 	}
 	for i := range trustees {
 		trusteesKeys[i] = trustees[i].pubKey
@@ -85,7 +88,8 @@ func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, dcNetMessage
 		for i := range n.peerKeys {
 			n.sharedSecrets[i] = config.CryptoSuite.Point().Mul(n.privKey, n.peerKeys[i])
 		}
-		n.DCNetEntity = NewDCNetEntity(i, DCNET_CLIENT, dcNetMessageSize, equivocationProtectionEnabled, n.sharedSecrets)
+		n.sessionKeys = SameSessionKeys(clientsEphKeys[i], len(n.peerKeys))
+		n.DCNetEntity = NewDCNetEntity(i, DCNET_CLIENT, dcNetMessageSize, equivocationProtectionEnabled, n.sharedSecrets, n.sessionKeys)
 	}
 
 	for i, n := range trustees {
@@ -97,7 +101,8 @@ func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, dcNetMessage
 		for i := range n.peerKeys {
 			n.sharedSecrets[i] = config.CryptoSuite.Point().Mul(n.privKey, n.peerKeys[i])
 		}
-		n.DCNetEntity = NewDCNetEntity(i, DCNET_TRUSTEE, dcNetMessageSize, equivocationProtectionEnabled, n.sharedSecrets)
+		n.sessionKeys = clientsEphKeys
+		n.DCNetEntity = NewDCNetEntity(i, DCNET_TRUSTEE, dcNetMessageSize, equivocationProtectionEnabled, n.sharedSecrets, n.sessionKeys)
 	}
 
 	// Create a set of fake history streams for the relay and clients
@@ -171,3 +176,152 @@ func SimulateRounds(t *testing.T, tg *TestGroup, maxRounds int32) {
 		}
 	}
 }
+
+func TestDCNetRevealBits(t *testing.T) {
+
+	payloadSize := 10
+	sharedKeys := make([]kyber.Point, 3)
+	for i := range sharedKeys {
+		sharedKeys[i] = config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream())
+	}
+	sessionKey := config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream())
+	client := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedKeys, SameSessionKeys(sessionKey, len(sharedKeys)))
+	client.KeepPadHistory(3)
+
+	//without payload, the cipher of a client is the XOR of its pads : the revealed bits must match it
+	for _, roundID := range []int32{0, 1, 5} {
+		cipher := DCNetCipherFromBytes(client.EncodeForRound(roundID, false, nil))
+
+		for _, bitPos := range []int{0, 7, 8, 8*payloadSize - 1} {
+			bits, err := client.RevealBits(roundID, bitPos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bits) != len(sharedKeys) {
+				t.Error("Should reveal one bit per shared key")
+			}
+			xor := 0
+			for i, b := range bits {
+				xor ^= b
+				if b != PadBit(sharedKeys[i], sessionKey, payloadSize, roundID, bitPos) {
+					t.Error("Revealed bit", i, "of round", roundID, "differs from the pad replayed from the keys")
+				}
+			}
+			if xor != int(cipher.Payload[bitPos/8]>>uint(bitPos%8))&1 {
+				t.Error("Revealed bits of round", roundID, "do not match the cipher at bit", bitPos)
+			}
+		}
+	}
+	if _, err := client.RevealBits(5, 8*payloadSize); err == nil {
+		t.Error("Should not reveal a bit out of the payload")
+	}
+
+	//only the last 3 rounds encoded are kept, and the precomputed ones
+	client.PrecomputePads(9)
+	for roundID := int32(6); roundID < 9; roundID++ {
+		client.EncodeForRound(roundID, false, nil)
+	}
+	for _, roundID := range []int32{0, 1, 5} {
+		if _, err := client.RevealBits(roundID, 0); err == nil {
+			t.Error("Should have forgotten the pads of round", roundID)
+		}
+	}
+	for _, roundID := range []int32{6, 7, 8, 9} {
+		if _, err := client.RevealBits(roundID, 0); err != nil {
+			t.Error("Should reveal the pads of round", roundID, "but", err)
+		}
+	}
+	if len(client.padHistory) != 4 {
+		t.Error("Should keep the PRNGs of 4 rounds, keeps", len(client.padHistory))
+	}
+}
+
+func TestDCNetPrecomputePads(t *testing.T) {
+
+	payloadSize := 10
+	sharedKeys := make([]kyber.Point, 3)
+	for i := range sharedKeys {
+		sharedKeys[i] = config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream())
+	}
+	sessionKeys := SameSessionKeys(config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream()), len(sharedKeys))
+	for _, equivocation := range []bool{false, true} {
+		reference := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, equivocation, sharedKeys, sessionKeys)
+		client := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, equivocation, sharedKeys, sessionKeys)
+
+		client.PrecomputePads(4)
+		if client.PrecomputedRounds() != 5 {
+			t.Error("Should have precomputed the pads of rounds 0 to 4, has", client.PrecomputedRounds())
+		}
+		client.PrecomputePads(2)
+		if client.PrecomputedRounds() != 5 {
+			t.Error("Should not precompute the same rounds twice")
+		}
+
+		//the ciphers must not depend on the precomputation, including when skipping rounds and after the cache
+		//(not as slot owner : with the equivocation protection, the owner adds a random key)
+		payload := []byte{1, 2, 3}
+		for _, roundID := range []int32{0, 3, 4, 8} {
+			expected := reference.EncodeForRound(roundID, false, payload)
+			if !bytes.Equal(client.EncodeForRound(roundID, false, payload), expected) {
+				t.Error("Cipher of round", roundID, "differs with precomputed pads (equivocation", equivocation, ")")
+			}
+		}
+		if client.PrecomputedRounds() != 0 {
+			t.Error("The pads of the encoded rounds should be freed, still has", client.PrecomputedRounds())
+		}
+
+		client.PrecomputePadsAhead(3)
+		client.PrecomputePadsAhead(2)
+		if client.PrecomputedRounds() != 3 {
+			t.Error("Should have the pads of the next 3 rounds ready, has", client.PrecomputedRounds())
+		}
+
+		//a goroutine keeps the pads of the next rounds ready while we encode (and skip) rounds
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 50; i++ {
+				client.PrecomputePadsAhead(3)
+			}
+			done <- true
+		}()
+		for roundID := int32(9); roundID < 40; roundID += 3 {
+			expected := reference.EncodeForRound(roundID, false, payload)
+			if !bytes.Equal(client.EncodeForRound(roundID, false, payload), expected) {
+				t.Error("Cipher of round", roundID, "differs with concurrently precomputed pads (equivocation", equivocation, ")")
+			}
+		}
+		<-done
+	}
+}
+
+func TestDCNetSessionKeys(t *testing.T) {
+
+	payloadSize := 10
+	sharedKeys := make([]kyber.Point, 2)
+	for i := range sharedKeys {
+		sharedKeys[i] = config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream())
+	}
+	session1 := SameSessionKeys(config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream()), len(sharedKeys))
+	session2 := SameSessionKeys(config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream()), len(sharedKeys))
+
+	//the same long-term keys (hence shared keys) in two sessions : the pads of each round must differ
+	client1 := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedKeys, session1)
+	client2 := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedKeys, session2)
+	again := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedKeys, session1)
+	for roundID := int32(0); roundID < 5; roundID++ {
+		cipher1 := client1.EncodeForRound(roundID, false, nil)
+		if bytes.Equal(cipher1, client2.EncodeForRound(roundID, false, nil)) {
+			t.Error("The pads of round", roundID, "are the same in two sessions")
+		}
+		if !bytes.Equal(cipher1, again.EncodeForRound(roundID, false, nil)) {
+			t.Error("The pads of round", roundID, "should only depend on the shared and session keys")
+		}
+	}
+
+	//the trustee of the pair draws the same pads as the client with the client's session key
+	trustee := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, false, sharedKeys[:1], session2[:1])
+	client := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedKeys[:1], session2[:1])
+	if !bytes.Equal(trustee.TrusteeEncodeForRound(0), client.EncodeForRound(0, false, nil)) {
+		t.Error("The client and the trustee of a pair should draw the same pads")
+	}
+}
@@ -38,10 +38,12 @@ func equivocationTestForDataLength(t *testing.T, payloadSize int) {
 	sharedSecrets_t[0] = config.CryptoSuite.Point().Mul(c1priv, tpub)
 	sharedSecrets_t[1] = config.CryptoSuite.Point().Mul(c2priv, tpub)
 
-	// set up the DC-nets
-	dcnet_Trustee := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, false, sharedSecrets_t)
-	dcnet_Client1 := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedSecret_c1)
-	dcnet_Client2 := NewDCNetEntity(1, DCNET_CLIENT, payloadSize, false, sharedSecret_c2)
+	// set up the DC-nets, with the ephemeral keys of the clients
+	c1eph, _ := crypto.NewKeyPair()
+	c2eph, _ := crypto.NewKeyPair()
+	dcnet_Trustee := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, false, sharedSecrets_t, []kyber.Point{c1eph, c2eph})
+	dcnet_Client1 := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedSecret_c1, []kyber.Point{c1eph})
+	dcnet_Client2 := NewDCNetEntity(1, DCNET_CLIENT, payloadSize, false, sharedSecret_c2, []kyber.Point{c2eph})
 
 	data := randomBytes(payloadSize)
 
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+//FECStatistics holds statistics about the forward error correction of the UDP downstream broadcast
+type FECStatistics struct {
+	begin      time.Time
+	nextReport time.Time
+	period     time.Duration
+	reportNo   int
+
+	totalParityPackets   int64
+	totalParityBytes     int64
+	totalRecovered       int64
+	totalUnrecoverable   int64
+	instantRecovered     int64
+	instantUnrecoverable int64
+}
+
+//NewFECStatistics create a new FECStatistics struct, with a period (for reporting) of 5 second
+func NewFECStatistics() *FECStatistics {
+	fiveSec := time.Duration(5) * time.Second
+	now := time.Now()
+	stats := FECStatistics{
+		begin:      now,
+		nextReport: now,
+		period:     fiveSec,
+		reportNo:   0}
+	return &stats
+}
+
+//AddParityPacket adds N bytes to the count of parity packets sent (or received)
+func (stats *FECStatistics) AddParityPacket(nBytes int64) {
+	stats.totalParityPackets++
+	stats.totalParityBytes += nBytes
+}
+
+//AddRecovered adds n to the count of lost rounds that were rebuilt from the parity packets
+func (stats *FECStatistics) AddRecovered(n int) {
+	stats.totalRecovered += int64(n)
+	stats.instantRecovered += int64(n)
+}
+
+//AddUnrecoverable adds n to the count of lost rounds that could not be rebuilt from the parity packets
+func (stats *FECStatistics) AddUnrecoverable(n int) {
+	stats.totalUnrecoverable += int64(n)
+	stats.instantUnrecoverable += int64(n)
+}
+
+//Recovered returns the total number of recovered and unrecoverable losses
+func (stats *FECStatistics) Recovered() (int64, int64) {
+	return stats.totalRecovered, stats.totalUnrecoverable
+}
+
+//Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
+func (stats *FECStatistics) Report() string {
+	return stats.ReportWithInfo("")
+}
+
+//ReportWithInfo prints (if t>period=5 seconds have passed since the last report) all the information, with extra data "info"
+func (stats *FECStatistics) ReportWithInfo(info string) string {
+	now := time.Now()
+	if now.After(stats.nextReport) {
+
+		//human-readable output
+		str := fmt.Sprintf("[%v] FEC %v parity packets (%0.1f kB), %v recovered (%v total), %v unrecoverable (%v total) Info: %s",
+			stats.reportNo,
+			stats.totalParityPackets,
+			float64(stats.totalParityBytes)/1024,
+			stats.instantRecovered,
+			stats.totalRecovered,
+			stats.instantUnrecoverable,
+			stats.totalUnrecoverable,
+			info)
+
+		log.Lvl1(str)
+
+		stats.instantRecovered = 0
+		stats.instantUnrecoverable = 0
+
+		stats.nextReport = now.Add(stats.period)
+		stats.reportNo++
+
+		return str
+	}
+
+	return ""
+}
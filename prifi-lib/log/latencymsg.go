@@ -2,19 +2,37 @@ package log
 
 import (
 	"encoding/binary"
-	"strconv"
 	"time"
 )
 
 const pattern uint16 = uint16(43690) //1010101010101010
 const latencyMsgLength int = 12      // 4bytes roundID + 8bytes timeStamp
 
-// Regroups the information about doing latency tests
+// Regroups the information about doing latency tests. A latency message carries the ID of its sender, in the slot of
+// its sender : the relay, and the clients to which it is echoed, learn which slot a probing client owns, i.e., which
+// cells are its own. Hence, the clients only probe if they are listed in ProbingClients (only client 0 if empty)
 type LatencyTests struct {
 	DoLatencyTests       bool
 	LatencyTestsInterval time.Duration
 	NextLatencyTest      time.Time
 	LatencyTestsToSend   []*LatencyTestToSend
+	ProbingClients       []int // the clients which send latency tests, and give up their anonymity; if empty, client 0
+}
+
+// IsProbing returns true if clientID sends latency tests
+func (lt *LatencyTests) IsProbing(clientID int) bool {
+	if !lt.DoLatencyTests {
+		return false
+	}
+	if len(lt.ProbingClients) == 0 {
+		return clientID == 0
+	}
+	for _, id := range lt.ProbingClients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
 }
 
 // One buffered latency test message. We only need to store the "createdAt" time.
@@ -82,27 +100,38 @@ func LatencyMessagesToBytes(msgs []*LatencyTestToSend, clientID int, roundID int
 }
 
 // DecodeLatencyMessages tries to decode Latency messages, and calls actionFunction with (originalRoundId, roundDiff, timeDiff)
-// for every found message
+// for every found message sent by clientID
 func DecodeLatencyMessages(buffer []byte, clientID int, receptionRoundID int32, actionFunction func(int32, int32, int64)) {
+	DecodeLatencyMessagesPerOrigin(buffer, receptionRoundID, func(originClientID int, originalRoundID int32, roundDiff int32, timeDiff int64) {
+		if originClientID == clientID {
+			actionFunction(originalRoundID, roundDiff, timeDiff)
+		}
+	})
+}
+
+// DecodeLatencyMessagesPerOrigin tries to decode Latency messages, whoever sent them, and calls actionFunction with
+// (originClientID, originalRoundId, roundDiff, timeDiff) for every found message. The timeDiff of the messages of
+// other entities is only meaningful if the clocks are synchronized.
+func DecodeLatencyMessagesPerOrigin(buffer []byte, receptionRoundID int32, actionFunction func(int, int32, int32, int64)) {
 
 	//check if it is a latency message
+	if len(buffer) < 6 {
+		return
+	}
 	patternComp := uint16(binary.BigEndian.Uint16(buffer[0:2]))
 	if patternComp != pattern {
 		return
 	}
 
-	//get the number of timestamps, and check the size
+	//get the number of timestamps, and check the size; with all the clients probing, the downstream data of the
+	//others may look like a latency message, we ignore it
 	nMessages := int(binary.BigEndian.Uint16(buffer[2:4]))
-	if 4+(nMessages)*latencyMsgLength > len(buffer) {
-		panic("Invalid message, " + strconv.Itoa(nMessages) + " msg, but size is " + strconv.Itoa(len(buffer)))
-	}
-
-	//check that it is our messages
-	clientIDcomp := int(binary.BigEndian.Uint16(buffer[4:6]))
-	if clientIDcomp != clientID {
+	if 6+(nMessages)*latencyMsgLength > len(buffer) {
 		return
 	}
 
+	originClientID := int(binary.BigEndian.Uint16(buffer[4:6]))
+
 	for i := 0; i < nMessages; i++ {
 		startPos := 6 + i*latencyMsgLength
 
@@ -113,7 +142,18 @@ func DecodeLatencyMessages(buffer []byte, clientID int, receptionRoundID int32,
 		diff := MsTimeStampNow() - timestamp
 		roundDiff := receptionRoundID - originalRoundID
 
-		actionFunction(originalRoundID, roundDiff, diff)
+		actionFunction(originClientID, originalRoundID, roundDiff, diff)
+	}
+}
+
+// LatencyMessageOrigin returns the round in which the latency messages in buffer were sent, if they were sent by
+// clientID. Unlike DecodeLatencyMessages, it does not trust the buffer, which may have been corrupted.
+func LatencyMessageOrigin(buffer []byte, clientID int) (int32, bool) {
+	if len(buffer) < 6+latencyMsgLength || binary.BigEndian.Uint16(buffer[0:2]) != pattern {
+		return 0, false
+	}
+	if int(binary.BigEndian.Uint16(buffer[4:6])) != clientID || binary.BigEndian.Uint16(buffer[2:4]) == 0 {
+		return 0, false
 	}
-	return
+	return int32(binary.BigEndian.Uint32(buffer[6:10])), true
 }
@@ -37,4 +37,59 @@ func TestLatencyMessages(t *testing.T) {
 	}
 	receptionRoundID := int32(20)
 	DecodeLatencyMessages(bytes, clientID, receptionRoundID, actionFunction)
+
+	//the messages are decoded for their origin only
+	decoded := 0
+	DecodeLatencyMessages(bytes, clientID+1, receptionRoundID, func(int32, int32, int64) { decoded++ })
+	if decoded != 0 {
+		t.Error("The latency messages of client", clientID, "should not be decoded for client", clientID+1)
+	}
+	origins := make(map[int]int)
+	DecodeLatencyMessagesPerOrigin(bytes, receptionRoundID, func(origin int, roundRec int32, roundDiff int32, timeDiff int64) {
+		origins[origin]++
+		if roundDiff != receptionRoundID-roundID {
+			t.Error("Wrong round diff", roundDiff)
+		}
+	})
+	if len(origins) != 1 || origins[clientID] != 2 {
+		t.Error("Should have decoded 2 messages from client", clientID, ", decoded", origins)
+	}
+
+	//a buffer announcing more messages than it holds is ignored
+	DecodeLatencyMessagesPerOrigin(bytes[:20], receptionRoundID, func(int, int32, int32, int64) {
+		t.Error("A truncated buffer has no latency message")
+	})
+
+	//only the messages of clientID have an origin
+	if origin, ok := LatencyMessageOrigin(bytes, clientID); !ok || origin != roundID {
+		t.Error("The latency messages should come from round", roundID)
+	}
+	if _, ok := LatencyMessageOrigin(bytes, clientID+1); ok {
+		t.Error("The latency messages are not from client", clientID+1)
+	}
+	if _, ok := LatencyMessageOrigin(bytes[:10], clientID); ok {
+		t.Error("A truncated buffer has no latency message")
+	}
+}
+
+func TestLatencyTestsProbingClients(t *testing.T) {
+
+	latencyTests := &LatencyTests{}
+	if latencyTests.IsProbing(0) {
+		t.Error("No client should probe when the latency tests are disabled")
+	}
+
+	latencyTests.DoLatencyTests = true
+	for clientID, expected := range map[int]bool{0: true, 1: false, 7: false} {
+		if latencyTests.IsProbing(clientID) != expected {
+			t.Error("Without a subset, only client 0 should probe, not", clientID)
+		}
+	}
+
+	latencyTests.ProbingClients = []int{1, 3}
+	for clientID, expected := range map[int]bool{0: false, 1: true, 2: false, 3: true} {
+		if latencyTests.IsProbing(clientID) != expected {
+			t.Error("Client", clientID, "should probe :", expected)
+		}
+	}
 }
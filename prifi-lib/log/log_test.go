@@ -15,10 +15,16 @@ func TestBWStatistics(t *testing.T) {
 }
 func TestLatencyStatistics(t *testing.T) {
 	b := NewTimeStatistics()
+	if mean, n := b.Mean(); mean != -1 || n != 0 {
+		t.Error("Mean without values should be -1, is", mean, "with", n, "values")
+	}
 	b.AddTime(int64(1000))
 	b.AddTime(int64(2000))
 	b.AddTime(int64(2000))
 	b.Report()
+	if mean, n := b.Mean(); mean < 1666 || mean > 1667 || n != 3 {
+		t.Error("Mean should be 1666.67 with 3 values, is", mean, "with", n, "values")
+	}
 }
 
 func TestUtils(t *testing.T) {
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+//PipelineStatistics holds statistics about the rounds processed by a client : in order, ahead of time, or skipped
+type PipelineStatistics struct {
+	begin      time.Time
+	nextReport time.Time
+	period     time.Duration
+	reportNo   int
+
+	totalProcessed  int64
+	totalBuffered   int64
+	totalSkipped    int64
+	instantSkipped  int64
+	longestPipeline int
+}
+
+//NewPipelineStatistics create a new PipelineStatistics struct, with a period (for reporting) of 5 second
+func NewPipelineStatistics() *PipelineStatistics {
+	fiveSec := time.Duration(5) * time.Second
+	now := time.Now()
+	stats := PipelineStatistics{
+		begin:      now,
+		nextReport: now,
+		period:     fiveSec,
+		reportNo:   0}
+	return &stats
+}
+
+//AddProcessed adds n rounds processed in a row, upon the reception of one round
+func (stats *PipelineStatistics) AddProcessed(n int) {
+	stats.totalProcessed += int64(n)
+	if n > stats.longestPipeline {
+		stats.longestPipeline = n
+	}
+}
+
+//AddBuffered counts a round received ahead of time, and buffered until the previous rounds are processed
+func (stats *PipelineStatistics) AddBuffered() {
+	stats.totalBuffered++
+}
+
+//AddSkipped adds n to the count of rounds given up, which were never processed
+func (stats *PipelineStatistics) AddSkipped(n int) {
+	stats.totalSkipped += int64(n)
+	stats.instantSkipped += int64(n)
+}
+
+//Skipped returns the total number of rounds skipped
+func (stats *PipelineStatistics) Skipped() int64 {
+	return stats.totalSkipped
+}
+
+//Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
+func (stats *PipelineStatistics) Report() string {
+	return stats.ReportWithInfo("")
+}
+
+//ReportWithInfo prints (if t>period=5 seconds have passed since the last report) all the information, with extra data "info"
+func (stats *PipelineStatistics) ReportWithInfo(info string) string {
+	now := time.Now()
+	if now.After(stats.nextReport) {
+
+		//human-readable output
+		str := fmt.Sprintf("[%v] Pipeline %v rounds processed, %v buffered, %v skipped (%v total), longest pipeline %v Info: %s",
+			stats.reportNo,
+			stats.totalProcessed,
+			stats.totalBuffered,
+			stats.instantSkipped,
+			stats.totalSkipped,
+			stats.longestPipeline,
+			info)
+
+		log.Lvl1(str)
+
+		stats.instantSkipped = 0
+
+		stats.nextReport = now.Add(stats.period)
+		stats.reportNo++
+
+		return str
+	}
+
+	return ""
+}
@@ -16,6 +16,13 @@ type SchedulesStatistics struct {
 	period                     time.Duration
 	reportNo                   int
 	scheduleLengthRepartitions map[int]int
+
+	//on the clients, the effect of the transmission policy
+	reservedWithData    int
+	reservedWithoutData int
+	deferredData        int
+	ownSlotsWithData    int
+	ownSlotsEmpty       int
 }
 
 //NewSchedulesStatistics create a new TimeStatistics struct, with a period (for reporting) of 5 second
@@ -44,6 +51,27 @@ func (stats *SchedulesStatistics) AddSchedule(newSchedule map[int]bool) {
 	stats.scheduleLengthRepartitions[scheduleLength]++
 }
 
+//AddReservation is called by a client at each schedule : we reserved a slot or not, and some data was waiting or not
+func (stats *SchedulesStatistics) AddReservation(reserved bool, hasData bool) {
+	switch {
+	case reserved && hasData:
+		stats.reservedWithData++
+	case reserved:
+		stats.reservedWithoutData++
+	case hasData:
+		stats.deferredData++
+	}
+}
+
+//AddOwnSlot is called by a client when it owns the slot of a round, and sent some data in it or not
+func (stats *SchedulesStatistics) AddOwnSlot(hasData bool) {
+	if hasData {
+		stats.ownSlotsWithData++
+	} else {
+		stats.ownSlotsEmpty++
+	}
+}
+
 //Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
 func (stats *SchedulesStatistics) Report() string {
 	return stats.ReportWithInfo("")
@@ -65,6 +93,12 @@ func (stats *SchedulesStatistics) ReportWithInfo(info string) string {
 			str += strconv.Itoa(k) + "->" + strconv.Itoa(stats.scheduleLengthRepartitions[k]) + "; "
 		}
 
+		//the transmission policy of a client
+		if stats.reservedWithData+stats.reservedWithoutData+stats.deferredData+stats.ownSlotsWithData+stats.ownSlotsEmpty > 0 {
+			str += fmt.Sprintf("Reservations %v with data, %v cover, %v deferred; Own slots %v with data, %v empty; ",
+				stats.reservedWithData, stats.reservedWithoutData, stats.deferredData, stats.ownSlotsWithData, stats.ownSlotsEmpty)
+		}
+
 		//human-readable output
 		str2 := fmt.Sprintf("[%v] Schedules %s Info: %s", stats.reportNo, str, info)
 		log.Lvl1(str2)
@@ -48,6 +48,14 @@ func (stats *TimeStatistics) TimeStatistics() (string, string, string) {
 	return fmt.Sprintf("%v", m), fmt.Sprintf("%v", v), fmt.Sprintf("%v", len(stats.times))
 }
 
+//Mean returns the mean of the stored values, and their number (the mean is -1 if there is none)
+func (stats *TimeStatistics) Mean() (float64, int) {
+	if len(stats.times) == 0 {
+		return -1, 0
+	}
+	return MeanInt64(stats.times), len(stats.times)
+}
+
 //AddLatency adds a latency to the stored latency array, and removes the oldest one if there are more than MAX_LATENCY_STORED
 func (stats *TimeStatistics) AddTime(latency int64) {
 	stats.times = append(stats.times, latency)
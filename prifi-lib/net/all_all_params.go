@@ -6,11 +6,13 @@ import (
 
 // ALL_ALL_PARAMETERS message contains all the parameters used by the protocol.
 type ALL_ALL_PARAMETERS struct {
-	TrusteesPks []kyber.Point // only filled when the relay sends this to the clients
-	ForceParams bool
-	ParamsInt   map[string]int
-	ParamsStr   map[string]string
-	ParamsBool  map[string]bool
+	TrusteesPks    []kyber.Point // only filled when the relay sends this to the clients
+	RelayPk        kyber.Point   // idem; the clients verify the signature of the downstream cells with it
+	StandbyRelayPk kyber.Point   // if not nil, the only relay which may resume the session (see REL_ALL_RESUME)
+	ForceParams    bool
+	ParamsInt      map[string]int
+	ParamsStr      map[string]string
+	ParamsBool     map[string]bool
 }
 
 /**
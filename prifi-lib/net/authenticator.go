@@ -0,0 +1,415 @@
+package net
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"gopkg.in/dedis/kyber.v2"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
+)
+
+/*
+ * Every message sent over the network is authenticated with the PriFi key of its sender. If the sender knows the key
+ * of the receiver, it MACs the message with a key derived from their Diffie-Hellman shared secret; otherwise (e.g., the
+ * relay sending the parameters, before it knows the keys of the clients and trustees), it signs the message.
+ * The receiver verifies the message with the key bound to the sender : the key of ClientID/TrusteeID, or, for the
+ * messages where the sender tells its key (CLI_REL_TELL_PK_AND_EPH_PK, TRU_REL_TELL_PK, ALL_ALL_PARAMETERS), this key;
+ * for REL_ALL_RESUME, the key of the standby relay announced in ALL_ALL_PARAMETERS. See the authenticate() method of
+ * each role.
+ *
+ * The MAC/signature covers a canonical encoding of the message (see writeCanonical), so it does not depend on how the
+ * network layer encodes it, and the sequence number of the message. Each sender numbers its messages from the time it
+ * was started (in ns), so the numbers keep increasing if it restarts; the receiver rejects a number it already accepted
+ * from this key, or older than its REPLAY_WINDOW last numbers (see checkReplay). The receiver only remembers the numbers
+ * while it runs : after a restart, it would accept once a message sent before. A message signed for a peer may be
+ * replayed to another peer which did not receive a newer message from the sender.
+ *
+ * The messages are not encrypted : this authenticates the control channels, it does not make them confidential. The
+ * cells are protected by the DC-net, the keys and the shuffle are public, and the data sent in the clear (e.g., the
+ * secrets revealed in a blame) is meant for the relay; an eavesdropper learns the IDs, the rounds and the sizes of the
+ * messages, which the relay learns anyway.
+ */
+
+// REPLAY_WINDOW is the number of sequence numbers (before the last one accepted from a peer) which may still be
+// accepted, if the messages are reordered (e.g., when the relay sends the downstream cells concurrently)
+const REPLAY_WINDOW = 4096
+
+// the kind of peers we authenticate messages with
+const (
+	PEER_RELAY = iota
+	PEER_CLIENT
+	PEER_TRUSTEE
+)
+
+// AUTHENTICATED_MESSAGE is a message with the MAC or the signature of its sender. The network layer transports Msg
+// with its own encoding, and gives back the message (not a pointer) to ReceivedMessage.
+type AUTHENTICATED_MESSAGE struct {
+	Msg       interface{}
+	Counter   uint64 // the sequence number of the message, covered by the MAC/signature
+	MAC       []byte // if set, HMAC-SHA256 with the key shared by the sender and the receiver
+	Signature []byte // otherwise, Schnorr signature with the key of the sender
+}
+
+// peer identifies a participant
+type peer struct {
+	role int
+	id   int
+}
+
+// replayWindow holds the sequence numbers accepted from a peer
+type replayWindow struct {
+	highest uint64
+	seen    map[uint64]bool // the numbers accepted, down to highest - REPLAY_WINDOW (at least)
+}
+
+// Authenticator authenticates the messages we send, and verifies the messages we receive, with our PriFi key
+type Authenticator struct {
+	sync.Mutex
+	privateKey kyber.Scalar
+	peers      map[peer]kyber.Point
+	macKeys    map[string][]byte        // MAC keys, by public key of the peer
+	counter    uint64                   // the sequence number of the last message we sealed
+	received   map[string]*replayWindow // the sequence numbers accepted, by public key of the peer
+}
+
+// NewAuthenticator returns an Authenticator for our private key, which knows no peer yet
+func NewAuthenticator(privateKey kyber.Scalar) *Authenticator {
+	return &Authenticator{
+		privateKey: privateKey,
+		peers:      make(map[peer]kyber.Point),
+		macKeys:    make(map[string][]byte),
+		counter:    uint64(time.Now().UnixNano()),
+		received:   make(map[string]*replayWindow),
+	}
+}
+
+// SetPrivateKey replaces our private key (e.g., with a long-term key loaded after NewAuthenticator)
+func (a *Authenticator) SetPrivateKey(privateKey kyber.Scalar) {
+	a.Lock()
+	defer a.Unlock()
+	a.privateKey = privateKey
+	a.macKeys = make(map[string][]byte)
+}
+
+// SetPeerKey sets the public key of a peer (role is PEER_*); the messages it sends must be authenticated with it
+func (a *Authenticator) SetPeerKey(role, id int, publicKey kyber.Point) {
+	a.Lock()
+	defer a.Unlock()
+	if publicKey == nil {
+		delete(a.peers, peer{role, id})
+		return
+	}
+	a.peers[peer{role, id}] = publicKey
+}
+
+// ResetPeerKeys forgets the public keys of all the peers (e.g., when the IDs of the participants are re-assigned)
+func (a *Authenticator) ResetPeerKeys() {
+	a.Lock()
+	defer a.Unlock()
+	a.peers = make(map[peer]kyber.Point)
+}
+
+// PeerKey returns the public key of a peer, or nil if we do not know it
+func (a *Authenticator) PeerKey(role, id int) kyber.Point {
+	a.Lock()
+	defer a.Unlock()
+	return a.peers[peer{role, id}]
+}
+
+// PeerKeys returns the public keys of all the peers with the given role
+func (a *Authenticator) PeerKeys(role int) []kyber.Point {
+	a.Lock()
+	defer a.Unlock()
+	keys := make([]kyber.Point, 0)
+	for p, k := range a.peers {
+		if p.role == role {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// macKey returns the key we share with the owner of publicKey
+func (a *Authenticator) macKey(publicKey kyber.Point) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	id := publicKey.String()
+	if key, found := a.macKeys[id]; found {
+		return key, nil
+	}
+	shared, err := config.CryptoSuite.Point().Mul(a.privateKey, publicKey).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("prifi-message-authentication"))
+	h.Write(shared)
+	key := h.Sum(nil)
+	a.macKeys[id] = key
+	return key, nil
+}
+
+// nextCounter returns the sequence number of the next message we seal
+func (a *Authenticator) nextCounter() uint64 {
+	a.Lock()
+	defer a.Unlock()
+	a.counter++
+	return a.counter
+}
+
+// checkReplay returns nil, and remembers the sequence number, if we did not accept it yet from the owner of publicKey
+func (a *Authenticator) checkReplay(publicKey kyber.Point, counter uint64) error {
+	a.Lock()
+	defer a.Unlock()
+
+	id := publicKey.String()
+	w, found := a.received[id]
+	if !found {
+		w = &replayWindow{seen: make(map[uint64]bool)}
+		a.received[id] = w
+	}
+	if counter+REPLAY_WINDOW <= w.highest {
+		return errors.New("sequence number " + strconv.FormatUint(counter, 10) + " is too old")
+	}
+	if w.seen[counter] {
+		return errors.New("sequence number " + strconv.FormatUint(counter, 10) + " was already received")
+	}
+	w.seen[counter] = true
+	if counter > w.highest {
+		w.highest = counter
+	}
+	if len(w.seen) > 2*REPLAY_WINDOW {
+		for c := range w.seen {
+			if c+REPLAY_WINDOW <= w.highest {
+				delete(w.seen, c)
+			}
+		}
+	}
+	return nil
+}
+
+// authenticatedBytes returns what the MAC/signature covers : the digest of the message, and its sequence number
+func authenticatedBytes(digest []byte, counter uint64) []byte {
+	b := make([]byte, len(digest)+8)
+	copy(b, digest)
+	binary.BigEndian.PutUint64(b[len(digest):], counter)
+	return b
+}
+
+// Seal authenticates a message for a peer : with a MAC if we know its key, with a signature otherwise
+func (a *Authenticator) Seal(role, id int, msg interface{}) (*AUTHENTICATED_MESSAGE, error) {
+	digest, err := Digest(msg)
+	if err != nil {
+		return nil, err
+	}
+	sealed := &AUTHENTICATED_MESSAGE{Msg: msg, Counter: a.nextCounter()}
+	digest = authenticatedBytes(digest, sealed.Counter)
+
+	if peerKey := a.PeerKey(role, id); peerKey != nil {
+		key, err := a.macKey(peerKey)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(digest)
+		sealed.MAC = mac.Sum(nil)
+		return sealed, nil
+	}
+
+	sealed.Signature, err = schnorr.Sign(config.CryptoSuite, a.privateKey, digest)
+	if err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// Open returns nil if the message is authenticated by the owner of one of the given keys, and is not a replay
+func (a *Authenticator) Open(msg AUTHENTICATED_MESSAGE, publicKeys ...kyber.Point) error {
+	msgName := reflect.TypeOf(msg.Msg).String()
+	digest, err := Digest(msg.Msg)
+	if err != nil {
+		return err
+	}
+	digest = authenticatedBytes(digest, msg.Counter)
+
+	//a replay is rejected only once the message is authenticated, so a forged number cannot block the real one
+	accept := func(publicKey kyber.Point) error {
+		if err := a.checkReplay(publicKey, msg.Counter); err != nil {
+			return errors.New("the " + msgName + " is a replay, " + err.Error())
+		}
+		return nil
+	}
+
+	for _, publicKey := range publicKeys {
+		if publicKey == nil {
+			continue
+		}
+		if len(msg.MAC) > 0 {
+			key, err := a.macKey(publicKey)
+			if err != nil {
+				return err
+			}
+			mac := hmac.New(sha256.New, key)
+			mac.Write(digest)
+			if hmac.Equal(mac.Sum(nil), msg.MAC) {
+				return accept(publicKey)
+			}
+		} else if len(msg.Signature) > 0 {
+			if schnorr.Verify(config.CryptoSuite, publicKey, digest, msg.Signature) == nil {
+				return accept(publicKey)
+			}
+		}
+	}
+
+	if len(msg.MAC) == 0 && len(msg.Signature) == 0 {
+		return errors.New("the " + msgName + " is not authenticated")
+	}
+	return errors.New("the " + msgName + " is not authenticated by its sender")
+}
+
+// Sender returns the peer a message to the relay claims to come from : the client of its ClientID, or the trustee of
+// its TrusteeID. If the message does not carry the ID of its sender, ok is false
+func Sender(msg interface{}) (role, id int, ok bool) {
+	switch typedMsg := msg.(type) {
+	case CLI_REL_TELL_PK_AND_EPH_PK:
+		return PEER_CLIENT, typedMsg.ClientID, true
+	case CLI_REL_UPSTREAM_DATA:
+		return PEER_CLIENT, typedMsg.ClientID, true
+	case CLI_REL_OPENCLOSED_DATA:
+		return PEER_CLIENT, typedMsg.ClientID, true
+	case CLI_REL_DOWNSTREAM_NACK:
+		return PEER_CLIENT, typedMsg.ClientID, true
+	case CLI_REL_DISRUPTION_REVEAL:
+		return PEER_CLIENT, typedMsg.ClientID, true
+	case TRU_REL_TELL_PK:
+		return PEER_TRUSTEE, typedMsg.TrusteeID, true
+	case TRU_REL_DC_CIPHER:
+		return PEER_TRUSTEE, typedMsg.TrusteeID, true
+	case TRU_REL_SHUFFLE_SIG:
+		return PEER_TRUSTEE, typedMsg.TrusteeID, true
+	case TRU_REL_DISRUPTION_REVEAL:
+		return PEER_TRUSTEE, typedMsg.TrusteeID, true
+	}
+	return 0, 0, false
+}
+
+// Digest returns the hash of the canonical encoding of a message (or of the message pointed to), including its type
+func Digest(msg interface{}) ([]byte, error) {
+	v := reflect.ValueOf(msg)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, errors.New("cannot authenticate a nil message")
+	}
+
+	buf := new(bytes.Buffer)
+	writeString(buf, v.Type().String())
+	if err := writeCanonical(buf, v); err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(buf.Bytes())
+	return h[:], nil
+}
+
+// writeCanonical encodes v in buf, such that a message decoded by the network layer has the same encoding as the
+// message sent : nil and empty slices or maps are encoded the same, the entries of a map are sorted, and the values
+// implementing encoding.BinaryMarshaler (e.g., kyber points) are encoded with it.
+func writeCanonical(buf *bytes.Buffer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			return nil
+		}
+		buf.WriteByte(1)
+		if m, ok := v.Interface().(encoding.BinaryMarshaler); ok {
+			b, err := m.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			writeBytes(buf, b)
+			return nil
+		}
+		return writeCanonical(buf, v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" { //unexported
+				continue
+			}
+			if err := writeCanonical(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			writeBytes(buf, v.Bytes())
+			return nil
+		}
+		writeInt(buf, int64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := writeCanonical(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		entries := make([][]byte, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			entry := new(bytes.Buffer)
+			if err := writeCanonical(entry, k); err != nil {
+				return err
+			}
+			if err := writeCanonical(entry, v.MapIndex(k)); err != nil {
+				return err
+			}
+			entries = append(entries, entry.Bytes())
+		}
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+		writeInt(buf, int64(len(entries)))
+		for _, e := range entries {
+			buf.Write(e)
+		}
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		writeInt(buf, int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		writeInt(buf, int64(math.Float64bits(v.Float())))
+	case reflect.String:
+		writeString(buf, v.String())
+	default:
+		return errors.New("cannot authenticate a message containing a " + v.Kind().String())
+	}
+	return nil
+}
+
+func writeInt(buf *bytes.Buffer, i int64) {
+	binary.Write(buf, binary.BigEndian, i)
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeInt(buf, int64(len(b)))
+	buf.Write(b)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeBytes(buf, []byte(s))
+}
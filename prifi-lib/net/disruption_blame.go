@@ -0,0 +1,52 @@
+package net
+
+import (
+	"encoding/binary"
+)
+
+/*
+ * The blame of a disruption is sent in the slot of the client, like data : the relay learns that the owner of the slot
+ * blames, not who it is. The cell starts with DISRUPTION_BLAME_PATTERN, followed by the round, the bit and the NIZK
+ * (with its length). A data cell which happens to look like a blame is still data, as its NIZK does not verify.
+ */
+
+// DISRUPTION_HISTORY_ROUNDS is the number of rounds during which a disrupted round can be blamed : the clients keep
+// what they sent, the relay keeps the ciphers, and the clients and trustees keep their pads during at least this number
+// of rounds (plus the rounds until the slot of the blamer comes back, see prifi-lib/client/disruption.go)
+const DISRUPTION_HISTORY_ROUNDS = 20
+
+// DISRUPTION_BLAME_PATTERN starts the cells which contain a blame (like the patterns of the latency and pcap messages)
+const DISRUPTION_BLAME_PATTERN uint16 = uint16(46515) //1011010110110011
+
+// disruptionBlameHeaderSize is the size of the pattern, round, bit and length of the NIZK
+const disruptionBlameHeaderSize = 2 + 4 + 4 + 2
+
+// ToCell returns the content of the cell which carries the blame
+func (m *CLI_REL_DISRUPTION_BLAME) ToCell() []byte {
+	cell := make([]byte, disruptionBlameHeaderSize+len(m.NIZK))
+	binary.BigEndian.PutUint16(cell[0:2], DISRUPTION_BLAME_PATTERN)
+	binary.BigEndian.PutUint32(cell[2:6], uint32(m.RoundID))
+	binary.BigEndian.PutUint32(cell[6:10], uint32(m.BitPos))
+	binary.BigEndian.PutUint16(cell[10:12], uint16(len(m.NIZK)))
+	copy(cell[disruptionBlameHeaderSize:], m.NIZK)
+	return cell
+}
+
+// DisruptionBlameFromCell parses a cell made by ToCell (possibly padded). It returns false if the cell is not a blame
+func DisruptionBlameFromCell(cell []byte) (CLI_REL_DISRUPTION_BLAME, bool) {
+	if len(cell) < disruptionBlameHeaderSize || binary.BigEndian.Uint16(cell[0:2]) != DISRUPTION_BLAME_PATTERN {
+		return CLI_REL_DISRUPTION_BLAME{}, false
+	}
+	nizkLength := int(binary.BigEndian.Uint16(cell[10:12]))
+	if len(cell) < disruptionBlameHeaderSize+nizkLength {
+		return CLI_REL_DISRUPTION_BLAME{}, false
+	}
+
+	m := CLI_REL_DISRUPTION_BLAME{
+		RoundID: int32(binary.BigEndian.Uint32(cell[2:6])),
+		BitPos:  int(int32(binary.BigEndian.Uint32(cell[6:10]))),
+		NIZK:    make([]byte, nizkLength),
+	}
+	copy(m.NIZK, cell[disruptionBlameHeaderSize:disruptionBlameHeaderSize+nizkLength])
+	return m, true
+}
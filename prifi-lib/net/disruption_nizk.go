@@ -0,0 +1,35 @@
+package net
+
+import (
+	"encoding/binary"
+)
+
+/*
+ * The NIZKs of the disruption blame (see prifi-lib/crypto/nizk.go) are bound to a context, so that they cannot be
+ * replayed in another blame : the blamed round and bit for CLI_REL_DISRUPTION_BLAME (whose NIZK proves that the sender
+ * owns the slot), a constant for the revealed secrets and the relay's key on the base of the shuffle (whose NIZKs
+ * already depend on the keys involved).
+ */
+
+// NIZKContext returns the context of the NIZK of the blame
+func (m *CLI_REL_DISRUPTION_BLAME) NIZKContext() []byte {
+	context := make([]byte, 12)
+	binary.BigEndian.PutUint32(context[0:4], uint32(m.RoundID))
+	binary.BigEndian.PutUint64(context[4:12], uint64(m.BitPos))
+	return append([]byte("disruption-blame"), context...)
+}
+
+// NIZKContext returns the context of the NIZK of the secret
+func (m *CLI_REL_DISRUPTION_SECRET) NIZKContext() []byte {
+	return []byte("disruption-secret")
+}
+
+// NIZKContext returns the context of the NIZK of the secret
+func (m *TRU_REL_DISRUPTION_SECRET) NIZKContext() []byte {
+	return []byte("disruption-secret")
+}
+
+// NIZKContext returns the context of the NIZK of RelayBasePk
+func (m *REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) NIZKContext() []byte {
+	return []byte("disruption-relay-base")
+}
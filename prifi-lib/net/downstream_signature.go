@@ -0,0 +1,64 @@
+package net
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"gopkg.in/dedis/kyber.v2"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
+)
+
+/*
+ * The relay signs each downstream cell (and each FEC parity packet) with its private key, and the clients verify it
+ * with the public key received in ALL_ALL_PARAMETERS (or REL_ALL_RESUME) before processing the cell. Otherwise,
+ * anyone could inject downstream cells, e.g. on the UDP broadcast, and desynchronize the clients.
+ *
+ * The signed content is the UDP encoding of the cell (see REL_CLI_DOWNSTREAM_DATA_UDP.ToBytes), without signature;
+ * a cell sent over TCP is signed as a UDP cell which is not a parity packet.
+ */
+
+// signedContent returns the bytes signed by the relay : the encoding of the message without its signature
+func (m *REL_CLI_DOWNSTREAM_DATA_UDP) signedContent() []byte {
+	unsigned := *m
+	unsigned.Signature = nil
+	content, _ := unsigned.ToBytes()
+	return content
+}
+
+// Sign sets the signature of the message, with the private key of the relay
+func (m *REL_CLI_DOWNSTREAM_DATA_UDP) Sign(privateKey kyber.Scalar) error {
+	sig, err := schnorr.Sign(config.CryptoSuite, privateKey, m.signedContent())
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// VerifySignature returns an error if the message is not signed by the relay with the given public key
+func (m *REL_CLI_DOWNSTREAM_DATA_UDP) VerifySignature(publicKey kyber.Point) error {
+	if len(m.Signature) == 0 {
+		return errors.New("downstream cell for round " + strconv.Itoa(int(m.RoundID)) + " is not signed")
+	}
+	if err := schnorr.Verify(config.CryptoSuite, publicKey, m.signedContent(), m.Signature); err != nil {
+		return errors.New("downstream cell for round " + strconv.Itoa(int(m.RoundID)) + " has an invalid signature, " + err.Error())
+	}
+	return nil
+}
+
+// Sign sets the signature of the message, with the private key of the relay
+func (m *REL_CLI_DOWNSTREAM_DATA) Sign(privateKey kyber.Scalar) error {
+	udp := &REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: *m}
+	if err := udp.Sign(privateKey); err != nil {
+		return err
+	}
+	m.Signature = udp.Signature
+	return nil
+}
+
+// VerifySignature returns an error if the message is not signed by the relay with the given public key
+func (m *REL_CLI_DOWNSTREAM_DATA) VerifySignature(publicKey kyber.Point) error {
+	udp := &REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: *m}
+	return udp.VerifySignature(publicKey)
+}
@@ -0,0 +1,185 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+ * Forward error correction (FEC) for the UDP downstream broadcast.
+ * The relay groups the REL_CLI_DOWNSTREAM_DATA_UDP of "GroupSize" consecutive rounds, and broadcasts one extra
+ * parity packet (the XOR of the encoded rounds) after the last round of each group. A client which missed exactly
+ * one round of a group can rebuild it locally from the parity and the other rounds, without asking for a retransmission.
+ * The XOR parity recovers at most one lost round per group : if two or more rounds of a group are lost, the parity only
+ * gives the XOR of them, none can be rebuilt, and the client falls back to a NACK for all of them.
+ * GroupSize = 1 simply duplicates every round; a larger GroupSize costs less bandwidth (1/GroupSize) but recovers less.
+ */
+
+// FEC_MAX_STORED_ROUNDS_FACTOR bounds the memory of the FECDecoder to FEC_MAX_STORED_ROUNDS_FACTOR * GroupSize rounds.
+const FEC_MAX_STORED_ROUNDS_FACTOR = 4
+
+// FECEncoder is used by the relay to produce the parity packets
+type FECEncoder struct {
+	GroupSize      int
+	groupStart     int32
+	roundsInParity int
+	parity         []byte
+}
+
+// FECDecoder is used by the clients to rebuild lost rounds from the parity packets
+type FECDecoder struct {
+	GroupSize       int
+	receivedSymbols map[int32][]byte
+	nextGroupStart  int32 // rounds < nextGroupStart already had their parity processed
+}
+
+// NewFECEncoder returns a FECEncoder producing one parity packet every "groupSize" rounds
+func NewFECEncoder(groupSize int) *FECEncoder {
+	return &FECEncoder{
+		GroupSize: groupSize,
+	}
+}
+
+// NewFECDecoder returns a FECDecoder for parity packets covering "groupSize" rounds
+func NewFECDecoder(groupSize int) *FECDecoder {
+	return &FECDecoder{
+		GroupSize:       groupSize,
+		receivedSymbols: make(map[int32][]byte),
+		nextGroupStart:  0,
+	}
+}
+
+// fecSymbol encodes a round as [0:4 length] [4:end encoded REL_CLI_DOWNSTREAM_DATA_UDP]
+func fecSymbol(msg REL_CLI_DOWNSTREAM_DATA) []byte {
+	m := &REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: msg}
+	encoded, _ := m.ToBytes()
+	symbol := make([]byte, 4+len(encoded))
+	binary.BigEndian.PutUint32(symbol[0:4], uint32(len(encoded)))
+	copy(symbol[4:], encoded)
+	return symbol
+}
+
+// xorInto XORs "b" into "a", growing "a" (with zeros) if needed, and returns it
+func xorInto(a, b []byte) []byte {
+	if len(b) > len(a) {
+		a2 := make([]byte, len(b))
+		copy(a2, a)
+		a = a2
+	}
+	for i := range b {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+// AddRound must be called with every round broadcasted, in order. Returns the parity packet to broadcast
+// if this round completes a group, nil otherwise.
+func (e *FECEncoder) AddRound(msg REL_CLI_DOWNSTREAM_DATA) *REL_CLI_DOWNSTREAM_DATA_UDP {
+
+	if e.GroupSize < 1 {
+		return nil
+	}
+
+	//rounds of a group must be consecutive; if not, start a new group from this round
+	if e.parity == nil || msg.RoundID != e.groupStart+int32(e.roundsInParity) {
+		e.groupStart = msg.RoundID
+		e.roundsInParity = 0
+		e.parity = make([]byte, 0)
+	}
+
+	e.parity = xorInto(e.parity, fecSymbol(msg))
+	e.roundsInParity++
+
+	if e.roundsInParity < e.GroupSize {
+		return nil
+	}
+
+	parity := &REL_CLI_DOWNSTREAM_DATA_UDP{
+		REL_CLI_DOWNSTREAM_DATA: REL_CLI_DOWNSTREAM_DATA{
+			RoundID: e.groupStart,
+			Data:    e.parity,
+		},
+		FECParityGroupSize: e.GroupSize,
+	}
+	e.parity = nil
+
+	return parity
+}
+
+// AddRound must be called with every round received via UDP. It is stored until the corresponding parity packet arrives.
+func (d *FECDecoder) AddRound(msg REL_CLI_DOWNSTREAM_DATA) {
+
+	if msg.RoundID < d.nextGroupStart {
+		return
+	}
+	d.receivedSymbols[msg.RoundID] = fecSymbol(msg)
+
+	//bound the memory, in case the parity packets are lost
+	for roundID := range d.receivedSymbols {
+		if roundID < msg.RoundID-int32(FEC_MAX_STORED_ROUNDS_FACTOR*d.GroupSize) {
+			delete(d.receivedSymbols, roundID)
+		}
+	}
+}
+
+// MayRecover returns true if the parity packet that covers this round has not been processed yet
+func (d *FECDecoder) MayRecover(roundID int32) bool {
+	return roundID >= d.nextGroupStart
+}
+
+// AddParity processes a parity packet. It returns the rebuilt round if exactly one round of the group was lost,
+// and the number of lost rounds of this group (0 if none, >1 if they could not be rebuilt : the parity only recovers
+// one round per group).
+func (d *FECDecoder) AddParity(msg REL_CLI_DOWNSTREAM_DATA_UDP) (*REL_CLI_DOWNSTREAM_DATA, int, error) {
+
+	if msg.FECParityGroupSize < 1 {
+		return nil, 0, errors.New("FECDecoder: not a parity packet")
+	}
+
+	groupStart := msg.RoundID
+	groupEnd := groupStart + int32(msg.FECParityGroupSize)
+
+	missing := make([]int32, 0)
+	parity := make([]byte, len(msg.Data))
+	copy(parity, msg.Data)
+	for roundID := groupStart; roundID < groupEnd; roundID++ {
+		if symbol, found := d.receivedSymbols[roundID]; found {
+			parity = xorInto(parity, symbol)
+		} else {
+			missing = append(missing, roundID)
+		}
+	}
+
+	//forget this group
+	for roundID := range d.receivedSymbols {
+		if roundID < groupEnd {
+			delete(d.receivedSymbols, roundID)
+		}
+	}
+	if groupEnd > d.nextGroupStart {
+		d.nextGroupStart = groupEnd
+	}
+
+	if len(missing) != 1 {
+		return nil, len(missing), nil
+	}
+
+	//exactly one round is missing, parity now contains its symbol
+	if len(parity) < 4 {
+		return nil, 1, errors.New("FECDecoder: parity packet too short")
+	}
+	length := int(binary.BigEndian.Uint32(parity[0:4]))
+	if length+4 > len(parity) {
+		return nil, 1, errors.New("FECDecoder: inconsistent length in parity packet")
+	}
+	decoded, err := new(REL_CLI_DOWNSTREAM_DATA_UDP).FromBytes(parity[4 : 4+length])
+	if err != nil {
+		return nil, 1, err
+	}
+	recovered := decoded.(REL_CLI_DOWNSTREAM_DATA_UDP).REL_CLI_DOWNSTREAM_DATA
+	if recovered.RoundID != missing[0] {
+		return nil, 1, errors.New("FECDecoder: rebuilt the wrong round")
+	}
+
+	return &recovered, 1, nil
+}
@@ -0,0 +1,113 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFEC(t *testing.T) {
+
+	groupSize := 3
+	encoder := NewFECEncoder(groupSize)
+	decoder := NewFECDecoder(groupSize)
+
+	rounds := make([]REL_CLI_DOWNSTREAM_DATA, 6)
+	for i := range rounds {
+		rounds[i] = REL_CLI_DOWNSTREAM_DATA{
+			RoundID:               int32(i + 1),
+			OwnershipID:           i % 2,
+			Data:                  genDataSlice()[0 : 10*(i+1)], //different lengths
+			FlagOpenClosedRequest: i == 2,
+		}
+	}
+
+	parities := make([]*REL_CLI_DOWNSTREAM_DATA_UDP, 0)
+	for i := range rounds {
+		p := encoder.AddRound(rounds[i])
+		if (i+1)%groupSize != 0 && p != nil {
+			t.Error("Encoder should not produce a parity before the end of the group")
+		}
+		if p != nil {
+			parities = append(parities, p)
+		}
+	}
+	if len(parities) != 2 {
+		t.Fatal("Encoder should have produced 2 parity packets, not", len(parities))
+	}
+	if parities[0].RoundID != 1 || parities[1].RoundID != 4 || parities[0].FECParityGroupSize != groupSize {
+		t.Error("Parity packets have the wrong header")
+	}
+
+	//the parity should survive the UDP encoding
+	b, _ := parities[0].ToBytes()
+	decodedParity, err := new(REL_CLI_DOWNSTREAM_DATA_UDP).FromBytes(b)
+	if err != nil {
+		t.Error(err)
+	}
+	parity0 := decodedParity.(REL_CLI_DOWNSTREAM_DATA_UDP)
+	if parity0.FECParityGroupSize != groupSize {
+		t.Error("FECParityGroupSize unparsed incorrectly")
+	}
+
+	//first group : round 2 is lost, it can be rebuilt
+	decoder.AddRound(rounds[0])
+	decoder.AddRound(rounds[2])
+	if !decoder.MayRecover(2) {
+		t.Error("Round 2 may still be recovered")
+	}
+	recovered, lost, err := decoder.AddParity(parity0)
+	if err != nil {
+		t.Error(err)
+	}
+	if lost != 1 || recovered == nil {
+		t.Fatal("Decoder should have rebuilt round 2")
+	}
+	if recovered.RoundID != 2 || recovered.OwnershipID != 1 || !bytes.Equal(recovered.Data, rounds[1].Data) {
+		t.Error("Decoder rebuilt round 2 incorrectly")
+	}
+	if decoder.MayRecover(2) {
+		t.Error("Round 2 has been processed")
+	}
+
+	//second group : rounds 4 and 6 are lost, cannot be rebuilt
+	decoder.AddRound(rounds[4])
+	recovered, lost, err = decoder.AddParity(*parities[1])
+	if err != nil {
+		t.Error(err)
+	}
+	if lost != 2 || recovered != nil {
+		t.Error("Decoder should not be able to rebuild two rounds")
+	}
+
+	//a group where one round arrived and two are lost : the parity only gives their XOR, nothing is rebuilt
+	encoder = NewFECEncoder(groupSize)
+	decoder = NewFECDecoder(groupSize)
+	var p3 *REL_CLI_DOWNSTREAM_DATA_UDP
+	for i := 0; i < groupSize; i++ {
+		p3 = encoder.AddRound(rounds[i])
+	}
+	decoder.AddRound(rounds[1])
+	recovered, lost, err = decoder.AddParity(*p3)
+	if err != nil {
+		t.Error(err)
+	}
+	if lost != 2 || recovered != nil {
+		t.Error("Decoder should not rebuild any of two rounds lost in the same group")
+	}
+
+	//nothing lost
+	encoder = NewFECEncoder(1)
+	decoder = NewFECDecoder(1)
+	p := encoder.AddRound(rounds[0])
+	decoder.AddRound(rounds[0])
+	recovered, lost, _ = decoder.AddParity(*p)
+	if lost != 0 || recovered != nil {
+		t.Error("Nothing was lost")
+	}
+
+	//not a parity packet
+	_, _, err = decoder.AddParity(REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: rounds[1]})
+	if err == nil {
+		t.Error("Should not accept a non-parity packet")
+	}
+}
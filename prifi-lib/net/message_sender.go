@@ -1,6 +1,7 @@
 package net
 
 import (
+	"context"
 	"errors"
 	"reflect"
 )
@@ -23,8 +24,8 @@ type MessageSender interface {
 	// ClientSubscribeToBroadcast should be called by the Clients in order to receive the Broadcast messages.
 	// Calling the function starts the handler but does not actually listen for broadcast messages.
 	// Sending true to startStopChan starts receiving the broadcasts.
-	// Sending false to startStopChan stops receiving the broadcasts.
-	ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error
+	// Sending false to startStopChan, or cancelling ctx, stops receiving the broadcasts, and returns.
+	ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error
 }
 
 /**
@@ -38,6 +39,7 @@ type MessageSenderWrapper struct {
 	logSuccessFunction   func(interface{})
 	logErrorFunction     func(interface{})
 	networkErrorHappened func(error)
+	authenticator        *Authenticator //if not nil, the messages to the relay, clients and trustees are authenticated with it
 }
 
 /**
@@ -77,6 +79,24 @@ func (m *MessageSenderWrapper) SetEntity(e string) {
 	m.entity = e
 }
 
+/**
+ * Authenticates all the messages sent from now on with "a" (see authenticator.go), except the broadcasted ones,
+ * which carry their own signature
+ */
+func (m *MessageSenderWrapper) SetAuthenticator(a *Authenticator) {
+	m.authenticator = a
+}
+
+/**
+ * Returns the message authenticated for the given peer, if we have an authenticator
+ */
+func (m *MessageSenderWrapper) seal(role, id int, msg interface{}) (interface{}, error) {
+	if m.authenticator == nil {
+		return msg, nil
+	}
+	return m.authenticator.Seal(role, id, msg)
+}
+
 /**
  * Send a message to client i. will automatically print what it does (Lvl3) if loggingenabled, and
  * will call networkErrorHappened on error
@@ -90,7 +110,14 @@ func (m *MessageSenderWrapper) BroadcastToAllClientsWithLog(msg interface{}, ext
  * will call networkErrorHappened on error
  */
 func (m *MessageSenderWrapper) SendToClientWithLog(i int, msg interface{}, extraInfos string) bool {
-	return m.sendToWithLog2(m.MessageSender.SendToClient, i, msg, extraInfos)
+	sendingFunc := func(i int, msg interface{}) error {
+		sealed, err := m.seal(PEER_CLIENT, i, msg)
+		if err != nil {
+			return err
+		}
+		return m.MessageSender.SendToClient(i, sealed)
+	}
+	return m.sendToWithLog2(sendingFunc, i, msg, extraInfos)
 }
 
 /**
@@ -98,7 +125,14 @@ func (m *MessageSenderWrapper) SendToClientWithLog(i int, msg interface{}, extra
  * will call networkErrorHappened on error
  */
 func (m *MessageSenderWrapper) SendToTrusteeWithLog(i int, msg interface{}, extraInfos string) bool {
-	return m.sendToWithLog2(m.MessageSender.SendToTrustee, i, msg, extraInfos)
+	sendingFunc := func(i int, msg interface{}) error {
+		sealed, err := m.seal(PEER_TRUSTEE, i, msg)
+		if err != nil {
+			return err
+		}
+		return m.MessageSender.SendToTrustee(i, sealed)
+	}
+	return m.sendToWithLog2(sendingFunc, i, msg, extraInfos)
 }
 
 /**
@@ -106,7 +140,14 @@ func (m *MessageSenderWrapper) SendToTrusteeWithLog(i int, msg interface{}, extr
  * will call networkErrorHappened on error
  */
 func (m *MessageSenderWrapper) SendToRelayWithLog(msg interface{}, extraInfos string) bool {
-	return m.sendToWithLog(m.MessageSender.SendToRelay, msg, extraInfos)
+	sendingFunc := func(msg interface{}) error {
+		sealed, err := m.seal(PEER_RELAY, 0, msg)
+		if err != nil {
+			return err
+		}
+		return m.MessageSender.SendToRelay(sealed)
+	}
+	return m.sendToWithLog(sendingFunc, msg, extraInfos)
 }
 
 /**
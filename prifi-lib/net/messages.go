@@ -29,15 +29,57 @@ import (
 // TRU_REL_TELL_NEW_BASE_AND_EPH_PKS
 // TRU_REL_TELL_PK
 // REL_TRU_TELL_RATE_CHANGE
+// CLI_REL_DOWNSTREAM_NACK
+// ALL_REL_RESYNC
+// ALL_REL_RESUME
+// REL_ALL_RESUME
 
 //not used yet :
 // REL_CLI_DOWNSTREAM_DATA
-// CLI_REL_DOWNSTREAM_NACK
 
 // ALL_ALL_SHUTDOWN message tells the participants to stop the protocol.
 type ALL_ALL_SHUTDOWN struct {
 }
 
+// ALL_REL_RESYNC message asks the relay to reconfigure the running protocol : at round RoundID (or at the next round,
+// if RoundID has already started), the relay sends a downstream cell with FlagResync, then restarts the setup with
+// the parameters in Params (only the parameters present are changed). It is given locally to the relay, and never sent on the network.
+type ALL_REL_RESYNC struct {
+	RoundID int32
+	Params  ALL_ALL_PARAMETERS
+}
+
+// ALL_REL_RESUME message makes a standby relay take over the session of a failed relay, described by State : instead of
+// running the setup, the relay restarts the communication at round State.ResumeRoundID, with the same pseudonyms.
+// It is given locally to the relay, and never sent on the network.
+type ALL_REL_RESUME struct {
+	State RELAY_FAILOVER_STATE
+}
+
+// RELAY_FAILOVER_STATE is the part of the relay's state which is replicated to the standby relay : the parameters,
+// the keys and the shuffle result (i.e., the pseudonyms), and the schedule. No participant has encoded a cipher for
+// a round >= ResumeRoundID, hence the standby relay can safely resume at this round.
+type RELAY_FAILOVER_STATE struct {
+	Params                  ALL_ALL_PARAMETERS
+	ClientsPks              []kyber.Point
+	ClientsEphPks           []kyber.Point
+	TrusteesPks             []kyber.Point
+	Shuffle                 REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG
+	OwnerSchedule           map[int]bool
+	LastOwner               int
+	NextOpenClosedRequestIn int32         // number of rounds until the next open/closed request, <= 0 if none is planned
+	SlotMACKeys             []kyber.Point // with the disruption protection, the keys of the HMACs of the slots
+	ResumeRoundID           int32
+}
+
+// REL_ALL_RESUME message is sent by a standby relay which took over the session, to the clients and trustees :
+// they keep their keys and slots, and continue the communication at round RoundID. The clients verify the downstream
+// cells with RelayPk from now on. RelayPk must be the StandbyRelayPk announced by the previous relay.
+type REL_ALL_RESUME struct {
+	RoundID int32
+	RelayPk kyber.Point
+}
+
 // CLI_REL_TELL_PK_AND_EPH_PK message contains the public key and ephemeral key of a client
 // and is sent to the relay.
 type CLI_REL_TELL_PK_AND_EPH_PK struct {
@@ -54,6 +96,14 @@ type CLI_REL_UPSTREAM_DATA struct {
 	Data     []byte
 }
 
+// CLI_REL_DOWNSTREAM_NACK message contains the rounds for which a client did not receive the
+// downstream data (e.g., lost UDP broadcast), and is sent to the relay, which retransmits them.
+type CLI_REL_DOWNSTREAM_NACK struct {
+	ClientID     int
+	RoundIDs     []int32
+	FECRecovered int // the number of rounds the client rebuilt from the FEC parity since its previous NACK
+}
+
 // CLI_REL_OPENCLOSED_DATA message contains whether slots are gonna be Open or Closed in the next round
 type CLI_REL_OPENCLOSED_DATA struct {
 	ClientID       int
@@ -69,6 +119,7 @@ type REL_CLI_DOWNSTREAM_DATA struct {
 	Data                  []byte
 	FlagResync            bool
 	FlagOpenClosedRequest bool
+	Signature             []byte // signature of the relay over all the above, see downstream_signature.go
 }
 
 //Converts []ByteArray -> [][]byte and returns it
@@ -82,18 +133,24 @@ func (m *REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) GetSignatures() [][]byte {
 
 // REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG message contains the ephemeral public keys and the signatures
 // of the trustees and is sent by the relay to the client.
+// With the disruption protection, RelayBasePk is the private key of the relay times Base, with a NIZK RelayBaseProof;
+// the owner of a slot keys the HMAC of its cells with its ephemeral private key times RelayBasePk.
 type REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG struct {
-	Base         kyber.Point
-	EphPks       []kyber.Point
-	TrusteesSigs []ByteArray
+	Base           kyber.Point
+	EphPks         []kyber.Point
+	TrusteesSigs   []ByteArray
+	RelayBasePk    kyber.Point
+	RelayBaseProof []byte
 }
 
 // REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE message contains the public keys and ephemeral keys
 // of the clients and is sent by the relay to the trustees.
+// EphPks are being shuffled; ClientsEphPks are the ephemeral keys of the clients by ID, which seed the pads with Pks.
 type REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE struct {
-	Pks    []kyber.Point
-	EphPks []kyber.Point
-	Base   kyber.Point
+	Pks           []kyber.Point
+	EphPks        []kyber.Point
+	Base          kyber.Point
+	ClientsEphPks []kyber.Point
 }
 
 //protobuf can't handle [][]abstract.Point, so we do []PublicKeyArray
@@ -145,9 +202,10 @@ type TRU_REL_SHUFFLE_SIG struct {
 	Sig       []byte
 }
 
-// REL_TRU_TELL_RATE_CHANGE message asks the trustees to update their window capacity to adapt their
-// sending rate and is sent by the relay.
+// REL_TRU_TELL_RATE_CHANGE message grants credit to a trustee and is sent by the relay.
+// The trustee may send ciphers for the rounds < RoundID + WindowCapacity (and must not send further).
 type REL_TRU_TELL_RATE_CHANGE struct {
+	RoundID        int32
 	WindowCapacity int
 }
 
@@ -175,6 +233,7 @@ structure (but does not decode it), and FromBytes(), which decodes the REL_CLI_D
 */
 type REL_CLI_DOWNSTREAM_DATA_UDP struct {
 	REL_CLI_DOWNSTREAM_DATA
+	FECParityGroupSize int // if > 0, this is not a round but the FEC parity of rounds [RoundID, RoundID+FECParityGroupSize)
 }
 
 // Print prints the raw value of this message.
@@ -191,7 +250,8 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) SetContent(data REL_CLI_DOWNSTREAM_DATA) {
 func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 
 	//convert the message to bytes
-	buf := make([]byte, 4+4+len(m.REL_CLI_DOWNSTREAM_DATA.Data)+4+4)
+	sig := m.REL_CLI_DOWNSTREAM_DATA.Signature
+	buf := make([]byte, 4+4+len(m.REL_CLI_DOWNSTREAM_DATA.Data)+len(sig)+4+4+4+4)
 	resyncInt := 0
 	if m.REL_CLI_DOWNSTREAM_DATA.FlagResync {
 		resyncInt = 1
@@ -201,12 +261,16 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 		openclosedInt = 1
 	}
 
-	// [0:4 roundID] [4:8 roundID] [8:end-8 data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
+	// [0:4 roundID] [4:8 ownershipID] [8:end-16-sigLen data] [end-16-sigLen:end-16 signature] [end-16:end-12 sigLen]
+	// [end-12:end-8 resyncFlag] [end-8:end-4 openClosedFlag] [end-4:end FECParityGroupSize]
 	binary.BigEndian.PutUint32(buf[0:4], uint32(m.REL_CLI_DOWNSTREAM_DATA.RoundID))
 	binary.BigEndian.PutUint32(buf[4:8], uint32(m.REL_CLI_DOWNSTREAM_DATA.OwnershipID))
-	binary.BigEndian.PutUint32(buf[len(buf)-8:len(buf)-4], uint32(resyncInt)) //todo : to be coded on one byte
-	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(openclosedInt))       //todo : to be coded on one byte
-	copy(buf[8:len(buf)-8], m.REL_CLI_DOWNSTREAM_DATA.Data)
+	binary.BigEndian.PutUint32(buf[len(buf)-16:len(buf)-12], uint32(len(sig)))
+	binary.BigEndian.PutUint32(buf[len(buf)-12:len(buf)-8], uint32(resyncInt))    //todo : to be coded on one byte
+	binary.BigEndian.PutUint32(buf[len(buf)-8:len(buf)-4], uint32(openclosedInt)) //todo : to be coded on one byte
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(m.FECParityGroupSize))
+	copy(buf[8:len(buf)-16-len(sig)], m.REL_CLI_DOWNSTREAM_DATA.Data)
+	copy(buf[len(buf)-16-len(sig):len(buf)-16], sig)
 
 	return buf, nil
 
@@ -215,18 +279,29 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 // FromBytes decodes the message contained in the message's byteEncoded field.
 func (m *REL_CLI_DOWNSTREAM_DATA_UDP) FromBytes(buffer []byte) (interface{}, error) {
 
-	//the smallest message is 4 bytes, indicating a length of 0
-	if len(buffer) < 8 { //4 (roundID) + 4 (flagResync)
-		e := "Messages.go : FromBytes() : cannot decode, smaller than 8 bytes"
+	//the smallest message has no data and no signature
+	if len(buffer) < 24 { //4 (roundID) + 4 (ownershipID) + 4 (sigLen) + 4 (flagResync) + 4 (flagOpenClosed) + 4 (FECParityGroupSize)
+		e := "Messages.go : FromBytes() : cannot decode, smaller than 24 bytes"
 		return REL_CLI_DOWNSTREAM_DATA_UDP{}, errors.New(e)
 	}
 
-	// [0:4 roundID] [4:end-8 data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
+	// [0:4 roundID] [4:8 ownershipID] [8:end-16-sigLen data] [end-16-sigLen:end-16 signature] [end-16:end-12 sigLen]
+	// [end-12:end-8 resyncFlag] [end-8:end-4 openClosedFlag] [end-4:end FECParityGroupSize]
 	roundID := int32(binary.BigEndian.Uint32(buffer[0:4]))
 	ownerShipID := int(binary.BigEndian.Uint32(buffer[4:8]))
-	flagResyncInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-8 : len(buffer)-4]))
-	flagOpenClosedInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-4:]))
-	data := buffer[8 : len(buffer)-8]
+	sigLen := int(binary.BigEndian.Uint32(buffer[len(buffer)-16 : len(buffer)-12]))
+	flagResyncInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-12 : len(buffer)-8]))
+	flagOpenClosedInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-8 : len(buffer)-4]))
+	fecParityGroupSize := int(binary.BigEndian.Uint32(buffer[len(buffer)-4:]))
+	if sigLen < 0 || sigLen > len(buffer)-24 {
+		e := "Messages.go : FromBytes() : cannot decode, invalid signature length"
+		return REL_CLI_DOWNSTREAM_DATA_UDP{}, errors.New(e)
+	}
+	data := buffer[8 : len(buffer)-16-sigLen]
+	var sig []byte
+	if sigLen > 0 {
+		sig = buffer[len(buffer)-16-sigLen : len(buffer)-16]
+	}
 
 	flagResync := false
 	if flagResyncInt == 1 {
@@ -237,19 +312,20 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) FromBytes(buffer []byte) (interface{}, err
 		flagOpenClosed = true
 	}
 
-	innerMessage := REL_CLI_DOWNSTREAM_DATA{roundID, ownerShipID, data, flagResync, flagOpenClosed}
-	resultMessage := REL_CLI_DOWNSTREAM_DATA_UDP{innerMessage}
+	innerMessage := REL_CLI_DOWNSTREAM_DATA{roundID, ownerShipID, data, flagResync, flagOpenClosed, sig}
+	resultMessage := REL_CLI_DOWNSTREAM_DATA_UDP{innerMessage, fecParityGroupSize}
 
 	return resultMessage, nil
 }
 
-// REL_CLI_DISRUPTED_ROUND is when the relay detects a disruption, and sends it back to the client
+// REL_CLI_DISRUPTED_ROUND is when the relay detects a disruption, and sends the output of the round to the clients
 type REL_CLI_DISRUPTED_ROUND struct {
 	RoundID int32
 	Data    []byte
 }
 
-// CLI_REL_DISRUPTION_BLAME contains a disrupted roundID and the position where a bit was flipped, and is sent to the relay
+// CLI_REL_DISRUPTION_BLAME contains a disrupted roundID and the position where a bit was flipped. It is sent to the relay
+// anonymously, in the slot of the client (see ToCell)
 type CLI_REL_DISRUPTION_BLAME struct {
 	RoundID int32
 	NIZK    []byte
@@ -2,9 +2,11 @@ package net
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/protobuf"
 	"gopkg.in/dedis/kyber.v2"
 	"testing"
 )
@@ -36,7 +38,7 @@ func (t *TestMessageSender) SendToRelay(msg interface{}) error {
 func (t *TestMessageSender) BroadcastToAllClients(msg interface{}) error {
 	return nil
 }
-func (t *TestMessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+func (t *TestMessageSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
 	return nil
 }
 
@@ -196,3 +198,287 @@ func TestUDPMessage(t *testing.T) {
 		t.Error("REL_CLI_DOWNSTREAM_DATA_UDP should not allow to decode message < 4 bytes")
 	}
 }
+
+func TestDownstreamSignature(t *testing.T) {
+
+	pub, priv := crypto.NewKeyPair()
+	otherPub, _ := crypto.NewKeyPair()
+
+	msg := &REL_CLI_DOWNSTREAM_DATA{RoundID: 3, OwnershipID: 1, Data: genDataSlice(), FlagOpenClosedRequest: true}
+	if err := msg.VerifySignature(pub); err == nil {
+		t.Error("An unsigned cell should not be authenticated")
+	}
+	if err := msg.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.VerifySignature(pub); err != nil {
+		t.Error("Should verify the signature,", err)
+	}
+	if err := msg.VerifySignature(otherPub); err == nil {
+		t.Error("Should not verify the signature with another key")
+	}
+
+	//the signature survives the UDP encoding
+	udp := &REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: *msg}
+	msgBytes, err := udp.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := new(REL_CLI_DOWNSTREAM_DATA_UDP).FromBytes(msgBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp2 := decoded.(REL_CLI_DOWNSTREAM_DATA_UDP)
+	if !bytes.Equal(udp2.Data, msg.Data) {
+		t.Error("Data unparsed incorrectly")
+	}
+	if err := udp2.VerifySignature(pub); err != nil {
+		t.Error("Should verify the signature after the UDP encoding,", err)
+	}
+
+	//any modification is detected
+	udp2.FlagResync = true
+	if err := udp2.VerifySignature(pub); err == nil {
+		t.Error("Should detect a modified flag")
+	}
+	udp2.FlagResync = false
+	udp2.FECParityGroupSize = 2
+	if err := udp2.VerifySignature(pub); err == nil {
+		t.Error("A cell should not be accepted as a FEC parity")
+	}
+	udp2.FECParityGroupSize = 0
+	udp2.Data[0]++
+	if err := udp2.VerifySignature(pub); err == nil {
+		t.Error("Should detect a modified cell")
+	}
+
+	//an invalid signature length cannot be decoded
+	msgBytes[len(msgBytes)-13] = 0xff
+	if _, err := new(REL_CLI_DOWNSTREAM_DATA_UDP).FromBytes(msgBytes); err == nil {
+		t.Error("Should not decode a message with an invalid signature length")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+
+	relayPub, relayPriv := crypto.NewKeyPair()
+	clientPub, clientPriv := crypto.NewKeyPair()
+	otherPub, otherPriv := crypto.NewKeyPair()
+	relay := NewAuthenticator(relayPriv)
+	client := NewAuthenticator(clientPriv)
+	other := NewAuthenticator(otherPriv)
+
+	//the digest does not depend on pointers, nor on nil/empty slices and maps
+	msg := CLI_REL_UPSTREAM_DATA{ClientID: 1, RoundID: 2, Data: genDataSlice()}
+	d1, _ := Digest(msg)
+	d2, _ := Digest(&msg)
+	if !bytes.Equal(d1, d2) {
+		t.Error("The digest of a message and of a pointer to it should be equal")
+	}
+	d1, _ = Digest(CLI_REL_DISRUPTION_REVEAL{ClientID: 1})
+	d2, _ = Digest(CLI_REL_DISRUPTION_REVEAL{ClientID: 1, Bits: make(map[int]int)})
+	if !bytes.Equal(d1, d2) {
+		t.Error("The digest should not depend on nil/empty maps")
+	}
+	d2, _ = Digest(TRU_REL_DISRUPTION_REVEAL{TrusteeID: 1})
+	if bytes.Equal(d1, d2) {
+		t.Error("The digest should depend on the type of the message")
+	}
+	if _, err := Digest(nil); err == nil {
+		t.Error("Should not authenticate a nil message")
+	}
+
+	//the relay does not know the client yet : it signs
+	params := new(ALL_ALL_PARAMETERS)
+	params.Add("NClients", 2)
+	params.RelayPk = relayPub
+	sealed, err := relay.Seal(PEER_CLIENT, 0, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed.Signature) == 0 || len(sealed.MAC) != 0 {
+		t.Error("Should sign a message for an unknown peer")
+	}
+	if err := client.Open(AUTHENTICATED_MESSAGE{Msg: *params, Counter: sealed.Counter, Signature: sealed.Signature}, relayPub); err != nil {
+		t.Error("Should verify the signature,", err)
+	}
+	if err := client.Open(*sealed, otherPub); err == nil {
+		t.Error("Should not verify the signature with another key")
+	}
+
+	//the signature survives the network encoding
+	params.RelayPk = nil
+	sealed, _ = relay.Seal(PEER_CLIENT, 0, params)
+	b, err := protobuf.Encode(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(ALL_ALL_PARAMETERS)
+	if err := protobuf.Decode(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Open(AUTHENTICATED_MESSAGE{Msg: *decoded, Counter: sealed.Counter, Signature: sealed.Signature}, relayPub); err != nil {
+		t.Error("Should verify the signature of the decoded message,", err)
+	}
+
+	//once the keys are known, we MAC
+	relay.SetPeerKey(PEER_CLIENT, 0, clientPub)
+	client.SetPeerKey(PEER_RELAY, 0, relayPub)
+	sealed, _ = client.Seal(PEER_RELAY, 0, &msg)
+	if len(sealed.MAC) == 0 || len(sealed.Signature) != 0 {
+		t.Error("Should MAC a message for a known peer")
+	}
+	if err := relay.Open(AUTHENTICATED_MESSAGE{Msg: msg, Counter: sealed.Counter, MAC: sealed.MAC}, clientPub); err != nil {
+		t.Error("Should verify the MAC,", err)
+	}
+	if err := relay.Open(*sealed, otherPub); err == nil {
+		t.Error("Should not verify the MAC with another key")
+	}
+	if len(relay.PeerKeys(PEER_CLIENT)) != 1 || len(relay.PeerKeys(PEER_TRUSTEE)) != 0 {
+		t.Error("Wrong peer keys")
+	}
+
+	//another client cannot authenticate a message in the name of client 0
+	other.SetPeerKey(PEER_RELAY, 0, relayPub)
+	forged, _ := other.Seal(PEER_RELAY, 0, &msg)
+	if err := relay.Open(*forged, clientPub); err == nil {
+		t.Error("Should not accept a message MACed by another client")
+	}
+	modified := msg
+	modified.RoundID++
+	if err := relay.Open(AUTHENTICATED_MESSAGE{Msg: modified, Counter: sealed.Counter, MAC: sealed.MAC}, clientPub); err == nil {
+		t.Error("Should detect a modified message")
+	}
+	if err := relay.Open(AUTHENTICATED_MESSAGE{Msg: msg}, clientPub); err == nil {
+		t.Error("Should not accept a message which is not authenticated")
+	}
+
+	relay.SetPeerKey(PEER_CLIENT, 0, nil)
+	if relay.PeerKey(PEER_CLIENT, 0) != nil {
+		t.Error("Should have forgotten the key of client 0")
+	}
+	relay.SetPeerKey(PEER_CLIENT, 1, clientPub)
+	relay.SetPeerKey(PEER_TRUSTEE, 0, otherPub)
+	relay.ResetPeerKeys()
+	if len(relay.PeerKeys(PEER_CLIENT)) != 0 || len(relay.PeerKeys(PEER_TRUSTEE)) != 0 {
+		t.Error("Should have forgotten the keys of all the peers")
+	}
+
+	//the messages to the relay tell who they come from, if they carry an ID
+	if role, id, ok := Sender(msg); !ok || role != PEER_CLIENT || id != 1 {
+		t.Error("Wrong sender of CLI_REL_UPSTREAM_DATA", role, id, ok)
+	}
+	if role, id, ok := Sender(TRU_REL_DC_CIPHER{TrusteeID: 2}); !ok || role != PEER_TRUSTEE || id != 2 {
+		t.Error("Wrong sender of TRU_REL_DC_CIPHER", role, id, ok)
+	}
+	if _, _, ok := Sender(CLI_REL_DISRUPTION_BLAME{}); ok {
+		t.Error("CLI_REL_DISRUPTION_BLAME does not carry the ID of its sender")
+	}
+}
+
+func TestAuthenticatorReplay(t *testing.T) {
+
+	relayPub, relayPriv := crypto.NewKeyPair()
+	clientPub, clientPriv := crypto.NewKeyPair()
+	relay := NewAuthenticator(relayPriv)
+	client := NewAuthenticator(clientPriv)
+	relay.SetPeerKey(PEER_CLIENT, 0, clientPub)
+	client.SetPeerKey(PEER_RELAY, 0, relayPub)
+
+	//a message is accepted once
+	msg := CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 2, Data: genDataSlice()}
+	first, _ := client.Seal(PEER_RELAY, 0, msg)
+	if err := relay.Open(*first, clientPub); err != nil {
+		t.Error("Should accept the message,", err)
+	}
+	if err := relay.Open(*first, clientPub); err == nil {
+		t.Error("Should reject a replayed message")
+	}
+
+	//the same content, sealed again, is a new message
+	second, _ := client.Seal(PEER_RELAY, 0, msg)
+	if second.Counter <= first.Counter {
+		t.Error("The sequence numbers should increase", first.Counter, second.Counter)
+	}
+
+	//the sequence number is authenticated
+	if err := relay.Open(AUTHENTICATED_MESSAGE{Msg: msg, Counter: second.Counter, MAC: first.MAC}, clientPub); err == nil {
+		t.Error("Should not accept a replayed MAC with a new sequence number")
+	}
+
+	//the messages may be reordered, within the window
+	third, _ := client.Seal(PEER_RELAY, 0, msg)
+	if err := relay.Open(*third, clientPub); err != nil {
+		t.Error("Should accept the third message,", err)
+	}
+	if err := relay.Open(*second, clientPub); err != nil {
+		t.Error("Should accept the second message, received after the third,", err)
+	}
+	if err := relay.Open(*second, clientPub); err == nil {
+		t.Error("Should reject a replayed message, received out of order")
+	}
+
+	//a message older than the window is rejected, even if never received
+	old, _ := client.Seal(PEER_RELAY, 0, msg)
+	for i := 0; i < REPLAY_WINDOW; i++ {
+		client.nextCounter()
+	}
+	last, _ := client.Seal(PEER_RELAY, 0, msg)
+	if err := relay.Open(*last, clientPub); err != nil {
+		t.Error("Should accept the last message,", err)
+	}
+	if err := relay.Open(*old, clientPub); err == nil {
+		t.Error("Should reject a message older than the window")
+	}
+
+	//a forged message with a future number does not block the real one
+	forged := *last
+	forged.Counter += 10
+	if err := relay.Open(forged, clientPub); err == nil {
+		t.Error("Should not accept a forged sequence number")
+	}
+	next, _ := client.Seal(PEER_RELAY, 0, msg)
+	if err := relay.Open(*next, clientPub); err != nil {
+		t.Error("Should accept the next message,", err)
+	}
+
+	//signed messages are numbered too, and a restarted sender keeps increasing its numbers
+	params := new(ALL_ALL_PARAMETERS)
+	params.Add("NClients", 2)
+	signed, _ := relay.Seal(PEER_CLIENT, 1, params)
+	if err := client.Open(*signed, relayPub); err != nil {
+		t.Error("Should accept the signed message,", err)
+	}
+	if err := client.Open(*signed, relayPub); err == nil {
+		t.Error("Should reject a replayed signed message")
+	}
+	restarted := NewAuthenticator(relayPriv)
+	signed, _ = restarted.Seal(PEER_CLIENT, 1, params)
+	if err := client.Open(*signed, relayPub); err != nil {
+		t.Error("Should accept the message of the restarted relay,", err)
+	}
+}
+
+func TestDisruptionBlameCell(t *testing.T) {
+
+	blame := CLI_REL_DISRUPTION_BLAME{RoundID: 12, BitPos: 300, NIZK: genDataSlice()[:64]}
+
+	//the cell is padded to the payload, like any cell
+	cell := make([]byte, 200)
+	copy(cell, blame.ToCell())
+	parsed, ok := DisruptionBlameFromCell(cell)
+	if !ok {
+		t.Fatal("Should parse the blame")
+	}
+	if parsed.RoundID != blame.RoundID || parsed.BitPos != blame.BitPos || !bytes.Equal(parsed.NIZK, blame.NIZK) {
+		t.Error("The parsed blame differs,", parsed)
+	}
+
+	//not a blame, or truncated
+	if _, ok := DisruptionBlameFromCell(make([]byte, 200)); ok {
+		t.Error("Should not parse a cell without the pattern")
+	}
+	if _, ok := DisruptionBlameFromCell(blame.ToCell()[:40]); ok {
+		t.Error("Should not parse a truncated blame")
+	}
+}
@@ -1,10 +1,15 @@
 package prifi_lib
 
 import (
+	"io"
+	"time"
+
 	"github.com/dedis/prifi/prifi-lib/client"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"github.com/dedis/prifi/prifi-lib/relay"
 	"github.com/dedis/prifi/prifi-lib/trustee"
+	"github.com/dedis/prifi/prifi-lib/utils"
+	"gopkg.in/dedis/kyber.v2"
 	"gopkg.in/dedis/onet.v2/log"
 )
 
@@ -23,9 +28,10 @@ type PriFiLibInstance struct { //todo remove this, like it was done for client
 	specializedLibInstance SpecializedLibInstance
 }
 
-//Prifi's "Relay", "Client" and "Trustee" instance all can receive a message
+//Prifi's "Relay", "Client" and "Trustee" instance all can receive a message, and be stopped
 type SpecializedLibInstance interface {
 	ReceivedMessage(msg interface{}) error
+	Stop()
 }
 
 // Possible role of PriFi entities.
@@ -42,6 +48,7 @@ const (
 func NewPriFiClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, msgSender net.MessageSender) *PriFiLibInstance {
 	msw := newMessageSenderWrapper(msgSender)
 	c := client.NewClient(doLatencyTest, dataOutputEnabled, dataForDCNet, dataFromDCNet, doReplayPcap, pcapFolder, msw)
+	c.EnableAuthentication()
 	p := &PriFiLibInstance{
 		role: PRIFI_ROLE_CLIENT,
 		specializedLibInstance: c,
@@ -54,6 +61,7 @@ func NewPriFiClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet cha
 func NewPriFiRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet chan []byte, experimentResultChan chan interface{}, timeoutHandler func([]int, []int), msgSender net.MessageSender) *PriFiLibInstance {
 	msw := newMessageSenderWrapper(msgSender)
 	r := relay.NewRelay(dataOutputEnabled, dataForClients, dataFromDCNet, experimentResultChan, timeoutHandler, msw)
+	r.EnableAuthentication()
 	p := &PriFiLibInstance{
 		role: PRIFI_ROLE_RELAY,
 		specializedLibInstance: r,
@@ -76,6 +84,7 @@ func NewPriFiTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int,
 	}
 
 	t := trustee.NewTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, msw)
+	t.EnableAuthentication()
 	p := &PriFiLibInstance{
 		role: PRIFI_ROLE_TRUSTEE,
 		specializedLibInstance: t,
@@ -95,6 +104,106 @@ func (p *PriFiLibInstance) ReceivedMessage(msg interface{}) error {
 	return nil
 }
 
+// Stop cancels the context of this PriFi entity, which stops all the goroutines and timers it started.
+// Unlike ALL_ALL_SHUTDOWN, it does not notify the other participants.
+func (p *PriFiLibInstance) Stop() {
+	p.specializedLibInstance.Stop()
+}
+
+// SetReplicationHandler sets the function which sends the state of the relay to a standby relay.
+// It does nothing if this entity is not a relay.
+func (p *PriFiLibInstance) SetReplicationHandler(handler func(*net.RELAY_FAILOVER_STATE) bool) {
+	if r, ok := p.specializedLibInstance.(*relay.PriFiLibRelayInstance); ok {
+		r.SetReplicationHandler(handler)
+	}
+}
+
+// SetStandbyRelayKey sets the public key of the standby relay, the only one the clients and trustees accept a resume
+// from. It does nothing if this entity is not a relay.
+func (p *PriFiLibInstance) SetStandbyRelayKey(standbyRelayPk kyber.Point) {
+	if r, ok := p.specializedLibInstance.(*relay.PriFiLibRelayInstance); ok {
+		r.SetStandbyRelayKey(standbyRelayPk)
+	}
+}
+
+// SetAuditLog starts the audit log of the relay in w (see prifi-lib/audit).
+// It does nothing if this entity is not a relay.
+func (p *PriFiLibInstance) SetAuditLog(w io.Writer) error {
+	if r, ok := p.specializedLibInstance.(*relay.PriFiLibRelayInstance); ok {
+		return r.SetAuditLog(w)
+	}
+	return nil
+}
+
+// SetPinnedTrustees sets the public keys of the trustees the client trusts (see prifi-lib/client/pinning.go).
+// It does nothing if this entity is not a client.
+func (p *PriFiLibInstance) SetPinnedTrustees(pinned []kyber.Point, minPinned int) error {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		return c.SetPinnedTrustees(pinned, minPinned)
+	}
+	return nil
+}
+
+// SetTransmissionPolicy sets the policy deciding when the client reserves slots (see prifi-lib/client/transmission_policy.go).
+// It does nothing if this entity is not a client.
+func (p *PriFiLibInstance) SetTransmissionPolicy(policy client.TransmissionPolicy) {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		c.SetTransmissionPolicy(policy)
+	}
+}
+
+// SetLatencyTests sets the interval between the latency tests of the client, and the clients which send some.
+// It does nothing if this entity is not a client.
+func (p *PriFiLibInstance) SetLatencyTests(interval time.Duration, probingClients []int) error {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		return c.SetLatencyTests(interval, probingClients)
+	}
+	return nil
+}
+
+// SetPadPrecomputation sets the number of rounds whose pads the client computes in advance (0 to disable).
+// It does nothing if this entity is not a client.
+func (p *PriFiLibInstance) SetPadPrecomputation(nRounds int) error {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		return c.SetPadPrecomputation(nRounds)
+	}
+	return nil
+}
+
+// SetPCAPReplayOptions tells the client which packets of its capture it replays, and how.
+// It does nothing if this entity is not a client.
+func (p *PriFiLibInstance) SetPCAPReplayOptions(options utils.PCAPReplayOptions) error {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		return c.SetPCAPReplayOptions(options)
+	}
+	return nil
+}
+
+// SetPCAPReplay makes the relay replay PCAPFolder/relay.pcap(ng) downstream (see prifi-lib/relay/pcap_replay.go).
+// It does nothing if this entity is not a relay.
+func (p *PriFiLibInstance) SetPCAPReplay(pcapFolder string, options utils.PCAPReplayOptions) error {
+	if r, ok := p.specializedLibInstance.(*relay.PriFiLibRelayInstance); ok {
+		return r.SetPCAPReplay(pcapFolder, options)
+	}
+	return nil
+}
+
+// ClientStatus returns a snapshot of the state of the client, and false if this entity is not a client.
+func (p *PriFiLibInstance) ClientStatus() (client.ClientStatus, bool) {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		return c.Status(), true
+	}
+	return client.ClientStatus{}, false
+}
+
+// PauseUpstream pauses (or resumes) the upstream transmission of the client, which then only sends cover traffic.
+// It does nothing if this entity is not a client.
+func (p *PriFiLibInstance) PauseUpstream(paused bool) {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		c.PauseUpstream(paused)
+	}
+}
+
 func newMessageSenderWrapper(msgSender net.MessageSender) *net.MessageSenderWrapper {
 
 	errHandling := func(e error) { /* do nothing yet, we are alerted of errors via the SDA */ }
@@ -107,3 +216,16 @@ func newMessageSenderWrapper(msgSender net.MessageSender) *net.MessageSenderWrap
 	}
 	return msw
 }
+
+// SetKeyPair sets the long-term key pair of this entity, instead of the fresh one generated at creation.
+func (p *PriFiLibInstance) SetKeyPair(publicKey kyber.Point, privateKey kyber.Scalar) error {
+	switch lib := p.specializedLibInstance.(type) {
+	case *client.PriFiLibClientInstance:
+		return lib.SetKeyPair(publicKey, privateKey)
+	case *trustee.PriFiLibTrusteeInstance:
+		return lib.SetKeyPair(publicKey, privateKey)
+	case *relay.PriFiLibRelayInstance:
+		return lib.SetKeyPair(publicKey, privateKey)
+	}
+	return nil
+}
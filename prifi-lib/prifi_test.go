@@ -1,6 +1,7 @@
 package prifi_lib
 
 import (
+	"context"
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"gopkg.in/dedis/onet.v2/log"
@@ -25,7 +26,7 @@ func (t *TestMessageSender) SendToRelay(msg interface{}) error {
 func (t *TestMessageSender) BroadcastToAllClients(msg interface{}) error {
 	return errors.New("not implemented")
 }
-func (t *TestMessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+func (t *TestMessageSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
 	return errors.New("not implemented")
 }
 
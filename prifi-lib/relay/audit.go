@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"io"
+
+	"github.com/dedis/prifi/prifi-lib/audit"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+// AUDIT_SIGNATURE_INTERVAL is the number of rounds after which the relay signs its audit log
+const AUDIT_SIGNATURE_INTERVAL = 100
+
+// SetAuditLog starts an audit log of the rounds in w (see prifi-lib/audit), signed with our key. It is closed when
+// the relay stops.
+func (p *PriFiLibRelayInstance) SetAuditLog(w io.Writer) error {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	l, err := audit.NewLog(w, p.relayState.privateKey, p.relayState.PublicKey, AUDIT_SIGNATURE_INTERVAL)
+	if err != nil {
+		return err
+	}
+	p.relayState.auditLog = l
+	return nil
+}
+
+// auditRound appends the entry of round "roundID" to the audit log, if any. "cell" is the decoded cell (nil if the
+// round was not decoded), "disruption" the result of the disruption check, and the missing participants are set if
+// the round timed out. It is called with the processing lock; the entry is only queued, the audit log writes it from
+// its own goroutine.
+func (p *PriFiLibRelayInstance) auditRound(roundID int32, cell []byte, disruption int, missingClients, missingTrustees []int) {
+	if p.relayState.auditLog == nil {
+		return
+	}
+
+	entry := &audit.Entry{
+		RoundID:         roundID,
+		OpenClosed:      p.relayState.OpenClosedSlotsRequestsRoundID[roundID],
+		OwnerSlot:       -1,
+		MissingClients:  missingClients,
+		MissingTrustees: missingTrustees,
+		Disruption:      disruption,
+		Equivocation:    audit.CHECK_DISABLED,
+	}
+	if data, found := p.relayState.roundManager.GetDataAlreadySentIfAny(roundID); found && data != nil {
+		entry.OwnerSlot = data.OwnershipID
+	}
+	if cell != nil {
+		entry.CellHash = audit.HashCell(cell)
+		// the equivocation protection yields an empty cell when it cannot decode it
+		if p.relayState.EquivocationProtectionEnabled {
+			entry.Equivocation = audit.CHECK_PASSED
+			if len(cell) == 0 {
+				entry.Equivocation = audit.CHECK_FAILED
+			}
+		}
+	}
+
+	if err := p.relayState.auditLog.AddRound(entry); err != nil {
+		log.Error("Relay : could not write round", roundID, "in the audit log,", err)
+	}
+}
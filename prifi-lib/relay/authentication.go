@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/kyber.v2"
+)
+
+/*
+Authentication of the messages (see prifi-lib/net/authenticator.go). Once EnableAuthentication is called, the messages
+we send are authenticated with our key, and ReceivedMessage only accepts the messages authenticated by their sender :
+a client (resp. trustee) tells its key in CLI_REL_TELL_PK_AND_EPH_PK (resp. TRU_REL_TELL_PK), which is bound to its ID
+from then on (until new parameters re-assign the IDs); all its other messages must be authenticated with this key.
+Hence, a client cannot send ciphers, NACKs or reveals in the name of another client. The blames are not messages : they
+are sent anonymously, in the slot of their sender (see disruption.go).
+The messages which are not wrapped in a net.AUTHENTICATED_MESSAGE are local calls (e.g., the parameters given by the
+SDA layer, the shutdown, the resume), and are not checked.
+*/
+
+// EnableAuthentication authenticates all the messages we send from now on
+func (p *PriFiLibRelayInstance) EnableAuthentication() {
+	p.messageSender.SetAuthenticator(p.relayState.authenticator)
+}
+
+// authenticate returns an error if the message is not authenticated by the client or trustee it claims to come from
+func (p *PriFiLibRelayInstance) authenticate(msg net.AUTHENTICATED_MESSAGE) error {
+	auth := p.relayState.authenticator
+
+	switch typedMsg := msg.Msg.(type) {
+	case net.CLI_REL_TELL_PK_AND_EPH_PK:
+		return p.authenticateNewKey(msg, net.PEER_CLIENT, typedMsg.ClientID, typedMsg.Pk)
+	case net.TRU_REL_TELL_PK:
+		return p.authenticateNewKey(msg, net.PEER_TRUSTEE, typedMsg.TrusteeID, typedMsg.Pk)
+	case net.CLI_REL_DISRUPTION_SECRET:
+		//the secrets do not carry the ID of their sender, but must come from the client and trustee we asked
+		if !p.relayState.blameSecretsAsked {
+			return errors.New("Relay : received a secret, but we did not ask for it")
+		}
+		return p.authenticateFrom(msg, net.PEER_CLIENT, p.relayState.blamingData[2])
+	case net.TRU_REL_DISRUPTION_SECRET:
+		if !p.relayState.blameSecretsAsked {
+			return errors.New("Relay : received a secret, but we did not ask for it")
+		}
+		return p.authenticateFrom(msg, net.PEER_TRUSTEE, p.relayState.blamingData[4])
+	case net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS:
+		//this message does not carry the ID of its sender, but must come from one of the trustees
+		return auth.Open(msg, auth.PeerKeys(net.PEER_TRUSTEE)...)
+	}
+
+	//the other messages carry the ID of their sender
+	if role, id, ok := net.Sender(msg.Msg); ok {
+		return p.authenticateFrom(msg, role, id)
+	}
+	return errors.New("Relay : does not accept a " + reflect.TypeOf(msg.Msg).String() + " from the network")
+}
+
+// authenticateNewKey checks that the message is authenticated with the key it tells, and that this key is the one
+// already bound to the ID of the sender, if any
+func (p *PriFiLibRelayInstance) authenticateNewKey(msg net.AUTHENTICATED_MESSAGE, role, id int, publicKey kyber.Point) error {
+	if publicKey == nil {
+		return errors.New("Relay : received a message from " + peerName(role, id) + " without public key")
+	}
+	if known := p.relayState.authenticator.PeerKey(role, id); known != nil && !known.Equal(publicKey) {
+		return errors.New("Relay : " + peerName(role, id) + " already has another public key")
+	}
+	return p.relayState.authenticator.Open(msg, publicKey)
+}
+
+// authenticateFrom checks that the message is authenticated with the key bound to the ID of the sender
+func (p *PriFiLibRelayInstance) authenticateFrom(msg net.AUTHENTICATED_MESSAGE, role, id int) error {
+	publicKey := p.relayState.authenticator.PeerKey(role, id)
+	if publicKey == nil {
+		return errors.New("Relay : received a message from " + peerName(role, id) + ", whose public key is unknown")
+	}
+	return p.relayState.authenticator.Open(msg, publicKey)
+}
+
+// peerName returns e.g. "client 2", for the logs
+func peerName(role, id int) string {
+	if role == net.PEER_TRUSTEE {
+		return "trustee " + strconv.Itoa(id)
+	}
+	return "client " + strconv.Itoa(id)
+}
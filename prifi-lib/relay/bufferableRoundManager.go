@@ -46,14 +46,12 @@ type BufferableRoundManager struct {
 	//holds the schedule, i.e. which ownerslot will be skipped in the future. Keys are in [0, nclients[
 	storedOwnerSchedule map[int]bool
 
-	//stop/resume functions when we have too much/little ciphers
-	DoSendStopResumeMessages bool
-	LowBound                 int //restart sending at lowerbound
-	HighBound                int //stop sending at higherbound
-	stopFunction             func(int)
-	stopSent                 bool
-	resumeFunction           func(int)
-	resumeSent               bool
+	//credit-based flow control of the trustees. Each trustee may send ciphers for rounds < grantedUpTo[trusteeID]
+	DoSendCredits bool
+	LowBound      int //grant new credit when a trustee has <= LowBound rounds of credit left
+	HighBound     int //number of rounds a trustee may run ahead of the relay
+	grantFunction func(int, int32, int)
+	grantedUpTo   map[int]int32
 }
 
 func sortedIntMapOfIntMapDump(m map[int]map[int32][]byte) {
@@ -315,13 +313,13 @@ func (b *BufferableRoundManager) closeRound() error {
 		delete(b.bufferedTrusteeCiphers[i], currentRoundID)
 	}
 
-	//send rate changes if needed
-	for trusteeID := range b.bufferedTrusteeCiphers {
-		b.sendRateChangeIfNeeded(trusteeID)
-	}
-
 	b.lastRoundClosed = currentRoundID
 
+	//grant credit to the trustees if needed
+	for trusteeID := 0; trusteeID < b.nTrustees; trusteeID++ {
+		b.grantCreditIfNeeded(trusteeID)
+	}
+
 	//reset the map
 	b.resetACKmaps()
 
@@ -439,6 +437,45 @@ func (b *BufferableRoundManager) SetStoredRoundSchedule(s map[int]bool) {
 	b.nextOCSlotRound = currentRoundID + int32(numberOfOpenSlots) + int32(b.maxNumberOfConcurrentRounds) + 1
 }
 
+// StoredRoundSchedule returns a copy of the schedule, the last slot owner, and the next round for an open/closed request
+func (b *BufferableRoundManager) StoredRoundSchedule() (map[int]bool, int, int32) {
+	b.Lock()
+	defer b.Unlock()
+
+	schedule := make(map[int]bool)
+	for k, v := range b.storedOwnerSchedule {
+		schedule[k] = v
+	}
+	return schedule, b.lastOwner, b.nextOCSlotRound
+}
+
+// ResumeAtRound makes "roundID" the next round to open, with the given schedule; it is used when a standby relay takes
+// over the session. No round must be open. The credit of the trustees restarts from this round
+func (b *BufferableRoundManager) ResumeAtRound(roundID int32, schedule map[int]bool, lastOwner int, nextOCSlotRound int32) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.openRounds) > 0 {
+		return errors.New("Cannot resume at round " + strconv.Itoa(int(roundID)) + ", some rounds are open")
+	}
+
+	b.lastRoundClosed = roundID - 1
+	b.storedOwnerSchedule = schedule
+	b.lastOwner = lastOwner
+	b.nextOCSlotRound = nextOCSlotRound
+	b.bufferedClientCiphers = make(map[int]map[int32][]byte)
+	b.bufferedTrusteeCiphers = make(map[int]map[int32][]byte)
+	b.resetACKmaps()
+
+	if b.DoSendCredits {
+		for trusteeID := 0; trusteeID < b.nTrustees; trusteeID++ {
+			b.grantedUpTo[trusteeID] = roundID + int32(b.HighBound)
+		}
+	}
+
+	return nil
+}
+
 // SetDataAlreadySent sets the "DataAlreadySent" field for the given round
 func (b *BufferableRoundManager) SetDataAlreadySent(roundID int32, data *net.REL_CLI_DOWNSTREAM_DATA) {
 	b.Lock()
@@ -465,6 +502,15 @@ func (b *BufferableRoundManager) GetDataAlreadySent(roundID int32) *net.REL_CLI_
 	return nil
 }
 
+// GetDataAlreadySentIfAny gets the "DataAlreadySent" field for the given round, if the round is still open.
+// Unlike GetDataAlreadySent, does not fail if the round has been closed (e.g., for retransmissions)
+func (b *BufferableRoundManager) GetDataAlreadySentIfAny(roundID int32) (*net.REL_CLI_DOWNSTREAM_DATA, bool) {
+	b.Lock()
+	defer b.Unlock()
+	data, found := b.dataAlreadySent[roundID]
+	return data, found
+}
+
 // AddTrusteeCipher adds a trustee cipher for a given round
 func (b *BufferableRoundManager) AddTrusteeCipher(roundID int32, trusteeID int, data []byte) error {
 	b.Lock()
@@ -487,8 +533,6 @@ func (b *BufferableRoundManager) AddTrusteeCipher(roundID int32, trusteeID int,
 		b.trusteeAckMap[trusteeID] = true
 	}
 
-	b.sendRateChangeIfNeeded(trusteeID)
-
 	return nil
 }
 
@@ -546,6 +590,27 @@ func (b *BufferableRoundManager) NumberOfBufferedCiphers(trusteeID int) int {
 	return len(b.bufferedTrusteeCiphers[trusteeID])
 }
 
+// TrusteeBufferLevels returns the smallest and the largest number of ciphers buffered for a trustee
+func (b *BufferableRoundManager) TrusteeBufferLevels() (int, int) {
+	b.Lock()
+	defer b.Unlock()
+
+	min, max := -1, 0
+	for trusteeID := 0; trusteeID < b.nTrustees; trusteeID++ {
+		n := len(b.bufferedTrusteeCiphers[trusteeID])
+		if min == -1 || n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if min == -1 {
+		min = 0
+	}
+	return min, max
+}
+
 // MissingCiphersForCurrentRound returns a pair of (clientIDs, trusteesIDs) where those entities did not send a cipher for this round
 func (b *BufferableRoundManager) MissingCiphersForCurrentRound() ([]int, []int) {
 	b.Lock()
@@ -576,44 +641,47 @@ func (b *BufferableRoundManager) IsRoundOpenend(roundID int32) bool {
 }
 
 /**
- * Adds a component to the BufferManager, that reacts to the # of buffered cipher (per trustees), and call stopFn()
- * and resumeFn() when the bounds are reached
+ * Adds a component to the BufferManager, that grants credit to each trustee : a trustee may run at most highBound
+ * rounds ahead of the relay. When a trustee has <= lowBound rounds of credit left, grantFn(trusteeID, roundID, highBound)
+ * is called, meaning that this trustee may now send ciphers for the rounds < roundID + highBound.
+ * The trustees start with an initial credit of highBound rounds (starting at round 0).
  */
-func (b *BufferableRoundManager) AddRateLimiter(lowBound, highBound int, stopFunction, resumeFunction func(int)) error {
-	if lowBound < 0 || lowBound > highBound {
-		return errors.New("Lowbound must be > 0 and < highBound")
+func (b *BufferableRoundManager) AddCreditLimiter(lowBound, highBound int, grantFunction func(int, int32, int)) error {
+	if lowBound < 0 || lowBound >= highBound {
+		return errors.New("Lowbound must be >= 0 and < highBound")
 	}
-	if highBound < lowBound {
-		return errors.New("Highbound must be > lowBound")
-	}
-	if stopFunction == nil {
-		return errors.New("Can't initiate a RateLimiter without a stop function")
-	}
-	if resumeFunction == nil {
-		return errors.New("Can't initiate a RateLimiter without a resume function")
+	if grantFunction == nil {
+		return errors.New("Can't initiate a CreditLimiter without a grant function")
 	}
 
-	b.DoSendStopResumeMessages = true
+	b.DoSendCredits = true
 	b.LowBound = lowBound
 	b.HighBound = highBound
-	b.stopFunction = stopFunction
-	b.resumeFunction = resumeFunction
+	b.grantFunction = grantFunction
+	b.grantedUpTo = make(map[int]int32)
+	for trusteeID := 0; trusteeID < b.nTrustees; trusteeID++ {
+		b.grantedUpTo[trusteeID] = int32(highBound)
+	}
 
 	return nil
 }
 
-func (b *BufferableRoundManager) sendRateChangeIfNeeded(trusteeID int) {
-	if b.DoSendStopResumeMessages {
-		n := b.NumberOfBufferedCiphers(trusteeID)
-		if n >= b.HighBound && !b.stopSent {
-			b.stopFunction(trusteeID)
-			b.stopSent = true
-			b.resumeSent = false
-		} else if n <= b.LowBound && !b.resumeSent {
-			b.resumeFunction(trusteeID)
-			b.stopSent = false
-			b.resumeSent = true
-		}
+// CreditOfTrustee returns the first round for which this trustee may not send a cipher yet
+func (b *BufferableRoundManager) CreditOfTrustee(trusteeID int) int32 {
+	b.Lock()
+	defer b.Unlock()
+	return b.grantedUpTo[trusteeID]
+}
+
+func (b *BufferableRoundManager) grantCreditIfNeeded(trusteeID int) {
+	if !b.DoSendCredits {
+		return
+	}
+	nextRoundNeeded := b.lastRoundClosed + 1
+	creditLeft := int(b.grantedUpTo[trusteeID] - nextRoundNeeded)
+	if creditLeft <= b.LowBound {
+		b.grantedUpTo[trusteeID] = nextRoundNeeded + int32(b.HighBound)
+		b.grantFunction(trusteeID, nextRoundNeeded, b.HighBound)
 	}
 }
 
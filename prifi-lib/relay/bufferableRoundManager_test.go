@@ -3,6 +3,7 @@ package relay
 import (
 	"bytes"
 	"crypto/rand"
+	"github.com/dedis/prifi/prifi-lib/net"
 	"gopkg.in/dedis/onet.v2/log"
 	"testing"
 )
@@ -437,87 +438,150 @@ func TestCipherBuffering(test *testing.T) {
 	}
 }
 
-func TestRateLimiter(test *testing.T) {
+func TestDataAlreadySentForRetransmission(test *testing.T) {
+
+	b := NewBufferableRoundManager(2, 1, 2)
+
+	roundID := b.OpenNextRound()
+	data := &net.REL_CLI_DOWNSTREAM_DATA{RoundID: roundID, Data: genDataSlice()}
+	b.SetDataAlreadySent(roundID, data)
+
+	d, found := b.GetDataAlreadySentIfAny(roundID)
+	if !found || d != data {
+		test.Error("Should be able to retrieve the data sent for an open round")
+	}
+
+	_, found = b.GetDataAlreadySentIfAny(roundID + 10)
+	if found {
+		test.Error("Should not find data for a round never opened")
+	}
+
+	b.AddClientCipher(roundID, 0, genDataSlice())
+	b.AddClientCipher(roundID, 1, genDataSlice())
+	b.AddTrusteeCipher(roundID, 0, genDataSlice())
+	b.CloseRound()
+
+	_, found = b.GetDataAlreadySentIfAny(roundID)
+	if found {
+		test.Error("Should not find data for a closed round")
+	}
+}
+
+func TestCreditLimiter(test *testing.T) {
 
 	window := 100
 	nClients := 1
-	nTrustees := 1
+	nTrustees := 2
 	b := NewBufferableRoundManager(nClients, nTrustees, window)
 
-	low := 1  //resume sending when <= low
-	high := 3 //stop sending when >= high
+	low := 1  //grant more credit when <= low rounds left
+	high := 3 //a trustee may run 3 rounds ahead
 
-	stopCalled := false
-	resumeCalled := false
+	grants := make(map[int]int32)
+	grantFn := func(trusteeID int, roundID int32, credit int) {
+		if credit != high {
+			test.Error("Should grant", high, "rounds of credit, not", credit)
+		}
+		grants[trusteeID] = roundID + int32(credit)
+	}
 
-	stopFn := func(int) {
-		stopCalled = true
+	if err := b.AddCreditLimiter(high, low, grantFn); err == nil {
+		test.Error("Should not accept lowBound > highBound")
 	}
-	resFn := func(int) {
-		resumeCalled = true
+	if err := b.AddCreditLimiter(low, high, nil); err == nil {
+		test.Error("Should not accept a nil grant function")
+	}
+	if err := b.AddCreditLimiter(low, high, grantFn); err != nil {
+		test.Error(err)
+	}
+	for trusteeID := 0; trusteeID < nTrustees; trusteeID++ {
+		if b.CreditOfTrustee(trusteeID) != int32(high) {
+			test.Error("Trustees should start with", high, "rounds of credit")
+		}
 	}
-
-	b.AddRateLimiter(low, high, stopFn, resFn)
 	data := genDataSlice()
 
-	b.OpenNextRound()
-	b.AddTrusteeCipher(0, 0, data)
-	if !resumeCalled {
-		test.Error("Resume should have been called")
+	//trustee 0 uses all its credit, trustee 1 is slower
+	for i := int32(0); i < int32(high); i++ {
+		b.OpenNextRound()
+		b.AddTrusteeCipher(i, 0, data)
+		b.AddClientCipher(i, 0, data)
+	}
+	b.AddTrusteeCipher(0, 1, data)
+	b.AddTrusteeCipher(1, 1, data)
+	if len(grants) != 0 {
+		test.Error("No credit should have been granted yet")
 	}
-	resumeCalled = false
 
-	b.OpenNextRound()
-	b.AddTrusteeCipher(1, 0, data)
-	b.OpenNextRound()
-	b.AddTrusteeCipher(2, 0, data)
-	b.OpenNextRound()
-	b.AddTrusteeCipher(3, 0, data)
-	if !stopCalled {
-		test.Error("Stop should have been called")
+	//round 0 closes, 2 rounds of credit left
+	if err := b.CloseRound(); err != nil {
+		test.Error(err)
 	}
-	stopCalled = false
-	b.OpenNextRound()
-	b.AddTrusteeCipher(4, 0, data)
-	if stopCalled {
-		test.Error("Stop not should have been called again")
+	if len(grants) != 0 {
+		test.Error("No credit should have been granted yet (2)")
 	}
-	stopCalled = false
 
-	b.AddClientCipher(0, 0, data)
-	err := b.CloseRound()
-	if err != nil {
+	//round 1 closes, 1 round of credit left for both trustees : both get some credit
+	if err := b.CloseRound(); err != nil {
 		test.Error(err)
 	}
-	if stopCalled {
-		test.Error("Stop not should have been called again (2)")
+	if len(grants) != nTrustees {
+		test.Error("Each trustee should have been granted credit, not", len(grants))
+	}
+	for trusteeID := 0; trusteeID < nTrustees; trusteeID++ {
+		if grants[trusteeID] != 2+int32(high) || b.CreditOfTrustee(trusteeID) != 2+int32(high) {
+			test.Error("Trustee", trusteeID, "should be allowed to send up to round", 2+high)
+		}
 	}
-	stopCalled = false
 
-	b.AddClientCipher(1, 0, data)
-	err = b.CloseRound()
-	if err != nil {
+	//trustee 1 is the bottleneck, round 2 is force-closed; credit does not need to be granted again
+	grants = make(map[int]int32)
+	if err := b.ForceCloseRound(); err != nil {
 		test.Error(err)
 	}
-	if stopCalled {
-		test.Error("Stop not should have been called again (3)")
+	if len(grants) != 0 {
+		test.Error("No credit should have been granted (3)")
 	}
-	stopCalled = false
-	b.AddClientCipher(2, 0, data)
-	err = b.CloseRound()
-	if err != nil {
+}
+
+func TestResumeAtRound(test *testing.T) {
+
+	b := NewBufferableRoundManager(2, 1, 2)
+	if err := b.AddCreditLimiter(1, 5, func(trusteeID int, roundID int32, credit int) {}); err != nil {
 		test.Error(err)
 	}
-	if stopCalled {
-		test.Error("Stop should not have been called")
+
+	schedule := map[int]bool{0: false, 1: true}
+	b.OpenNextRound()
+	if err := b.ResumeAtRound(100, schedule, 0, 102); err == nil {
+		test.Error("Should not resume while a round is open")
 	}
-	b.AddClientCipher(3, 0, data)
-	err = b.CloseRound()
-	if err != nil {
+	b.ForceCloseRound()
+
+	if err := b.ResumeAtRound(100, schedule, 0, 102); err != nil {
 		test.Error(err)
 	}
+	if b.NextRoundToOpen() != 100 {
+		test.Error("Next round to open should be 100, not", b.NextRoundToOpen())
+	}
+	if b.CreditOfTrustee(0) != 105 {
+		test.Error("Trustee 0 should be allowed to send up to round 105, not", b.CreditOfTrustee(0))
+	}
+	s, lastOwner, nextOCSlotRound := b.StoredRoundSchedule()
+	if len(s) != 2 || s[0] || !s[1] || lastOwner != 0 || nextOCSlotRound != 102 {
+		test.Error("The schedule was not restored correctly", s, lastOwner, nextOCSlotRound)
+	}
+	if b.UpdateAndGetNextOwnerID() != 1 {
+		test.Error("Slot 0 is closed, the next owner should be 1")
+	}
 
-	if !resumeCalled {
-		test.Error("Resume should have been called")
+	if roundID := b.OpenNextRound(); roundID != 100 {
+		test.Error("Should open round 100, not", roundID)
+	}
+	b.AddClientCipher(100, 0, genDataSlice())
+	b.AddClientCipher(100, 1, genDataSlice())
+	b.AddTrusteeCipher(100, 0, genDataSlice())
+	if !b.HasAllCiphersForCurrentRound() {
+		test.Error("Should have all ciphers for round 100")
 	}
 }
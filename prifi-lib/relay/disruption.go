@@ -1,25 +1,163 @@
 package relay
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/audit"
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"gopkg.in/dedis/kyber.v2"
 	"gopkg.in/dedis/onet.v2/log"
-	"strconv"
 )
 
-// Received_CLI_REL_BLAME
-func (p *PriFiLibRelayInstance) Received_CLI_REL_BLAME(msg net.CLI_REL_DISRUPTION_BLAME) error {
+/*
+Disruption blame, on the relay side (see prifi-lib/client/disruption.go for the client side).
+Each cell starts with an HMAC keyed with the key of its slot : our private key times the key of the slot in the shuffle
+(see keySlots). The owner of the slot computes the same key from RelayBasePk, without us learning who it is. If the
+HMAC of a round is wrong, we do not forward the cell, and send its output to all clients (REL_CLI_DISRUPTED_ROUND).
+The owner of the round then blames it in its next slot (see receivedBlame), and we ask everyone to reveal the bits of
+their pads at the flipped position. The blamed bit was sent as 0 and output as 1 : the disruptor is whoever sent a
+cipher which is not the XOR of its pads, unless a client and a trustee disagree on the pad they share; then, we ask
+them their shared secret, and replay the pad to find out who lied. Either way, the blame ends with a resync.
+For this, we keep the ciphers of the last rounds (pastRounds), i.e., (nClients + nTrustees) * PayloadSize bytes per
+round. With the equivocation protection, the cipher of the owner is not the XOR of its pads : blames are not supported.
+*/
+
+// DISRUPTION_BLAME_TIMEOUT is the time given to the clients and trustees to reveal their bits and secrets; then, the
+// blame is abandoned, and we resync
+const DISRUPTION_BLAME_TIMEOUT = 30 * time.Second
+
+// pastRound is what we keep of a round, to find the disruptor if its owner blames it
+type pastRound struct {
+	owner     int      // the slot which owned the round, or -1 if unknown
+	clients   [][]byte // the ciphers of the clients, by ID
+	trustees  [][]byte // the ciphers of the trustees, by ID
+	output    []byte   // the decoded cell, with its HMAC
+	disrupted bool     // true if the HMAC was wrong
+}
+
+// pastRoundsWindow returns the number of rounds we keep : the clients keep their cells during
+// DISRUPTION_HISTORY_ROUNDS, and a blame comes in the next slot of its sender, at most nClients rounds later with the
+// round-robin schedule (with the open/closed slots, a blame which comes later is forgotten)
+func (p *PriFiLibRelayInstance) pastRoundsWindow() int32 {
+	return int32(net.DISRUPTION_HISTORY_ROUNDS + p.relayState.nClients)
+}
+
+// keySlots computes the key of the HMAC of each slot (our private key times the key of the slot), and gives the
+// clients our private key times the base of the shuffle, with a NIZK that it is, so that each can compute the key of
+// its slot
+func (p *PriFiLibRelayInstance) keySlots(msg *net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) {
+	base := config.CryptoSuite.Point().Base()
+	msg.RelayBasePk = config.CryptoSuite.Point().Mul(p.relayState.privateKey, msg.Base)
+	msg.RelayBaseProof = crypto.ProveDLEQ(p.relayState.privateKey, base, msg.Base, msg.NIZKContext())
+
+	p.relayState.slotMACKeys = make([]kyber.Point, len(msg.EphPks))
+	for s, pk := range msg.EphPks {
+		p.relayState.slotMACKeys[s] = config.CryptoSuite.Point().Mul(p.relayState.privateKey, pk)
+	}
+}
+
+// checkDisruption checks the HMAC of the cell of the round (with the key of the slot which owned it), and remembers
+// the ciphers of the round. It returns audit.CHECK_DISABLED if we do not know the owner (e.g., the first round). If the
+// HMAC is wrong, we send the output of the round to all clients, so that its owner can blame it
+func (p *PriFiLibRelayInstance) checkDisruption(roundID int32, clientSlices, trusteesSlices [][]byte, cell []byte) int {
+	owner := -1
+	if data, found := p.relayState.roundManager.GetDataAlreadySentIfAny(roundID); found && data != nil {
+		owner = data.OwnershipID
+	}
+	round := &pastRound{owner: owner, clients: clientSlices, trustees: trusteesSlices, output: cell}
+	p.relayState.pastRounds[roundID] = round
+	for r := range p.relayState.pastRounds {
+		if r <= roundID-p.pastRoundsWindow() {
+			delete(p.relayState.pastRounds, r)
+		}
+	}
+
+	if owner < 0 || owner >= len(p.relayState.slotMACKeys) || len(cell) < 32 {
+		return audit.CHECK_DISABLED
+	}
+	key, err := p.relayState.slotMACKeys[owner].MarshalBinary()
+	if err != nil {
+		log.Error("Relay : cannot marshal the key of slot", owner, ",", err)
+		return audit.CHECK_DISABLED
+	}
+	if ValidateHmac256(cell[32:], cell[0:32], key) {
+		return audit.CHECK_PASSED
+	}
+
+	log.Error("Relay : round", roundID, "failed the disruption check, telling the clients")
+	round.disrupted = true
+	toSend := &net.REL_CLI_DISRUPTED_ROUND{
+		RoundID: roundID,
+		Data:    cell}
+	for i := 0; i < p.relayState.nClients; i++ {
+		p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", disrupted round "+strconv.Itoa(int(roundID))+")")
+	}
+	return audit.CHECK_FAILED
+}
+
+// verifyBlame checks that the blame is sent in the slot which owned the blamed round, that this round was disrupted,
+// and the NIZK of the blame : the sender must know the ephemeral private key of the slot, i.e., the x such that x * Base
+// is the key of the slot in the shuffle
+func (p *PriFiLibRelayInstance) verifyBlame(slot int, msg net.CLI_REL_DISRUPTION_BLAME) error {
+	roundStr := strconv.Itoa(int(msg.RoundID))
+	round, found := p.relayState.pastRounds[msg.RoundID]
+	if !found {
+		return errors.New("Relay : cannot check the blame of round " + roundStr + ", we do not remember it")
+	}
+	if round.owner != slot {
+		return errors.New("Relay : the blame of round " + roundStr + " is not sent in the slot which owned it")
+	}
+	if !round.disrupted {
+		return errors.New("Relay : round " + roundStr + " passed the disruption check, it cannot be blamed")
+	}
+	if msg.BitPos < 0 || msg.BitPos >= 8*len(round.output) || bitAt(round.output, msg.BitPos) != 1 {
+		return errors.New("Relay : cannot blame bit " + strconv.Itoa(msg.BitPos) + " of round " + roundStr + ", it was not output as 1")
+	}
+	shuffle := p.relayState.shuffleResult
+	if shuffle == nil || slot < 0 || slot >= len(shuffle.EphPks) {
+		return errors.New("Relay : cannot check the blame of round " + roundStr + ", slot " + strconv.Itoa(slot) + " is not in the shuffle")
+	}
+	if err := crypto.VerifyDL(msg.NIZK, shuffle.Base, shuffle.EphPks[slot], msg.NIZKContext()); err != nil {
+		return errors.New("Relay : invalid blame of round " + roundStr + ", the sender does not own slot " + strconv.Itoa(slot) + " : " + err.Error())
+	}
+	return nil
+}
 
-	// TODO: Check NIZK
+// receivedBlame handles a blame found in the cell of the slot "slot". If it is valid, the communication stops, and we
+// ask everyone to reveal their bits at BitPos; otherwise, the cell is data which looks like a blame
+func (p *PriFiLibRelayInstance) receivedBlame(slot int, msg net.CLI_REL_DISRUPTION_BLAME) error {
+
+	if p.relayState.EquivocationProtectionEnabled {
+		return errors.New("Relay : blames are not supported with the equivocation protection")
+	}
+	if p.stateMachine.State() == "BLAMING" {
+		return errors.New("Relay : already blaming")
+	}
+	if err := p.verifyBlame(slot, msg); err != nil {
+		return err
+	}
+
+	log.Error("Relay : the owner of round", msg.RoundID, "blames bit", msg.BitPos, ", stopping the communication to find the disruptor")
 	p.stateMachine.ChangeState("BLAMING")
 
+	p.relayState.clientBitMap = make(map[int]map[int]int)
+	p.relayState.trusteeBitMap = make(map[int]map[int]int)
+	p.relayState.blamingData = make([]int, 6)
+	p.relayState.blamingData[0] = int(msg.RoundID)
+	p.relayState.blamingData[1] = msg.BitPos
+	p.relayState.blameSecretsAsked = false
+
 	toSend := &net.REL_ALL_DISRUPTION_REVEAL{
 		RoundID: msg.RoundID,
 		BitPos:  msg.BitPos}
 
-	p.relayState.blamingData[0] = int(msg.RoundID)
-	p.relayState.blamingData[1] = msg.BitPos
-
 	// broadcast to all trustees
 	for j := 0; j < p.relayState.nTrustees; j++ {
 		// send to the j-th trustee
@@ -32,8 +170,60 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_BLAME(msg net.CLI_REL_DISRUPTIO
 		p.messageSender.SendToClientWithLog(i, toSend, "Reveal message sent to client "+strconv.Itoa(i+1))
 	}
 
-	//Bool var to let the round finish then stop, switch to state blaming, and reveal ?
+	go p.blameTimeout(p.relayState.sessionCtx)
+
+	return nil
+}
+
+// blameTimeout abandons the blame if it did not end after DISRUPTION_BLAME_TIMEOUT, and resyncs. The blame ends with a
+// resync, which cancels "ctx"
+func (p *PriFiLibRelayInstance) blameTimeout(ctx context.Context) {
+	if !utils.SleepOrCancel(ctx, DISRUPTION_BLAME_TIMEOUT) {
+		return
+	}
+
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
 
+	if ctx.Err() != nil || p.stateMachine.State() != "BLAMING" {
+		return
+	}
+	missingClients := make([]int, 0)
+	for i := 0; i < p.relayState.nClients; i++ {
+		if _, found := p.relayState.clientBitMap[i]; !found {
+			missingClients = append(missingClients, i)
+		}
+	}
+	missingTrustees := make([]int, 0)
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		if _, found := p.relayState.trusteeBitMap[j]; !found {
+			missingTrustees = append(missingTrustees, j)
+		}
+	}
+	log.Error("Relay : the blame timed out; missing the bits of clients", missingClients, "and trustees", missingTrustees,
+		"(secrets asked :", p.relayState.blameSecretsAsked, ")")
+	p.endBlame()
+}
+
+// ignoredWhileBlaming returns true if we are blaming : the rounds in flight are dropped, until the blame ends
+func (p *PriFiLibRelayInstance) ignoredWhileBlaming(msgName string) bool {
+	if p.stateMachine.State() != "BLAMING" {
+		return false
+	}
+	log.Lvl3("Relay : dropping", msgName, "during the blame")
+	return true
+}
+
+// checkRevealedBits returns an error unless "bits" has one bit (0 or 1) for each of the n IDs
+func checkRevealedBits(bits map[int]int, n int) error {
+	if len(bits) != n {
+		return errors.New("revealed " + strconv.Itoa(len(bits)) + " bits instead of " + strconv.Itoa(n))
+	}
+	for id, bit := range bits {
+		if id < 0 || id >= n || (bit != 0 && bit != 1) {
+			return errors.New("revealed an invalid bit for ID " + strconv.Itoa(id))
+		}
+	}
 	return nil
 }
 
@@ -43,6 +233,12 @@ Put bits in maps and find the disruptor if we received everything
 */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_REVEAL(msg net.CLI_REL_DISRUPTION_REVEAL) error {
 
+	if _, found := p.relayState.clientBitMap[msg.ClientID]; found {
+		return errors.New("Relay : client " + strconv.Itoa(msg.ClientID) + " already revealed its bits")
+	}
+	if err := checkRevealedBits(msg.Bits, p.relayState.nTrustees); err != nil {
+		return errors.New("Relay : client " + strconv.Itoa(msg.ClientID) + " " + err.Error())
+	}
 	p.relayState.clientBitMap[msg.ClientID] = msg.Bits
 
 	if (len(p.relayState.clientBitMap) == p.relayState.nClients) && (len(p.relayState.trusteeBitMap) == p.relayState.nTrustees) {
@@ -57,6 +253,12 @@ Put bits in maps and find the disruptor if we received everything
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_REVEAL(msg net.TRU_REL_DISRUPTION_REVEAL) error {
 
+	if _, found := p.relayState.trusteeBitMap[msg.TrusteeID]; found {
+		return errors.New("Relay : trustee " + strconv.Itoa(msg.TrusteeID) + " already revealed its bits")
+	}
+	if err := checkRevealedBits(msg.Bits, p.relayState.nClients); err != nil {
+		return errors.New("Relay : trustee " + strconv.Itoa(msg.TrusteeID) + " " + err.Error())
+	}
 	p.relayState.trusteeBitMap[msg.TrusteeID] = msg.Bits
 
 	if (len(p.relayState.clientBitMap) == p.relayState.nClients) && (len(p.relayState.trusteeBitMap) == p.relayState.nTrustees) {
@@ -66,91 +268,159 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_REVEAL(msg net.TRU_REL_DISRUPTI
 }
 
 /*
-findDisruptor is called when we received all the bits from clients and trustees, we must find a mismatch
+findDisruptor is called when we received all the bits from clients and trustees. If a client and a trustee disagree on
+their pad, we ask them their shared secret; otherwise, the disruptor is whoever sent a cipher which is not the XOR of its pads
 */
-func (p *PriFiLibRelayInstance) findDisruptor() error {
+func (p *PriFiLibRelayInstance) findDisruptor() {
+	roundID := int32(p.relayState.blamingData[0])
+	bitPos := p.relayState.blamingData[1]
 
-	for clientID, val := range p.relayState.clientBitMap {
-		for trusteeID, values := range p.relayState.trusteeBitMap {
-			if val[trusteeID] != values[clientID] {
+	for clientID := 0; clientID < p.relayState.nClients; clientID++ {
+		for trusteeID := 0; trusteeID < p.relayState.nTrustees; trusteeID++ {
+			clientBit := p.relayState.clientBitMap[clientID][trusteeID]
+			trusteeBit := p.relayState.trusteeBitMap[trusteeID][clientID]
+			if clientBit != trusteeBit {
 				log.Lvl1("Found difference between client ", clientID, " and trustee ", trusteeID)
 
 				// message to trustee j and client i to reveal secrets
 				p.relayState.blamingData[2] = clientID
-				p.relayState.blamingData[3] = val[trusteeID]
+				p.relayState.blamingData[3] = clientBit
 				p.relayState.blamingData[4] = trusteeID
-				p.relayState.blamingData[5] = values[clientID]
+				p.relayState.blamingData[5] = trusteeBit
+				p.relayState.blameSecretsAsked = true
 				toSend := &net.REL_ALL_DISRUPTION_SECRET{
 					UserID: clientID}
-				p.messageSender.SendToTrustee(trusteeID, toSend)
+				p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "")
 				toSend2 := &net.REL_ALL_DISRUPTION_SECRET{
 					UserID: trusteeID}
-				p.messageSender.SendToClient(clientID, toSend2)
-				return nil
+				p.messageSender.SendToClientWithLog(clientID, toSend2, "")
+				return
 			}
 		}
 	}
-	log.Lvl1("Found no differences in revealed bits")
-	return nil
+
+	round := p.relayState.pastRounds[roundID]
+	for clientID := 0; clientID < p.relayState.nClients; clientID++ {
+		if cipherBit(round.clients[clientID], bitPos) != xorBits(p.relayState.clientBitMap[clientID]) {
+			p.convict(net.PEER_CLIENT, clientID, "its cipher is not the XOR of its pads")
+		}
+	}
+	for trusteeID := 0; trusteeID < p.relayState.nTrustees; trusteeID++ {
+		if cipherBit(round.trustees[trusteeID], bitPos) != xorBits(p.relayState.trusteeBitMap[trusteeID]) {
+			p.convict(net.PEER_TRUSTEE, trusteeID, "its cipher is not the XOR of its pads")
+		}
+	}
+	p.endBlame()
 }
 
 /*
 Received_TRU_REL_SECRET handles TRU_REL_SECRET messages
-Check the NIZK, if correct regenerate the cipher up to the disrupted round and check if this trustee is the disruptor
+Check the NIZK, if correct regenerate the pad of the disrupted round and check if this trustee is the disruptor
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_SECRET(msg net.TRU_REL_DISRUPTION_SECRET) error {
-	val := p.replayRounds(msg.Secret)
-	if val != p.relayState.blamingData[5] {
-		log.Lvl1("Trustee ", p.relayState.blamingData[4], " lied and is considered a disruptor")
+	if !p.relayState.blameSecretsAsked {
+		return errors.New("Relay : received a secret, but we did not ask for it")
+	}
+	clientID := p.relayState.blamingData[2]
+	trusteeID := p.relayState.blamingData[4]
+
+	base := config.CryptoSuite.Point().Base()
+	trusteePk := p.relayState.trustees[trusteeID].PublicKey
+	clientPk := p.relayState.clients[clientID].PublicKey
+	if err := crypto.VerifyDLEQ(msg.NIZK, base, trusteePk, clientPk, msg.Secret, msg.NIZKContext()); err != nil {
+		p.convict(net.PEER_TRUSTEE, trusteeID, "it revealed an invalid secret ("+err.Error()+")")
+	} else {
+		p.replayPad(msg.Secret)
 	}
+	p.endBlame()
 	return nil
 }
 
 /*
 Received_CLI_REL_SECRET handles CLI_REL_SECRET messages
-Check the NIZK, if correct regenerate the cipher up to the disrupted round and check if this client is the disruptor
+Check the NIZK, if correct regenerate the pad of the disrupted round and check if this client is the disruptor
 */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_SECRET(msg net.CLI_REL_DISRUPTION_SECRET) error {
-	val := p.replayRounds(msg.Secret)
-	if val != p.relayState.blamingData[3] {
-		log.Lvl1("Client ", p.relayState.blamingData[2], " lied and is considered a disruptor")
+	if !p.relayState.blameSecretsAsked {
+		return errors.New("Relay : received a secret, but we did not ask for it")
 	}
+	clientID := p.relayState.blamingData[2]
+	trusteeID := p.relayState.blamingData[4]
+
+	base := config.CryptoSuite.Point().Base()
+	clientPk := p.relayState.clients[clientID].PublicKey
+	trusteePk := p.relayState.trustees[trusteeID].PublicKey
+	if err := crypto.VerifyDLEQ(msg.NIZK, base, clientPk, trusteePk, msg.Secret, msg.NIZKContext()); err != nil {
+		p.convict(net.PEER_CLIENT, clientID, "it revealed an invalid secret ("+err.Error()+")")
+	} else {
+		p.replayPad(msg.Secret)
+	}
+	p.endBlame()
 	return nil
 }
 
 /*
-replayRounds takes the secret revealed by a user and recomputes until the disrupted bit
+replayPad takes the (verified) secret shared by the client and the trustee which disagree, recomputes the bit of their
+pad in the disrupted round, and convicts the one who revealed another bit. This replays the pad from the first round;
+this is done once per blame
 */
-func (p *PriFiLibRelayInstance) replayRounds(secret kyber.Point) int {
-	/*
-		bytes, err := secret.MarshalBinary()
-		if err != nil {
-			log.Fatal("Could not marshal point !")
-		}
-		roundID := p.relayState.blamingData[0]
-		sharedPRNG := config.CryptoSuite.XOF(bytes)
-		key := make([]byte, config.CryptoSuite.XOF(nil).KeySize())
-		sharedPRNG.Partial(key, key, nil)
-		dcCipher := config.CryptoSuite.XOF(key)
-
-		for i := 0; i < roundID; i++ {
-			//discard crypto material
-			dst := make([]byte, p.relayState.PayloadSize)
-			dcCipher.Read(dst)
-		}
+func (p *PriFiLibRelayInstance) replayPad(secret kyber.Point) {
+	clientID := p.relayState.blamingData[2]
+	trusteeID := p.relayState.blamingData[4]
+	roundID := int32(p.relayState.blamingData[0])
+	bitPos := p.relayState.blamingData[1]
 
-		dst := make([]byte, p.relayState.PayloadSize)
-		dcCipher.Read(dst)
-		bitPos := p.relayState.blamingData[0]
-		m := float64(bitPos) / float64(8)
-		m = math.Floor(m)
-		m2 := int(m)
-		n := bitPos % 8
-		mask := byte(1 << uint8(n))
-		if (dst[m2] & mask) == 0 {
-			return 0
-		}
-	*/
-	log.Fatal("not implemented")
-	return 1
+	bit := dcnet.PadBit(secret, p.relayState.clients[clientID].EphemeralPublicKey, p.relayState.PayloadSize, roundID, bitPos)
+	if bit != p.relayState.blamingData[3] {
+		p.convict(net.PEER_CLIENT, clientID, "it lied about its pad")
+	}
+	if bit != p.relayState.blamingData[5] {
+		p.convict(net.PEER_TRUSTEE, trusteeID, "it lied about its pad")
+	}
+}
+
+// convict records that the client or trustee disrupted the communication
+func (p *PriFiLibRelayInstance) convict(role, id int, reason string) {
+	name := peerName(role, id)
+	log.Error("Relay :", name, "is considered a disruptor,", reason)
+	p.relayState.disruptors = append(p.relayState.disruptors, name)
+}
+
+// Disruptors returns the clients and trustees found disrupting the communication since the relay started, e.g. "client 2"
+func (p *PriFiLibRelayInstance) Disruptors() []string {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+	return append([]string{}, p.relayState.disruptors...)
+}
+
+// endBlame resyncs : the clients and trustees drop the blamed configuration, and a new shuffle gives new slots.
+// The disruptors found, if any, are in the logs and in relayState.disruptors
+func (p *PriFiLibRelayInstance) endBlame() {
+	log.Lvl1("Relay : the blame of round", p.relayState.blamingData[0], "is over, resyncing")
+	p.relayState.blameSecretsAsked = false
+	p.relayState.pendingResync = &net.ALL_REL_RESYNC{}
+	p.downstreamPhase_sendResync()
+}
+
+// bitAt returns the bit at bitPos in data (the bits of each byte are numbered from the least significant)
+func bitAt(data []byte, bitPos int) int {
+	return int(data[bitPos/8]>>uint(bitPos%8)) & 1
+}
+
+// cipherBit returns the bit at bitPos in the payload of the cipher, or -1 if the cipher is too short
+func cipherBit(cipher []byte, bitPos int) int {
+	payload := dcnet.DCNetCipherFromBytes(cipher).Payload
+	if bitPos >= 8*len(payload) {
+		return -1
+	}
+	return bitAt(payload, bitPos)
+}
+
+// xorBits returns the XOR of the revealed bits
+func xorBits(bits map[int]int) int {
+	x := 0
+	for _, b := range bits {
+		x ^= b
+	}
+	return x
 }
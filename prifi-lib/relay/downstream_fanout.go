@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+/*
+DownstreamFanOut sends the downstream unicasts (UseUDP=false) concurrently : each client has its own sender goroutine,
+fed by a bounded queue. The relay only enqueues the cell, hence a slow TCP peer does not delay the round start of the
+other clients. A client whose queue overflows cannot keep up; it is reported to "overflowHandler" (once), which
+should treat it as a timed-out participant. The sender goroutines live until Stop() is called or the parent context
+is cancelled.
+*/
+type DownstreamFanOut struct {
+	queues          []chan downstreamSendJob
+	ctx             context.Context
+	cancel          context.CancelFunc
+	send            func(int, *net.REL_CLI_DOWNSTREAM_DATA, string) bool
+	overflowHandler func(int)
+	overflowed      map[int]bool
+}
+
+type downstreamSendJob struct {
+	msg        *net.REL_CLI_DOWNSTREAM_DATA
+	extraInfos string
+	enqueued   time.Time
+}
+
+// NewDownstreamFanOut starts one sender goroutine per client, each with a queue of "queueSize" messages
+func NewDownstreamFanOut(parent context.Context, nClients, queueSize int, send func(int, *net.REL_CLI_DOWNSTREAM_DATA, string) bool, overflowHandler func(int)) *DownstreamFanOut {
+	ctx, cancel := context.WithCancel(parent)
+	f := &DownstreamFanOut{
+		queues:          make([]chan downstreamSendJob, nClients),
+		ctx:             ctx,
+		cancel:          cancel,
+		send:            send,
+		overflowHandler: overflowHandler,
+		overflowed:      make(map[int]bool),
+	}
+	for i := 0; i < nClients; i++ {
+		f.queues[i] = make(chan downstreamSendJob, queueSize)
+		go f.clientSender(i, f.queues[i])
+	}
+	return f
+}
+
+// clientSender sends the messages queued for one client, and reports the send latency (queuing + sending) of this client
+func (f *DownstreamFanOut) clientSender(clientID int, queue chan downstreamSendJob) {
+	stats := prifilog.NewTimeStatistics()
+	info := "downstream-send-latency-client-" + strconv.Itoa(clientID)
+	for {
+		select {
+		case job := <-queue:
+			f.send(clientID, job.msg, job.extraInfos)
+			stats.AddTime(time.Since(job.enqueued).Nanoseconds() / 1e6) //ms
+			stats.ReportWithInfo(info)
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// Send enqueues msg for this client without blocking. Returns false if the queue of this client is full
+// (the message is dropped, and the client is reported to the overflow handler)
+func (f *DownstreamFanOut) Send(clientID int, msg *net.REL_CLI_DOWNSTREAM_DATA, extraInfos string) bool {
+	select {
+	case f.queues[clientID] <- downstreamSendJob{msg: msg, extraInfos: extraInfos, enqueued: time.Now()}:
+		return true
+	default:
+	}
+
+	log.Lvl1("Relay : downstream queue of client", clientID, "is full (", cap(f.queues[clientID]), "messages), dropping round", msg.RoundID)
+	if !f.overflowed[clientID] {
+		f.overflowed[clientID] = true
+		if f.overflowHandler != nil {
+			f.overflowHandler(clientID)
+		}
+	}
+	return false
+}
+
+// Stop stops all sender goroutines; the messages still queued are not sent
+func (f *DownstreamFanOut) Stop() {
+	f.cancel()
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+func TestDownstreamFanOut(test *testing.T) {
+
+	nClients := 3
+	queueSize := 2
+	slowClient := 1
+
+	var lock sync.Mutex
+	received := make(map[int][]int32)
+	sent := make(chan int, nClients*(queueSize+1))
+	slowClientBlocked := make(chan bool, 1)
+	unblockSlowClient := make(chan bool)
+
+	sendFn := func(clientID int, msg *net.REL_CLI_DOWNSTREAM_DATA, extraInfos string) bool {
+		if clientID == slowClient {
+			slowClientBlocked <- true
+			<-unblockSlowClient
+		}
+		lock.Lock()
+		received[clientID] = append(received[clientID], msg.RoundID)
+		lock.Unlock()
+		sent <- clientID
+		return true
+	}
+	waitFor := func(c chan bool, what string) {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			test.Fatal("Timed out waiting for", what)
+		}
+	}
+	waitSent := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-sent:
+			case <-time.After(time.Second):
+				test.Fatal("Timed out waiting for the messages to be sent,", i, "of", n)
+			}
+		}
+	}
+	overflows := make([]int, 0)
+	overflowFn := func(clientID int) {
+		overflows = append(overflows, clientID)
+	}
+
+	f := NewDownstreamFanOut(context.Background(), nClients, queueSize, sendFn, overflowFn)
+
+	//the slow client holds one message in its sender, and queueSize in its queue
+	for round := int32(0); round < int32(queueSize)+1; round++ {
+		for i := 0; i < nClients; i++ {
+			if !f.Send(i, &net.REL_CLI_DOWNSTREAM_DATA{RoundID: round}, "") {
+				test.Error("Client", i, "should not overflow yet (round", round, ")")
+			}
+		}
+		if round == 0 {
+			waitFor(slowClientBlocked, "the slow client to take its first message")
+		}
+	}
+
+	//the other clients are not delayed by the slow one
+	waitSent((nClients - 1) * (queueSize + 1))
+	lock.Lock()
+	for i := 0; i < nClients; i++ {
+		if i != slowClient && len(received[i]) != queueSize+1 {
+			test.Error("Client", i, "should have received", queueSize+1, "messages, not", len(received[i]))
+		}
+	}
+	lock.Unlock()
+
+	//the slow client overflows, and is reported once
+	if f.Send(slowClient, &net.REL_CLI_DOWNSTREAM_DATA{RoundID: 10}, "") {
+		test.Error("The slow client should overflow")
+	}
+	f.Send(slowClient, &net.REL_CLI_DOWNSTREAM_DATA{RoundID: 11}, "")
+	if len(overflows) != 1 || overflows[0] != slowClient {
+		test.Error("The slow client should have been reported once, got", overflows)
+	}
+
+	//once unblocked, the slow client receives the queued messages, in order
+	for i := 0; i < queueSize+1; i++ {
+		if i > 0 {
+			waitFor(slowClientBlocked, "the slow client to take its next message")
+		}
+		unblockSlowClient <- true
+	}
+	waitSent(queueSize + 1)
+	lock.Lock()
+	if len(received[slowClient]) != queueSize+1 {
+		test.Error("Slow client should have received", queueSize+1, "messages, not", len(received[slowClient]))
+	}
+	for i, roundID := range received[slowClient] {
+		if roundID != int32(i) {
+			test.Error("Slow client received the rounds in the wrong order", received[slowClient])
+		}
+	}
+	lock.Unlock()
+
+	f.Stop()
+}
@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+)
+
+// DOWNSTREAM_SCHEDULER_MAX_QUEUED_FRAMES is the number of frames the DownstreamScheduler buffers. When full, the relay
+// stops reading the egress server, which slows down the streams as before.
+const DOWNSTREAM_SCHEDULER_MAX_QUEUED_FRAMES = 100
+
+/*
+DownstreamScheduler shares the downstream cells between the multiplexed streams with weighted fair queuing.
+Frames arrive tagged by the egress server with a QoS class (see stream_multiplexer.TagFrame); each stream gets a
+share of the downstream bandwidth proportional to the weight of its class, so a bulk download cannot starve an
+interactive session. This is self-clocked fair queuing : each frame gets a virtual finish time
+max(virtualTime, finish time of the previous frame of its stream) + length / weight, and the frame with the smallest
+finish time is sent first.
+*/
+type DownstreamScheduler struct {
+	weights     []int
+	queues      map[string]*downstreamStreamQueue
+	virtualTime float64
+	nQueued     int
+}
+
+type downstreamStreamQueue struct {
+	frames      [][]byte
+	finishTimes []float64
+	lastFinish  float64
+}
+
+// ParseQoSWeights parses a comma-separated list of weights (e.g., "4,1"), the i-th weight being the one of QoS class i
+func ParseQoSWeights(s string) ([]int, error) {
+	weights := make([]int, 0)
+	for _, w := range strings.Split(s, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil {
+			return nil, errors.New("Cannot parse QoS weight \"" + w + "\", error is " + err.Error())
+		}
+		if weight < 1 {
+			return nil, errors.New("QoS weights must be >= 1, not " + strconv.Itoa(weight))
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
+
+// NewDownstreamScheduler creates a DownstreamScheduler with one weight per QoS class
+func NewDownstreamScheduler(weights []int) *DownstreamScheduler {
+	return &DownstreamScheduler{
+		weights:     weights,
+		queues:      make(map[string]*downstreamStreamQueue),
+		virtualTime: 0,
+		nQueued:     0,
+	}
+}
+
+// IsFull returns true if no more frames should be enqueued
+func (d *DownstreamScheduler) IsFull() bool {
+	return d.nQueued >= DOWNSTREAM_SCHEDULER_MAX_QUEUED_FRAMES
+}
+
+// Len returns the number of frames queued
+func (d *DownstreamScheduler) Len() int {
+	return d.nQueued
+}
+
+// Enqueue adds a tagged frame from the egress server
+func (d *DownstreamScheduler) Enqueue(taggedFrame []byte) {
+	class, frame := stream_multiplexer.UntagFrame(taggedFrame)
+	if int(class) >= len(d.weights) {
+		class = byte(len(d.weights) - 1)
+	}
+	streamID := ""
+	if len(frame) >= stream_multiplexer.MULTIPLEXER_HEADER_SIZE {
+		streamID = string(frame[0:4])
+	}
+
+	q, found := d.queues[streamID]
+	if !found {
+		q = &downstreamStreamQueue{
+			frames:      make([][]byte, 0),
+			finishTimes: make([]float64, 0),
+			lastFinish:  0,
+		}
+		d.queues[streamID] = q
+	}
+
+	start := d.virtualTime
+	if q.lastFinish > start {
+		start = q.lastFinish
+	}
+	finish := start + float64(len(frame))/float64(d.weights[class])
+
+	q.frames = append(q.frames, frame)
+	q.finishTimes = append(q.finishTimes, finish)
+	q.lastFinish = finish
+	d.nQueued++
+}
+
+// Dequeue returns the (untagged) frame to send next, or nil if nothing is queued
+func (d *DownstreamScheduler) Dequeue() []byte {
+	bestStream := ""
+	var best *downstreamStreamQueue
+	for streamID, q := range d.queues {
+		if best == nil || q.finishTimes[0] < best.finishTimes[0] ||
+			(q.finishTimes[0] == best.finishTimes[0] && streamID < bestStream) {
+			bestStream = streamID
+			best = q
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	frame := best.frames[0]
+	d.virtualTime = best.finishTimes[0]
+	best.frames = best.frames[1:]
+	best.finishTimes = best.finishTimes[1:]
+	if len(best.frames) == 0 {
+		delete(d.queues, bestStream)
+	}
+	d.nQueued--
+
+	return frame
+}
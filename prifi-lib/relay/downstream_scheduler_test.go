@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+)
+
+func genTaggedFrame(class byte, streamID string, length int) []byte {
+	frame := make([]byte, stream_multiplexer.MULTIPLEXER_HEADER_SIZE+length)
+	copy(frame[0:4], []byte(streamID))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(length))
+	return stream_multiplexer.TagFrame(class, frame)
+}
+
+func TestDownstreamScheduler(test *testing.T) {
+
+	if _, err := ParseQoSWeights("4,x"); err == nil {
+		test.Error("Should not accept a non-integer weight")
+	}
+	if _, err := ParseQoSWeights("4,0"); err == nil {
+		test.Error("Should not accept a zero weight")
+	}
+	weights, err := ParseQoSWeights("4, 1")
+	if err != nil || len(weights) != 2 || weights[0] != 4 || weights[1] != 1 {
+		test.Fatal("Could not parse the weights", weights, err)
+	}
+
+	d := NewDownstreamScheduler(weights)
+	if d.Dequeue() != nil {
+		test.Error("Empty scheduler should return nil")
+	}
+
+	//a bulk download arrives first, then an interactive session
+	for i := 0; i < 10; i++ {
+		d.Enqueue(genTaggedFrame(stream_multiplexer.QOS_CLASS_BULK, "bulk", 1000))
+	}
+	d.Enqueue(genTaggedFrame(stream_multiplexer.QOS_CLASS_INTERACTIVE, "ssh0", 100))
+	d.Enqueue(genTaggedFrame(stream_multiplexer.QOS_CLASS_INTERACTIVE, "ssh0", 100))
+	if d.Len() != 12 {
+		test.Error("Scheduler should hold 12 frames, not", d.Len())
+	}
+
+	//the interactive frames should not wait behind the bulk ones
+	for i := 0; i < 2; i++ {
+		frame := d.Dequeue()
+		if !bytes.Equal(frame[0:4], []byte("ssh0")) {
+			test.Error("Interactive frame", i, "should be scheduled first, got stream", string(frame[0:4]))
+		}
+		if len(frame) != stream_multiplexer.MULTIPLEXER_HEADER_SIZE+100 {
+			test.Error("Frame should be untagged")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		frame := d.Dequeue()
+		if frame == nil || !bytes.Equal(frame[0:4], []byte("bulk")) {
+			test.Error("Bulk frame", i, "should follow")
+		}
+	}
+	if d.Len() != 0 || d.Dequeue() != nil {
+		test.Error("Scheduler should be empty")
+	}
+
+	//two bulk streams share the bandwidth equally
+	for i := 0; i < 4; i++ {
+		d.Enqueue(genTaggedFrame(stream_multiplexer.QOS_CLASS_BULK, "dl_A", 1000))
+	}
+	for i := 0; i < 4; i++ {
+		d.Enqueue(genTaggedFrame(stream_multiplexer.QOS_CLASS_BULK, "dl_B", 1000))
+	}
+	countA := 0
+	for i := 0; i < 4; i++ {
+		if bytes.Equal(d.Dequeue()[0:4], []byte("dl_A")) {
+			countA++
+		}
+	}
+	if countA != 2 {
+		test.Error("Two bulk streams should alternate, stream A got", countA, "of the first 4 cells")
+	}
+
+	//unknown classes use the last weight, bounded queue
+	d = NewDownstreamScheduler(weights)
+	for !d.IsFull() {
+		d.Enqueue(genTaggedFrame(7, "strm", 10))
+	}
+	if d.Len() != DOWNSTREAM_SCHEDULER_MAX_QUEUED_FRAMES {
+		test.Error("Scheduler should stop accepting frames at", DOWNSTREAM_SCHEDULER_MAX_QUEUED_FRAMES)
+	}
+}
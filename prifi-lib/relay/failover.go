@@ -0,0 +1,259 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/kyber.v2"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+/*
+Warm standby relay. The relay replicates what is needed to continue the session (parameters, public keys, result of the
+shuffle, slot schedule) to a standby relay, via the replication handler given by the service.
+The state is replicated with a lease : it contains a round ResumeRoundID such that no round >= ResumeRoundID has been
+opened, nor granted to a trustee. When the relay comes close to this limit, it replicates its state again with a new one.
+When the relay fails, the standby resumes the session at ResumeRoundID (see Received_ALL_REL_RESUME) : the clients and
+trustees keep their keys, slots and DC-net streams, skip the rounds in-between, and no round is ever encoded twice.
+They only accept a resume from the standby relay announced in the parameters (see SetStandbyRelayKey).
+The replication handler is called by a goroutine (see replicator), not to stop the rounds while the standby relay
+answers; if it is slower than the rounds, the lease may run out, and a failover restarts the protocol, as above.
+This needs the credit-based flow control of the trustees (RelayTrusteeCacheHighBound > 0), otherwise the trustees
+might already be past ResumeRoundID; it does not work with the equivocation protection, whose history is lost. In
+those cases, the clients and trustees refuse to resume, and the protocol is restarted.
+*/
+
+// FAILOVER_ROUND_LEASE is the number of rounds the relay may use before replicating its state again
+const FAILOVER_ROUND_LEASE = 1000
+
+// replicationJob is a state to send to the standby relay, for the session of ctx
+type replicationJob struct {
+	ctx     context.Context
+	handler func(*net.RELAY_FAILOVER_STATE) bool
+	state   *net.RELAY_FAILOVER_STATE
+}
+
+// SetReplicationHandler sets the function which sends our state to the standby relay. It returns false if the state
+// could not be sent. If nil (the default), nothing is replicated. It is called by another goroutine than the rounds,
+// one state at a time
+func (p *PriFiLibRelayInstance) SetReplicationHandler(handler func(*net.RELAY_FAILOVER_STATE) bool) {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	p.relayState.replicationHandler = handler
+}
+
+// SetStandbyRelayKey sets the public key of the standby relay, which we announce in ALL_ALL_PARAMETERS : the clients and
+// trustees only accept a REL_ALL_RESUME authenticated by this key. If nil (the default), they accept none
+func (p *PriFiLibRelayInstance) SetStandbyRelayKey(standbyRelayPk kyber.Point) {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	p.relayState.standbyRelayPk = standbyRelayPk
+}
+
+// maxRoundInUse returns the biggest round for which a client or a trustee may have encoded something, once we open the next round
+func (p *PriFiLibRelayInstance) maxRoundInUse() int32 {
+	next := p.relayState.roundManager.NextRoundToOpen()
+	if p.relayState.TrusteeCacheHighBound > 1 {
+		return next + int32(p.relayState.TrusteeCacheHighBound) - 1
+	}
+	return next
+}
+
+// replicateIfNeeded replicates our state if the rounds in use come close to the round where the standby would resume
+func (p *PriFiLibRelayInstance) replicateIfNeeded() {
+	if p.relayState.replicationHandler == nil || p.relayState.shuffleResult == nil {
+		return
+	}
+	if p.maxRoundInUse() >= p.relayState.replicatingUpTo-FAILOVER_ROUND_LEASE/2 {
+		p.replicate()
+	}
+}
+
+// replicate queues our state for the standby relay, with a new lease. If the replicator still has a state to send,
+// it is replaced by this one
+func (p *PriFiLibRelayInstance) replicate() {
+	state := p.FailoverState(p.maxRoundInUse() + FAILOVER_ROUND_LEASE)
+	job := replicationJob{ctx: p.relayState.sessionCtx, handler: p.relayState.replicationHandler, state: state}
+	p.relayState.replicatingUpTo = state.ResumeRoundID
+
+	if p.relayState.replicationQueue == nil {
+		p.relayState.replicationQueue = make(chan replicationJob, 1)
+		go p.replicator(p.ctx, p.relayState.replicationQueue)
+	}
+	select {
+	case <-p.relayState.replicationQueue:
+	default:
+	}
+	p.relayState.replicationQueue <- job
+}
+
+// replicator sends the queued states to the standby relay, until ctx is cancelled. Once the standby relay has a state,
+// we may use the rounds up to its ResumeRoundID
+func (p *PriFiLibRelayInstance) replicator(ctx context.Context, queue chan replicationJob) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-queue:
+			ok := job.handler(job.state)
+
+			p.relayState.processingLock.Lock()
+			switch {
+			case job.ctx != p.relayState.sessionCtx:
+				//the relay was re-initialized meanwhile, it replicates the new session once shuffled
+			case !ok:
+				log.Error("Relay : could not replicate our state to the standby relay, a failover would restart the protocol")
+				p.relayState.replicatingUpTo = p.relayState.replicatedUpTo
+			default:
+				p.relayState.replicatedUpTo = job.state.ResumeRoundID
+				log.Lvl2("Relay : replicated our state, the standby relay would resume at round", job.state.ResumeRoundID)
+			}
+			p.relayState.processingLock.Unlock()
+		}
+	}
+}
+
+// FailoverState returns what a standby relay needs to resume the session at round "resumeRoundID"
+func (p *PriFiLibRelayInstance) FailoverState(resumeRoundID int32) *net.RELAY_FAILOVER_STATE {
+	state := &net.RELAY_FAILOVER_STATE{
+		Params:        *p.currentParameters(),
+		ClientsPks:    make([]kyber.Point, p.relayState.nClients),
+		ClientsEphPks: make([]kyber.Point, p.relayState.nClients),
+		TrusteesPks:   make([]kyber.Point, p.relayState.nTrustees),
+		ResumeRoundID: resumeRoundID,
+	}
+	for i := 0; i < p.relayState.nClients; i++ {
+		state.ClientsPks[i] = p.relayState.clients[i].PublicKey
+		state.ClientsEphPks[i] = p.relayState.clients[i].EphemeralPublicKey
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		state.TrusteesPks[j] = p.relayState.trustees[j].PublicKey
+	}
+	if p.relayState.shuffleResult != nil {
+		state.Shuffle = *p.relayState.shuffleResult
+	}
+	state.SlotMACKeys = p.relayState.slotMACKeys
+	schedule, lastOwner, nextOCSlotRound := p.relayState.roundManager.StoredRoundSchedule()
+	state.OwnerSchedule = schedule
+	state.LastOwner = lastOwner
+	state.NextOpenClosedRequestIn = nextOCSlotRound - p.relayState.roundManager.NextRoundToOpen()
+
+	return state
+}
+
+// currentParameters returns the parameters of the relay, as received in ALL_ALL_PARAMETERS
+func (p *PriFiLibRelayInstance) currentParameters() *net.ALL_ALL_PARAMETERS {
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("NTrustees", p.relayState.nTrustees)
+	msg.Add("NClients", p.relayState.nClients)
+	msg.Add("PayloadSize", p.relayState.PayloadSize)
+	msg.Add("DownstreamCellSize", p.relayState.DownstreamCellSize)
+	msg.Add("WindowSize", p.relayState.WindowSize)
+	msg.Add("UseDummyDataDown", p.relayState.UseDummyDataDown)
+	msg.Add("UseOpenClosedSlots", p.relayState.UseOpenClosedSlots)
+	msg.Add("ExperimentRoundLimit", p.relayState.ExperimentRoundLimit)
+	msg.Add("UseUDP", p.relayState.UseUDP)
+	msg.Add("DCNetType", p.relayState.dcNetType)
+	msg.Add("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
+	msg.Add("OpenClosedSlotsMinDelayBetweenRequests", p.relayState.OpenClosedSlotsMinDelayBetweenRequests)
+	msg.Add("OpenClosedSlotsMaxDelayBetweenRequests", p.relayState.OpenClosedSlotsMaxDelayBetweenRequests)
+	msg.Add("OpenClosedSlotsPolicy", p.relayState.OpenClosedSlotsPolicy)
+	msg.Add("RelayMaxNumberOfConsecutiveFailedRounds", p.relayState.MaxNumberOfConsecutiveFailedRounds)
+	msg.Add("RelayProcessingLoopSleepTime", p.relayState.ProcessingLoopSleepTime)
+	msg.Add("RelayRoundTimeOut", p.relayState.RoundTimeOut)
+	msg.Add("RelayTrusteeCacheLowBound", p.relayState.TrusteeCacheLowBound)
+	msg.Add("RelayTrusteeCacheHighBound", p.relayState.TrusteeCacheHighBound)
+	msg.Add("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
+	msg.Add("UDPFECGroupSize", p.relayState.UDPFECGroupSize)
+	msg.Add("AdaptiveWindow", p.relayState.AdaptiveWindow)
+	msg.Add("DownstreamQoSWeights", p.relayState.DownstreamQoSWeights)
+	msg.Add("DownstreamFanOutQueueSize", p.relayState.DownstreamFanOutQueueSize)
+	msg.ForceParams = true
+	return msg
+}
+
+/*
+Received_ALL_REL_RESUME handles ALL_REL_RESUME messages. They are sent by the service of a standby relay when the
+primary relay failed. We restore the replicated state, open the round ResumeRoundID, and tell the clients and
+trustees to continue from there.
+*/
+func (p *PriFiLibRelayInstance) Received_ALL_REL_RESUME(msg net.ALL_REL_RESUME) error {
+
+	state := msg.State
+	nClients := state.Params.IntValueOrElse("NClients", 0)
+	nTrustees := state.Params.IntValueOrElse("NTrustees", 0)
+
+	if len(state.ClientsPks) != nClients || len(state.ClientsEphPks) != nClients || len(state.Shuffle.EphPks) != nClients {
+		return errors.New("Relay : cannot resume, the replicated state has not the keys of the " + strconv.Itoa(nClients) + " clients")
+	}
+	if len(state.TrusteesPks) != nTrustees {
+		return errors.New("Relay : cannot resume, the replicated state has not the keys of the " + strconv.Itoa(nTrustees) + " trustees")
+	}
+	if state.Params.BoolValueOrElse("EquivocationProtectionEnabled", false) {
+		return errors.New("Relay : cannot resume with the equivocation protection, the history of the downstream data is lost")
+	}
+
+	params := new(net.ALL_ALL_PARAMETERS)
+	for k, v := range state.Params.ParamsInt {
+		params.Add(k, v)
+	}
+	for k, v := range state.Params.ParamsStr {
+		params.Add(k, v)
+	}
+	for k, v := range state.Params.ParamsBool {
+		params.Add(k, v)
+	}
+	params.Add("StartNow", false)
+	params.ForceParams = true
+	if err := p.Received_ALL_ALL_PARAMETERS(*params); err != nil {
+		return err
+	}
+
+	for i := 0; i < nClients; i++ {
+		p.relayState.clients[i] = NodeRepresentation{i, true, state.ClientsPks[i], state.ClientsEphPks[i]}
+		p.relayState.authenticator.SetPeerKey(net.PEER_CLIENT, i, state.ClientsPks[i])
+	}
+	for j := 0; j < nTrustees; j++ {
+		p.relayState.trustees[j] = NodeRepresentation{j, true, state.TrusteesPks[j], nil}
+		p.relayState.authenticator.SetPeerKey(net.PEER_TRUSTEE, j, state.TrusteesPks[j])
+	}
+	p.relayState.nClientsPkCollected = nClients
+	p.relayState.nTrusteesPkCollected = nTrustees
+	shuffle := state.Shuffle
+	p.relayState.shuffleResult = &shuffle
+	p.relayState.slotMACKeys = state.SlotMACKeys
+
+	nextOCSlotRound := state.ResumeRoundID + 1
+	if state.NextOpenClosedRequestIn > 1 {
+		nextOCSlotRound = state.ResumeRoundID + state.NextOpenClosedRequestIn
+	}
+	if err := p.relayState.roundManager.ResumeAtRound(state.ResumeRoundID, state.OwnerSchedule, state.LastOwner, nextOCSlotRound); err != nil {
+		return err
+	}
+	p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, p.relayState.PayloadSize, false, nil, nil)
+	p.relayState.DCNet.DecodeStart(state.ResumeRoundID)
+
+	// like after the shuffle, there is no downstream data for the first round
+	roundID := p.relayState.roundManager.OpenNextRound()
+	p.stateMachine.ChangeState("COMMUNICATING")
+	p.relayState.numberOfNonAckedDownstreamPackets = 1
+	p.relayState.replicatedUpTo = roundID
+	p.relayState.replicatingUpTo = roundID
+
+	toSend := &net.REL_ALL_RESUME{RoundID: roundID, RelayPk: p.relayState.PublicKey}
+	for j := 0; j < nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "(trustee "+strconv.Itoa(j)+", resume at round "+strconv.Itoa(int(roundID))+")")
+	}
+	for i := 0; i < nClients; i++ {
+		p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", resume at round "+strconv.Itoa(int(roundID))+")")
+	}
+
+	log.Lvl1("Relay : resumed the session at round", roundID)
+
+	return nil
+}
@@ -18,6 +18,11 @@ Then, this file simple handle the answer to the different message kind :
 - CLI_REL_UPSTREAM_DATA - data for the DC-net
 - REL_CLI_UDP_DOWNSTREAM_DATA - is NEVER received here, but casted to CLI_REL_UPSTREAM_DATA by messages.go
 - TRU_REL_DC_CIPHER - data for the DC-net
+- CLI_REL_DOWNSTREAM_NACK - a client missed some downstream rounds, we retransmit them over TCP
+- ALL_REL_RESYNC - (local) change some parameters of the running protocol, see resync.go
+- ALL_REL_RESUME - (local) take over the session of a failed relay, see failover.go
+- CLI_REL_DISRUPTION_REVEAL, TRU_REL_DISRUPTION_REVEAL - the bits of the pads of a blamed round, see disruption.go
+- CLI_REL_DISRUPTION_SECRET, TRU_REL_DISRUPTION_SECRET - the secret shared by a client and a trustee which disagree on their pad
 
 local functions :
 
@@ -32,8 +37,10 @@ considered disconnected
 */
 
 import (
+	"context"
 	"errors"
 
+	"github.com/dedis/prifi/prifi-lib/audit"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
@@ -53,6 +60,8 @@ type PriFiLibRelayInstance struct {
 	messageSender *net.MessageSenderWrapper
 	relayState    *RelayState
 	stateMachine  *utils.StateMachine
+	ctx           context.Context //owns all the goroutines and timers of this relay; cancelled by Stop()
+	cancel        context.CancelFunc
 }
 
 // NewPriFiRelay creates a new PriFi relay entity state.
@@ -78,6 +87,7 @@ func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet
 	relayState.timeStatistics["sending-data"] = prifilog.NewTimeStatistics()
 	relayState.timeStatistics["pcap-delay"] = prifilog.NewTimeStatistics()
 	relayState.PublicKey, relayState.privateKey = crypto.NewKeyPair()
+	relayState.authenticator = net.NewAuthenticator(relayState.privateKey)
 	relayState.slotScheduler = new(scheduler.BitMaskSlotScheduler_Relay)
 	relayState.roundManager = new(BufferableRoundManager)
 	relayState.processingLock = *new(sync.Mutex)
@@ -102,14 +112,49 @@ func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet
 	sm.Init(states, logFn, errFn)
 	sm.SetEntity("Relay")
 
+	ctx, cancel := context.WithCancel(context.Background())
 	prifi := PriFiLibRelayInstance{
 		messageSender: msgSender,
 		relayState:    relayState,
 		stateMachine:  sm,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 	return &prifi
 }
 
+// SetKeyPair sets our long-term key pair, instead of the fresh one generated at creation, so that the clients and
+// trustees (and the verifiers of the audit log) can know our public key in advance. It must be called before the
+// protocol starts, and before SetAuditLog.
+func (p *PriFiLibRelayInstance) SetKeyPair(publicKey kyber.Point, privateKey kyber.Scalar) error {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	if !crypto.IsKeyPair(publicKey, privateKey) {
+		return errors.New("Relay : the public key does not match the private key")
+	}
+	if p.stateMachine.State() != "BEFORE_INIT" {
+		return errors.New("Relay : cannot change the key pair in state " + p.stateMachine.State())
+	}
+	if p.relayState.auditLog != nil {
+		return errors.New("Relay : cannot change the key pair once the audit log is started")
+	}
+	p.relayState.PublicKey = publicKey
+	p.relayState.privateKey = privateKey
+	p.relayState.authenticator.SetPrivateKey(privateKey)
+	return nil
+}
+
+// Stop cancels the context of this relay, which stops all the goroutines and timers it started. Can be called several times.
+func (p *PriFiLibRelayInstance) Stop() {
+	p.cancel()
+	if p.relayState.auditLog != nil {
+		if err := p.relayState.auditLog.Close(); err != nil {
+			log.Error("Relay : could not close the audit log,", err)
+		}
+	}
+}
+
 // NodeRepresentation regroups the information about one client or trustee.
 type NodeRepresentation struct {
 	ID                 int
@@ -156,24 +201,54 @@ type RelayState struct {
 	dcNetType                              string
 	time0                                  uint64
 	pcapLogger                             *utils.PCAPLog
+	pcapReplay                             *pcapReplay // if not nil, we replay a capture downstream, see pcap_replay.go
 	DisruptionProtectionEnabled            bool
 	OpenClosedSlotsMinDelayBetweenRequests int
 	OpenClosedSlotsRequestsRoundID         map[int32]bool // contains roundID -> true if that round should be a OC slot request
+	OpenClosedSlotsPolicy                  string         // "Fixed" (default) or "Adaptive"
+	OpenClosedSlotsMaxDelayBetweenRequests int            // upper bound of the back-off of the "Adaptive" policy
+	openClosedPolicy                       OpenClosedSchedulingPolicy
+	openClosedBackOff                      bool // true while we wait before opening the rounds of the next schedule (all slots were closed)
 	numberOfConsecutiveFailedRounds        int
 	MaxNumberOfConsecutiveFailedRounds     int // Kill the protocol if that many rounds fail consecutively
 	ProcessingLoopSleepTime                int
 	RoundTimeOut                           int //The timeout before retransmission (UDP) and/or considering the round failed
-	TrusteeCacheLowBound                   int // Number of ciphertexts buffered by trustees. When <= TRUSTEE_CACHE_LOWBOUND, resume sending
-	TrusteeCacheHighBound                  int // Number of ciphertexts buffered by trustees. When >= TRUSTEE_CACHE_HIGHBOUND, stop sending
+	TrusteeCacheLowBound                   int // Rounds of credit left to a trustee. When <= TRUSTEE_CACHE_LOWBOUND, grant new credit
+	TrusteeCacheHighBound                  int // Number of rounds a trustee may run ahead of the relay. If 0, trustees are not rate-limited
 	EquivocationProtectionEnabled          bool
+	UDPFECGroupSize                        int // if > 0, a FEC parity packet is broadcasted every UDPFECGroupSize rounds
+	fecEncoder                             *net.FECEncoder
+	fecStatistics                          *prifilog.FECStatistics
+	AdaptiveWindow                         bool // if true, the number of concurrent rounds adapts between 1 and WindowSize
+	windowController                       *WindowController
+	DownstreamQoSWeights                   string // if non-empty, the weights of the QoS classes, e.g. "4,1" (interactive, bulk)
+	downstreamScheduler                    *DownstreamScheduler
+	DownstreamFanOutQueueSize              int // if > 0 (and not UseUDP), the downstream unicasts are sent concurrently, with queues of this size
+	downstreamFanOut                       *DownstreamFanOut
+	pendingResync                          *net.ALL_REL_RESYNC // if not nil, a resync is scheduled
+	resyncInProgress                       bool                // true from the resync until we communicate again
+	sessionCtx                             context.Context     // cancelled when the relay is re-initialized; owns the timeouts of the rounds
+	cancelSession                          context.CancelFunc
+	shuffleResult                          *net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG // the pseudonyms, sent to the clients
+	replicationHandler                     func(*net.RELAY_FAILOVER_STATE) bool       // if not nil, sends our state to the standby relay
+	replicatedUpTo                         int32                                      // the standby relay would resume at this round
+	replicatingUpTo                        int32                                      // the same, once the queued state is replicated
+	replicationQueue                       chan replicationJob                        // the state waiting for the replicator, see failover.go
+	standbyRelayPk                         kyber.Point                                // if not nil, announced to the clients and trustees as the only relay which may resume
+	auditLog                               *audit.Log                                 // if not nil, we log each round there, see audit.go
+	authenticator                          *net.Authenticator                         // verifies the messages of the clients and trustees, see authentication.go
 
 	// sync
 	processingLock sync.Mutex // either we treat a message, or a timeout, never both
 
 	//disruption protection
-	clientBitMap  map[int]map[int]int
-	trusteeBitMap map[int]map[int]int
-	blamingData   []int //[round#, bitPos, clientID, bitRevealed, trusteeID, bitRevealed]
+	clientBitMap      map[int]map[int]int
+	trusteeBitMap     map[int]map[int]int
+	blamingData       []int                // [round#, bitPos, clientID, bitRevealed, trusteeID, bitRevealed]
+	blameSecretsAsked bool                 // true once we asked the client and trustee of blamingData their shared secret
+	pastRounds        map[int32]*pastRound // the last rounds, to check the blames and find the disruptors (see disruption.go)
+	slotMACKeys       []kyber.Point        // the keys of the HMACs, by slot (see keySlots)
+	disruptors        []string             // the clients and trustees found disrupting the communication, since we started
 
 	//Used for verifiable DC-net, part of the dcnet.old/owned.go
 	VerifiableDCNetKeys [][]byte
@@ -189,6 +264,14 @@ func (p *PriFiLibRelayInstance) ReceivedMessage(msg interface{}) error {
 
 	var err error
 
+	//the messages from the network are authenticated, the others are local calls
+	if authenticated, ok := msg.(net.AUTHENTICATED_MESSAGE); ok {
+		if err := p.authenticate(authenticated); err != nil {
+			return err
+		}
+		msg = authenticated.Msg
+	}
+
 	switch typedMsg := msg.(type) {
 	case net.ALL_ALL_PARAMETERS:
 		if typedMsg.ForceParams || p.stateMachine.AssertState("BEFORE_INIT") {
@@ -196,16 +279,36 @@ func (p *PriFiLibRelayInstance) ReceivedMessage(msg interface{}) error {
 		}
 	case net.ALL_ALL_SHUTDOWN:
 		err = p.Received_ALL_ALL_SHUTDOWN(typedMsg)
+	case net.ALL_REL_RESYNC:
+		if p.stateMachine.State() != "COMMUNICATING" {
+			err = errors.New("Relay : cannot resync in state " + p.stateMachine.State() + ", only when communicating")
+		} else {
+			err = p.Received_ALL_REL_RESYNC(typedMsg)
+		}
+	case net.ALL_REL_RESUME:
+		if p.stateMachine.State() != "BEFORE_INIT" {
+			err = errors.New("Relay : cannot resume a session in state " + p.stateMachine.State() + ", only before the setup")
+		} else {
+			err = p.Received_ALL_REL_RESUME(typedMsg)
+		}
 	case net.CLI_REL_UPSTREAM_DATA:
-		if p.stateMachine.AssertState("COMMUNICATING") {
+		if !p.ignoredDuringResync("CLI_REL_UPSTREAM_DATA", "COMMUNICATING") && !p.ignoredWhileBlaming("CLI_REL_UPSTREAM_DATA") &&
+			p.stateMachine.AssertState("COMMUNICATING") {
 			err = p.Received_CLI_REL_UPSTREAM_DATA(typedMsg)
 		}
 	case net.CLI_REL_OPENCLOSED_DATA:
-		if p.stateMachine.AssertState("COMMUNICATING") {
+		if !p.ignoredDuringResync("CLI_REL_OPENCLOSED_DATA", "COMMUNICATING") && !p.ignoredWhileBlaming("CLI_REL_OPENCLOSED_DATA") &&
+			p.stateMachine.AssertState("COMMUNICATING") {
 			err = p.Received_CLI_REL_OPENCLOSED_DATA(typedMsg)
 		}
+	case net.CLI_REL_DOWNSTREAM_NACK:
+		if !p.ignoredDuringResync("CLI_REL_DOWNSTREAM_NACK", "COMMUNICATING") && !p.ignoredWhileBlaming("CLI_REL_DOWNSTREAM_NACK") &&
+			p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_DOWNSTREAM_NACK(typedMsg)
+		}
 	case net.TRU_REL_DC_CIPHER:
-		if p.stateMachine.AssertStateOrState("COMMUNICATING", "COLLECTING_SHUFFLE_SIGNATURES") {
+		if !p.ignoredDuringResync("TRU_REL_DC_CIPHER", "COMMUNICATING", "COLLECTING_SHUFFLE_SIGNATURES") && !p.ignoredWhileBlaming("TRU_REL_DC_CIPHER") &&
+			p.stateMachine.AssertStateOrState("COMMUNICATING", "COLLECTING_SHUFFLE_SIGNATURES") {
 			err = p.Received_TRU_REL_DC_CIPHER(typedMsg)
 		}
 	case net.TRU_REL_TELL_PK:
@@ -224,6 +327,22 @@ func (p *PriFiLibRelayInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("COLLECTING_SHUFFLE_SIGNATURES") {
 			err = p.Received_TRU_REL_SHUFFLE_SIG(typedMsg)
 		}
+	case net.CLI_REL_DISRUPTION_REVEAL:
+		if p.stateMachine.AssertState("BLAMING") {
+			err = p.Received_CLI_REL_REVEAL(typedMsg)
+		}
+	case net.TRU_REL_DISRUPTION_REVEAL:
+		if p.stateMachine.AssertState("BLAMING") {
+			err = p.Received_TRU_REL_REVEAL(typedMsg)
+		}
+	case net.CLI_REL_DISRUPTION_SECRET:
+		if p.stateMachine.AssertState("BLAMING") {
+			err = p.Received_CLI_REL_SECRET(typedMsg)
+		}
+	case net.TRU_REL_DISRUPTION_SECRET:
+		if p.stateMachine.AssertState("BLAMING") {
+			err = p.Received_TRU_REL_SECRET(typedMsg)
+		}
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
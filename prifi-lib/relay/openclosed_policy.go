@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"errors"
+	"time"
+)
+
+//OPEN_CLOSED_POLICY_POLLING_PERIOD is how often the relay checks for downstream data while backing off
+const OPEN_CLOSED_POLICY_POLLING_PERIOD = 10 * time.Millisecond
+
+/*
+An OpenClosedSchedulingPolicy decides how long the relay waits, after having received an open/closed (OC) schedule,
+before starting the next rounds. When all slots are closed, the next downstream round is again an OC request, hence
+this delay is the polling period of an idle group.
+The policy is informed of the activity (open slots, data waiting for the clients), and can react to it.
+*/
+type OpenClosedSchedulingPolicy interface {
+	//DelayAfterSchedule is called after each OC schedule, with the number of open slots in it
+	DelayAfterSchedule(numberOfOpenSlots int) time.Duration
+
+	//InterruptibleByActivity returns true if the delay should end as soon as there is downstream data for the clients
+	InterruptibleByActivity() bool
+
+	//NotifyActivity is called when the delay was interrupted by downstream data
+	NotifyActivity()
+}
+
+//SetOpenClosedSchedulingPolicy replaces the policy chosen by the parameters (must be called after ALL_ALL_PARAMETERS)
+func (p *PriFiLibRelayInstance) SetOpenClosedSchedulingPolicy(policy OpenClosedSchedulingPolicy) {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+	p.relayState.openClosedPolicy = policy
+}
+
+//NewOpenClosedSchedulingPolicy returns the policy with the given name ("Fixed" or "Adaptive")
+func NewOpenClosedSchedulingPolicy(name string, minDelayMs, maxDelayMs int) (OpenClosedSchedulingPolicy, error) {
+	switch name {
+	case "", "Fixed":
+		return &FixedOpenClosedPolicy{Delay: time.Duration(minDelayMs) * time.Millisecond}, nil
+	case "Adaptive":
+		return NewAdaptiveOpenClosedPolicy(time.Duration(minDelayMs)*time.Millisecond, time.Duration(maxDelayMs)*time.Millisecond), nil
+	}
+	return nil, errors.New("Unknown OpenClosedSlotsPolicy " + name)
+}
+
+//FixedOpenClosedPolicy is the historical behavior : a constant sleep when all slots are closed
+type FixedOpenClosedPolicy struct {
+	Delay time.Duration
+}
+
+//DelayAfterSchedule returns Delay if all slots are closed, 0 otherwise
+func (f *FixedOpenClosedPolicy) DelayAfterSchedule(numberOfOpenSlots int) time.Duration {
+	if numberOfOpenSlots == 0 {
+		return f.Delay
+	}
+	return 0
+}
+
+//InterruptibleByActivity returns false, the sleep is constant
+func (f *FixedOpenClosedPolicy) InterruptibleByActivity() bool {
+	return false
+}
+
+//NotifyActivity does nothing
+func (f *FixedOpenClosedPolicy) NotifyActivity() {
+}
+
+/*
+AdaptiveOpenClosedPolicy backs off exponentially while the group is idle : the first idle schedule is followed by
+MinDelay, then the delay doubles at each consecutive idle schedule, up to MaxDelay. As soon as some slot is open,
+the delay is reset and the next OC request is issued right after the data rounds. While backing off, the relay
+wakes up immediately if some downstream data arrives (the clients are likely to answer).
+*/
+type AdaptiveOpenClosedPolicy struct {
+	MinDelay     time.Duration
+	MaxDelay     time.Duration
+	currentDelay time.Duration
+}
+
+//NewAdaptiveOpenClosedPolicy returns an AdaptiveOpenClosedPolicy backing off from minDelay to maxDelay
+func NewAdaptiveOpenClosedPolicy(minDelay, maxDelay time.Duration) *AdaptiveOpenClosedPolicy {
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	return &AdaptiveOpenClosedPolicy{
+		MinDelay:     minDelay,
+		MaxDelay:     maxDelay,
+		currentDelay: 0,
+	}
+}
+
+//DelayAfterSchedule returns 0 after some activity, and an exponentially increasing delay while idle
+func (a *AdaptiveOpenClosedPolicy) DelayAfterSchedule(numberOfOpenSlots int) time.Duration {
+	if numberOfOpenSlots > 0 {
+		a.currentDelay = 0
+		return 0
+	}
+
+	if a.currentDelay == 0 {
+		a.currentDelay = a.MinDelay
+	} else {
+		a.currentDelay *= 2
+	}
+	if a.currentDelay > a.MaxDelay {
+		a.currentDelay = a.MaxDelay
+	}
+	return a.currentDelay
+}
+
+//InterruptibleByActivity returns true, the back-off ends when downstream data arrives
+func (a *AdaptiveOpenClosedPolicy) InterruptibleByActivity() bool {
+	return true
+}
+
+//NotifyActivity resets the back-off
+func (a *AdaptiveOpenClosedPolicy) NotifyActivity() {
+	a.currentDelay = 0
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOpenClosedSchedulingPolicies(test *testing.T) {
+
+	min := 100 * time.Millisecond
+	max := 800 * time.Millisecond
+
+	//default policy : constant delay when idle, no delay otherwise
+	fixed, err := NewOpenClosedSchedulingPolicy("", 100, 800)
+	if err != nil {
+		test.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if fixed.DelayAfterSchedule(0) != min {
+			test.Error("Fixed policy should always sleep", min, "when idle")
+		}
+	}
+	if fixed.DelayAfterSchedule(2) != 0 {
+		test.Error("Fixed policy should not sleep when some slots are open")
+	}
+	if fixed.InterruptibleByActivity() {
+		test.Error("Fixed policy should not be interruptible")
+	}
+
+	//adaptive policy : exponential back-off, reset by activity
+	adaptive, err := NewOpenClosedSchedulingPolicy("Adaptive", 100, 800)
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := []time.Duration{min, 2 * min, 4 * min, max, max}
+	for i, e := range expected {
+		if d := adaptive.DelayAfterSchedule(0); d != e {
+			test.Error("Adaptive policy, idle schedule", i, ": expected", e, "got", d)
+		}
+	}
+	if adaptive.DelayAfterSchedule(1) != 0 {
+		test.Error("Adaptive policy should not sleep after some activity")
+	}
+	if adaptive.DelayAfterSchedule(0) != min {
+		test.Error("Adaptive policy should restart the back-off from", min)
+	}
+	adaptive.DelayAfterSchedule(0)
+	adaptive.NotifyActivity()
+	if adaptive.DelayAfterSchedule(0) != min {
+		test.Error("Adaptive policy should restart the back-off after NotifyActivity")
+	}
+	if !adaptive.InterruptibleByActivity() {
+		test.Error("Adaptive policy should be interruptible")
+	}
+
+	_, err = NewOpenClosedSchedulingPolicy("Unknown", 100, 800)
+	if err == nil {
+		test.Error("Should not accept an unknown policy")
+	}
+}
@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/utils"
+	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+/*
+ * The clients replay captures upstream (see prifi-lib/client), but most real traffic is downstream. With a downstream
+ * replay, the relay reads PCAPFolder/relay.pcap (or relay.pcapng), and injects its packets in DataForClients at the
+ * times of the capture, as if they came from the egress server : they go through the downstream scheduler, the cell
+ * packing and the UDP broadcast like any other data. As upstream, each packet starts with a meta-message (its ID and
+ * its time in the capture); the clients, told by the parameter "PCAPReplayDownstream", compute the delay of each
+ * packet with it. Typically, the options filter the inbound packets of the capture, e.g. "dst=<the client's IP>".
+ *
+ * The times are relative to time0, the end of round 0; the clients use the beginning of round 1, which is the same
+ * time up to the latency of the broadcast.
+ */
+
+// pcapReplay is the capture the relay replays downstream
+type pcapReplay struct {
+	file    string
+	options utils.PCAPReplayOptions
+}
+
+// SetPCAPReplay makes the relay replay PCAPFolder/relay.pcap (or relay.pcapng) downstream, with the given options,
+// each time the protocol starts.
+func (p *PriFiLibRelayInstance) SetPCAPReplay(pcapFolder string, options utils.PCAPReplayOptions) error {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	if options.TimeScale < 0 {
+		return errors.New("Relay : the PCAP time scale cannot be negative")
+	}
+	file := pcapFolder + "relay.pcap"
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		file += "ng"
+	}
+	if _, err := os.Stat(file); err != nil {
+		return errors.New("Cannot replay " + pcapFolder + "relay.pcap(ng), error is " + err.Error())
+	}
+	p.relayState.pcapReplay = &pcapReplay{
+		file:    file,
+		options: options,
+	}
+	return nil
+}
+
+// startPCAPReplay starts replaying the capture, if any, relatively to time0. It stops with the session.
+func (p *PriFiLibRelayInstance) startPCAPReplay() {
+	replay := p.relayState.pcapReplay
+	if replay == nil {
+		return
+	}
+
+	cellSize := p.relayState.DownstreamCellSize
+	if cellSize < 1 {
+		log.Error("Relay : cannot replay the capture downstream, DownstreamCellSize is", cellSize)
+		return
+	}
+	packets, err := utils.ParsePCAPWithOptions(replay.file, cellSize, replay.options)
+	if err != nil {
+		log.Error("Relay : cannot replay the capture downstream,", err)
+		return
+	}
+	log.Lvl1("Relay : replaying", len(packets), "packets of", replay.file, "downstream")
+
+	tagged := p.relayState.downstreamScheduler != nil
+	go replayPCAPDownstream(p.relayState.sessionCtx, packets, p.relayState.time0, cellSize, tagged, p.relayState.DataForClients)
+}
+
+// replayPCAPDownstream sends the packets in dataForClients at their time since time0, until they are all sent or ctx
+// is cancelled. If tagged, the cells are tagged for the downstream scheduler, as interactive traffic.
+func replayPCAPDownstream(ctx context.Context, packets []utils.Packet, time0 uint64, cellSize int, tagged bool, dataForClients chan []byte) {
+	for len(packets) > 0 {
+		relativeNow := uint64(prifilog.MsTimeStampNow()) - time0
+
+		//wait for the next packet
+		if next := packets[0].MsSinceBeginningOfCapture; next > relativeNow {
+			timer := time.NewTimer(time.Duration(next-relativeNow) * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+
+		var cell []byte
+		cell, packets = nextPCAPCell(packets, relativeNow, cellSize)
+		if tagged {
+			cell = stream_multiplexer.TagFrame(stream_multiplexer.QOS_CLASS_INTERACTIVE, cell)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case dataForClients <- cell:
+		}
+	}
+	log.Lvl1("Relay : replayed all the packets of the capture downstream")
+}
+
+// nextPCAPCell packs the first packets due at relativeNow in a cell of at most cellSize bytes (but at least one
+// packet), and returns it with the packets left. As upstream, the cell is as long as the packets it replays, even if
+// they only contain their meta-message.
+func nextPCAPCell(packets []utils.Packet, relativeNow uint64, cellSize int) ([]byte, []utils.Packet) {
+	cell := make([]byte, 0)
+	realLength := 0
+	for i, packet := range packets {
+		if i > 0 && (packet.MsSinceBeginningOfCapture > relativeNow || realLength+packet.RealLength > cellSize) {
+			return padPCAPCell(cell, realLength), packets[i:]
+		}
+		cell = append(cell, packet.Header...)
+		realLength += packet.RealLength
+	}
+	return padPCAPCell(cell, realLength), packets[len(packets):]
+}
+
+// padPCAPCell pads the meta-messages in cell with zeros, up to the real length of the packets
+func padPCAPCell(cell []byte, realLength int) []byte {
+	if len(cell) < realLength {
+		cell = append(cell, make([]byte, realLength-len(cell))...)
+	}
+	return cell
+}
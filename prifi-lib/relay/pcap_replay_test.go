@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/utils"
+	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+)
+
+// pcapPacket returns a replayed packet, whose header is its ID
+func pcapPacket(id uint32, ms uint64, realLength int) utils.Packet {
+	return utils.Packet{ID: id, MsSinceBeginningOfCapture: ms, Header: []byte{byte(id)}, RealLength: realLength}
+}
+
+func TestNextPCAPCell(t *testing.T) {
+	packets := []utils.Packet{pcapPacket(1, 0, 10), pcapPacket(2, 5, 20), pcapPacket(3, 5, 30), pcapPacket(4, 50, 10)}
+
+	//the packets due are packed, up to the cell size, and padded to their real length
+	cell, left := nextPCAPCell(packets, 10, 40)
+	if len(cell) != 30 || cell[0] != 1 || cell[1] != 2 || cell[2] != 0 {
+		t.Error("Wrong cell", cell)
+	}
+	if len(left) != 2 || left[0].ID != 3 {
+		t.Error("Wrong packets left", left)
+	}
+
+	//the packets in the future wait
+	cell, left = nextPCAPCell(left, 10, 100)
+	if len(cell) != 30 || cell[0] != 3 || len(left) != 1 {
+		t.Error("Should not pack the packets which are not due", cell, left)
+	}
+
+	//a packet bigger than a cell is sent alone
+	cell, left = nextPCAPCell([]utils.Packet{pcapPacket(5, 0, 50), pcapPacket(6, 0, 1)}, 10, 40)
+	if len(cell) != 50 || len(left) != 1 {
+		t.Error("Should send a big packet alone", cell, left)
+	}
+}
+
+func TestReplayPCAPDownstream(t *testing.T) {
+	time0 := uint64(prifilog.MsTimeStampNow())
+	packets := []utils.Packet{pcapPacket(1, 0, 10), pcapPacket(2, 0, 10), pcapPacket(3, 100, 10), pcapPacket(4, 10000, 10)}
+	dataForClients := make(chan []byte)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		replayPCAPDownstream(ctx, packets, time0, 100, true, dataForClients)
+		done <- true
+	}()
+
+	//the first packets are due now, in one tagged cell
+	class, cell := stream_multiplexer.UntagFrame(<-dataForClients)
+	if class != stream_multiplexer.QOS_CLASS_INTERACTIVE || len(cell) != 20 || cell[0] != 1 || cell[1] != 2 {
+		t.Error("Wrong first cell", class, cell)
+	}
+
+	//the next one at its time in the capture
+	_, cell = stream_multiplexer.UntagFrame(<-dataForClients)
+	if elapsed := uint64(prifilog.MsTimeStampNow()) - time0; cell[0] != 3 || elapsed < 100 {
+		t.Error("Wrong second cell, or sent too early", cell, elapsed)
+	}
+
+	//the replay stops with the session
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("The replay should stop when its context is cancelled")
+	}
+}
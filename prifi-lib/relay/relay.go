@@ -18,6 +18,8 @@ Then, this file simple handle the answer to the different message kind :
 - CLI_REL_UPSTREAM_DATA - data for the DC-net
 - REL_CLI_UDP_DOWNSTREAM_DATA - is NEVER received here, but casted to CLI_REL_UPSTREAM_DATA by messages.go
 - TRU_REL_DC_CIPHER - data for the DC-net
+- CLI_REL_DOWNSTREAM_NACK - a client missed some downstream rounds, we retransmit them over TCP
+- ALL_REL_RESYNC - (local) change some parameters of the running protocol, see resync.go
 
 local functions :
 
@@ -32,6 +34,7 @@ considered disconnected
 */
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"strconv"
@@ -40,6 +43,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"github.com/dedis/prifi/prifi-lib/audit"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
@@ -73,7 +77,9 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_SHUTDOWN(msg net.ALL_ALL_SHUTDO
 		p.messageSender.SendToClientWithLog(j, msg2, "")
 	}
 
-	// TODO : stop all go-routines we created
+	// stop all go-routines we created (timeouts, downstream senders)
+	p.Stop()
+	p.relayState.downstreamFanOut = nil
 
 	return err
 }
@@ -95,21 +101,46 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	reportingLimit := msg.IntValueOrElse("ExperimentRoundLimit", p.relayState.ExperimentRoundLimit)
 	useUDP := msg.BoolValueOrElse("UseUDP", p.relayState.UseUDP)
 	dcNetType := msg.StringValueOrElse("DCNetType", p.relayState.dcNetType)
-	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
+	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
 	openClosedSlotsMinDelayBetweenRequests := msg.IntValueOrElse("OpenClosedSlotsMinDelayBetweenRequests", p.relayState.OpenClosedSlotsMinDelayBetweenRequests)
+	openClosedSlotsMaxDelayBetweenRequests := msg.IntValueOrElse("OpenClosedSlotsMaxDelayBetweenRequests", p.relayState.OpenClosedSlotsMaxDelayBetweenRequests)
+	openClosedSlotsPolicy := msg.StringValueOrElse("OpenClosedSlotsPolicy", p.relayState.OpenClosedSlotsPolicy)
 	maxNumberOfConsecutiveFailedRounds := msg.IntValueOrElse("RelayMaxNumberOfConsecutiveFailedRounds", p.relayState.MaxNumberOfConsecutiveFailedRounds)
 	processingLoopSleepTime := msg.IntValueOrElse("RelayProcessingLoopSleepTime", p.relayState.ProcessingLoopSleepTime)
 	roundTimeOut := msg.IntValueOrElse("RelayRoundTimeOut", p.relayState.RoundTimeOut)
 	trusteeCacheLowBound := msg.IntValueOrElse("RelayTrusteeCacheLowBound", p.relayState.TrusteeCacheLowBound)
 	trusteeCacheHighBound := msg.IntValueOrElse("RelayTrusteeCacheHighBound", p.relayState.TrusteeCacheHighBound)
 	equivocationProtectionEnabled := msg.BoolValueOrElse("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
+	udpFECGroupSize := msg.IntValueOrElse("UDPFECGroupSize", p.relayState.UDPFECGroupSize)
+	adaptiveWindow := msg.BoolValueOrElse("AdaptiveWindow", p.relayState.AdaptiveWindow)
+	downstreamQoSWeights := msg.StringValueOrElse("DownstreamQoSWeights", p.relayState.DownstreamQoSWeights)
+	downstreamFanOutQueueSize := msg.IntValueOrElse("DownstreamFanOutQueueSize", p.relayState.DownstreamFanOutQueueSize)
 
 	if payloadSize < 1 {
 		return errors.New("payloadSize cannot be 0")
 	}
+	if udpFECGroupSize < 0 {
+		return errors.New("UDPFECGroupSize cannot be negative")
+	}
+	if downstreamFanOutQueueSize < 0 {
+		return errors.New("DownstreamFanOutQueueSize cannot be negative")
+	}
+	var downstreamScheduler *DownstreamScheduler
+	if downstreamQoSWeights != "" {
+		weights, err := ParseQoSWeights(downstreamQoSWeights)
+		if err != nil {
+			return err
+		}
+		downstreamScheduler = NewDownstreamScheduler(weights)
+	}
+	openClosedPolicy, err := NewOpenClosedSchedulingPolicy(openClosedSlotsPolicy, openClosedSlotsMinDelayBetweenRequests, openClosedSlotsMaxDelayBetweenRequests)
+	if err != nil {
+		return err
+	}
 
 	p.relayState.clients = make([]NodeRepresentation, nClients)
 	p.relayState.trustees = make([]NodeRepresentation, nTrustees)
+	p.relayState.authenticator.ResetPeerKeys() // the IDs are re-assigned, the participants tell their keys again
 	p.relayState.nClients = nClients
 	p.relayState.nTrustees = nTrustees
 	p.relayState.nTrusteesPkCollected = 0
@@ -124,12 +155,40 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	p.relayState.WindowSize = windowSize
 	p.relayState.numberOfNonAckedDownstreamPackets = 0
 	p.relayState.OpenClosedSlotsMinDelayBetweenRequests = openClosedSlotsMinDelayBetweenRequests
+	p.relayState.OpenClosedSlotsMaxDelayBetweenRequests = openClosedSlotsMaxDelayBetweenRequests
+	p.relayState.OpenClosedSlotsPolicy = openClosedSlotsPolicy
+	p.relayState.openClosedPolicy = openClosedPolicy
+	p.relayState.openClosedBackOff = false
 	p.relayState.MaxNumberOfConsecutiveFailedRounds = maxNumberOfConsecutiveFailedRounds
 	p.relayState.ProcessingLoopSleepTime = processingLoopSleepTime
 	p.relayState.RoundTimeOut = roundTimeOut
 	p.relayState.TrusteeCacheLowBound = trusteeCacheLowBound
 	p.relayState.TrusteeCacheHighBound = trusteeCacheHighBound
 	p.relayState.EquivocationProtectionEnabled = equivocationProtectionEnabled
+	p.relayState.UDPFECGroupSize = udpFECGroupSize
+	p.relayState.fecEncoder = net.NewFECEncoder(udpFECGroupSize)
+	p.relayState.fecStatistics = prifilog.NewFECStatistics()
+	p.relayState.AdaptiveWindow = adaptiveWindow
+	p.relayState.windowController = NewWindowController(windowSize, trusteeCacheLowBound, trusteeCacheHighBound)
+	p.relayState.DownstreamQoSWeights = downstreamQoSWeights
+	p.relayState.downstreamScheduler = downstreamScheduler
+	p.relayState.DownstreamFanOutQueueSize = downstreamFanOutQueueSize
+	if p.relayState.cancelSession != nil {
+		p.relayState.cancelSession() // stops the timeouts and the downstream senders of the previous configuration
+	}
+	p.relayState.sessionCtx, p.relayState.cancelSession = context.WithCancel(p.ctx)
+	p.relayState.downstreamFanOut = nil
+	if downstreamFanOutQueueSize > 0 && !useUDP {
+		sendFn := func(clientID int, msg *net.REL_CLI_DOWNSTREAM_DATA, extraInfos string) bool {
+			return p.messageSender.SendToClientWithLog(clientID, msg, extraInfos)
+		}
+		overflowFn := func(clientID int) {
+			log.Error("Relay : client", clientID, "cannot keep up with the downstream data, treating it as timed-out")
+			//we are sending a round, under the processing lock : the handler must not delay it, nor wait for the lock
+			go p.relayState.timeoutHandler([]int{clientID}, []int{})
+		}
+		p.relayState.downstreamFanOut = NewDownstreamFanOut(p.relayState.sessionCtx, nClients, downstreamFanOutQueueSize, sendFn, overflowFn)
+	}
 	p.relayState.MessageHistory = config.CryptoSuite.XOF([]byte("init")) //any non-nil, non-empty, constant array
 	p.relayState.VerifiableDCNetKeys = make([][]byte, nTrustees)
 	p.relayState.nVkeysCollected = 0
@@ -140,7 +199,11 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	p.relayState.clientBitMap = make(map[int]map[int]int)
 	p.relayState.trusteeBitMap = make(map[int]map[int]int)
 	p.relayState.blamingData = make([]int, 6)
+	p.relayState.blameSecretsAsked = false
+	p.relayState.pastRounds = make(map[int32]*pastRound)
+	p.relayState.slotMACKeys = nil
 	p.relayState.OpenClosedSlotsRequestsRoundID = make(map[int32]bool)
+	p.relayState.shuffleResult = nil
 
 	switch dcNetType {
 	case "Verifiable":
@@ -148,18 +211,16 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	}
 
 	//this should be in NewRelayState, but we need p
-	if !p.relayState.roundManager.DoSendStopResumeMessages {
-		//Add rate-limiting component to buffer manager
-
-		stopFn := func(trusteeID int) {
-			toSend := &net.REL_TRU_TELL_RATE_CHANGE{WindowCapacity: 0}
-			p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "(trustee "+strconv.Itoa(trusteeID)+")")
+	if !p.relayState.roundManager.DoSendCredits && p.relayState.TrusteeCacheHighBound > 0 {
+		//Add credit-based flow control to buffer manager
+		grantFn := func(trusteeID int, roundID int32, credit int) {
+			toSend := &net.REL_TRU_TELL_RATE_CHANGE{RoundID: roundID, WindowCapacity: credit}
+			p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "(trustee "+strconv.Itoa(trusteeID)+", rounds < "+strconv.Itoa(int(roundID)+credit)+")")
 		}
-		resumeFn := func(trusteeID int) {
-			toSend := &net.REL_TRU_TELL_RATE_CHANGE{WindowCapacity: 1}
-			p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "(trustee "+strconv.Itoa(trusteeID)+")")
+		err := p.relayState.roundManager.AddCreditLimiter(p.relayState.TrusteeCacheLowBound, p.relayState.TrusteeCacheHighBound, grantFn)
+		if err != nil {
+			return err
 		}
-		p.relayState.roundManager.AddRateLimiter(p.relayState.TrusteeCacheLowBound, p.relayState.TrusteeCacheHighBound, stopFn, resumeFn)
 	}
 
 	log.Lvlf3("Relay new state: %+v\n", p.relayState)
@@ -192,6 +253,9 @@ func (p *PriFiLibRelayInstance) BroadcastParameters() error {
 	msg.Add("DCNetType", p.relayState.dcNetType)
 	msg.Add("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
 	msg.Add("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
+	msg.Add("TrusteeInitialCredit", p.relayState.TrusteeCacheHighBound)
+	msg.RelayPk = p.relayState.PublicKey
+	msg.StandbyRelayPk = p.relayState.standbyRelayPk
 	msg.ForceParams = true
 
 	// Send those parameters to all trustees
@@ -228,6 +292,11 @@ If it's for this round, we call decode on it, and remember we received it.
 If for a future round we need to Buffer it.
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_DC_CIPHER(msg net.TRU_REL_DC_CIPHER) error {
+	if msg.TrusteeID < 0 || msg.TrusteeID >= p.relayState.nTrustees {
+		// e.g., a trustee parked by a resync, which had not yet received the news
+		log.Lvl2("Relay : dropping a cipher from trustee", msg.TrusteeID, ", which is not part of the current configuration")
+		return nil
+	}
 	p.relayState.roundManager.AddTrusteeCipher(msg.RoundID, msg.TrusteeID, msg.Data)
 	if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 		p.upstreamPhase1_processCiphers(true)
@@ -247,6 +316,45 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_OPENCLOSED_DATA(msg net.CLI_REL
 	return nil
 }
 
+// Received_CLI_REL_DOWNSTREAM_NACK handles the reception of a NACK, sent by a client who missed some downstream
+// rounds (typically lost UDP broadcasts). If the rounds are still open, we retransmit them via unicast (TCP) to this client
+func (p *PriFiLibRelayInstance) Received_CLI_REL_DOWNSTREAM_NACK(msg net.CLI_REL_DOWNSTREAM_NACK) error {
+
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients {
+		e := "Relay : received a NACK from unknown client " + strconv.Itoa(msg.ClientID)
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	if msg.FECRecovered < 0 {
+		e := "Relay : received a NACK from client " + strconv.Itoa(msg.ClientID) + " with a negative count of recovered rounds"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	//with FEC, clients only NACK the losses they could not recover, and count the ones they rebuilt since their last NACK
+	if p.relayState.UDPFECGroupSize > 0 {
+		p.relayState.fecStatistics.AddRecovered(msg.FECRecovered)
+		p.relayState.fecStatistics.AddUnrecoverable(len(msg.RoundIDs))
+		p.relayState.fecStatistics.ReportWithInfo("relay")
+	}
+
+	for _, roundID := range msg.RoundIDs {
+		data, found := p.relayState.roundManager.GetDataAlreadySentIfAny(roundID)
+		if !found || data == nil {
+			log.Lvl2("Relay : client", msg.ClientID, "asked for retransmission of round", roundID, "but it is not open anymore, ignoring.")
+			continue
+		}
+
+		log.Lvl2("Relay : retransmitting round", roundID, "to client", msg.ClientID)
+		if p.messageSender.SendToClientWithLog(msg.ClientID, data, "(retransmission, client "+strconv.Itoa(msg.ClientID)+", round "+strconv.Itoa(int(roundID))+")") {
+			p.relayState.bitrateStatistics.AddDownstreamRetransmitCell(int64(len(data.Data)))
+		}
+	}
+
+	return nil
+}
+
 // upstreamPhase1_processCiphers collects all DC-net ciphers, and decides what to do with them (is it a OCMap message ?
 // a data message ?)
 // it then proceed accordingly, finalizes the round, and calls downstreamPhase_sendMany()
@@ -282,14 +390,26 @@ func (p *PriFiLibRelayInstance) upstreamPhase1_processCiphers(finishedByTrustee
 	// used if we're replaying a pcap. The first message we decode is "time0"
 	if roundID == 0 {
 		p.relayState.time0 = uint64(prifilog.MsTimeStampNow())
+		p.startPCAPReplay()
 	}
 
+	// must be measured before the round is closed
+	timeSpentInRound := p.relayState.roundManager.TimeSpentInRound(roundID)
+
 	// one round has just passed ! Round start with downstream data, and end with upstream data, like here.
 	p.upstreamPhase3_finalizeRound(roundID)
 
+	// adapt the number of concurrent rounds
+	if p.relayState.AdaptiveWindow {
+		minBuffer, maxBuffer := p.relayState.roundManager.TrusteeBufferLevels()
+		p.relayState.windowController.RoundFinished(timeSpentInRound, finishedByTrustee, minBuffer, maxBuffer)
+	}
+
 	// inter-round sleep
 	if p.relayState.ProcessingLoopSleepTime > 0 {
-		time.Sleep(time.Duration(p.relayState.ProcessingLoopSleepTime) * time.Millisecond)
+		if !utils.SleepOrCancel(p.ctx, time.Duration(p.relayState.ProcessingLoopSleepTime)*time.Millisecond) {
+			return
+		}
 	}
 
 	// downstream phase
@@ -299,9 +419,19 @@ func (p *PriFiLibRelayInstance) upstreamPhase1_processCiphers(finishedByTrustee
 // downstreamPhase_sendMany starts as many rounds (by opening the round and sending downstream data) as specified
 // by the window
 func (p *PriFiLibRelayInstance) downstreamPhase_sendMany() {
-	// send the data down
-	for i := p.relayState.numberOfNonAckedDownstreamPackets; i < p.relayState.WindowSize; i++ {
-		log.Lvl3("Relay : Gonna send, non-acked packets is", p.relayState.numberOfNonAckedDownstreamPackets, "(window is", p.relayState.WindowSize, ")")
+	windowSize := p.relayState.WindowSize
+	if p.relayState.AdaptiveWindow {
+		windowSize = p.relayState.windowController.WindowSize()
+	}
+
+	// after a schedule with all slots closed, waitBeforeNextSchedule opens the next rounds
+	if p.relayState.openClosedBackOff {
+		return
+	}
+
+	// send the data down (unless we just started a resync)
+	for i := p.relayState.numberOfNonAckedDownstreamPackets; i < windowSize && p.stateMachine.State() == "COMMUNICATING"; i++ {
+		log.Lvl3("Relay : Gonna send, non-acked packets is", p.relayState.numberOfNonAckedDownstreamPackets, "(window is", windowSize, ")")
 		p.downstreamPhase1_openRoundAndSendData()
 	}
 }
@@ -323,6 +453,7 @@ func (p *PriFiLibRelayInstance) upstreamPhase2a_extractOCMap(roundID int32) erro
 
 	//here we have the plaintext map
 	openClosedData := p.relayState.DCNet.DecodeCell()
+	p.auditRound(roundID, openClosedData, audit.CHECK_DISABLED, nil, nil)
 
 	//compute the map
 	newSchedule := p.relayState.slotScheduler.Relay_ComputeFinalSchedule(openClosedData, p.relayState.nClients)
@@ -330,22 +461,62 @@ func (p *PriFiLibRelayInstance) upstreamPhase2a_extractOCMap(roundID int32) erro
 	p.relayState.schedulesStatistics.AddSchedule(newSchedule)
 
 	// if all slots are closed, do not immediately send the next downstream data (which will be a OCSlots schedule)
-	hasOpenSlot := false
+	numberOfOpenSlots := 0
 	for _, v := range newSchedule {
 		if v {
-			hasOpenSlot = true
-			break
+			numberOfOpenSlots++
 		}
 	}
-	if !hasOpenSlot {
-		log.Lvl3("All slots closed, sleeping for", p.relayState.OpenClosedSlotsMinDelayBetweenRequests, "ms")
-		d := time.Duration(p.relayState.OpenClosedSlotsMinDelayBetweenRequests) * time.Millisecond
-		time.Sleep(d)
+	d := p.relayState.openClosedPolicy.DelayAfterSchedule(numberOfOpenSlots)
+	if d > 0 {
+		log.Lvl3("All slots closed, waiting for", d, "before opening the next rounds")
+		p.relayState.openClosedBackOff = true
+		go p.waitBeforeNextSchedule(p.relayState.sessionCtx, d, p.relayState.openClosedPolicy.InterruptibleByActivity())
 	}
 
 	return nil
 }
 
+// waitBeforeNextSchedule waits for d without holding the processing lock (the messages of the rounds in flight are
+// still processed), then opens the next rounds. If "interruptible", it wakes up as soon as there is downstream data
+// for the clients. If the relay is stopped or re-initialized meanwhile (i.e., "ctx" is cancelled), it does nothing
+func (p *PriFiLibRelayInstance) waitBeforeNextSchedule(ctx context.Context, d time.Duration, interruptible bool) {
+	activity := false
+	if !interruptible {
+		if !utils.SleepOrCancel(ctx, d) {
+			return
+		}
+	} else {
+		deadline := time.Now().Add(d)
+		for {
+			activity = len(p.relayState.DataForClients) > 0 || len(p.relayState.PriorityDataForClients) > 0
+			remaining := deadline.Sub(time.Now())
+			if activity || remaining <= 0 {
+				break
+			}
+			if remaining > OPEN_CLOSED_POLICY_POLLING_PERIOD {
+				remaining = OPEN_CLOSED_POLICY_POLLING_PERIOD
+			}
+			if !utils.SleepOrCancel(ctx, remaining) {
+				return
+			}
+		}
+	}
+
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	if ctx.Err() != nil || !p.relayState.openClosedBackOff {
+		return
+	}
+	if activity {
+		log.Lvl3("Downstream data arrived, ending the open/closed back-off")
+		p.relayState.openClosedPolicy.NotifyActivity()
+	}
+	p.relayState.openClosedBackOff = false
+	p.downstreamPhase_sendMany()
+}
+
 // upstreamPhase2b_extractPayload is called when we know the payload is data (and not an OCMap message)
 // If enabled, it checks the Disruption protection, and perhaps starts a blame
 // If it's a latency-test message, we send it back to the clients.
@@ -368,22 +539,32 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 		p.relayState.DCNet.DecodeTrustee(roundID, s)
 	}
 	upstreamPlaintext := p.relayState.DCNet.DecodeCell()
+	decodedCell := upstreamPlaintext
 
 	p.relayState.bitrateStatistics.AddUpstreamCell(int64(len(upstreamPlaintext)))
 
 	//disruption-protection
+	disruptionCheck := audit.CHECK_DISABLED
 	if p.relayState.DisruptionProtectionEnabled {
-
 		log.Lvl3("Verifying HMAC for disruption protection")
-		hmac := upstreamPlaintext[0:32]
+		disruptionCheck = p.checkDisruption(roundID, clientSlices, trusteesSlices, decodedCell)
 		upstreamPlaintext = upstreamPlaintext[32:]
+	}
 
-		clientID := -1 // todo loop with the schedule
-		valid := ValidateHmac256(upstreamPlaintext, hmac, clientID)
+	p.auditRound(roundID, decodedCell, disruptionCheck, nil, nil)
 
-		if !valid {
-			// start blame
-			log.Error("Warning: Disruption Protection check failed")
+	if disruptionCheck == audit.CHECK_FAILED {
+		// the cell was corrupted, we do not forward it (the owner of the slot may blame it, see disruption.go)
+		return errors.New("Relay : round " + strconv.Itoa(int(roundID)) + " failed the disruption check")
+	}
+	if disruptionCheck == audit.CHECK_PASSED {
+		// a blame is sent in the slot of its sender, like data
+		if blame, isBlame := net.DisruptionBlameFromCell(upstreamPlaintext); isBlame {
+			err := p.receivedBlame(p.relayState.pastRounds[roundID].owner, blame)
+			if err == nil {
+				return nil
+			}
+			log.Lvl2("Relay : the cell of round", roundID, "looks like a blame, but is not;", err)
 		}
 	}
 
@@ -397,45 +578,18 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 			// then, we simply have to send it down
 			// log.Info("Relay noticed a latency-test message on round", p.relayState.dcnetRoundManager.CurrentRound())
 			p.relayState.PriorityDataForClients <- upstreamPlaintext
-		} else if pattern == 21845 {
-			//0101010101010101
-			ID := int32(binary.BigEndian.Uint32(upstreamPlaintext[2:6]))
-			timestamp := int64(binary.BigEndian.Uint64(upstreamPlaintext[6:14]))
-			frag := false
-			if upstreamPlaintext[14] == byte(1) {
-				frag = true
-			}
-			now := prifilog.MsTimeStampNow() - int64(p.relayState.time0)
-			diff := now - timestamp
-
-			log.Lvl2("Got a PCAP meta-message (id", ID, ",frag", frag, ") at", now, ", delay since original is", diff, "ms")
-			p.relayState.timeStatistics["pcap-delay"].AddTime(diff)
-			p.relayState.pcapLogger.ReceivedPcap(uint32(ID), frag, uint64(timestamp), p.relayState.time0, uint32(len(upstreamPlaintext)))
-
-			//also decode other messages
-			pos := 15
-			for pos+15 <= len(upstreamPlaintext) {
-				pattern := int(binary.BigEndian.Uint16(upstreamPlaintext[pos : pos+2]))
-				if pattern != 21845 {
-					break
-				}
-				ID := int32(binary.BigEndian.Uint32(upstreamPlaintext[pos+2 : pos+6]))
-				timestamp := int64(binary.BigEndian.Uint64(upstreamPlaintext[pos+6 : pos+14]))
-				frag := false
-				if upstreamPlaintext[pos+14] == byte(1) {
-					frag = true
-				}
 
+			p.recordUpstreamLatency(upstreamPlaintext, roundID)
+		} else if pattern == 21845 {
+			//0101010101010101, one or several pcap meta-messages
+			utils.DecodePCAPMetaMessages(upstreamPlaintext, func(ID uint32, timestamp uint64, frag bool) {
 				now := prifilog.MsTimeStampNow() - int64(p.relayState.time0)
-				diff := now - timestamp
+				diff := now - int64(timestamp)
 
 				log.Lvl2("Got a PCAP meta-message (id", ID, ",frag", frag, ") at", now, ", delay since original is", diff, "ms")
 				p.relayState.timeStatistics["pcap-delay"].AddTime(diff)
-				p.relayState.pcapLogger.ReceivedPcap(uint32(ID), frag, uint64(timestamp), p.relayState.time0, uint32(len(upstreamPlaintext)))
-
-				pos += 15
-			}
-
+				p.relayState.pcapLogger.ReceivedPcap(ID, frag, timestamp, p.relayState.time0, uint32(len(upstreamPlaintext)))
+			})
 		}
 	}
 
@@ -501,6 +655,36 @@ func (p *PriFiLibRelayInstance) upstreamPhase3_finalizeRound(roundID int32) erro
 	return nil
 }
 
+// fillDownstreamScheduler moves the frames waiting in DataForClients into the downstream scheduler, until it is full
+func (p *PriFiLibRelayInstance) fillDownstreamScheduler() {
+	for !p.relayState.downstreamScheduler.IsFull() {
+		select {
+		case frame := <-p.relayState.DataForClients:
+			p.relayState.downstreamScheduler.Enqueue(frame)
+		default:
+			return
+		}
+	}
+}
+
+// recordUpstreamLatency records the latency until here of the latency messages in the cell, per client (assuming
+// synchronized clocks); the clients measure the round-trip. The ID of the client is written in the anonymous cell by
+// its sender, we only trust it to be one of our clients : a probing client tells which slot it owns (see
+// prifilog.LatencyTests)
+func (p *PriFiLibRelayInstance) recordUpstreamLatency(cell []byte, roundID int32) {
+	prifilog.DecodeLatencyMessagesPerOrigin(cell, roundID, func(clientID int, originalRoundID int32, roundDiff int32, timeDiff int64) {
+		if clientID < 0 || clientID >= p.relayState.nClients {
+			log.Lvl2("Relay : ignored a latency message of unknown client", clientID, "in round", roundID)
+			return
+		}
+		key := "upstream-latency-client-" + strconv.Itoa(clientID)
+		if _, exists := p.relayState.timeStatistics[key]; !exists {
+			p.relayState.timeStatistics[key] = prifilog.NewTimeStatistics()
+		}
+		p.relayState.timeStatistics[key].AddTime(timeDiff)
+	})
+}
+
 /*
 sendDownstreamData is simply called when the Relay has processed the upstream cell from all clients, and is ready to finalize the round by sending the data down.
 If it's a latency-test message, we send it back to the clients.
@@ -510,6 +694,14 @@ have the data already (and we're not waiting on it). Clean the old data.
 */
 func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
+	// if a resync is scheduled for this round, we tell the clients instead of sending data
+	if p.relayState.pendingResync != nil && p.relayState.roundManager.NextRoundToOpen() >= p.relayState.pendingResync.RoundID {
+		return p.downstreamPhase_sendResync()
+	}
+
+	// make sure the standby relay, if any, would not resume at a round we might use
+	p.replicateIfNeeded()
+
 	var downstreamCellContent []byte
 
 	select {
@@ -521,6 +713,15 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
 	}
 
+	// only if we don't have priority data for clients, share the cell between the streams
+	if downstreamCellContent == nil && p.relayState.downstreamScheduler != nil {
+		p.fillDownstreamScheduler()
+		downstreamCellContent = p.relayState.downstreamScheduler.Dequeue()
+		if downstreamCellContent == nil {
+			downstreamCellContent = make([]byte, 1)
+		}
+	}
+
 	// only if we don't have priority data for clients
 	if downstreamCellContent == nil {
 		select {
@@ -542,7 +743,7 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
 	nextDownstreamRoundID := p.relayState.roundManager.NextRoundToOpen()
 
-	// TODO : if something went wrong before, this flag should be used to warn the clients that the config has changed
+	// the resync rounds are sent by downstreamPhase_sendResync
 	flagResync := false
 
 	// periodically set to True so client can advertise their bitmap
@@ -569,6 +770,9 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		Data:                  downstreamCellContent,
 		FlagResync:            flagResync,
 		FlagOpenClosedRequest: flagOpenClosedRequest}
+	if err := toSend.Sign(p.relayState.privateKey); err != nil {
+		log.Error("Relay : could not sign the downstream cell for round", nextDownstreamRoundID, ",", err)
+	}
 
 	if roundOpened, _ := p.relayState.roundManager.currentRound(); !roundOpened {
 		//prepare for the next round (this empties the dc-net buffer, making them ready for a new round)
@@ -582,7 +786,12 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		// broadcast to all clients
 		for i := 0; i < p.relayState.nClients; i++ {
 			//send to the i-th client
-			p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", round "+strconv.Itoa(int(nextDownstreamRoundID))+")")
+			extraInfos := "(client " + strconv.Itoa(i) + ", round " + strconv.Itoa(int(nextDownstreamRoundID)) + ")"
+			if p.relayState.downstreamFanOut != nil {
+				p.relayState.downstreamFanOut.Send(i, toSend, extraInfos)
+			} else {
+				p.messageSender.SendToClientWithLog(i, toSend, extraInfos)
+			}
 		}
 
 		p.relayState.bitrateStatistics.AddDownstreamCell(int64(len(downstreamCellContent)))
@@ -591,6 +800,17 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		p.messageSender.BroadcastToAllClientsWithLog(toSend2, "(UDP broadcast, round "+strconv.Itoa(int(nextDownstreamRoundID))+")")
 
 		p.relayState.bitrateStatistics.AddDownstreamUDPCell(int64(len(downstreamCellContent)), p.relayState.nClients)
+
+		//if FEC is enabled, after each group of rounds, broadcast the parity
+		if parity := p.relayState.fecEncoder.AddRound(*toSend); parity != nil {
+			if err := parity.Sign(p.relayState.privateKey); err != nil {
+				log.Error("Relay : could not sign the FEC parity for round", parity.RoundID, ",", err)
+			}
+			p.messageSender.BroadcastToAllClientsWithLog(parity, "(UDP broadcast, FEC parity for rounds "+strconv.Itoa(int(parity.RoundID))+
+				"-"+strconv.Itoa(int(parity.RoundID)+parity.FECParityGroupSize-1)+")")
+			p.relayState.fecStatistics.AddParityPacket(int64(len(parity.Data)))
+			p.relayState.fecStatistics.ReportWithInfo("relay")
+		}
 	}
 
 	timeMs := timing.StopMeasure("sending-data").Nanoseconds() / 1e6
@@ -599,7 +819,7 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 	log.Lvl3("Relay is done broadcasting messages for round " + strconv.Itoa(int(nextDownstreamRoundID)) + ".")
 
 	//we just sent the data down, initiating a round. Let's prevent being blocked by a dead client
-	go p.checkIfRoundHasEndedAfterTimeOut_Phase1(nextDownstreamRoundID)
+	go p.checkIfRoundHasEndedAfterTimeOut_Phase1(p.relayState.sessionCtx, nextDownstreamRoundID)
 
 	//now relay enters a waiting state (collecting all ciphers from clients/trustees)
 	timing.StartMeasure("waiting-on-someone")
@@ -616,6 +836,7 @@ We do nothing, until we have received one per trustee; Then, we pack them in one
 func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_PK(msg net.TRU_REL_TELL_PK) error {
 
 	p.relayState.trustees[msg.TrusteeID] = NodeRepresentation{msg.TrusteeID, true, msg.Pk, msg.Pk}
+	p.relayState.authenticator.SetPeerKey(net.PEER_TRUSTEE, msg.TrusteeID, msg.Pk)
 	p.relayState.nTrusteesPkCollected++
 
 	log.Lvl2("Relay : received TRU_REL_TELL_PK (" + strconv.Itoa(p.relayState.nTrusteesPkCollected) + "/" + strconv.Itoa(p.relayState.nTrustees) + ")")
@@ -639,7 +860,12 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_PK(msg net.TRU_REL_TELL_PK
 		toSend.Add("DCNetType", p.relayState.dcNetType)
 		toSend.Add("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
 		toSend.Add("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
+		toSend.Add("UDPFECGroupSize", p.relayState.UDPFECGroupSize)
+		toSend.Add("PCAPReplayDownstream", p.relayState.pcapReplay != nil)
 		toSend.TrusteesPks = trusteesPk
+		toSend.RelayPk = p.relayState.PublicKey
+		toSend.StandbyRelayPk = p.relayState.standbyRelayPk
+		toSend.ForceParams = p.relayState.resyncInProgress // clients which missed the FlagResync are still communicating
 
 		// Send those parameters to all clients
 		for j := 0; j < p.relayState.nClients; j++ {
@@ -662,6 +888,7 @@ and send them to the first trustee for it to Neff-Shuffle them.
 func (p *PriFiLibRelayInstance) Received_CLI_REL_TELL_PK_AND_EPH_PK(msg net.CLI_REL_TELL_PK_AND_EPH_PK) error {
 
 	p.relayState.clients[msg.ClientID] = NodeRepresentation{msg.ClientID, true, msg.Pk, msg.EphPk}
+	p.relayState.authenticator.SetPeerKey(net.PEER_CLIENT, msg.ClientID, msg.Pk)
 	p.relayState.nClientsPkCollected++
 
 	log.Lvl2("Relay : received CLI_REL_TELL_PK_AND_EPH_PK (" + strconv.Itoa(p.relayState.nClientsPkCollected) + "/" + strconv.Itoa(p.relayState.nClients) + ")")
@@ -688,8 +915,10 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_TELL_PK_AND_EPH_PK(msg net.CLI_
 
 		//todo: fix this. The neff shuffle now stores twices the ephemeral public keys
 		toSend.Pks = make([]kyber.Point, p.relayState.nClients)
+		toSend.ClientsEphPks = make([]kyber.Point, p.relayState.nClients)
 		for i := 0; i < p.relayState.nClients; i++ {
 			toSend.Pks[i] = p.relayState.clients[i].PublicKey
+			toSend.ClientsEphPks[i] = p.relayState.clients[i].EphemeralPublicKey
 		}
 
 		// send to the 1st trustee
@@ -733,8 +962,10 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 
 		//todo: fix this. The neff shuffle now stores twices the ephemeral public keys
 		toSend.Pks = make([]kyber.Point, p.relayState.nClients)
+		toSend.ClientsEphPks = make([]kyber.Point, p.relayState.nClients)
 		for i := 0; i < p.relayState.nClients; i++ {
 			toSend.Pks[i] = p.relayState.clients[i].PublicKey
+			toSend.ClientsEphPks[i] = p.relayState.clients[i].EphemeralPublicKey
 		}
 
 		// send to the i-th trustee
@@ -762,7 +993,7 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 		}
 
 		p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, p.relayState.PayloadSize,
-			p.relayState.EquivocationProtectionEnabled, nil)
+			p.relayState.EquivocationProtectionEnabled, nil, nil)
 
 		// prepare to collect the ciphers
 		p.relayState.DCNet.DecodeStart(0)
@@ -806,10 +1037,16 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_SHUFFLE_SIG(msg net.TRU_REL_SHU
 			return errors.New(e)
 		}
 		msg := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
+		if p.relayState.DisruptionProtectionEnabled {
+			p.keySlots(msg)
+		}
+		p.relayState.shuffleResult = msg
+		p.relayState.pastRounds = make(map[int32]*pastRound)
 		// changing state
 		p.relayState.roundManager.OpenNextRound()
 		log.Lvl2("Relay : ready to communicate.")
 		p.stateMachine.ChangeState("COMMUNICATING")
+		p.relayState.resyncInProgress = false
 
 		timing.StopMeasureAndLogWithInfo("resync-shuffle-trustee-2step", strconv.Itoa(p.relayState.nClients))
 		timing.StopMeasureAndLogWithInfo("resync-shuffle", strconv.Itoa(p.relayState.nClients))
@@ -823,14 +1060,18 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_SHUFFLE_SIG(msg net.TRU_REL_SHU
 
 		//client will answer will CLI_REL_UPSTREAM_DATA. There is no data down on round 0. We set the following variable to 1 since the reception of CLI_REL_UPSTREAM_DATA decrements it.
 		p.relayState.numberOfNonAckedDownstreamPackets = 1
+
+		// the pseudonyms changed, the standby relay needs them
+		if p.relayState.replicationHandler != nil {
+			p.replicate()
+		}
 	}
 
 	return nil
 }
 
-// ValidateHmac256 returns true iff the recomputed HMAC is equal to the given one
-func ValidateHmac256(message, inputHmac []byte, clientID int) bool {
-	key := []byte("client-secret" + strconv.Itoa(clientID)) // quick hack, this should be a random shared secret
+// ValidateHmac256 returns true iff the recomputed HMAC (keyed with the key of the slot, see keySlots) is equal to the given one
+func ValidateHmac256(message, inputHmac, key []byte) bool {
 	h := hmac.New(sha256.New, key)
 	h.Write(message)
 	computedHmac := h.Sum(nil)
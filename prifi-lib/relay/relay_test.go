@@ -2,15 +2,20 @@ package relay
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"github.com/dedis/prifi/prifi-lib/audit"
 	"github.com/dedis/prifi/prifi-lib/client"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/kyber.v2"
 	"gopkg.in/dedis/kyber.v2/sign/schnorr"
 	"gopkg.in/dedis/onet.v2/log"
+	"runtime"
 	"strconv"
 	"sync"
 	"testing"
@@ -48,7 +53,7 @@ func (t *TestMessageSender) SendToRelay(msg interface{}) error {
 func (t *TestMessageSender) BroadcastToAllClients(msg interface{}) error {
 	return t.SendToClient(0, msg)
 }
-func (t *TestMessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+func (t *TestMessageSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
 	return errors.New("Not for relay")
 }
 
@@ -230,11 +235,11 @@ func TestRelayRun1(t *testing.T) {
 	if rs.TrusteeCacheHighBound != 15 {
 		t.Error("TrusteeCacheHighBound should be 15")
 	}
-	if rs.roundManager.resumeFunction == nil {
-		t.Error("bufferManager.resumeFunction was not set correctly")
+	if rs.roundManager.grantFunction == nil {
+		t.Error("bufferManager.grantFunction was not set correctly")
 	}
-	if rs.roundManager.stopFunction == nil {
-		t.Error("bufferManager.stopFunction was not set correctly")
+	if !rs.roundManager.DoSendCredits || rs.roundManager.CreditOfTrustee(0) != 15 {
+		t.Error("bufferManager credit limiter was not set correctly")
 	}
 	if relay.stateMachine.State() != "COLLECTING_TRUSTEES_PKS" {
 		t.Error("In wrong state ! we should be in COLLECTING_TRUSTEES_PKS, but are in ", relay.stateMachine.State())
@@ -287,6 +292,9 @@ func TestRelayRun1(t *testing.T) {
 	}
 	msg5 := msg4.(*net.ALL_ALL_PARAMETERS)
 
+	if msg5.RelayPk == nil || !msg5.RelayPk.Equal(relay.relayState.PublicKey) {
+		t.Error("RelayPk not set correctly")
+	}
 	if msg5.ParamsInt["NClients"] != nClients {
 		t.Error("nClients not set correctly")
 	}
@@ -881,6 +889,9 @@ func TestRelayRun3(t *testing.T) {
 	if !bytes.Equal(msg20.Data[0:12], latencyMessage) {
 		t.Error("Relay should re-send latency messages")
 	}
+	if err := msg20.VerifySignature(relay.relayState.PublicKey); err != nil {
+		t.Error("Relay should sign the downstream data, but", err)
+	}
 
 	msg21 := net.CLI_REL_UPSTREAM_DATA{
 		ClientID: 1,
@@ -1005,3 +1016,965 @@ func TestRelayRun4(t *testing.T) {
 		t.Error("Relay should output an error when DCNetType != {Simple, Verifiable}")
 	}
 }
+
+func TestRelayResync(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { t.Error("Relay should not time out", clients, trustees) }
+	resultChan := make(chan interface{}, 1)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+	dataForClients := make(chan []byte, 6)
+	dataFromDCNet := make(chan []byte, 3)
+
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+
+	//cannot resync before communicating
+	resync := net.ALL_REL_RESYNC{}
+	resync.Params.Add("PayloadSize", 500)
+	if err := relay.ReceivedMessage(resync); err == nil {
+		t.Error("Relay should not resync if it is not communicating")
+	}
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	nClients := 1
+	upCellSize := 1500
+	msg.Add("StartNow", true)
+	msg.Add("NClients", nClients)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", upCellSize)
+	msg.Add("DownstreamCellSize", 10*upCellSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("UseUDP", false)
+	msg.Add("UseDummyDataDown", false)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("UseOpenClosedSlots", false)
+	msg.Add("DisruptionProtectionEnabled", false)
+	msg.Add("RelayProcessingLoopSleepTime", 0)
+	msg.Add("RelayRoundTimeOut", 3600*1000)
+	msg.Add("RelayTrusteeCacheLowBound", 0)
+	msg.Add("RelayTrusteeCacheHighBound", 0)
+
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if _, err := getTrusteeMessage("ALL_ALL_PARAMETERS"); err != nil {
+		t.Error(err)
+	}
+
+	//setup : trustee's key, client's keys, shuffle, signature
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	if err := relay.ReceivedMessage(net.TRU_REL_TELL_PK{TrusteeID: 0, Pk: trusteePub}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	clientParams, err := getClientMessage("ALL_ALL_PARAMETERS")
+	if err != nil {
+		t.Error(err)
+	}
+	if clientParams.(*net.ALL_ALL_PARAMETERS).ForceParams {
+		t.Error("The first parameters of the clients should not be forced")
+	}
+	cliPub, _ := crypto.NewKeyPair()
+	cliEphPub, _ := crypto.NewKeyPair()
+	if err := relay.ReceivedMessage(net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: cliPub, EphPk: cliEphPub}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg2, err := getTrusteeMessage("REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE")
+	if err != nil {
+		t.Error(err)
+	}
+	toShuffle := msg2.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	if len(toShuffle.ClientsEphPks) != 1 || !toShuffle.ClientsEphPks[0].Equal(cliEphPub) {
+		t.Error("Relay should tell the trustees the ephemeral keys of the clients by ID, which seed their pads")
+	}
+	if err := relay.ReceivedMessage(net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS{NewBase: toShuffle.Base, NewEphPks: toShuffle.EphPks, Proof: make([]byte, 50)}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg3, err := getTrusteeMessage("REL_TRU_TELL_TRANSCRIPT")
+	if err != nil {
+		t.Error(err)
+	}
+	transcript := msg3.(*net.REL_TRU_TELL_TRANSCRIPT)
+	blob, err := transcript.Bases[0].MarshalBinary()
+	if err != nil {
+		t.Error("Can't marshall the last shares...")
+	}
+	pkBytes, err := transcript.EphPks[0].Keys[0].MarshalBinary()
+	if err != nil {
+		t.Error("Can't marshall shuffled public key")
+	}
+	blob = append(blob, pkBytes...)
+	signature, err := schnorr.Sign(config.CryptoSuite, trusteePriv, blob)
+	if err != nil {
+		log.Fatal("Couldn't Schnorr sign")
+	}
+	if err := relay.ReceivedMessage(net.TRU_REL_SHUFFLE_SIG{TrusteeID: 0, Sig: signature}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if relay.stateMachine.State() != "COMMUNICATING" {
+		t.Error("In wrong state ! we should be in COMMUNICATING, but are in ", relay.stateMachine.State())
+	}
+	if _, err := getClientMessage("REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG"); err != nil {
+		t.Error(err)
+	}
+
+	//the number of clients cannot change
+	badResync := net.ALL_REL_RESYNC{}
+	badResync.Params.Add("NClients", nClients+1)
+	if err := relay.ReceivedMessage(badResync); err == nil {
+		t.Error("Relay should not accept a resync changing the number of clients")
+	}
+
+	//resync as soon as possible, i.e., instead of opening round 1
+	resync = net.ALL_REL_RESYNC{RoundID: 0}
+	resync.Params.Add("PayloadSize", 500)
+	resync.Params.Add("WindowSize", 2)
+	resync.Params.Add("UseOpenClosedSlots", true)
+	if err := relay.ReceivedMessage(resync); err != nil {
+		t.Error("Relay should accept this resync, but", err)
+	}
+	if relay.relayState.PayloadSize != upCellSize {
+		t.Error("The resync should only happen at the end of the current round")
+	}
+
+	emptyData := dcnet.DCNetCipher{
+		Payload: make([]byte, upCellSize),
+	}
+	if err := relay.ReceivedMessage(net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 0, Data: emptyData.ToBytes()}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if err := relay.ReceivedMessage(net.TRU_REL_DC_CIPHER{TrusteeID: 0, RoundID: 0, Data: emptyData.ToBytes()}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+
+	//the clients are told to resync
+	msg4, err := getClientMessage("REL_CLI_DOWNSTREAM_DATA")
+	if err != nil {
+		t.Error(err)
+	}
+	down := msg4.(*net.REL_CLI_DOWNSTREAM_DATA)
+	if !down.FlagResync || down.RoundID != 1 {
+		t.Error("Relay should have sent a FlagResync for round 1, sent", down.RoundID, down.FlagResync)
+	}
+
+	//and the setup restarts with the new parameters
+	rs := relay.relayState
+	if relay.stateMachine.State() != "COLLECTING_TRUSTEES_PKS" {
+		t.Error("In wrong state ! we should be in COLLECTING_TRUSTEES_PKS, but are in ", relay.stateMachine.State())
+	}
+	if rs.PayloadSize != 500 || rs.WindowSize != 2 || !rs.UseOpenClosedSlots {
+		t.Error("The parameters of the resync were not applied")
+	}
+	if rs.DownstreamCellSize != 10*upCellSize || rs.nTrustees != 1 || rs.UseUDP {
+		t.Error("The parameters not part of the resync should not change")
+	}
+	msg5, err := getTrusteeMessage("ALL_ALL_PARAMETERS")
+	if err != nil {
+		t.Error(err)
+	}
+	if msg5.(*net.ALL_ALL_PARAMETERS).ParamsInt["PayloadSize"] != 500 {
+		t.Error("Relay should have sent the new PayloadSize to the trustee")
+	}
+
+	//a cipher of the previous configuration is dropped
+	if err := relay.ReceivedMessage(net.TRU_REL_DC_CIPHER{TrusteeID: 0, RoundID: 1, Data: emptyData.ToBytes()}); err != nil {
+		t.Error("Relay should drop this message silently, but", err)
+	}
+
+	//the clients get forced parameters, even if they missed the FlagResync
+	if err := relay.ReceivedMessage(net.TRU_REL_TELL_PK{TrusteeID: 0, Pk: trusteePub}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg6, err := getClientMessage("ALL_ALL_PARAMETERS")
+	if err != nil {
+		t.Error(err)
+	}
+	if !msg6.(*net.ALL_ALL_PARAMETERS).ForceParams || msg6.(*net.ALL_ALL_PARAMETERS).ParamsInt["PayloadSize"] != 500 {
+		t.Error("Relay should have sent the new, forced parameters to the client")
+	}
+
+	relay.Stop()
+}
+
+func TestRelayFailover(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { t.Error("Relay should not time out", clients, trustees) }
+	resultChan := make(chan interface{}, 1)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+	dataForClients := make(chan []byte, 6)
+	dataFromDCNet := make(chan []byte, 3)
+
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	//the standby relay answers only when released, the relay must not wait for it
+	replicated := make(chan *net.RELAY_FAILOVER_STATE, 10)
+	release := make(chan bool)
+	relay.SetReplicationHandler(func(state *net.RELAY_FAILOVER_STATE) bool {
+		replicated <- state
+		<-release
+		return true
+	})
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	upCellSize := 1500
+	msg.Add("StartNow", true)
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", upCellSize)
+	msg.Add("DownstreamCellSize", 10*upCellSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("UseUDP", false)
+	msg.Add("UseDummyDataDown", false)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("UseOpenClosedSlots", false)
+	msg.Add("DisruptionProtectionEnabled", false)
+	msg.Add("RelayProcessingLoopSleepTime", 0)
+	msg.Add("RelayRoundTimeOut", 3600*1000)
+	msg.Add("RelayTrusteeCacheLowBound", 0)
+	msg.Add("RelayTrusteeCacheHighBound", 0)
+
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if _, err := getTrusteeMessage("ALL_ALL_PARAMETERS"); err != nil {
+		t.Error(err)
+	}
+
+	//setup : trustee's key, client's keys, shuffle, signature
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	if err := relay.ReceivedMessage(net.TRU_REL_TELL_PK{TrusteeID: 0, Pk: trusteePub}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if _, err := getClientMessage("ALL_ALL_PARAMETERS"); err != nil {
+		t.Error(err)
+	}
+	cliPub, _ := crypto.NewKeyPair()
+	cliEphPub, _ := crypto.NewKeyPair()
+	if err := relay.ReceivedMessage(net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: cliPub, EphPk: cliEphPub}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg2, err := getTrusteeMessage("REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE")
+	if err != nil {
+		t.Error(err)
+	}
+	toShuffle := msg2.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	if err := relay.ReceivedMessage(net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS{NewBase: toShuffle.Base, NewEphPks: toShuffle.EphPks, Proof: make([]byte, 50)}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg3, err := getTrusteeMessage("REL_TRU_TELL_TRANSCRIPT")
+	if err != nil {
+		t.Error(err)
+	}
+	transcript := msg3.(*net.REL_TRU_TELL_TRANSCRIPT)
+	blob, err := transcript.Bases[0].MarshalBinary()
+	if err != nil {
+		t.Error("Can't marshall the last shares...")
+	}
+	pkBytes, err := transcript.EphPks[0].Keys[0].MarshalBinary()
+	if err != nil {
+		t.Error("Can't marshall shuffled public key")
+	}
+	blob = append(blob, pkBytes...)
+	signature, err := schnorr.Sign(config.CryptoSuite, trusteePriv, blob)
+	if err != nil {
+		log.Fatal("Couldn't Schnorr sign")
+	}
+	if len(replicated) != 0 {
+		t.Error("Relay should not replicate its state before the shuffle is done")
+	}
+	if err := relay.ReceivedMessage(net.TRU_REL_SHUFFLE_SIG{TrusteeID: 0, Sig: signature}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if _, err := getClientMessage("REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG"); err != nil {
+		t.Error(err)
+	}
+
+	//the state is replicated as soon as the pseudonyms are known, with a lease on the next rounds
+	var state *net.RELAY_FAILOVER_STATE
+	select {
+	case state = <-replicated:
+	case <-time.After(time.Second):
+		t.Fatal("Relay should have replicated its state")
+	}
+	relay.relayState.processingLock.Lock()
+	replicatedUpTo := relay.relayState.replicatedUpTo
+	relay.relayState.processingLock.Unlock()
+	if replicatedUpTo == state.ResumeRoundID {
+		t.Error("Relay should not count on the lease before the standby relay has the state")
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for replicatedUpTo != state.ResumeRoundID && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		relay.relayState.processingLock.Lock()
+		replicatedUpTo = relay.relayState.replicatedUpTo
+		relay.relayState.processingLock.Unlock()
+	}
+	if replicatedUpTo != state.ResumeRoundID {
+		t.Error("Relay should use the lease once the standby relay has the state, but is at", replicatedUpTo)
+	}
+	if len(replicated) != 0 {
+		t.Error("Relay should have replicated its state once, but did", 1+len(replicated), "times")
+	}
+	if state.ResumeRoundID != 1+FAILOVER_ROUND_LEASE {
+		t.Error("The standby relay should resume at round", 1+FAILOVER_ROUND_LEASE, ", not", state.ResumeRoundID)
+	}
+	if len(state.ClientsPks) != 1 || !state.ClientsPks[0].Equal(cliPub) || len(state.TrusteesPks) != 1 || !state.TrusteesPks[0].Equal(trusteePub) {
+		t.Error("The replicated state should contain the public keys of the participants")
+	}
+	if len(state.Shuffle.EphPks) != 1 || state.Params.IntValueOrElse("PayloadSize", 0) != upCellSize {
+		t.Error("The replicated state should contain the shuffle and the parameters")
+	}
+
+	//the relay fails, the standby relay takes over
+	relay.Stop()
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+	standby := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+
+	badState := *state
+	badState.ClientsPks = nil
+	if err := standby.ReceivedMessage(net.ALL_REL_RESUME{State: badState}); err == nil {
+		t.Error("Relay should not resume without the keys of the clients")
+	}
+
+	if err := standby.ReceivedMessage(net.ALL_REL_RESUME{State: *state}); err != nil {
+		t.Error("Relay should be able to resume, but", err)
+	}
+	if standby.stateMachine.State() != "COMMUNICATING" {
+		t.Error("In wrong state ! we should be in COMMUNICATING, but are in ", standby.stateMachine.State())
+	}
+	if err := standby.ReceivedMessage(net.ALL_REL_RESUME{State: *state}); err == nil {
+		t.Error("Relay should not resume twice")
+	}
+	for _, get := range []func(string) (interface{}, error){getTrusteeMessage, getClientMessage} {
+		msg4, err := get("REL_ALL_RESUME")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if msg4.(*net.REL_ALL_RESUME).RoundID != state.ResumeRoundID {
+			t.Error("Relay should resume at round", state.ResumeRoundID, ", not", msg4.(*net.REL_ALL_RESUME).RoundID)
+		}
+	}
+
+	//the session continues from there
+	emptyData := dcnet.DCNetCipher{
+		Payload: make([]byte, upCellSize),
+	}
+	if err := standby.ReceivedMessage(net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: state.ResumeRoundID, Data: emptyData.ToBytes()}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if err := standby.ReceivedMessage(net.TRU_REL_DC_CIPHER{TrusteeID: 0, RoundID: state.ResumeRoundID, Data: emptyData.ToBytes()}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg5, err := getClientMessage("REL_CLI_DOWNSTREAM_DATA")
+	if err != nil {
+		t.Error(err)
+	} else if msg5.(*net.REL_CLI_DOWNSTREAM_DATA).RoundID != state.ResumeRoundID+1 {
+		t.Error("Relay should have sent the downstream data of round", state.ResumeRoundID+1, ", not", msg5.(*net.REL_CLI_DOWNSTREAM_DATA).RoundID)
+	}
+
+	standby.Stop()
+}
+
+func TestRelayAuthentication(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	resultChan := make(chan interface{}, 1)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), resultChan, timeoutHandler, msw)
+	relay.EnableAuthentication()
+	relayPub := relay.relayState.PublicKey
+	standbyPub, _ := crypto.NewKeyPair()
+	relay.SetStandbyRelayKey(standbyPub)
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("StartNow", true)
+	msg.Add("NClients", 2)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("DownstreamCellSize", 1500)
+	msg.Add("WindowSize", 1)
+	msg.Add("UseUDP", false)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 3600*1000)
+
+	//the parameters are a local call
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+
+	//the relay does not know the trustee yet : it signs the parameters, which carry its key
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	trustee := net.NewAuthenticator(trusteePriv)
+	msg2, err := getTrusteeMessage("ALL_ALL_PARAMETERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, ok := msg2.(*net.AUTHENTICATED_MESSAGE)
+	if !ok {
+		t.Fatal("The messages to the trustees should be authenticated")
+	}
+	params := sealed.Msg.(*net.ALL_ALL_PARAMETERS)
+	if params.RelayPk == nil || !params.RelayPk.Equal(relayPub) {
+		t.Error("The parameters should contain the key of the relay")
+	}
+	if params.StandbyRelayPk == nil || !params.StandbyRelayPk.Equal(standbyPub) {
+		t.Error("The parameters should announce the key of the standby relay, the only one which may resume")
+	}
+	if err := trustee.Open(*sealed, relayPub); err != nil || len(sealed.Signature) == 0 {
+		t.Error("The parameters should be signed by the relay,", err)
+	}
+	trustee.SetPeerKey(net.PEER_RELAY, 0, relayPub)
+
+	toSend, _ := trustee.Seal(net.PEER_RELAY, 0, net.TRU_REL_TELL_PK{TrusteeID: 0, Pk: trusteePub})
+	if err := relay.ReceivedMessage(*toSend); err != nil {
+		t.Error("Relay should accept the key of the trustee, but", err)
+	}
+
+	//the clients register their keys
+	client0Pub, client0Priv := crypto.NewKeyPair()
+	client1Pub, client1Priv := crypto.NewKeyPair()
+	client0 := net.NewAuthenticator(client0Priv)
+	client1 := net.NewAuthenticator(client1Priv)
+	client0.SetPeerKey(net.PEER_RELAY, 0, relayPub)
+	client1.SetPeerKey(net.PEER_RELAY, 0, relayPub)
+	ephPub, _ := crypto.NewKeyPair()
+
+	toSend, _ = client0.Seal(net.PEER_RELAY, 0, net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: client0Pub, EphPk: ephPub})
+	if err := relay.ReceivedMessage(*toSend); err != nil {
+		t.Error("Relay should accept the key of client 0, but", err)
+	}
+
+	//client 1 tries to register as client 0, with its own key or with the key of client 0
+	toSend, _ = client1.Seal(net.PEER_RELAY, 0, net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: client1Pub, EphPk: ephPub})
+	if err := relay.ReceivedMessage(*toSend); err == nil {
+		t.Error("Relay should not accept another key for client 0")
+	}
+	toSend, _ = client1.Seal(net.PEER_RELAY, 0, net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: client0Pub, EphPk: ephPub})
+	if err := relay.ReceivedMessage(*toSend); err == nil {
+		t.Error("Relay should not accept the key of client 0 from client 1")
+	}
+	if relay.relayState.nClientsPkCollected != 1 || !relay.relayState.clients[0].PublicKey.Equal(client0Pub) {
+		t.Error("The messages of client 1 should have been dropped")
+	}
+
+	toSend, _ = client1.Seal(net.PEER_RELAY, 0, net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 1, Pk: client1Pub, EphPk: ephPub})
+	if err := relay.ReceivedMessage(*toSend); err != nil {
+		t.Error("Relay should accept the key of client 1, but", err)
+	}
+
+	//now that it knows the keys, the relay MACs its messages
+	msg2, err = getTrusteeMessage("REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed = msg2.(*net.AUTHENTICATED_MESSAGE)
+	if err := trustee.Open(*sealed, relayPub); err != nil || len(sealed.MAC) == 0 {
+		t.Error("The message should be MACed by the relay,", err)
+	}
+
+	//client 1 sends data in the name of client 0
+	data := net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 0, Data: make([]byte, 1500)}
+	toSend, _ = client1.Seal(net.PEER_RELAY, 0, data)
+	if err := relay.authenticate(*toSend); err == nil {
+		t.Error("Relay should not accept data from client 1 in the name of client 0")
+	}
+	toSend, _ = client0.Seal(net.PEER_RELAY, 0, data)
+	if err := relay.authenticate(*toSend); err != nil {
+		t.Error("Relay should accept data from client 0, but", err)
+	}
+	if err := relay.authenticate(*toSend); err == nil {
+		t.Error("Relay should not accept the data of client 0 twice")
+	}
+	data.ClientID = 5
+	toSend, _ = client1.Seal(net.PEER_RELAY, 0, data)
+	if err := relay.authenticate(*toSend); err == nil {
+		t.Error("Relay should not accept data from an unknown client")
+	}
+
+	//the same for the other messages carrying the ID of their sender
+	nack, _ := client1.Seal(net.PEER_RELAY, 0, net.CLI_REL_DOWNSTREAM_NACK{ClientID: 0, RoundIDs: []int32{1}})
+	if err := relay.authenticate(*nack); err == nil {
+		t.Error("Relay should not accept a NACK from client 1 in the name of client 0")
+	}
+	reveal, _ := client1.Seal(net.PEER_RELAY, 0, net.TRU_REL_DISRUPTION_REVEAL{TrusteeID: 0})
+	if err := relay.authenticate(*reveal); err == nil {
+		t.Error("Relay should not accept a reveal from client 1 in the name of trustee 0")
+	}
+
+	//the messages which are not authenticated, or which the relay only receives locally, are dropped
+	if err := relay.ReceivedMessage(net.AUTHENTICATED_MESSAGE{Msg: net.CLI_REL_UPSTREAM_DATA{ClientID: 1}}); err == nil {
+		t.Error("Relay should not accept a message without MAC nor signature")
+	}
+	shutdown, _ := client0.Seal(net.PEER_RELAY, 0, net.ALL_ALL_SHUTDOWN{})
+	if err := relay.ReceivedMessage(*shutdown); err == nil {
+		t.Error("Relay should not accept a shutdown from a client")
+	}
+	if relay.stateMachine.State() == "SHUTDOWN" {
+		t.Error("Relay should not have shut down")
+	}
+
+	//new parameters re-assign the IDs : the keys bound to the previous ones are forgotten
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if len(relay.relayState.authenticator.PeerKeys(net.PEER_CLIENT)) != 0 || len(relay.relayState.authenticator.PeerKeys(net.PEER_TRUSTEE)) != 0 {
+		t.Error("Relay should have forgotten the keys of the participants")
+	}
+	toSend, _ = client1.Seal(net.PEER_RELAY, 0, net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: client1Pub, EphPk: ephPub})
+	if err := relay.authenticate(*toSend); err != nil {
+		t.Error("Relay should accept the key of client 1 as the new client 0, but", err)
+	}
+}
+
+func TestRelayStopReleasesGoroutines(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	timeoutHandler := func(clients, trustees []int) {}
+	sendFn := func(clientID int, msg *net.REL_CLI_DOWNSTREAM_DATA, extraInfos string) bool { return true }
+
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		relay := NewRelay(true, make(chan []byte, 1), make(chan []byte, 1), make(chan interface{}, 1), timeoutHandler, msw)
+		relay.relayState.RoundTimeOut = 3600 * 1000
+		relay.relayState.openClosedPolicy = &FixedOpenClosedPolicy{Delay: time.Hour}
+		relay.relayState.downstreamFanOut = NewDownstreamFanOut(relay.ctx, 3, 1, sendFn, nil)
+
+		//the goroutines started during a round
+		go relay.checkIfRoundHasEndedAfterTimeOut_Phase1(relay.ctx, 0)
+		go relay.waitBeforeNextSchedule(relay.ctx, time.Hour, true)
+
+		if runtime.NumGoroutine() <= baseline {
+			t.Error("Relay should have started some goroutines")
+		}
+
+		if err := relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{}); err != nil {
+			t.Error(err)
+		}
+		relay.Stop() //should be idempotent
+	}
+
+	if !goroutinesBackTo(baseline, time.Second) {
+		t.Error("Goroutines leaked after stopping the relay :", runtime.NumGoroutine(), "running, baseline was", baseline)
+	}
+}
+
+func TestRelayOpenClosedBackOffReleasesLock(t *testing.T) {
+
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	timeoutHandler := func(clients, trustees []int) {}
+	dataForClients := make(chan []byte, 1)
+	relay := NewRelay(true, dataForClients, make(chan []byte, 1), make(chan interface{}, 1), timeoutHandler, msw)
+	defer relay.Stop()
+
+	relay.relayState.processingLock.Lock()
+	relay.relayState.openClosedPolicy = NewAdaptiveOpenClosedPolicy(time.Hour, time.Hour)
+	relay.relayState.openClosedBackOff = true
+	relay.relayState.processingLock.Unlock()
+	go relay.waitBeforeNextSchedule(relay.ctx, time.Hour, true)
+
+	//while backing off, the relay still processes the messages, and does not open rounds
+	locked := make(chan bool)
+	go func() {
+		relay.relayState.processingLock.Lock()
+		relay.downstreamPhase_sendMany()
+		relay.relayState.processingLock.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("The back-off should not hold the processing lock")
+	}
+
+	//downstream data ends the back-off
+	dataForClients <- []byte{1}
+	deadline := time.Now().Add(time.Second)
+	backingOff := true
+	for backingOff && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		relay.relayState.processingLock.Lock()
+		backingOff = relay.relayState.openClosedBackOff
+		relay.relayState.processingLock.Unlock()
+	}
+	if backingOff {
+		t.Error("Downstream data should end the back-off")
+	}
+}
+
+// goroutinesBackTo waits up to "timeout" for the number of goroutines to be <= baseline
+func goroutinesBackTo(baseline int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if runtime.NumGoroutine() <= baseline {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return runtime.NumGoroutine() <= baseline
+}
+
+func TestRelayAuditLog(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { t.Error("Relay should not time out", clients, trustees) }
+	resultChan := make(chan interface{}, 1)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+	dataForClients := make(chan []byte, 6)
+	dataFromDCNet := make(chan []byte, 3)
+
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+
+	//the log is signed with our long-term key, which the verifier knows in advance
+	relayPub, relayPriv := crypto.NewKeyPair()
+	otherPub, _ := crypto.NewKeyPair()
+	if err := relay.SetKeyPair(otherPub, relayPriv); err == nil {
+		t.Error("Relay should not accept a public key which does not match its private key")
+	}
+	if err := relay.SetKeyPair(relayPub, relayPriv); err != nil {
+		t.Error("Relay should accept its key pair, but", err)
+	}
+	auditLog := new(bytes.Buffer)
+	if err := relay.SetAuditLog(auditLog); err != nil {
+		t.Fatal("Relay should be able to start its audit log, but", err)
+	}
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	upCellSize := 1500
+	msg.Add("StartNow", true)
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", upCellSize)
+	msg.Add("DownstreamCellSize", 10*upCellSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("UseUDP", false)
+	msg.Add("UseDummyDataDown", false)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("UseOpenClosedSlots", false)
+	msg.Add("DisruptionProtectionEnabled", false)
+	msg.Add("RelayProcessingLoopSleepTime", 0)
+	msg.Add("RelayRoundTimeOut", 3600*1000)
+	msg.Add("RelayTrusteeCacheLowBound", 0)
+	msg.Add("RelayTrusteeCacheHighBound", 0)
+
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	if err := relay.SetKeyPair(relayPub, relayPriv); err == nil {
+		t.Error("Relay should not change its key pair once the protocol started")
+	}
+	msg2, err := getTrusteeMessage("ALL_ALL_PARAMETERS")
+	if err != nil {
+		t.Error(err)
+	} else if !msg2.(*net.ALL_ALL_PARAMETERS).RelayPk.Equal(relayPub) {
+		t.Error("Relay should announce its long-term public key")
+	}
+
+	//setup : trustee's key, client's keys, shuffle, signature
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	if err := relay.ReceivedMessage(net.TRU_REL_TELL_PK{TrusteeID: 0, Pk: trusteePub}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	cliPub, _ := crypto.NewKeyPair()
+	cliEphPub, _ := crypto.NewKeyPair()
+	if err := relay.ReceivedMessage(net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: cliPub, EphPk: cliEphPub}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg3, err := getTrusteeMessage("REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	toShuffle := msg3.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	if err := relay.ReceivedMessage(net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS{NewBase: toShuffle.Base, NewEphPks: toShuffle.EphPks, Proof: make([]byte, 50)}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+	msg4, err := getTrusteeMessage("REL_TRU_TELL_TRANSCRIPT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := msg4.(*net.REL_TRU_TELL_TRANSCRIPT)
+	blob, err := transcript.Bases[0].MarshalBinary()
+	if err != nil {
+		t.Error("Can't marshall the last shares...")
+	}
+	pkBytes, err := transcript.EphPks[0].Keys[0].MarshalBinary()
+	if err != nil {
+		t.Error("Can't marshall shuffled public key")
+	}
+	blob = append(blob, pkBytes...)
+	signature, err := schnorr.Sign(config.CryptoSuite, trusteePriv, blob)
+	if err != nil {
+		log.Fatal("Couldn't Schnorr sign")
+	}
+	if err := relay.ReceivedMessage(net.TRU_REL_SHUFFLE_SIG{TrusteeID: 0, Sig: signature}); err != nil {
+		t.Error("Relay should be able to receive this message, but", err)
+	}
+
+	//a few rounds
+	emptyData := dcnet.DCNetCipher{
+		Payload: make([]byte, upCellSize),
+	}
+	nRounds := 3
+	for r := int32(0); r < int32(nRounds); r++ {
+		if err := relay.ReceivedMessage(net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: r, Data: emptyData.ToBytes()}); err != nil {
+			t.Error("Relay should be able to receive this message, but", err)
+		}
+		if err := relay.ReceivedMessage(net.TRU_REL_DC_CIPHER{TrusteeID: 0, RoundID: r, Data: emptyData.ToBytes()}); err != nil {
+			t.Error("Relay should be able to receive this message, but", err)
+		}
+	}
+
+	//stopping the relay signs the end of the log
+	relay.Stop()
+
+	report, err := audit.Verify(bytes.NewReader(auditLog.Bytes()), relayPub)
+	if err != nil {
+		t.Fatal("The audit log of the relay should be valid, but", err)
+	}
+	if report.Chains != 1 || report.Rounds != nRounds || report.SignedRounds != nRounds || len(report.FailedRounds) != 0 {
+		t.Error("The audit log should contain the", nRounds, "rounds, all signed and successful, but", report)
+	}
+	if _, err := audit.Verify(bytes.NewReader(auditLog.Bytes()), otherPub); err == nil {
+		t.Error("The audit log should not be valid with another public key")
+	}
+}
+
+func TestRelayDisruptionBlame(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	resultChan := make(chan interface{}, 1)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), resultChan, timeoutHandler, msw)
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("StartNow", false)
+	msg.Add("NClients", 2)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("DownstreamCellSize", 1500)
+	msg.Add("WindowSize", 1)
+	msg.Add("UseUDP", false)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("DisruptionProtectionEnabled", true)
+	msg.Add("RelayRoundTimeOut", 3600*1000)
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+
+	//two slots, after the shuffle; the first one owned round 5, whose bit 12 was flipped by client 1 :
+	//client 0 (the owner) sent 0, and its pad and the pad of trustee 0 are 1, the pad of client 1 is 0
+	_, basePriv := crypto.NewKeyPair()
+	base := config.CryptoSuite.Point().Mul(basePriv, nil)
+	_, slot0Priv := crypto.NewKeyPair()
+	_, slot1Priv := crypto.NewKeyPair()
+	relay.relayState.shuffleResult = &net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG{
+		Base:   base,
+		EphPks: []kyber.Point{config.CryptoSuite.Point().Mul(slot0Priv, base), config.CryptoSuite.Point().Mul(slot1Priv, base)},
+	}
+	cipherWithBit12 := func() []byte {
+		c := &dcnet.DCNetCipher{Payload: make([]byte, 1500)}
+		c.Payload[1] = 1 << 4
+		return c.ToBytes()
+	}
+	output := make([]byte, 1500)
+	output[1] = 1 << 4
+	relay.relayState.pastRounds[5] = &pastRound{
+		owner:     0,
+		clients:   [][]byte{cipherWithBit12(), cipherWithBit12()},
+		trustees:  [][]byte{cipherWithBit12()},
+		output:    output,
+		disrupted: true,
+	}
+	relay.relayState.pastRounds[6] = &pastRound{owner: 0, output: output}
+	relay.stateMachine.ChangeState("COMMUNICATING")
+
+	blame := func(roundID int32, bitPos int, priv kyber.Scalar) net.CLI_REL_DISRUPTION_BLAME {
+		b := net.CLI_REL_DISRUPTION_BLAME{RoundID: roundID, BitPos: bitPos}
+		b.NIZK = crypto.ProveDL(priv, base, b.NIZKContext())
+		return b
+	}
+
+	//the owner of another slot cannot blame
+	if err := relay.receivedBlame(0, blame(5, 12, slot1Priv)); err == nil {
+		t.Error("Relay should reject a blame from a client which did not own the round")
+	}
+	//the blame must be sent in the slot which owned the round
+	if err := relay.receivedBlame(1, blame(5, 12, slot0Priv)); err == nil {
+		t.Error("Relay should reject a blame sent in another slot")
+	}
+	//nor can anyone blame a round we do not remember, or which passed the disruption check
+	if err := relay.receivedBlame(0, blame(7, 12, slot0Priv)); err == nil {
+		t.Error("Relay should reject a blame of a round it does not remember")
+	}
+	if err := relay.receivedBlame(0, blame(6, 12, slot0Priv)); err == nil {
+		t.Error("Relay should reject a blame of a round which was not disrupted")
+	}
+	//the blamed bit must have been output as 1
+	if err := relay.receivedBlame(0, blame(5, 13, slot0Priv)); err == nil {
+		t.Error("Relay should reject a blame of a bit which was output as 0")
+	}
+	//a proof is bound to the round and bit it blames
+	replayed := blame(5, 13, slot0Priv)
+	replayed.BitPos = 12
+	if err := relay.receivedBlame(0, replayed); err == nil {
+		t.Error("Relay should reject a blame whose NIZK was made for another bit")
+	}
+	if relay.stateMachine.State() != "COMMUNICATING" || len(sentToTrustee) != 0 || len(sentToClient) != 0 {
+		t.Error("Relay should not start a blame for an invalid CLI_REL_DISRUPTION_BLAME")
+	}
+
+	if err := relay.receivedBlame(0, blame(5, 12, slot0Priv)); err != nil {
+		t.Error("Relay should accept a blame from the owner of the round, but", err)
+	}
+	if relay.stateMachine.State() != "BLAMING" {
+		t.Error("Relay should be blaming, but is in state", relay.stateMachine.State())
+	}
+	msg2, err := getTrusteeMessage("REL_ALL_DISRUPTION_REVEAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reveal := msg2.(*net.REL_ALL_DISRUPTION_REVEAL)
+	if reveal.RoundID != 5 || reveal.BitPos != 12 {
+		t.Error("Relay should ask to reveal bit 12 of round 5, but asked", reveal)
+	}
+	if _, err := getClientMessage("REL_ALL_DISRUPTION_REVEAL"); err != nil {
+		t.Error("Relay should ask the clients to reveal their bits too")
+	}
+	sentToClient = make([]interface{}, 0)
+
+	//the revealed bits must have one bit per trustee (resp. client)
+	if err := relay.ReceivedMessage(net.CLI_REL_DISRUPTION_REVEAL{ClientID: 0, Bits: map[int]int{0: 1, 1: 0}}); err == nil {
+		t.Error("Relay should reject the bits of more trustees than there are")
+	}
+	if err := relay.ReceivedMessage(net.TRU_REL_DISRUPTION_REVEAL{TrusteeID: 0, Bits: map[int]int{0: 1, 1: 2}}); err == nil {
+		t.Error("Relay should reject an invalid bit")
+	}
+
+	//the pads are consistent, the disruptor is the client whose cipher is not the XOR of its pads
+	reveals := []interface{}{
+		net.CLI_REL_DISRUPTION_REVEAL{ClientID: 0, Bits: map[int]int{0: 1}},
+		net.CLI_REL_DISRUPTION_REVEAL{ClientID: 1, Bits: map[int]int{0: 0}},
+		net.TRU_REL_DISRUPTION_REVEAL{TrusteeID: 0, Bits: map[int]int{0: 1, 1: 0}},
+	}
+	for _, r := range reveals {
+		if err := relay.ReceivedMessage(r); err != nil {
+			t.Error("Relay should accept the revealed bits, but", err)
+		}
+	}
+	if len(relay.relayState.disruptors) != 1 || relay.relayState.disruptors[0] != "client 1" {
+		t.Error("Relay should have found that client 1 disrupted the round, but found", relay.relayState.disruptors)
+	}
+
+	//the blame ends with a resync
+	msg3, err := getClientMessage("REL_CLI_DOWNSTREAM_DATA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg3.(*net.REL_CLI_DOWNSTREAM_DATA).FlagResync {
+		t.Error("Relay should resync after the blame")
+	}
+	if relay.stateMachine.State() != "COLLECTING_TRUSTEES_PKS" {
+		t.Error("Relay should restart the setup after the blame, but is in state", relay.stateMachine.State())
+	}
+}
+
+func TestRelayFECStatistics(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	resultChan := make(chan interface{}, 1)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), resultChan, timeoutHandler, msw)
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("StartNow", false)
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("DownstreamCellSize", 1500)
+	msg.Add("WindowSize", 1)
+	msg.Add("UseUDP", true)
+	msg.Add("UDPFECGroupSize", 2)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 3600*1000)
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+
+	//the client NACKs the rounds it could not rebuild, and tells us how many it did rebuild
+	if err := relay.Received_CLI_REL_DOWNSTREAM_NACK(net.CLI_REL_DOWNSTREAM_NACK{ClientID: 0, RoundIDs: []int32{4, 5}, FECRecovered: 3}); err != nil {
+		t.Error("Relay should accept this NACK, but", err)
+	}
+	if err := relay.Received_CLI_REL_DOWNSTREAM_NACK(net.CLI_REL_DOWNSTREAM_NACK{ClientID: 0, RoundIDs: []int32{6}, FECRecovered: -10}); err == nil {
+		t.Error("Relay should reject a NACK with a negative count of recovered rounds")
+	}
+	recovered, unrecoverable := relay.relayState.fecStatistics.Recovered()
+	if recovered != 3 || unrecoverable != 2 {
+		t.Error("Relay should count 3 recovered and 2 unrecoverable rounds, but counted", recovered, unrecoverable)
+	}
+}
+
+func TestRelayUpstreamLatency(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { t.Error("Relay should not time out", clients, trustees) }
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 1), timeoutHandler, msw)
+	defer relay.Stop()
+	relay.relayState.nClients = 2
+
+	probe := func(clientID int) []byte {
+		tests := []*prifilog.LatencyTestToSend{{CreatedAt: time.Now()}}
+		cell, _ := prifilog.LatencyMessagesToBytes(tests, clientID, 3, 100, func(int64) {})
+		return cell
+	}
+
+	//the latency is recorded per client
+	relay.recordUpstreamLatency(probe(1), 4)
+	if _, found := relay.relayState.timeStatistics["upstream-latency-client-1"]; !found {
+		t.Error("Relay should record the latency of client 1")
+	}
+
+	//the ID is written by the sender of the anonymous cell, the relay only accepts the IDs of its clients
+	relay.recordUpstreamLatency(probe(2), 4)
+	relay.recordUpstreamLatency(probe(65535), 4)
+	for key := range relay.relayState.timeStatistics {
+		if key == "upstream-latency-client-2" || key == "upstream-latency-client-65535" {
+			t.Error("Relay should not record the latency of an unknown client,", key)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+/*
+Live reconfiguration of the relay (and, through it, of the clients and trustees).
+When the relay receives an ALL_REL_RESYNC, it continues normally until the requested round. For this round, instead of
+some downstream data, it sends a cell with FlagResync to the clients (who stop communicating), and restarts the setup
+(trustees' public keys, clients' ephemeral keys, shuffle) with the new parameters, without restarting the SDA protocol.
+The parameters which can change are PayloadSize, DownstreamCellSize, WindowSize, UseOpenClosedSlots and NTrustees; the
+trustees which are not part of the new configuration (ID >= NTrustees) are parked until a later resync.
+During the resync, the leftovers of the previous configuration (upstream data, ciphers, NACKs) are dropped.
+*/
+
+/*
+Received_ALL_REL_RESYNC handles ALL_REL_RESYNC messages. It checks the new parameters, and schedules the resync.
+*/
+func (p *PriFiLibRelayInstance) Received_ALL_REL_RESYNC(msg net.ALL_REL_RESYNC) error {
+
+	if nClients := msg.Params.IntValueOrElse("NClients", p.relayState.nClients); nClients != p.relayState.nClients {
+		return errors.New("Resync cannot change the number of clients (" + strconv.Itoa(p.relayState.nClients) + " -> " + strconv.Itoa(nClients) + ")")
+	}
+	if nTrustees := msg.Params.IntValueOrElse("NTrustees", p.relayState.nTrustees); nTrustees < 1 {
+		return errors.New("Resync needs at least one trustee, not " + strconv.Itoa(nTrustees))
+	}
+	if payloadSize := msg.Params.IntValueOrElse("PayloadSize", p.relayState.PayloadSize); payloadSize < 1 {
+		return errors.New("payloadSize cannot be 0")
+	}
+	if windowSize := msg.Params.IntValueOrElse("WindowSize", p.relayState.WindowSize); windowSize < 1 {
+		return errors.New("WindowSize cannot be smaller than 1")
+	}
+
+	resync := msg
+	if next := p.relayState.roundManager.NextRoundToOpen(); resync.RoundID < next {
+		resync.RoundID = next
+	}
+	p.relayState.pendingResync = &resync
+
+	log.Lvl1("Relay : resync scheduled for round", resync.RoundID)
+
+	return nil
+}
+
+// downstreamPhase_sendResync tells the clients to resync instead of opening the next round, then restarts the setup
+// with the new parameters. If they cannot be applied, the protocol is restarted via the timeout handler
+func (p *PriFiLibRelayInstance) downstreamPhase_sendResync() error {
+
+	resync := p.relayState.pendingResync
+	p.relayState.pendingResync = nil
+	roundID := p.relayState.roundManager.NextRoundToOpen()
+
+	log.Lvl1("Relay : resyncing at round", roundID)
+
+	// no data in this cell, the clients will not process it
+	toSend := &net.REL_CLI_DOWNSTREAM_DATA{
+		RoundID:     roundID,
+		OwnershipID: -1,
+		Data:        make([]byte, 1),
+		FlagResync:  true}
+	if err := toSend.Sign(p.relayState.privateKey); err != nil {
+		log.Error("Relay : could not sign the resync cell for round", roundID, ",", err)
+	}
+	if p.relayState.UseUDP {
+		toSend2 := &net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: *toSend}
+		p.messageSender.BroadcastToAllClientsWithLog(toSend2, "(UDP broadcast, resync at round "+strconv.Itoa(int(roundID))+")")
+	} else {
+		for i := 0; i < p.relayState.nClients; i++ {
+			p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", resync at round "+strconv.Itoa(int(roundID))+")")
+		}
+	}
+
+	// restart the setup with the new parameters (the missing ones keep their current value)
+	oldNTrustees := p.relayState.nTrustees
+	params := new(net.ALL_ALL_PARAMETERS)
+	for k, v := range resync.Params.ParamsInt {
+		params.Add(k, v)
+	}
+	for k, v := range resync.Params.ParamsStr {
+		params.Add(k, v)
+	}
+	for k, v := range resync.Params.ParamsBool {
+		params.Add(k, v)
+	}
+	params.Add("StartNow", true)
+	params.ForceParams = true
+
+	p.relayState.resyncInProgress = true
+	if err := p.Received_ALL_ALL_PARAMETERS(*params); err != nil {
+		log.Error("Relay : could not apply the parameters of the resync, restarting the protocol. Error is", err)
+		p.relayState.timeoutHandler(make([]int, 0), make([]int, 0))
+		return err
+	}
+
+	// park the trustees which are not part of the new configuration; they stop sending ciphers
+	for j := p.relayState.nTrustees; j < oldNTrustees; j++ {
+		park := new(net.ALL_ALL_PARAMETERS)
+		park.Add("StartNow", false)
+		park.Add("NClients", p.relayState.nClients)
+		park.Add("NTrustees", p.relayState.nTrustees)
+		park.Add("PayloadSize", p.relayState.PayloadSize)
+		park.Add("NextFreeTrusteeID", j)
+		park.RelayPk = p.relayState.PublicKey
+		park.ForceParams = true
+		p.messageSender.SendToTrusteeWithLog(j, park, "(parking trustee "+strconv.Itoa(j)+")")
+	}
+
+	return nil
+}
+
+// ignoredDuringResync returns true if we are resyncing and not in one of "expectedStates" : the message is a leftover
+// of the previous configuration, and should be dropped
+func (p *PriFiLibRelayInstance) ignoredDuringResync(msgName string, expectedStates ...string) bool {
+	if !p.relayState.resyncInProgress {
+		return false
+	}
+	state := p.stateMachine.State()
+	for _, s := range expectedStates {
+		if s == state {
+			return false
+		}
+	}
+	log.Lvl3("Relay : dropping", msgName, "from the configuration before the resync (in state", state, ")")
+	return true
+}
@@ -1,6 +1,9 @@
 package relay
 
 import (
+	"context"
+	"github.com/dedis/prifi/prifi-lib/audit"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"gopkg.in/dedis/onet.v2/log"
 	"time"
 )
@@ -10,15 +13,22 @@ This first timeout happens after a short delay. Clients will not be considered d
 but if we use UDP, it can mean that a client missed a broadcast, and we re-sent the message.
 If the round was *not* done, we do another timeout (Phase 2), and then, clients/trustees will be considered
 online if they didn't answer by that time.
+If the relay is stopped or re-initialized meanwhile (i.e., "ctx" is cancelled), the timer is released and nothing is checked.
 */
-func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID int32) {
+func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(ctx context.Context, roundID int32) {
 
-	time.Sleep(time.Duration(p.relayState.RoundTimeOut) * time.Millisecond)
+	if !utils.SleepOrCancel(ctx, time.Duration(p.relayState.RoundTimeOut)*time.Millisecond) {
+		return
+	}
 
 	// never start treating two timeout concurrently (or receiving a message)
 	p.relayState.processingLock.Lock()
 	defer p.relayState.processingLock.Unlock()
 
+	if ctx.Err() != nil {
+		return //this round belongs to a previous configuration
+	}
+
 	if !p.relayState.roundManager.IsRoundOpenend(roundID) {
 		return //everything went dwell, it's great !
 	}
@@ -27,6 +37,10 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 		return //nothing to ensure in that case
 	}
 
+	if p.stateMachine.State() == "BLAMING" {
+		return //the rounds in flight are dropped, the blame ends with a resync (see disruption.go)
+	}
+
 	// new policy : just kill that round, do not retransmit, let SOCKS take care of the loss
 
 	p.relayState.numberOfConsecutiveFailedRounds++
@@ -36,6 +50,7 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 	// if we missed too many rounds, kill the experiment
 	missingClientCiphers, missingTrusteeCiphers := p.relayState.roundManager.MissingCiphersForCurrentRound()
 	log.Lvl1("missing clients", missingClientCiphers, "and trustees", missingTrusteeCiphers)
+	p.auditRound(roundID, nil, audit.CHECK_DISABLED, missingClientCiphers, missingTrusteeCiphers)
 
 	if p.relayState.numberOfConsecutiveFailedRounds >= p.relayState.MaxNumberOfConsecutiveFailedRounds {
 		log.Error("MAX_NUMBER_OF_CONSECUTIVE_FAILED_ROUNDS (", p.relayState.MaxNumberOfConsecutiveFailedRounds,
@@ -53,6 +68,10 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 
 		p.relayState.numberOfNonAckedDownstreamPackets-- // packet is not "in-flight" because it is lost
 
+		if p.relayState.AdaptiveWindow {
+			p.relayState.windowController.RoundTimedOut()
+		}
+
 		// if we still have open rounds (after closing this one), we need to tell the DC-net to move to this new round
 		if roundOpened, roundID := p.relayState.roundManager.currentRound(); roundOpened {
 			//prepare for the next round (this empties the dc-net buffer, making them ready for a new round)
@@ -62,8 +81,8 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 		// if we can, open new rounds
 		p.downstreamPhase_sendMany()
 
-		// we should also try to finalize the next round
-		if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
+		// we should also try to finalize the next round (unless a resync just started)
+		if p.stateMachine.State() == "COMMUNICATING" && p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 			log.Lvl1("Timeouts: Following round was ready, calling hasAllCiphersForUpstream(true)")
 			p.upstreamPhase1_processCiphers(true)
 		}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"gopkg.in/dedis/onet.v2/log"
+	"time"
+)
+
+/*
+WindowController adapts the number of concurrently open rounds (the "window") of the relay.
+The static WindowSize is kept as an upper bound (the BufferableRoundManager is sized with it).
+
+The controller works like TCP Vegas: it remembers the smallest round latency seen (open->close, "base latency"),
+and periodically estimates how many rounds are just waiting in queues :
+
+	queued = window * (1 - baseLatency / averageLatency)
+
+If almost nothing is queued, the link is latency-bound and a larger window increases throughput. If several rounds
+are queued, the bottleneck (bandwidth, processing) is saturated, and a larger window only inflates the buffered
+ciphers; we shrink it. Additionally :
+- if we mostly waited on trustees whose buffers are empty, trustees are the bottleneck, we do not grow the window
+- if some trustee buffer reaches the high bound, we shrink the window to save memory
+- on a round timeout, the window is halved
+*/
+type WindowController struct {
+	maxWindow int
+	window    int
+
+	trusteeCacheLowBound  int
+	trusteeCacheHighBound int
+
+	baseLatency time.Duration //smallest average latency observed, slowly forgotten
+
+	//statistics for the current observation period
+	roundsInPeriod           int
+	latencySumInPeriod       time.Duration
+	waitedOnTrusteesInPeriod int
+	minTrusteeBufferInPeriod int
+	maxTrusteeBufferInPeriod int
+}
+
+//WINDOW_CONTROLLER_MIN_PERIOD is the minimum number of rounds between two window updates
+const WINDOW_CONTROLLER_MIN_PERIOD = 10
+
+//WINDOW_CONTROLLER_BASE_LATENCY_DECAY slowly increases the base latency, so that a route change is eventually noticed
+const WINDOW_CONTROLLER_BASE_LATENCY_DECAY = 1.02
+
+//NewWindowController returns a WindowController starting with a window of 1, and never exceeding maxWindow
+func NewWindowController(maxWindow, trusteeCacheLowBound, trusteeCacheHighBound int) *WindowController {
+	if maxWindow < 1 {
+		maxWindow = 1
+	}
+	w := &WindowController{
+		maxWindow:             maxWindow,
+		window:                1,
+		trusteeCacheLowBound:  trusteeCacheLowBound,
+		trusteeCacheHighBound: trusteeCacheHighBound,
+	}
+	w.resetPeriod()
+	return w
+}
+
+//WindowSize returns the current number of rounds that should be open concurrently
+func (w *WindowController) WindowSize() int {
+	return w.window
+}
+
+func (w *WindowController) resetPeriod() {
+	w.roundsInPeriod = 0
+	w.latencySumInPeriod = 0
+	w.waitedOnTrusteesInPeriod = 0
+	w.minTrusteeBufferInPeriod = -1
+	w.maxTrusteeBufferInPeriod = 0
+}
+
+//RoundFinished must be called every time a round is closed, with the time spent in this round, whether the round
+//was finished by a trustee cipher (i.e., we were waiting on the trustees), and the smallest and largest number of
+//ciphers buffered for a trustee. It returns the new window size.
+func (w *WindowController) RoundFinished(timeInRound time.Duration, waitedOnTrustees bool, minTrusteeBuffer, maxTrusteeBuffer int) int {
+
+	w.roundsInPeriod++
+	w.latencySumInPeriod += timeInRound
+	if waitedOnTrustees {
+		w.waitedOnTrusteesInPeriod++
+	}
+	if w.minTrusteeBufferInPeriod == -1 || minTrusteeBuffer < w.minTrusteeBufferInPeriod {
+		w.minTrusteeBufferInPeriod = minTrusteeBuffer
+	}
+	if maxTrusteeBuffer > w.maxTrusteeBufferInPeriod {
+		w.maxTrusteeBufferInPeriod = maxTrusteeBuffer
+	}
+
+	//wait until we have enough samples (at least two full windows)
+	if w.roundsInPeriod < WINDOW_CONTROLLER_MIN_PERIOD || w.roundsInPeriod < 2*w.window {
+		return w.window
+	}
+
+	avgLatency := w.latencySumInPeriod / time.Duration(w.roundsInPeriod)
+	if avgLatency <= 0 {
+		w.resetPeriod()
+		return w.window
+	}
+
+	w.baseLatency = time.Duration(float64(w.baseLatency) * WINDOW_CONTROLLER_BASE_LATENCY_DECAY)
+	if w.baseLatency == 0 || avgLatency < w.baseLatency {
+		w.baseLatency = avgLatency
+	}
+
+	queued := float64(w.window) * (1 - float64(w.baseLatency)/float64(avgLatency))
+	trusteesAreBottleneck := w.waitedOnTrusteesInPeriod*2 > w.roundsInPeriod && w.minTrusteeBufferInPeriod <= w.trusteeCacheLowBound
+	trusteesBuffersFull := w.trusteeCacheHighBound > 0 && w.maxTrusteeBufferInPeriod >= w.trusteeCacheHighBound
+
+	oldWindow := w.window
+	switch {
+	case trusteesBuffersFull || queued > 1.5:
+		w.window--
+	case queued < 0.5 && !trusteesAreBottleneck:
+		w.window++
+	}
+	w.clamp()
+
+	if w.window != oldWindow {
+		log.Lvl2("WindowController : window", oldWindow, "->", w.window, "(avg latency", avgLatency, ", base", w.baseLatency,
+			", queued", queued, ", trusteesAreBottleneck", trusteesAreBottleneck, ", trusteesBuffersFull", trusteesBuffersFull, ")")
+	}
+
+	w.resetPeriod()
+	return w.window
+}
+
+//RoundTimedOut must be called when a round had to be force-closed. It halves the window, and returns the new window size.
+func (w *WindowController) RoundTimedOut() int {
+	w.window = w.window / 2
+	w.clamp()
+	w.resetPeriod()
+	return w.window
+}
+
+func (w *WindowController) clamp() {
+	if w.window < 1 {
+		w.window = 1
+	}
+	if w.window > w.maxWindow {
+		w.window = w.maxWindow
+	}
+}
@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func feedWindowController(w *WindowController, nRounds int, latency time.Duration, waitedOnTrustees bool, minBuffer, maxBuffer int) int {
+	window := w.WindowSize()
+	for i := 0; i < nRounds; i++ {
+		window = w.RoundFinished(latency, waitedOnTrustees, minBuffer, maxBuffer)
+	}
+	return window
+}
+
+func TestWindowController(test *testing.T) {
+
+	maxWindow := 4
+	w := NewWindowController(maxWindow, 10, 15)
+
+	if w.WindowSize() != 1 {
+		test.Error("WindowController should start with a window of 1")
+	}
+
+	//constant latency : nothing is queued, the window should grow up to maxWindow, but not further
+	window := feedWindowController(w, 200, 10*time.Millisecond, false, 12, 12)
+	if window != maxWindow {
+		test.Error("Window should have grown to", maxWindow, ", but is", window)
+	}
+
+	//the latency increases a lot : rounds are queued, the window should shrink
+	window = feedWindowController(w, 2*WINDOW_CONTROLLER_MIN_PERIOD, 40*time.Millisecond, false, 12, 12)
+	if window >= maxWindow {
+		test.Error("Window should have shrunk, but is", window)
+	}
+
+	//a timeout halves the window
+	before := w.WindowSize()
+	if w.RoundTimedOut() != before/2 && before/2 >= 1 {
+		test.Error("A timeout should halve the window")
+	}
+	for i := 0; i < 5; i++ {
+		w.RoundTimedOut()
+	}
+	if w.WindowSize() != 1 {
+		test.Error("Window should never be smaller than 1")
+	}
+
+	//we wait on trustees which have nothing buffered : growing the window is useless
+	w = NewWindowController(maxWindow, 10, 15)
+	window = feedWindowController(w, 200, 10*time.Millisecond, true, 0, 0)
+	if window != 1 {
+		test.Error("Window should not grow when the trustees are the bottleneck, but is", window)
+	}
+
+	//trustee buffers are full : the window should shrink, even if nothing is queued
+	w = NewWindowController(maxWindow, 10, 15)
+	feedWindowController(w, 200, 10*time.Millisecond, false, 12, 12)
+	window = feedWindowController(w, 4*maxWindow*WINDOW_CONTROLLER_MIN_PERIOD, 10*time.Millisecond, false, 15, 15)
+	if window != 1 {
+		test.Error("Window should shrink when the trustee buffers are full, but is", window)
+	}
+
+	//invalid upper bound
+	w = NewWindowController(0, 10, 15)
+	window = feedWindowController(w, 200, 10*time.Millisecond, false, 12, 12)
+	if window != 1 {
+		test.Error("Window should be bounded by 1, but is", window)
+	}
+}
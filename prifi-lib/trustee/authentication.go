@@ -0,0 +1,51 @@
+package trustee
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+/*
+Authentication of the messages (see prifi-lib/net/authenticator.go). Once EnableAuthentication is called, the messages
+we send are authenticated with our key, and ReceivedMessage only accepts the messages authenticated by the relay,
+whose key we learn in ALL_ALL_PARAMETERS. As for the clients, REL_ALL_RESUME is only accepted if it is authenticated by
+the key of the standby relay announced in ALL_ALL_PARAMETERS.
+*/
+
+// EnableAuthentication authenticates all the messages we send from now on
+func (p *PriFiLibTrusteeInstance) EnableAuthentication() {
+	p.messageSender.SetAuthenticator(p.trusteeState.authenticator)
+}
+
+// authenticate returns an error if the message is not authenticated by the relay
+func (p *PriFiLibTrusteeInstance) authenticate(msg net.AUTHENTICATED_MESSAGE) error {
+	auth := p.trusteeState.authenticator
+	relayKey := auth.PeerKey(net.PEER_RELAY, 0)
+
+	switch typedMsg := msg.Msg.(type) {
+	case net.ALL_ALL_PARAMETERS:
+		if typedMsg.RelayPk == nil {
+			return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : received parameters without the key of the relay")
+		}
+		if relayKey != nil && !relayKey.Equal(typedMsg.RelayPk) {
+			return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : received parameters from another relay")
+		}
+		return auth.Open(msg, typedMsg.RelayPk)
+	case net.REL_ALL_RESUME:
+		standbyKey := p.trusteeState.standbyRelayPk
+		if standbyKey == nil {
+			return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : received a resume, but the relay announced no standby relay")
+		}
+		if typedMsg.RelayPk == nil || !standbyKey.Equal(typedMsg.RelayPk) {
+			return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : received a resume from another relay than the announced standby")
+		}
+		return auth.Open(msg, standbyKey)
+	}
+
+	if relayKey == nil {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : received a message, but the key of the relay is unknown")
+	}
+	return auth.Open(msg, relayKey)
+}
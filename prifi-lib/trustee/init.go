@@ -1,6 +1,7 @@
 package trustee
 
 import (
+	"context"
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
@@ -13,18 +14,16 @@ import (
 	"strings"
 )
 
-// Possible sending rates for the trustees.
-const (
-	TRUSTEE_KILL_SEND_PROCESS int16 = iota // kills the goroutine responsible for sending messages
-	TRUSTEE_RATE_ACTIVE
-	TRUSTEE_RATE_HALVED
-)
+// TRUSTEE_DEFAULT_INITIAL_CREDIT is the number of rounds a trustee may send before receiving credit, if the relay does not specify it
+const TRUSTEE_DEFAULT_INITIAL_CREDIT = 10
 
 // PriFiLibTrusteeInstance contains the mutable state of a PriFi entity.
 type PriFiLibTrusteeInstance struct {
 	messageSender *net.MessageSenderWrapper
 	trusteeState  *TrusteeState
 	stateMachine  *utils.StateMachine
+	ctx           context.Context //owns the sending goroutines of this trustee; cancelled by Stop()
+	cancel        context.CancelFunc
 }
 
 // NewPriFiClientWithState creates a new PriFi client entity state.
@@ -33,8 +32,9 @@ func NewTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, msgS
 	trusteeState := new(TrusteeState)
 
 	//init the static stuff
-	trusteeState.sendingRate = make(chan int16, 10)
+	trusteeState.sendingCredit = make(chan int32, 10)
 	trusteeState.PublicKey, trusteeState.privateKey = crypto.NewKeyPair()
+	trusteeState.authenticator = net.NewAuthenticator(trusteeState.privateKey)
 	neffShuffle := new(scheduler.NeffShuffle)
 	neffShuffle.Init()
 	trusteeState.neffShuffle = neffShuffle.TrusteeView
@@ -46,6 +46,7 @@ func NewTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, msgS
 	}
 
 	trusteeState.BaseSleepTime = baseSleepTime
+	trusteeState.InitialCredit = TRUSTEE_DEFAULT_INITIAL_CREDIT
 
 	//init the state machine
 	states := []string{"BEFORE_INIT", "INITIALIZING", "SHUFFLE_DONE", "READY", "BLAMING", "SHUTDOWN"}
@@ -62,14 +63,39 @@ func NewTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, msgS
 	}
 	sm.Init(states, logFn, errFn)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	trusteeState.sendingCtx, trusteeState.stopSending = context.WithCancel(ctx)
 	prifi := PriFiLibTrusteeInstance{
 		messageSender: msgSender,
 		trusteeState:  trusteeState,
 		stateMachine:  sm,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 	return &prifi
 }
 
+// Stop cancels the context of this trustee, which stops the sending goroutine. Can be called several times.
+func (p *PriFiLibTrusteeInstance) Stop() {
+	p.cancel()
+}
+
+// SetKeyPair replaces our long-term key pair (used for the DC-net secrets, the shuffle signatures and the
+// authentication), e.g., with a key pair loaded from a file, so that we keep the same identity across restarts.
+// It must be called before joining.
+func (p *PriFiLibTrusteeInstance) SetKeyPair(publicKey kyber.Point, privateKey kyber.Scalar) error {
+	if !crypto.IsKeyPair(publicKey, privateKey) {
+		return errors.New("Trustee : the public key does not match the private key")
+	}
+	if p.stateMachine.State() != "BEFORE_INIT" {
+		return errors.New("Trustee : cannot change the key pair in state " + p.stateMachine.State())
+	}
+	p.trusteeState.PublicKey = publicKey
+	p.trusteeState.privateKey = privateKey
+	p.trusteeState.authenticator.SetPrivateKey(privateKey)
+	return nil
+}
+
 // TrusteeState contains the mutable state of the trustee.
 type TrusteeState struct {
 	DCNet                         *dcnet.DCNetEntity
@@ -83,13 +109,20 @@ type TrusteeState struct {
 	PayloadSize                   int
 	privateKey                    kyber.Scalar
 	PublicKey                     kyber.Point
-	sendingRate                   chan int16
+	authenticator                 *net.Authenticator //verifies the messages of the relay, see authentication.go
+	standbyRelayPk                kyber.Point        //if not nil, the only relay we accept a resume from
+	sendingCredit                 chan int32         //credit updates (first round which may not be sent) for the sending goroutine
+	sendingCtx                    context.Context    //cancelled when the sending goroutine must stop (shutdown, or new parameters)
+	stopSending                   context.CancelFunc
+	senderDone                    chan struct{} //closed when the sending goroutine returned
 	sharedSecrets                 []kyber.Point
 	TrusteeID                     int
 	BaseSleepTime                 int
-	AlwaysSlowDown                bool //enforce the sleep in the sending function even if rate is FULL
-	NeverSlowDown                 bool //ignore the sleep in the sending function if rate is STOPPED
+	InitialCredit                 int  //number of rounds we may send before receiving credit from the relay. If <= 0, no flow control
+	AlwaysSlowDown                bool //enforce the sleep in the sending function even if we have credit
+	NeverSlowDown                 bool //ignore the credit granted by the relay
 	EquivocationProtectionEnabled bool
+	DisruptionProtectionEnabled   bool //if true, we keep our pads to reveal them in a blame (see Received_REL_ALL_REVEAL)
 }
 
 // NeffShuffleResult holds the result of the NeffShuffle,
@@ -106,6 +139,14 @@ func (p *PriFiLibTrusteeInstance) ReceivedMessage(msg interface{}) error {
 
 	var err error
 
+	//the messages from the network are authenticated, the others are local calls
+	if authenticated, ok := msg.(net.AUTHENTICATED_MESSAGE); ok {
+		if err := p.authenticate(authenticated); err != nil {
+			return err
+		}
+		msg = authenticated.Msg
+	}
+
 	switch typedMsg := msg.(type) {
 	case net.ALL_ALL_PARAMETERS:
 		if typedMsg.ForceParams || p.stateMachine.AssertState("BEFORE_INIT") {
@@ -125,15 +166,20 @@ func (p *PriFiLibTrusteeInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_TRU_TELL_RATE_CHANGE(typedMsg)
 		}
+	case net.REL_ALL_RESUME:
+		if p.stateMachine.State() != "READY" {
+			//we have no session to resume (e.g., we restarted); the relay will restart the protocol
+			err = errors.New("Trustee : cannot resume a session in state " + p.stateMachine.State())
+		} else {
+			err = p.Received_REL_ALL_RESUME(typedMsg)
+		}
 	case net.REL_ALL_DISRUPTION_REVEAL:
 		if p.stateMachine.AssertState("READY") {
-			log.Fatal("not implemented")
-			//err = p.Received_REL_ALL_REVEAL(typedMsg)
+			err = p.Received_REL_ALL_REVEAL(typedMsg)
 		}
 	case net.REL_ALL_DISRUPTION_SECRET:
 		if p.stateMachine.AssertState("BLAMING") {
-			log.Fatal("not implemented")
-			//err = p.Received_REL_ALL_SECRET(typedMsg)
+			err = p.Received_REL_ALL_SECRET(typedMsg)
 		}
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
@@ -10,14 +10,20 @@ Then, this file simple handle the answer to the different message kind :
 - ALL_ALL_PARAMETERS - (specialized into ALL_TRU_PARAMETERS) - used to initialize the relay over the network / overwrite its configuration
 - REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE - the client's identities (and ephemeral ones), and a base. We react by Neff-Shuffling and sending the result
 - REL_TRU_TELL_TRANSCRIPT - the Neff-Shuffle's results. We perform some checks, sign the last one, send it to the relay, and follow by continuously sending ciphers.
-- REL_TRU_TELL_RATE_CHANGE - Received when the relay requests a sending rate change, the message contains the necessary information needed to perform this change
+- REL_TRU_TELL_RATE_CHANGE - Received when the relay grants us credit, i.e., the rounds for which we may send ciphers
+- REL_ALL_RESUME - a standby relay took over the session; we continue sending ciphers from the given round
+- REL_ALL_DISRUPTION_REVEAL - a round was blamed; we stop sending, and reveal the bits of our pads at the blamed position
+- REL_ALL_DISRUPTION_SECRET - we disagree with a client on our pad; we reveal the secret we share with it, with a NIZK
 */
 
 import (
+	"context"
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"gopkg.in/dedis/kyber.v2"
 	"gopkg.in/dedis/onet.v2/log"
 	"strconv"
@@ -32,7 +38,7 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_SHUTDOWN(msg net.ALL_ALL_SHUT
 	log.Lvl1("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : Received a SHUTDOWN message. ")
 
 	//stop the sending process
-	p.trusteeState.sendingRate <- TRUSTEE_KILL_SEND_PROCESS
+	p.Stop()
 
 	p.stateMachine.ChangeState("SHUTDOWN")
 
@@ -55,6 +61,8 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 	payloadSize := msg.IntValueOrElse("PayloadSize", p.trusteeState.PayloadSize)
 	dcNetType := msg.StringValueOrElse("DCNetType", "not initilaized")
 	equivProtection := msg.BoolValueOrElse("EquivocationProtectionEnabled", false)
+	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
+	initialCredit := msg.IntValueOrElse("TrusteeInitialCredit", p.trusteeState.InitialCredit)
 
 	//sanity checks
 	if trusteeID < -1 {
@@ -82,6 +90,25 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 	p.trusteeState.PayloadSize = payloadSize
 	p.trusteeState.TrusteeID = trusteeID
 	p.trusteeState.EquivocationProtectionEnabled = equivProtection
+	p.trusteeState.DisruptionProtectionEnabled = disruptionProtection
+	p.trusteeState.InitialCredit = initialCredit
+	if msg.RelayPk != nil {
+		p.trusteeState.authenticator.SetPeerKey(net.PEER_RELAY, 0, msg.RelayPk)
+	}
+	p.trusteeState.standbyRelayPk = msg.StandbyRelayPk
+
+	//if we were already sending (i.e., the relay resyncs), stop sending the ciphers of the previous configuration, and
+	//drop its DC-net : the next one is seeded with the fresh ephemeral keys the clients rejoin with, so that its pads,
+	//which restart at round 0, differ from those of the previous configuration
+	p.trusteeState.stopSending()
+	if p.trusteeState.senderDone != nil {
+		<-p.trusteeState.senderDone
+		p.trusteeState.senderDone = nil
+	}
+	p.trusteeState.DCNet = nil
+	p.trusteeState.sendingCtx, p.trusteeState.stopSending = context.WithCancel(p.ctx)
+	p.trusteeState.sendingCredit = make(chan int32, 10)
+
 	p.trusteeState.neffShuffle.Init(trusteeID, p.trusteeState.privateKey, p.trusteeState.PublicKey)
 
 	//placeholders for pubkeys and secrets
@@ -101,8 +128,8 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 }
 
 /*
-Send_TRU_REL_PK tells the relay's public key to the relay
-(this, of course, provides no security, but this is an early version of the protocol).
+Send_TRU_REL_PK tells the trustee's public key to the relay.
+The relay binds it to our ID : our next messages must be authenticated with it (see authentication.go).
 This is the first action of the trustee.
 */
 func (p *PriFiLibTrusteeInstance) Send_TRU_REL_PK() error {
@@ -113,76 +140,76 @@ func (p *PriFiLibTrusteeInstance) Send_TRU_REL_PK() error {
 
 /*
 Send_TRU_REL_DC_CIPHER sends DC-net ciphers to the relay continuously once started.
-One can control the rate by sending flags to "rateChan".
+The relay controls the rate by granting credit : we may only send the ciphers for the rounds before the limit
+received on "creditChan" (initially, InitialCredit rounds after firstRoundID). When we run out of credit, we wait for more.
+It returns when "ctx" is cancelled (see Stop(), or when new parameters are received).
 */
-func (p *PriFiLibTrusteeInstance) Send_TRU_REL_DC_CIPHER(rateChan chan int16) {
+func (p *PriFiLibTrusteeInstance) Send_TRU_REL_DC_CIPHER(ctx context.Context, creditChan chan int32, firstRoundID int32) {
 
 	stop := false
-	currentRate := TRUSTEE_RATE_ACTIVE
-	roundID := int32(0)
+	roundID := firstRoundID
+	creditLimit := firstRoundID + int32(p.trusteeState.InitialCredit) //we may send the rounds < creditLimit
+	noFlowControl := p.trusteeState.InitialCredit <= 0 || p.trusteeState.NeverSlowDown
 
 	for !stop {
-		select {
-		case newRate := <-rateChan:
-
-			if currentRate != newRate {
-				if newRate == TRUSTEE_RATE_ACTIVE && !p.trusteeState.AlwaysSlowDown {
-					log.Lvl1("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : rate changed from " + strconv.Itoa(int(currentRate)) + " to FULL")
-				} else if newRate == TRUSTEE_RATE_HALVED && !p.trusteeState.NeverSlowDown {
-					log.Lvl1("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : rate changed from " + strconv.Itoa(int(currentRate)) + " to HALVED")
-				}
-				currentRate = newRate
-			}
-
-			if newRate == TRUSTEE_KILL_SEND_PROCESS {
+		if noFlowControl || roundID < creditLimit {
+			select {
+			case <-ctx.Done():
 				stop = true
-			}
 
-		default:
-			if currentRate == TRUSTEE_RATE_ACTIVE {
-				if p.trusteeState.AlwaysSlowDown {
-					log.Lvl4("Trustee " + strconv.Itoa(p.trusteeState.ID) + " rate FULL, sleeping for " + strconv.Itoa(p.trusteeState.BaseSleepTime))
-					time.Sleep(time.Duration(p.trusteeState.BaseSleepTime) * time.Millisecond)
-				}
-				newRoundID, err := sendData(p, roundID)
-				if err != nil {
-					stop = true
-				}
-				roundID = newRoundID
+			case newLimit := <-creditChan:
+				creditLimit = p.updateCredit(creditLimit, newLimit)
 
-			} else if currentRate == TRUSTEE_RATE_HALVED {
-				if !p.trusteeState.NeverSlowDown {
-					//sorry double neg. If NeverSlowDown = true, we skip this sleep
-					log.Lvl4("Trustee " + strconv.Itoa(p.trusteeState.ID) + " rate HALVED, sleeping for " + strconv.Itoa(p.trusteeState.BaseSleepTime))
-					time.Sleep(time.Duration(p.trusteeState.BaseSleepTime) * time.Millisecond)
+			default:
+				if p.trusteeState.AlwaysSlowDown {
+					log.Lvl4("Trustee " + strconv.Itoa(p.trusteeState.ID) + " sleeping for " + strconv.Itoa(p.trusteeState.BaseSleepTime))
+					if !utils.SleepOrCancel(ctx, time.Duration(p.trusteeState.BaseSleepTime)*time.Millisecond) {
+						stop = true
+						break
+					}
 				}
 				newRoundID, err := sendData(p, roundID)
 				if err != nil {
 					stop = true
 				}
 				roundID = newRoundID
-
-			} else {
-				log.Lvl2("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : In unrecognized sending state")
 			}
-
+		} else {
+			log.Lvl3("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : no credit left for round " + strconv.Itoa(int(roundID)) + ", waiting")
+			select {
+			case <-ctx.Done():
+				stop = true
+			case newLimit := <-creditChan:
+				creditLimit = p.updateCredit(creditLimit, newLimit)
+			}
 		}
 	}
 	log.Lvl2("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : Stopped.")
 }
 
+// updateCredit logs the credit change, and returns the new limit
+func (p *PriFiLibTrusteeInstance) updateCredit(oldLimit, newLimit int32) int32 {
+	if oldLimit != newLimit {
+		log.Lvl3("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : credit changed from round " + strconv.Itoa(int(oldLimit)) + " to " + strconv.Itoa(int(newLimit)))
+	}
+	return newLimit
+}
+
 /*
 Received_REL_TRU_TELL_RATE_CHANGE handles REL_TRU_TELL_RATE_CHANGE messages
-by changing the cipher sending rate.
-Either the trustee must stop sending because the relay is at full capacity
-or the trustee sends normally because the relay has emptied up enough capacity.
+by updating the credit of the sending goroutine : from now on, we may send the ciphers
+for the rounds < RoundID + WindowCapacity. A WindowCapacity of 0 stops the trustee.
 */
 func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_RATE_CHANGE(msg net.REL_TRU_TELL_RATE_CHANGE) error {
 
-	if msg.WindowCapacity == 0 {
-		p.trusteeState.sendingRate <- TRUSTEE_RATE_HALVED
-	} else {
-		p.trusteeState.sendingRate <- TRUSTEE_RATE_ACTIVE
+	if msg.WindowCapacity < 0 || msg.RoundID < 0 {
+		return errors.New("REL_TRU_TELL_RATE_CHANGE cannot grant a negative credit")
+	}
+
+	select {
+	case p.trusteeState.sendingCredit <- msg.RoundID + int32(msg.WindowCapacity):
+	case <-p.trusteeState.sendingCtx.Done():
+		//the sending goroutine is stopped, nobody will read this credit
 	}
 
 	return nil
@@ -237,6 +264,11 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_
 		log.Error(e)
 		return errors.New(e)
 	}
+	if len(clientsPks) != p.trusteeState.nClients || len(msg.ClientsEphPks) != len(clientsPks) {
+		e := "Trustee " + strconv.Itoa(p.trusteeState.ID) + " : len(clientsPks) and len(msg.ClientsEphPks) must be == nClients"
+		log.Error(e)
+		return errors.New(e)
+	}
 
 	//fill in the clients keys
 	for i := 0; i < len(clientsPks); i++ {
@@ -244,8 +276,18 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_
 		p.trusteeState.sharedSecrets[i] = config.CryptoSuite.Point().Mul(p.trusteeState.privateKey, clientsPks[i])
 	}
 
+	//the pads shared with each client are seeded with its ephemeral key too, fresh in each session (see dcnet.go)
 	p.trusteeState.DCNet = dcnet.NewDCNetEntity(p.trusteeState.ID, dcnet.DCNET_TRUSTEE,
-		p.trusteeState.PayloadSize, p.trusteeState.EquivocationProtectionEnabled, p.trusteeState.sharedSecrets)
+		p.trusteeState.PayloadSize, p.trusteeState.EquivocationProtectionEnabled, p.trusteeState.sharedSecrets, msg.ClientsEphPks)
+	if p.trusteeState.DisruptionProtectionEnabled {
+		//a blamed round is at most DISRUPTION_HISTORY_ROUNDS + nClients rounds old for the relay, and we run ahead of
+		//the relay by at most our credit; without flow control, old rounds may be forgotten, and the blame times out
+		historyRounds := net.DISRUPTION_HISTORY_ROUNDS + p.trusteeState.nClients
+		if p.trusteeState.InitialCredit > 0 {
+			historyRounds += p.trusteeState.InitialCredit
+		}
+		p.trusteeState.DCNet.KeepPadHistory(historyRounds)
+	}
 
 	//In case we use the simple dcnet, vkey isn't needed
 	vkey := make([]byte, 1)
@@ -286,37 +328,95 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_TRANSCRIPT(msg net.REL_T
 	p.stateMachine.ChangeState("READY")
 
 	//everything is ready, we start sending
-	go p.Send_TRU_REL_DC_CIPHER(p.trusteeState.sendingRate)
+	p.startSending(0)
 
 	return nil
 }
 
+// startSending starts the goroutine sending the ciphers from round "firstRoundID"
+func (p *PriFiLibTrusteeInstance) startSending(firstRoundID int32) {
+	done := make(chan struct{})
+	p.trusteeState.senderDone = done
+	go func() {
+		defer close(done)
+		p.Send_TRU_REL_DC_CIPHER(p.trusteeState.sendingCtx, p.trusteeState.sendingCredit, firstRoundID)
+	}()
+}
+
 /*
-Received_REL_ALL_REVEAL handles REL_ALL_REVEAL messages.
-We send back one bit per client, from the shared cipher, at bitPos
+Received_REL_ALL_RESUME handles REL_ALL_RESUME messages. They are sent by a standby relay which took over the session
+of the failed relay. We keep our keys and DC-net, and restart sending the ciphers from the given round; we refuse if we
+already sent ciphers for this round (then, the relay restarts the protocol).
 */
+func (p *PriFiLibTrusteeInstance) Received_REL_ALL_RESUME(msg net.REL_ALL_RESUME) error {
+
+	//stop the sending goroutine of the previous relay, and wait for it to be done with the DC-net
+	p.trusteeState.stopSending()
+	if p.trusteeState.senderDone != nil {
+		<-p.trusteeState.senderDone
+	}
+
+	if !p.trusteeState.DCNet.CanEncodeForRound(msg.RoundID) {
+		e := "Trustee " + strconv.Itoa(p.trusteeState.ID) + " : cannot resume at round " + strconv.Itoa(int(msg.RoundID)) + ", already sent ciphers for it"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	//the new relay authenticates its messages with its own key (the standby key, see authentication.go); it has no
+	//standby itself until it sends new parameters
+	p.trusteeState.authenticator.SetPeerKey(net.PEER_RELAY, 0, msg.RelayPk)
+	p.trusteeState.standbyRelayPk = nil
+
+	p.trusteeState.sendingCtx, p.trusteeState.stopSending = context.WithCancel(p.ctx)
+	p.trusteeState.sendingCredit = make(chan int32, 10)
+	p.startSending(msg.RoundID)
+
+	log.Lvl1("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : resumed with a new relay at round " + strconv.Itoa(int(msg.RoundID)))
+
+	return nil
+}
+
 /*
+Received_REL_ALL_REVEAL handles REL_ALL_REVEAL messages.
+We stop sending ciphers (the blame ends with a resync), and send back one bit per client, from the pad we share with
+it in the blamed round, at bitPos
+*/
 func (p *PriFiLibTrusteeInstance) Received_REL_ALL_REVEAL(msg net.REL_ALL_DISRUPTION_REVEAL) error {
+
+	p.trusteeState.stopSending()
+	if p.trusteeState.senderDone != nil {
+		<-p.trusteeState.senderDone
+	}
 	p.stateMachine.ChangeState("BLAMING")
-	bits := p.trusteeState.DCNet.RevealBits(msg.RoundID, msg.BitPos, p.trusteeState.PayloadSize)
+
+	bits, err := p.trusteeState.DCNet.RevealBits(msg.RoundID, msg.BitPos)
+	if err != nil {
+		e := "Trustee " + strconv.Itoa(p.trusteeState.ID) + " : cannot reveal the bits of round " + strconv.Itoa(int(msg.RoundID)) + ", " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
 	toSend := &net.TRU_REL_DISRUPTION_REVEAL{
 		TrusteeID: p.trusteeState.ID,
 		Bits:      bits}
 	p.messageSender.SendToRelayWithLog(toSend, "Revealed bits")
 	return nil
 }
-*/
 
 /*
 Received_REL_ALL_SECRET handles REL_ALL_SECRET messages.
-We send back the shared secret with the indicated client
+We send back the secret we share with the indicated client, with a NIZK that it is our private key times the public
+key of the client
 */
 func (p *PriFiLibTrusteeInstance) Received_REL_ALL_SECRET(msg net.REL_ALL_DISRUPTION_SECRET) error {
 
-	secret := p.trusteeState.sharedSecrets[msg.UserID]
+	if msg.UserID < 0 || msg.UserID >= len(p.trusteeState.sharedSecrets) {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : cannot reveal the secret shared with client " + strconv.Itoa(msg.UserID))
+	}
+
+	base := config.CryptoSuite.Point().Base()
 	toSend := &net.TRU_REL_DISRUPTION_SECRET{
-		Secret: secret,
-		NIZK:   make([]byte, 0)}
+		Secret: p.trusteeState.sharedSecrets[msg.UserID]}
+	toSend.NIZK = crypto.ProveDLEQ(p.trusteeState.privateKey, base, p.trusteeState.ClientPublicKeys[msg.UserID], toSend.NIZKContext())
 	p.messageSender.SendToRelayWithLog(toSend, "Sent secret to relay")
 	return nil
 }
@@ -1,11 +1,15 @@
 package trustee
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"runtime"
 	"testing"
 
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"gopkg.in/dedis/kyber.v2"
@@ -34,7 +38,7 @@ func (t *TestMessageSender) SendToRelay(msg interface{}) error {
 func (t *TestMessageSender) BroadcastToAllClients(msg interface{}) error {
 	return errors.New("Clients should never sent to other clients")
 }
-func (t *TestMessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+func (t *TestMessageSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
 	return nil
 }
 
@@ -66,8 +70,8 @@ func TestTrustee(t *testing.T) {
 	trustee := NewTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, msw)
 
 	ts := trustee.trusteeState
-	if ts.sendingRate == nil {
-		t.Error("sendingRate should not be nil")
+	if ts.sendingCredit == nil {
+		t.Error("sendingCredit should not be nil")
 	}
 	if trustee.stateMachine.State() != "BEFORE_INIT" {
 		t.Error("State was not set correctly")
@@ -173,10 +177,12 @@ func TestTrustee(t *testing.T) {
 	}
 	msg4 := toSend.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
 
-	//we inject the public keys
+	//we inject the public keys, and the ephemeral keys of the clients by ID
 	msg4.Pks = make([]kyber.Point, nClients)
+	msg4.ClientsEphPks = make([]kyber.Point, nClients)
 	for i := 0; i < nClients; i++ {
 		msg4.Pks[i] = clientPubKeys[i]
+		msg4.ClientsEphPks[i] = clientPubKeys[i]
 	}
 
 	//we receive the shuffle
@@ -244,6 +250,7 @@ func TestTrustee(t *testing.T) {
 	}
 
 	//should have sent a few ciphers before getting the stop message
+	var firstPads []byte
 	select {
 	case msg8 := <-msgSender.sentToRelay:
 		msg8_parsed := msg8.(*net.TRU_REL_DC_CIPHER)
@@ -254,6 +261,7 @@ func TestTrustee(t *testing.T) {
 		if msg8_parsed.RoundID != 0 {
 			t.Error("TRU_REL_DC_CIPHER has the wrong round ID")
 		}
+		firstPads = dcnet.DCNetCipherFromBytes(msg8_parsed.Data).Payload
 		if len(msg8_parsed.Data) != upCellSize+8 {
 			t.Error("TRU_REL_DC_CIPHER sent a payload with wrong size")
 		}
@@ -279,11 +287,13 @@ func TestTrustee(t *testing.T) {
 
 	select {
 	case _ = <-msgSender.sentToRelay:
-		//t.Error("Trustee should not have sent a TRU_REL_DC_CIPHER to the relay")
+		t.Error("Trustee should not have sent a TRU_REL_DC_CIPHER to the relay")
 	default:
 	}
 
+	//the trustee sent the rounds < TRUSTEE_DEFAULT_INITIAL_CREDIT, allow one more
 	startMsg := &net.REL_TRU_TELL_RATE_CHANGE{
+		RoundID:        TRUSTEE_DEFAULT_INITIAL_CREDIT,
 		WindowCapacity: 1,
 	}
 
@@ -310,11 +320,122 @@ func TestTrustee(t *testing.T) {
 		t.Error("Trustee should have sent a TRU_REL_DC_CIPHER to the relay")
 	}
 
+	//exactly one more
+	select {
+	case _ = <-msgSender.sentToRelay:
+		t.Error("Trustee should respect its credit")
+	default:
+	}
+
+	//a standby relay takes over; we cannot resume at a round we already sent
+	if err := trustee.ReceivedMessage(net.REL_ALL_RESUME{RoundID: 3}); err == nil {
+		t.Error("Trustee should not resume at round 3, it already sent a cipher for it")
+	}
+	if err := trustee.ReceivedMessage(net.REL_ALL_RESUME{RoundID: 1000}); err != nil {
+		t.Error("Trustee should be able to resume at round 1000, but", err)
+	}
+	if err := trustee.ReceivedMessage(net.REL_TRU_TELL_RATE_CHANGE{RoundID: 1000, WindowCapacity: 1}); err != nil {
+		t.Error("Should handle this credit message, but", err)
+	}
+	time.Sleep(time.Duration(baseSleepTime*2) * time.Millisecond)
+	select {
+	case msgX := <-msgSender.sentToRelay:
+		if msgX.(*net.TRU_REL_DC_CIPHER).RoundID != 1000 {
+			t.Error("Trustee should resume sending at round 1000, not", msgX.(*net.TRU_REL_DC_CIPHER).RoundID)
+		}
+	default:
+		t.Error("Trustee should have sent a TRU_REL_DC_CIPHER to the new relay")
+	}
+	select {
+	case _ = <-msgSender.sentToRelay:
+		t.Error("Trustee should respect the credit of the new relay")
+	default:
+	}
+
+	badMsg := &net.REL_TRU_TELL_RATE_CHANGE{
+		RoundID:        0,
+		WindowCapacity: -1,
+	}
+	if err := trustee.ReceivedMessage(*badMsg); err == nil {
+		t.Error("Should not accept a negative credit")
+	}
+
 	randomMsg := net.CLI_REL_TELL_PK_AND_EPH_PK{}
 	if err := trustee.ReceivedMessage(randomMsg); err == nil {
 		t.Error("Should not accept this CLI_REL_TELL_PK_AND_EPH_PK message")
 	}
 
+	//the relay resyncs with a bigger payload : we stop sending, and send our public key again
+	resyncMsg := new(net.ALL_ALL_PARAMETERS)
+	resyncMsg.ForceParams = true
+	resyncMsg.Add("StartNow", true)
+	resyncMsg.Add("NClients", nClients)
+	resyncMsg.Add("NTrustees", nTrustees)
+	resyncMsg.Add("PayloadSize", 2*upCellSize)
+	resyncMsg.Add("NextFreeTrusteeID", trusteeID)
+	resyncMsg.Add("DCNetType", dcNetType)
+	oldCreditChan := ts.sendingCredit
+
+	if err := trustee.ReceivedMessage(*resyncMsg); err != nil {
+		t.Error("Trustee should be able to receive this message:", err)
+	}
+	if trustee.stateMachine.State() != "INITIALIZING" {
+		t.Error("Trustee should be in state INITIALIZING")
+	}
+	if ts.PayloadSize != 2*upCellSize {
+		t.Error("PayloadSize should have been updated")
+	}
+	if ts.sendingCredit == oldCreditChan {
+		t.Error("The credit of the previous configuration should be discarded")
+	}
+	select {
+	case msgX := <-msgSender.sentToRelay:
+		_ = msgX.(*net.TRU_REL_TELL_PK)
+	default:
+		t.Error("Trustee should have sent a TRU_REL_TELL_PK to the relay")
+	}
+
+	//the previous sending goroutine is stopped, even with some credit
+	oldCreditChan <- TRUSTEE_DEFAULT_INITIAL_CREDIT + 100
+	time.Sleep(time.Duration(baseSleepTime*2) * time.Millisecond)
+	select {
+	case _ = <-msgSender.sentToRelay:
+		t.Error("Trustee should not send the ciphers of the previous configuration")
+	default:
+	}
+	if ts.DCNet != nil {
+		t.Error("Trustee should drop the DC-net of the previous configuration")
+	}
+
+	//the clients rejoin with fresh ephemeral keys : the pads of the new configuration restart at round 0, but differ
+	n = new(scheduler.NeffShuffle)
+	n.Init()
+	n.RelayView.Init(1)
+	for i := 0; i < nClients; i++ {
+		ephPk, _ := crypto.NewKeyPair()
+		n.RelayView.AddClient(ephPk)
+	}
+	toSend, _, err = n.RelayView.SendToNextTrustee()
+	if err != nil {
+		t.Error(err)
+	}
+	msg4 = toSend.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	msg4.Pks = clientPubKeys
+	msg4.ClientsEphPks = msg4.EphPks
+	if err := trustee.ReceivedMessage(*msg4); err != nil {
+		t.Error("Trustee should be able to receive this message:", err)
+	}
+	select {
+	case msgX := <-msgSender.sentToRelay:
+		_ = msgX.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+	default:
+		t.Fatal("Trustee should have sent a TRU_REL_TELL_NEW_BASE_AND_EPH_PKS to the relay")
+	}
+	newPads := dcnet.DCNetCipherFromBytes(ts.DCNet.TrusteeEncodeForRound(0)).Payload
+	if bytes.Equal(newPads[:upCellSize], firstPads) {
+		t.Error("Trustee should not repeat the pads of round 0 after a resync")
+	}
+
 	shutdownMsg := net.ALL_ALL_SHUTDOWN{}
 	if err := trustee.ReceivedMessage(shutdownMsg); err != nil {
 		t.Error("Should handle this ALL_ALL_SHUTDOWN message, but", err)
@@ -325,3 +446,147 @@ func TestTrustee(t *testing.T) {
 
 	t.SkipNow() //we started a goroutine, let's kill everything, we're good
 }
+
+func TestTrusteeStopReleasesGoroutines(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msgSender.sentToRelay = make(chan interface{}, 15)
+	msw := newTestMessageSenderWrapper(msgSender)
+
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		//the sending goroutine sleeps a long time before each round
+		trustee := NewTrustee(false, true, 3600*1000, msw)
+		go trustee.Send_TRU_REL_DC_CIPHER(trustee.trusteeState.sendingCtx, trustee.trusteeState.sendingCredit, 0)
+
+		if err := trustee.ReceivedMessage(net.ALL_ALL_SHUTDOWN{}); err != nil {
+			t.Error(err)
+		}
+		trustee.Stop() //should be idempotent
+
+		//granting credit to a stopped trustee should not block, even past the buffer of the credit channel
+		for j := 0; j < 2*cap(trustee.trusteeState.sendingCredit); j++ {
+			trustee.Received_REL_TRU_TELL_RATE_CHANGE(net.REL_TRU_TELL_RATE_CHANGE{RoundID: int32(j), WindowCapacity: 1})
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > baseline {
+		t.Error("Goroutines leaked after stopping the trustee :", runtime.NumGoroutine(), "running, baseline was", baseline)
+	}
+}
+
+func TestTrusteeKeyPair(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msgSender.sentToRelay = make(chan interface{}, 15)
+	msw := newTestMessageSenderWrapper(msgSender)
+	trustee := NewTrustee(false, false, 1000, msw)
+	trustee.EnableAuthentication()
+	ts := trustee.trusteeState
+
+	pub, priv := crypto.NewKeyPair()
+	otherPub, _ := crypto.NewKeyPair()
+	if err := trustee.SetKeyPair(otherPub, priv); err == nil {
+		t.Error("Trustee should not accept a public key which does not match the private key")
+	}
+	if err := trustee.SetKeyPair(pub, priv); err != nil {
+		t.Error(err)
+	}
+	if !ts.PublicKey.Equal(pub) || !ts.privateKey.Equal(priv) {
+		t.Error("Trustee should use the given key pair")
+	}
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("StartNow", true)
+	msg.Add("NClients", 2)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeTrusteeID", 0)
+	msg.Add("DCNetType", "Simple")
+	if err := trustee.ReceivedMessage(*msg); err != nil {
+		t.Error("Trustee should be able to receive this message:", err)
+	}
+
+	//we tell the key pair we were given, authenticated with it
+	select {
+	case sent := <-msgSender.sentToRelay:
+		authenticated := sent.(*net.AUTHENTICATED_MESSAGE)
+		if !authenticated.Msg.(*net.TRU_REL_TELL_PK).Pk.Equal(pub) {
+			t.Error("Trustee did not send the given public key")
+		}
+		if err := net.NewAuthenticator(priv).Open(*authenticated, pub); err != nil {
+			t.Error("Trustee should authenticate its messages with the given key pair,", err)
+		}
+	default:
+		t.Error("Trustee should have sent a TRU_REL_TELL_PK to the relay")
+	}
+
+	//once we joined, our key pair cannot change
+	newPub, newPriv := crypto.NewKeyPair()
+	if err := trustee.SetKeyPair(newPub, newPriv); err == nil {
+		t.Error("Trustee should not change its key pair once initialized")
+	}
+	trustee.Stop()
+}
+
+func TestTrusteeAuthenticatedResume(t *testing.T) {
+
+	msgSender := new(TestMessageSender)
+	msgSender.sentToRelay = make(chan interface{}, 15)
+	msw := newTestMessageSenderWrapper(msgSender)
+	trustee := NewTrustee(false, false, 1000, msw)
+	trustee.EnableAuthentication()
+
+	relayPub, relayPriv := crypto.NewKeyPair()
+	standbyPub, standbyPriv := crypto.NewKeyPair()
+	attackerPub, attackerPriv := crypto.NewKeyPair()
+	relay := net.NewAuthenticator(relayPriv)
+	standby := net.NewAuthenticator(standbyPriv)
+	attacker := net.NewAuthenticator(attackerPriv)
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("StartNow", true)
+	msg.Add("NClients", 2)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("NextFreeTrusteeID", 0)
+	msg.Add("DCNetType", "Simple")
+	msg.RelayPk = relayPub
+	msg.StandbyRelayPk = standbyPub
+	sealed, _ := relay.Seal(net.PEER_TRUSTEE, 0, *msg)
+	if err := trustee.ReceivedMessage(*sealed); err != nil {
+		t.Error("Trustee should be able to receive this message:", err)
+	}
+
+	//anyone can sign a resume with its own key, but only the announced standby relay can take over
+	forged, _ := attacker.Seal(net.PEER_TRUSTEE, 0, net.REL_ALL_RESUME{RoundID: 1000, RelayPk: attackerPub})
+	if err := trustee.authenticate(*forged); err == nil {
+		t.Error("Trustee should not accept a resume from a relay which is not the announced standby")
+	}
+	forged, _ = attacker.Seal(net.PEER_TRUSTEE, 0, net.REL_ALL_RESUME{RoundID: 1000, RelayPk: standbyPub})
+	if err := trustee.authenticate(*forged); err == nil {
+		t.Error("Trustee should not accept a resume in the name of the standby relay")
+	}
+	resume, _ := standby.Seal(net.PEER_TRUSTEE, 0, net.REL_ALL_RESUME{RoundID: 1000, RelayPk: standbyPub})
+	if err := trustee.authenticate(*resume); err != nil {
+		t.Error("Trustee should accept a resume from the announced standby relay, but", err)
+	}
+
+	//without an announced standby relay, no one can take over
+	msg.StandbyRelayPk = nil
+	sealed, _ = relay.Seal(net.PEER_TRUSTEE, 0, *msg)
+	if err := trustee.ReceivedMessage(*sealed); err != nil {
+		t.Error("Trustee should be able to receive this message:", err)
+	}
+	if err := trustee.authenticate(*resume); err == nil {
+		t.Error("Trustee should not accept a resume if the relay announced no standby relay")
+	}
+	trustee.Stop()
+}
@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+ * To replay only a part of a capture (e.g., the packets a client sent, or one connection), the packets are filtered
+ * on their 5-tuple. A filter is a list of space-separated "key=value" terms, which must all match :
+ *
+ *  proto=tcp|udp|<number>  src=<ip>  dst=<ip>  sport=<port>  dport=<port>  host=<ip>  port=<port>
+ *
+ * "host" (resp. "port") matches either the source or the destination. For instance, "src=10.0.0.2" keeps the packets
+ * sent by 10.0.0.2 (its outbound direction), and "dst=10.0.0.2 proto=tcp sport=443" its inbound HTTPS traffic.
+ * The packets which are not IP do not match a non-empty filter.
+ */
+
+// IP protocol numbers
+const (
+	IPPROTO_TCP = 6
+	IPPROTO_UDP = 17
+)
+
+// PacketFlow is the 5-tuple of a packet; the ports are 0 if the protocol is neither TCP nor UDP
+type PacketFlow struct {
+	Protocol int
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  int
+	DstPort  int
+}
+
+// PCAPFilter selects packets by their 5-tuple; a zero field matches anything
+type PCAPFilter struct {
+	Protocol int
+	SrcIP    net.IP
+	DstIP    net.IP
+	HostIP   net.IP
+	SrcPort  int
+	DstPort  int
+	Port     int
+}
+
+// ParsePCAPFilter parses a filter such as "src=10.0.0.2 proto=tcp"; the empty string gives a nil filter
+func ParsePCAPFilter(s string) (*PCAPFilter, error) {
+	terms := strings.Fields(s)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	f := new(PCAPFilter)
+	for _, term := range terms {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.New("Invalid PCAP filter term \"" + term + "\", expected key=value")
+		}
+		key, value := kv[0], kv[1]
+
+		var err error
+		switch key {
+		case "proto":
+			f.Protocol, err = parseProtocol(value)
+		case "src":
+			f.SrcIP, err = parseIP(value)
+		case "dst":
+			f.DstIP, err = parseIP(value)
+		case "host":
+			f.HostIP, err = parseIP(value)
+		case "sport":
+			f.SrcPort, err = parsePort(value)
+		case "dport":
+			f.DstPort, err = parsePort(value)
+		case "port":
+			f.Port, err = parsePort(value)
+		default:
+			err = errors.New("unknown key \"" + key + "\"")
+		}
+		if err != nil {
+			return nil, errors.New("Invalid PCAP filter term \"" + term + "\": " + err.Error())
+		}
+	}
+	return f, nil
+}
+
+func parseProtocol(value string) (int, error) {
+	switch value {
+	case "tcp":
+		return IPPROTO_TCP, nil
+	case "udp":
+		return IPPROTO_UDP, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > 255 {
+		return 0, errors.New("expected tcp, udp or a protocol number")
+	}
+	return n, nil
+}
+
+func parseIP(value string) (net.IP, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.New("expected an IP address")
+	}
+	return ip, nil
+}
+
+func parsePort(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > 65535 {
+		return 0, errors.New("expected a port number")
+	}
+	return n, nil
+}
+
+// Matches returns true if the packet with this flow (nil if it is not IP) passes the filter. A nil filter matches all.
+func (f *PCAPFilter) Matches(flow *PacketFlow) bool {
+	if f == nil {
+		return true
+	}
+	if flow == nil {
+		return false
+	}
+	if f.Protocol != 0 && f.Protocol != flow.Protocol {
+		return false
+	}
+	if f.SrcIP != nil && !f.SrcIP.Equal(flow.SrcIP) {
+		return false
+	}
+	if f.DstIP != nil && !f.DstIP.Equal(flow.DstIP) {
+		return false
+	}
+	if f.HostIP != nil && !f.HostIP.Equal(flow.SrcIP) && !f.HostIP.Equal(flow.DstIP) {
+		return false
+	}
+	if f.SrcPort != 0 && f.SrcPort != flow.SrcPort {
+		return false
+	}
+	if f.DstPort != 0 && f.DstPort != flow.DstPort {
+		return false
+	}
+	if f.Port != 0 && f.Port != flow.SrcPort && f.Port != flow.DstPort {
+		return false
+	}
+	return true
+}
+
+// DecodePacket returns the 5-tuple of a captured packet, and its transport payload (the data of the TCP or UDP
+// segment, otherwise what follows the IP header). It returns an error if the packet is not IP, or is truncated.
+func DecodePacket(pkt CapturedPacket) (*PacketFlow, []byte, error) {
+	ipPacket, err := linkPayload(pkt.LinkType, pkt.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ipPacket) < 1 {
+		return nil, nil, errors.New("empty IP packet")
+	}
+
+	flow := new(PacketFlow)
+	var transport []byte
+	fragmented := false
+
+	switch ipPacket[0] >> 4 {
+	case 4:
+		if len(ipPacket) < 20 {
+			return nil, nil, errors.New("truncated IPv4 header")
+		}
+		headerLength := int(ipPacket[0]&0x0F) * 4
+		totalLength := int(binary.BigEndian.Uint16(ipPacket[2:4]))
+		if headerLength < 20 || len(ipPacket) < headerLength {
+			return nil, nil, errors.New("truncated IPv4 header")
+		}
+		if totalLength >= headerLength && totalLength < len(ipPacket) {
+			ipPacket = ipPacket[:totalLength] //removes the link-layer padding
+		}
+		flow.Protocol = int(ipPacket[9])
+		flow.SrcIP = net.IP(ipPacket[12:16])
+		flow.DstIP = net.IP(ipPacket[16:20])
+		fragmented = binary.BigEndian.Uint16(ipPacket[6:8])&0x1FFF != 0
+		transport = ipPacket[headerLength:]
+
+	case 6:
+		if len(ipPacket) < 40 {
+			return nil, nil, errors.New("truncated IPv6 header")
+		}
+		payloadLength := int(binary.BigEndian.Uint16(ipPacket[4:6]))
+		if 40+payloadLength < len(ipPacket) {
+			ipPacket = ipPacket[:40+payloadLength]
+		}
+		flow.SrcIP = net.IP(ipPacket[8:24])
+		flow.DstIP = net.IP(ipPacket[24:40])
+		nextHeader := int(ipPacket[6])
+		transport = ipPacket[40:]
+
+		//skip the extension headers
+	extensionHeaders:
+		for {
+			switch nextHeader {
+			case 0, 43, 60: //hop-by-hop, routing, destination options
+				if len(transport) < 8 || len(transport) < (int(transport[1])+1)*8 {
+					return nil, nil, errors.New("truncated IPv6 extension header")
+				}
+				nextHeader, transport = int(transport[0]), transport[(int(transport[1])+1)*8:]
+			case 44: //fragment
+				if len(transport) < 8 {
+					return nil, nil, errors.New("truncated IPv6 fragment header")
+				}
+				fragmented = binary.BigEndian.Uint16(transport[2:4])&0xFFF8 != 0
+				nextHeader, transport = int(transport[0]), transport[8:]
+			default:
+				break extensionHeaders
+			}
+		}
+		flow.Protocol = nextHeader
+
+	default:
+		return nil, nil, errors.New("not an IP packet")
+	}
+
+	//only the first fragment has the transport header
+	if fragmented {
+		return flow, transport, nil
+	}
+
+	switch flow.Protocol {
+	case IPPROTO_TCP:
+		if len(transport) < 20 || len(transport) < int(transport[12]>>4)*4 {
+			return nil, nil, errors.New("truncated TCP header")
+		}
+		flow.SrcPort = int(binary.BigEndian.Uint16(transport[0:2]))
+		flow.DstPort = int(binary.BigEndian.Uint16(transport[2:4]))
+		transport = transport[int(transport[12]>>4)*4:]
+	case IPPROTO_UDP:
+		if len(transport) < 8 {
+			return nil, nil, errors.New("truncated UDP header")
+		}
+		flow.SrcPort = int(binary.BigEndian.Uint16(transport[0:2]))
+		flow.DstPort = int(binary.BigEndian.Uint16(transport[2:4]))
+		transport = transport[8:]
+	}
+	return flow, transport, nil
+}
+
+// linkPayload removes the link-layer header of a packet
+func linkPayload(linkType uint32, data []byte) ([]byte, error) {
+	switch linkType {
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		return data, nil
+
+	case LINKTYPE_NULL:
+		if len(data) < 4 {
+			return nil, errors.New("truncated loopback header")
+		}
+		return data[4:], nil
+
+	case LINKTYPE_ETHERNET:
+		if len(data) < 14 {
+			return nil, errors.New("truncated Ethernet header")
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		//skip the VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return nil, errors.New("not an IP packet (EtherType " + strconv.FormatUint(uint64(etherType), 16) + ")")
+		}
+		return data, nil
+
+	case LINKTYPE_LINUX_SLL:
+		if len(data) < 16 {
+			return nil, errors.New("truncated Linux cooked header")
+		}
+		return data[16:], nil
+	}
+	return nil, errors.New("unsupported link type " + strconv.Itoa(int(linkType)))
+}
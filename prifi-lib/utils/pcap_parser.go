@@ -3,15 +3,25 @@ package utils
 import (
 	"encoding/binary"
 	"errors"
-	"github.com/Lukasa/gopcap"
 	"gopkg.in/dedis/onet.v2/log"
 	"math/rand"
 	"os"
+	"strconv"
 	"time"
 )
 
-const pattern uint16 = uint16(21845) //0101010101010101
-const metaMessageLength int = 15     // 2bytes pattern + 4bytes ID + 8bytes timeStamp + 1 bit fragmentation
+const pattern uint16 = uint16(21845)    //0101010101010101
+const metaMessageLength int = 15        // 2bytes pattern + 4bytes ID + 8bytes timeStamp + 1 byte flags
+const payloadMetaMessageLength int = 17 // a meta message + 2bytes length, followed by the payload
+
+// The flags of a meta message
+const (
+	PCAP_FLAG_FINAL_FRAGMENT byte = 1 // the last fragment of a packet
+	PCAP_FLAG_HAS_PAYLOAD    byte = 2 // followed by the length and the real payload of the packet
+)
+
+// PCAP_MAX_RANDOM_OFFSET is the maximum random time (in ms) added to all the times of a capture
+const PCAP_MAX_RANDOM_OFFSET = 10000
 
 // Packet is an ID(Packet number), TimeSent in microsecond, and some Data
 type Packet struct {
@@ -21,70 +31,153 @@ type Packet struct {
 	RealLength                int
 }
 
+// PCAPReplayOptions tells which packets of a capture are replayed, and how
+type PCAPReplayOptions struct {
+	RealPayloads bool        // if true, the packets carry their real payload after the meta message; otherwise, only the meta message
+	TimeScale    float64     // the times of the capture are multiplied by this factor, e.g., 2 replays twice slower; 0 means 1
+	Seed         int64       // the seed of the random offset; 0 means a random seed
+	Filter       *PCAPFilter // only the packets matching it are replayed; nil means all
+}
+
 // Parses a .pcap file, and returns all valid packets. A packet is (ID, TimeSent [micros], Data)
 func ParsePCAP(path string, maxPayloadLength int) ([]Packet, error) {
+	return ParsePCAPWithOptions(path, maxPayloadLength, PCAPReplayOptions{})
+}
+
+// ParsePCAPWithOptions parses a .pcap or .pcapng file, and returns the packets to replay. A random offset in
+// [0, PCAP_MAX_RANDOM_OFFSET] ms is added to all times. Packets bigger than maxPayloadLength are fragmented.
+func ParsePCAPWithOptions(path string, maxPayloadLength int, options PCAPReplayOptions) ([]Packet, error) {
 	pcapfile, err := os.Open(path)
 	if err != nil {
-		return nil, errors.New("Cannot open" + path + "error is" + err.Error())
+		return nil, errors.New("Cannot open " + path + ", error is " + err.Error())
 	}
-	parsed, err := gopcap.Parse(pcapfile)
+	defer pcapfile.Close()
+
+	captured, err := ReadCapture(pcapfile)
 	if err != nil {
-		return nil, errors.New("Cannot parse" + path + "error is" + err.Error())
+		return nil, errors.New("Cannot parse " + path + ", error is " + err.Error())
+	}
+	if options.RealPayloads && maxPayloadLength <= payloadMetaMessageLength {
+		return nil, errors.New("Cannot replay real payloads in cells of " + strconv.Itoa(maxPayloadLength) + " bytes")
 	}
 
-	out := make([]Packet, 0)
-
-	if len(parsed.Packets) == 0 {
-		return out, nil
+	timeScale := options.TimeScale
+	if timeScale <= 0 {
+		timeScale = 1
+	}
+	seed := options.Seed
+	if seed == 0 {
+		seed = time.Now().UTC().UnixNano()
 	}
+	random_offset := uint64(rand.New(rand.NewSource(seed)).Intn(PCAP_MAX_RANDOM_OFFSET)) // r is in ms
 
-	time0 := parsed.Packets[0].Timestamp.Nanoseconds()
+	out := make([]Packet, 0)
+	var time0 time.Duration
+	id := uint32(0)
 
-	// Adds a random number \in [0, 10] sec to all times
-	rand.Seed(time.Now().UTC().UnixNano())
-	random_offset := uint64(rand.Intn(10000)) // r is in ms
+	for _, pkt := range captured {
 
-	for id, pkt := range parsed.Packets {
+		flow, payload, err := DecodePacket(pkt)
+		if err != nil {
+			// not an IP packet (or truncated) : it can only be replayed without filter, as a whole
+			flow = nil
+			payload = pkt.Data
+		}
+		if !options.Filter.Matches(flow) {
+			continue
+		}
+		if id == 0 {
+			time0 = pkt.Timestamp
+		}
 
-		t := uint64((pkt.Timestamp.Nanoseconds()-time0)/1000000) + random_offset
-		remainingLen := int(pkt.IncludedLen)
+		t := uint64(float64(pkt.Timestamp-time0)*timeScale/float64(time.Millisecond)) + random_offset
 
-		//maybe this packet is bigger than the payload size. Then, generate many packets
-		for remainingLen > maxPayloadLength {
-			p2 := Packet{
-				ID:     uint32(id),
-				Header: metaBytes(maxPayloadLength, uint32(id), t, false),
-				MsSinceBeginningOfCapture: t,
-				RealLength:                maxPayloadLength,
-			}
-			out = append(out, p2)
-			remainingLen -= maxPayloadLength
+		if options.RealPayloads {
+			out = append(out, payloadPackets(id, t, payload, maxPayloadLength)...)
+		} else {
+			out = append(out, metaPackets(id, t, len(pkt.Data), maxPayloadLength)...)
 		}
+		id++
+	}
 
-		//add the last packet, that will trigger the relay pattern match
-		if remainingLen < metaMessageLength {
-			remainingLen = metaMessageLength
-		}
-		p := Packet{
-			ID:     uint32(id),
-			Header: metaBytes(remainingLen, uint32(id), t, true),
+	return out, nil
+}
+
+// metaPackets returns the meta messages replaying a packet of "length" bytes : they only contain its ID and time, but
+// account for its length
+func metaPackets(id uint32, t uint64, length int, maxPayloadLength int) []Packet {
+	out := make([]Packet, 0)
+	remainingLen := length
+
+	//maybe this packet is bigger than the payload size. Then, generate many packets
+	for remainingLen > maxPayloadLength {
+		p2 := Packet{
+			ID:                        id,
+			Header:                    metaBytes(maxPayloadLength, id, t, false),
 			MsSinceBeginningOfCapture: t,
-			RealLength:                remainingLen,
+			RealLength:                maxPayloadLength,
 		}
-		out = append(out, p)
+		out = append(out, p2)
+		remainingLen -= maxPayloadLength
 	}
 
-	return out, nil
+	//add the last packet, that will trigger the relay pattern match
+	if remainingLen < metaMessageLength {
+		remainingLen = metaMessageLength
+	}
+	p := Packet{
+		ID:                        id,
+		Header:                    metaBytes(remainingLen, id, t, true),
+		MsSinceBeginningOfCapture: t,
+		RealLength:                remainingLen,
+	}
+	return append(out, p)
 }
 
-func getPayloadOrRandom(pkt gopcap.Packet, packetID uint32, msSinceBeginningOfCapture uint64) []byte {
-	len := pkt.IncludedLen
+// payloadPackets returns the meta messages replaying "payload", each followed by a fragment of it
+func payloadPackets(id uint32, t uint64, payload []byte, maxPayloadLength int) []Packet {
+	out := make([]Packet, 0)
+	maxFragmentLength := maxPayloadLength - payloadMetaMessageLength
 
-	if true || pkt.Data == nil {
-		return metaBytes(int(len), packetID, msSinceBeginningOfCapture, false)
+	for {
+		fragment := payload
+		final := len(fragment) <= maxFragmentLength
+		if !final {
+			fragment = payload[:maxFragmentLength]
+		}
+		header := payloadMetaBytes(id, t, final, fragment)
+		out = append(out, Packet{
+			ID:                        id,
+			Header:                    header,
+			MsSinceBeginningOfCapture: t,
+			RealLength:                len(header),
+		})
+		if final {
+			return out
+		}
+		payload = payload[maxFragmentLength:]
 	}
+}
 
-	return pkt.Data.LinkData().InternetData().TransportData()
+// DecodePCAPMetaMessages calls "handler" for each meta message at the beginning of "data" (a cell can contain several
+// packets), and returns false if "data" does not start with a meta message
+func DecodePCAPMetaMessages(data []byte, handler func(ID uint32, timeSentInPcap uint64, isFinalFragment bool)) bool {
+	pos := 0
+	for pos+metaMessageLength <= len(data) && binary.BigEndian.Uint16(data[pos:pos+2]) == pattern {
+		ID := binary.BigEndian.Uint32(data[pos+2 : pos+6])
+		timestamp := binary.BigEndian.Uint64(data[pos+6 : pos+14])
+		flags := data[pos+14]
+		handler(ID, timestamp, flags&PCAP_FLAG_FINAL_FRAGMENT != 0)
+		pos += metaMessageLength
+
+		if flags&PCAP_FLAG_HAS_PAYLOAD != 0 {
+			if pos+2 > len(data) {
+				break
+			}
+			pos += 2 + int(binary.BigEndian.Uint16(data[pos:pos+2]))
+		}
+	}
+	return pos > 0
 }
 
 func metaBytes(length int, packetID uint32, timeSentInPcap uint64, isFinalPacket bool) []byte {
@@ -99,11 +192,21 @@ func metaBytes(length int, packetID uint32, timeSentInPcap uint64, isFinalPacket
 	binary.BigEndian.PutUint64(out[6:14], timeSentInPcap)
 	out[14] = byte(0)
 	if isFinalPacket {
-		out[14] = byte(1)
+		out[14] = PCAP_FLAG_FINAL_FRAGMENT
 	}
 	return out
 }
 
+// payloadMetaBytes returns a meta message followed by "payload"
+func payloadMetaBytes(packetID uint32, timeSentInPcap uint64, isFinalPacket bool, payload []byte) []byte {
+	out := make([]byte, payloadMetaMessageLength+len(payload))
+	copy(out, metaBytes(metaMessageLength, packetID, timeSentInPcap, isFinalPacket))
+	out[14] |= PCAP_FLAG_HAS_PAYLOAD
+	binary.BigEndian.PutUint16(out[15:17], uint16(len(payload)))
+	copy(out[17:], payload)
+	return out
+}
+
 func recognizableBytes(length int, packetID uint32) []byte {
 	if length == 0 {
 		return make([]byte, 0)
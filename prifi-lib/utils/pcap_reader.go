@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+ * This file reads the packets of a capture, either in the libpcap format (.pcap, microsecond or nanosecond timestamps)
+ * or in the pcapng format (.pcapng, with any number of sections and interfaces). The format is detected from the
+ * content of the file, not from its name. In a pcapng file, the Enhanced Packet Blocks and the (obsolete) Packet
+ * Blocks are read; the Simple Packet Blocks, which have no timestamp, are ignored.
+ */
+
+// The link types we can decode (see http://www.tcpdump.org/linktypes.html)
+const (
+	LINKTYPE_NULL      uint32 = 0
+	LINKTYPE_ETHERNET  uint32 = 1
+	LINKTYPE_RAW       uint32 = 101
+	LINKTYPE_LINUX_SLL uint32 = 113
+	LINKTYPE_IPV4      uint32 = 228
+	LINKTYPE_IPV6      uint32 = 229
+)
+
+const pcapMagicMicroseconds uint32 = 0xa1b2c3d4
+const pcapMagicNanoseconds uint32 = 0xa1b23c4d
+const pcapngSectionHeader uint32 = 0x0A0D0D0A
+const pcapngByteOrderMagic uint32 = 0x1A2B3C4D
+const pcapngInterfaceDescription uint32 = 1
+const pcapngPacket uint32 = 2
+const pcapngEnhancedPacket uint32 = 6
+const pcapngOptionTsResol uint16 = 9
+
+// maxCaptureBlockLength bounds the size of a record, so that a corrupted file cannot make us allocate gigabytes
+const maxCaptureBlockLength = 16 * 1024 * 1024
+
+// CapturedPacket is a packet read from a capture file
+type CapturedPacket struct {
+	Timestamp      time.Duration // since the epoch
+	OriginalLength int           // the length of the packet on the wire
+	Data           []byte        // the captured bytes, maybe less than OriginalLength
+	LinkType       uint32
+}
+
+// ReadCapture reads all the packets of a pcap or pcapng capture, sorted by timestamp
+func ReadCapture(r io.Reader) ([]CapturedPacket, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, errors.New("Cannot read the capture header, error is " + err.Error())
+	}
+
+	var packets []CapturedPacket
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		packets, err = readPCAPNG(br)
+	} else {
+		packets, err = readPCAP(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//the interfaces of a pcapng file may be interleaved out of order
+	sort.SliceStable(packets, func(i, j int) bool {
+		return packets[i].Timestamp < packets[j].Timestamp
+	})
+	return packets, nil
+}
+
+// readPCAP reads a libpcap file
+func readPCAP(r io.Reader) ([]CapturedPacket, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("Cannot read the pcap header, error is " + err.Error())
+	}
+
+	var order binary.ByteOrder
+	var tsUnit time.Duration
+	switch {
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagicMicroseconds:
+		order, tsUnit = binary.LittleEndian, time.Microsecond
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagicMicroseconds:
+		order, tsUnit = binary.BigEndian, time.Microsecond
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagicNanoseconds:
+		order, tsUnit = binary.LittleEndian, time.Nanosecond
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagicNanoseconds:
+		order, tsUnit = binary.BigEndian, time.Nanosecond
+	default:
+		return nil, errors.New("Not a pcap or pcapng capture, magic number is " + strconv.FormatUint(uint64(binary.BigEndian.Uint32(header[0:4])), 16))
+	}
+	linkType := order.Uint32(header[20:24]) & 0x0FFFFFFF //the upper bits are the FCS length
+
+	packets := make([]CapturedPacket, 0)
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, errors.New("Cannot read the header of pcap record " + strconv.Itoa(len(packets)) + ", error is " + err.Error())
+		}
+		tsSec := order.Uint32(record[0:4])
+		tsFrac := order.Uint32(record[4:8])
+		capturedLength := order.Uint32(record[8:12])
+		originalLength := order.Uint32(record[12:16])
+		if capturedLength > maxCaptureBlockLength {
+			return nil, errors.New("pcap record " + strconv.Itoa(len(packets)) + " is too large (" + strconv.FormatUint(uint64(capturedLength), 10) + " bytes)")
+		}
+
+		data := make([]byte, capturedLength)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, errors.New("Cannot read pcap record " + strconv.Itoa(len(packets)) + ", error is " + err.Error())
+		}
+		packets = append(packets, CapturedPacket{
+			Timestamp:      time.Duration(tsSec)*time.Second + time.Duration(tsFrac)*tsUnit,
+			OriginalLength: int(originalLength),
+			Data:           data,
+			LinkType:       linkType,
+		})
+	}
+}
+
+// pcapngInterface is what we need to know about an interface of a pcapng section
+type pcapngInterface struct {
+	linkType uint32
+	tsResol  byte // as in the if_tsresol option
+}
+
+// readPCAPNG reads a pcapng file
+func readPCAPNG(r io.Reader) ([]CapturedPacket, error) {
+	packets := make([]CapturedPacket, 0)
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapngInterface
+
+	blockHeader := make([]byte, 8)
+	for blockNo := 0; ; blockNo++ {
+		if _, err := io.ReadFull(r, blockHeader); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, errors.New("Cannot read the header of pcapng block " + strconv.Itoa(blockNo) + ", error is " + err.Error())
+		}
+
+		//a section header gives the byte order of all the blocks of its section, including its own length
+		blockType := order.Uint32(blockHeader[0:4])
+		if binary.LittleEndian.Uint32(blockHeader[0:4]) == pcapngSectionHeader {
+			blockType = pcapngSectionHeader
+			byteOrderMagic := make([]byte, 4)
+			if _, err := io.ReadFull(r, byteOrderMagic); err != nil {
+				return nil, errors.New("Cannot read pcapng section header, error is " + err.Error())
+			}
+			switch {
+			case binary.LittleEndian.Uint32(byteOrderMagic) == pcapngByteOrderMagic:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(byteOrderMagic) == pcapngByteOrderMagic:
+				order = binary.BigEndian
+			default:
+				return nil, errors.New("Invalid byte-order magic in pcapng block " + strconv.Itoa(blockNo))
+			}
+			interfaces = nil
+			blockHeader = append(blockHeader[0:8:8], byteOrderMagic...)
+		}
+
+		blockLength := order.Uint32(blockHeader[4:8])
+		if blockLength%4 != 0 || blockLength < uint32(len(blockHeader))+4 || blockLength > maxCaptureBlockLength {
+			return nil, errors.New("Invalid length " + strconv.FormatUint(uint64(blockLength), 10) + " of pcapng block " + strconv.Itoa(blockNo))
+		}
+		body := make([]byte, int(blockLength)-len(blockHeader))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, errors.New("Cannot read pcapng block " + strconv.Itoa(blockNo) + ", error is " + err.Error())
+		}
+		body = body[:len(body)-4] //the trailing copy of the length
+		blockHeader = blockHeader[0:8]
+
+		switch blockType {
+		case pcapngInterfaceDescription:
+			if len(body) < 8 {
+				return nil, errors.New("pcapng interface description block " + strconv.Itoa(blockNo) + " is too short")
+			}
+			iface := pcapngInterface{linkType: uint32(order.Uint16(body[0:2])), tsResol: 6}
+			if value := pcapngOption(order, body[8:], pcapngOptionTsResol); len(value) > 0 {
+				iface.tsResol = value[0]
+			}
+			interfaces = append(interfaces, iface)
+
+		case pcapngEnhancedPacket, pcapngPacket:
+			if len(body) < 20 {
+				return nil, errors.New("pcapng packet block " + strconv.Itoa(blockNo) + " is too short")
+			}
+			var interfaceID uint32
+			if blockType == pcapngEnhancedPacket {
+				interfaceID = order.Uint32(body[0:4])
+			} else {
+				interfaceID = uint32(order.Uint16(body[0:2]))
+			}
+			if int(interfaceID) >= len(interfaces) {
+				return nil, errors.New("pcapng packet block " + strconv.Itoa(blockNo) + " refers to an unknown interface " + strconv.Itoa(int(interfaceID)))
+			}
+			iface := interfaces[interfaceID]
+			ts := uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12]))
+			capturedLength := order.Uint32(body[12:16])
+			originalLength := order.Uint32(body[16:20])
+			if uint64(capturedLength) > uint64(len(body)-20) {
+				return nil, errors.New("pcapng packet block " + strconv.Itoa(blockNo) + " is shorter than its packet")
+			}
+			data := make([]byte, capturedLength)
+			copy(data, body[20:])
+
+			packets = append(packets, CapturedPacket{
+				Timestamp:      pcapngTimestamp(ts, iface.tsResol),
+				OriginalLength: int(originalLength),
+				Data:           data,
+				LinkType:       iface.linkType,
+			})
+		}
+	}
+}
+
+// pcapngOption returns the value of the first option "code" in "options", or nil
+func pcapngOption(order binary.ByteOrder, options []byte, code uint16) []byte {
+	for len(options) >= 4 {
+		optionCode := order.Uint16(options[0:2])
+		optionLength := int(order.Uint16(options[2:4]))
+		if optionCode == 0 || 4+optionLength > len(options) {
+			return nil
+		}
+		if optionCode == code {
+			return options[4 : 4+optionLength]
+		}
+		options = options[4+(optionLength+3)/4*4:]
+	}
+	return nil
+}
+
+// pcapngTimestamp converts a timestamp in units of the if_tsresol "tsResol" : 10^-tsResol seconds, or 2^-tsResol
+// seconds if its most significant bit is set
+func pcapngTimestamp(ts uint64, tsResol byte) time.Duration {
+	exponent := int(tsResol & 0x7F)
+	if tsResol&0x80 != 0 {
+		return time.Duration(float64(ts) * float64(time.Second) / math.Exp2(float64(exponent)))
+	}
+	if exponent <= 9 {
+		return time.Duration(ts * uint64(math.Pow10(9-exponent)))
+	}
+	return time.Duration(ts / uint64(math.Pow10(exponent-9)))
+}
@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ipv4UDP returns an IPv4/UDP packet
+func ipv4UDP(src, dst []byte, sport, dport int, payload []byte) []byte {
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[9] = IPPROTO_UDP
+	copy(pkt[12:16], src)
+	copy(pkt[16:20], dst)
+	binary.BigEndian.PutUint16(pkt[20:22], uint16(sport))
+	binary.BigEndian.PutUint16(pkt[22:24], uint16(dport))
+	binary.BigEndian.PutUint16(pkt[24:26], uint16(8+len(payload)))
+	copy(pkt[28:], payload)
+	return pkt
+}
+
+// ethernet wraps an IP packet in an Ethernet frame, with some padding
+func ethernet(ipPacket []byte) []byte {
+	frame := make([]byte, 14, 14+len(ipPacket)+4)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	frame = append(frame, ipPacket...)
+	return append(frame, 0, 0, 0, 0)
+}
+
+// writePCAP returns a little-endian, microsecond pcap file with the given frames, 10 ms apart
+func writePCAP(linkType uint32, frames [][]byte) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagicMicroseconds)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], linkType)
+	buf.Write(header)
+
+	for i, frame := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], 1000)
+		binary.LittleEndian.PutUint32(record[4:8], uint32(i*10000))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+		buf.Write(record)
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// pcapngBlock returns a big-endian pcapng block
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(block[0:4], blockType)
+	binary.BigEndian.PutUint32(block[4:8], uint32(12+len(body)))
+	block = append(block, body...)
+	return append(block, block[4:8]...)
+}
+
+// writePCAPNG returns a big-endian pcapng file with two interfaces (in ms and in ns), and the given frames on
+// alternating interfaces, 10 ms apart but written in reverse order
+func writePCAPNG(frames [][]byte) []byte {
+	var buf bytes.Buffer
+
+	shb := make([]byte, 16)
+	binary.BigEndian.PutUint32(shb[0:4], pcapngByteOrderMagic)
+	binary.BigEndian.PutUint16(shb[4:6], 1)
+	binary.BigEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF)
+	buf.Write(pcapngBlock(pcapngSectionHeader, shb))
+
+	for _, tsResol := range []byte{3, 9} {
+		idb := make([]byte, 8)
+		binary.BigEndian.PutUint16(idb[0:2], uint16(LINKTYPE_ETHERNET))
+		option := []byte{0, byte(pcapngOptionTsResol), 0, 1, tsResol, 0, 0, 0, 0, 0, 0, 0}
+		buf.Write(pcapngBlock(pcapngInterfaceDescription, append(idb, option...)))
+	}
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		iface := uint32(i % 2)
+		ts := uint64(1000000 + i*10) //ms
+		if iface == 1 {
+			ts *= 1000000 //ns
+		}
+		epb := make([]byte, 20)
+		binary.BigEndian.PutUint32(epb[0:4], iface)
+		binary.BigEndian.PutUint32(epb[4:8], uint32(ts>>32))
+		binary.BigEndian.PutUint32(epb[8:12], uint32(ts))
+		binary.BigEndian.PutUint32(epb[12:16], uint32(len(frames[i])))
+		binary.BigEndian.PutUint32(epb[16:20], uint32(len(frames[i])))
+		buf.Write(pcapngBlock(pcapngEnhancedPacket, append(epb, frames[i]...)))
+	}
+	return buf.Bytes()
+}
+
+func testFrames() [][]byte {
+	client := []byte{10, 0, 0, 2}
+	server := []byte{10, 0, 0, 1}
+	return [][]byte{
+		ethernet(ipv4UDP(client, server, 5000, 53, []byte("query"))),
+		ethernet(ipv4UDP(server, client, 53, 5000, []byte("a longer answer"))),
+		ethernet(ipv4UDP(client, server, 5000, 53, bytes.Repeat([]byte{7}, 100))),
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	frames := testFrames()
+
+	for name, file := range map[string][]byte{"pcap": writePCAP(LINKTYPE_ETHERNET, frames), "pcapng": writePCAPNG(frames)} {
+		packets, err := ReadCapture(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(name, ": could not read the capture,", err)
+		}
+		if len(packets) != len(frames) {
+			t.Fatal(name, ": read", len(packets), "packets instead of", len(frames))
+		}
+		for i, pkt := range packets {
+			if !bytes.Equal(pkt.Data, frames[i]) || pkt.OriginalLength != len(frames[i]) || pkt.LinkType != LINKTYPE_ETHERNET {
+				t.Error(name, ": wrong packet", i, pkt)
+			}
+			if want := 1000*time.Second + time.Duration(i*10)*time.Millisecond; pkt.Timestamp != want {
+				t.Error(name, ": packet", i, "has timestamp", pkt.Timestamp, "instead of", want)
+			}
+		}
+	}
+
+	if _, err := ReadCapture(bytes.NewReader([]byte("not a capture file at all"))); err == nil {
+		t.Error("Should not read an invalid capture")
+	}
+}
+
+func TestDecodePacketAndFilter(t *testing.T) {
+	frames := testFrames()
+
+	flow, payload, err := DecodePacket(CapturedPacket{Data: frames[1], LinkType: LINKTYPE_ETHERNET})
+	if err != nil {
+		t.Fatal("Could not decode the packet,", err)
+	}
+	if flow.Protocol != IPPROTO_UDP || flow.SrcPort != 53 || flow.DstPort != 5000 || flow.SrcIP.String() != "10.0.0.1" || flow.DstIP.String() != "10.0.0.2" {
+		t.Error("Wrong flow", flow)
+	}
+	if string(payload) != "a longer answer" {
+		t.Error("Wrong payload (the Ethernet padding must be removed)", payload)
+	}
+	if _, _, err := DecodePacket(CapturedPacket{Data: frames[1][:20], LinkType: LINKTYPE_ETHERNET}); err == nil {
+		t.Error("Should not decode a truncated packet")
+	}
+
+	outbound, err := ParsePCAPFilter("src=10.0.0.2 proto=udp dport=53")
+	if err != nil {
+		t.Fatal("Could not parse the filter,", err)
+	}
+	query, _, _ := DecodePacket(CapturedPacket{Data: frames[0], LinkType: LINKTYPE_ETHERNET})
+	if !outbound.Matches(query) || outbound.Matches(flow) || outbound.Matches(nil) {
+		t.Error("The outbound filter should match the query only, not the answer nor non-IP packets")
+	}
+	if f, _ := ParsePCAPFilter("host=10.0.0.2 port=53"); !f.Matches(flow) {
+		t.Error("The host/port filter should match both directions")
+	}
+	if f, err := ParsePCAPFilter(""); f != nil || err != nil || !f.Matches(nil) {
+		t.Error("The empty filter should match everything")
+	}
+	for _, bad := range []string{"src", "src=", "src=notanip", "dport=70000", "proto=icmpx", "color=blue"} {
+		if _, err := ParsePCAPFilter(bad); err == nil {
+			t.Error("Should not parse the filter", bad)
+		}
+	}
+}
+
+func TestParsePCAPWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "client0.pcapng")
+	if err := ioutil.WriteFile(path, writePCAPNG(testFrames()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//metadata only, all packets : the offset is the same with the same seed
+	packets, err := ParsePCAPWithOptions(path, 200, PCAPReplayOptions{Seed: 42})
+	if err != nil {
+		t.Fatal("Could not parse the capture,", err)
+	}
+	again, _ := ParsePCAPWithOptions(path, 200, PCAPReplayOptions{Seed: 42})
+	if len(packets) != 3 || packets[0].MsSinceBeginningOfCapture != again[0].MsSinceBeginningOfCapture {
+		t.Fatal("Wrong packets, or not reproducible with a fixed seed", packets)
+	}
+	offset := packets[0].MsSinceBeginningOfCapture
+	if offset >= PCAP_MAX_RANDOM_OFFSET || packets[1].MsSinceBeginningOfCapture != offset+10 {
+		t.Error("Wrong times", packets)
+	}
+
+	//real payloads of the outbound packets, twice slower
+	filter, _ := ParsePCAPFilter("src=10.0.0.2")
+	packets, err = ParsePCAPWithOptions(path, 50, PCAPReplayOptions{Seed: 42, RealPayloads: true, TimeScale: 2, Filter: filter})
+	if err != nil {
+		t.Fatal("Could not parse the capture,", err)
+	}
+	if len(packets) != 5 || packets[0].ID != 0 || packets[1].ID != 1 || packets[4].ID != 1 {
+		t.Fatal("Should have replayed 2 packets, the second in 4 fragments", packets)
+	}
+	if packets[1].MsSinceBeginningOfCapture != offset+40 {
+		t.Error("The second outbound packet should be replayed 40 ms after the first", packets[1].MsSinceBeginningOfCapture-offset)
+	}
+
+	//the relay finds the meta messages, even when several packets are sent in one cell
+	cell := make([]byte, 0)
+	for _, p := range packets {
+		if p.RealLength != len(p.Header) || p.RealLength > 50 {
+			t.Error("Wrong fragment length", p.RealLength)
+		}
+		cell = append(cell, p.Header...)
+	}
+	cell = append(cell, make([]byte, 20)...)
+	var ids []uint32
+	var finals int
+	received := make([]byte, 0)
+	found := DecodePCAPMetaMessages(cell, func(ID uint32, ts uint64, isFinal bool) {
+		ids = append(ids, ID)
+		if isFinal {
+			finals++
+		}
+	})
+	if !found || len(ids) != 5 || finals != 2 {
+		t.Error("Wrong meta messages", ids, finals)
+	}
+	for _, p := range packets {
+		received = append(received, p.Header[payloadMetaMessageLength:]...)
+	}
+	if !bytes.Equal(received, append([]byte("query"), bytes.Repeat([]byte{7}, 100)...)) {
+		t.Error("The fragments do not contain the real payloads")
+	}
+	if DecodePCAPMetaMessages(make([]byte, 20), func(uint32, uint64, bool) {}) {
+		t.Error("Should not find meta messages in zeros")
+	}
+
+	if _, err := ParsePCAPWithOptions(path, 10, PCAPReplayOptions{RealPayloads: true}); err == nil {
+		t.Error("Should not replay real payloads in cells smaller than a meta message")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+
+	"github.com/dedis/prifi/prifi-lib/audit"
+	"github.com/dedis/prifi/prifi-lib/config"
+	"gopkg.in/dedis/kyber.v2/util/encoding"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// verifyAuditLog replays the audit log of a relay (see prifi-lib/audit), and checks its hash chains and signatures.
+// All the chains must be signed with the given public key (in hex), the PriFiPublic of the relay : otherwise, anyone
+// could rewrite the whole log and sign it with their own key.
+func verifyAuditLog(c *cli.Context) error {
+	if c.NArg() < 2 {
+		log.Error("Please give the audit log to verify, and the PriFi public key of the relay")
+		os.Exit(1)
+	}
+
+	publicKey, err := encoding.StringHexToPoint(config.CryptoSuite, c.Args().Get(1))
+	if err != nil {
+		log.Error("Could not parse the public key", c.Args().Get(1), ":", err)
+		os.Exit(1)
+	}
+
+	f, err := os.Open(c.Args().First())
+	if err != nil {
+		log.Error("Could not open the audit log:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	report, err := audit.Verify(f, publicKey)
+	log.Info("Replayed", report.Chains, "chain(s) with", report.Rounds, "rounds,", report.SignedRounds, "of them signed.")
+	for i, pk := range report.PublicKeys {
+		log.Info("Chain", i, "is signed by", pk)
+	}
+	if len(report.FailedRounds) > 0 {
+		log.Info("Rounds which timed out or failed a check :", report.FailedRounds)
+	}
+	if len(report.UnsignedRounds) > 0 {
+		log.Info("Rounds not covered by a signature :", report.UnsignedRounds)
+	}
+	if err != nil {
+		log.Error("The audit log is NOT valid:", err)
+		os.Exit(1)
+	}
+
+	log.Info("The audit log is valid.")
+	return nil
+}
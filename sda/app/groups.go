@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	prifi_service "github.com/dedis/prifi/sda/services"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/app"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+/*
+ * Besides the default group (the [[servers]] of group.toml), group.toml can describe other PriFi groups, e.g. :
+ *
+ * [[groups]]
+ *   Name = "lowlatency"
+ *   PriFiConfig = "prifi-lowlatency.toml"
+ *   [[groups.servers]]
+ *     Address = "tcp://127.0.0.1:7000"
+ *     Public = "..."
+ *     Description = "relay"
+ *   [[groups.servers]]
+ *     ...
+ *
+ * PriFiConfig is the prifi.toml of the group (relative to group.toml); if empty, the group uses the one given by
+ * --prifi_config. The relay, standby relay and trustees take part in all the groups in which they are listed with
+ * their description; a client takes part in the group given by --prifi_group (the default group if empty).
+ *
+ * A trustee can also carry its PriFi public key (PriFiPublic = "..."); the clients of the group pin those keys, in
+ * addition to the ClientPinnedTrustees of prifi.toml (see prifi-lib/client/pinning.go). The PriFiPublic of the standby
+ * relay is announced by the relay to the clients and trustees, which only accept a resume from it (unless
+ * RelayStandbyPriFiPublic is set in prifi.toml).
+ */
+
+// groupsToml holds the [[servers]] (the default group) and the [[groups]] of group.toml
+type groupsToml struct {
+	Servers []*serverToml `toml:"servers"`
+	Groups  []*groupToml  `toml:"groups"`
+}
+
+// groupToml holds one of the [[groups]] of group.toml
+type groupToml struct {
+	Name        string
+	PriFiConfig string
+	Servers     []*serverToml `toml:"servers"`
+}
+
+// serverToml holds one server of a group, as in the [[servers]] of group.toml
+type serverToml struct {
+	Address     string
+	Suite       string `toml:",omitempty"`
+	Public      string
+	Description string
+	PriFiPublic string `toml:",omitempty"`
+}
+
+// prifiGroup is a PriFi group described in group.toml
+type prifiGroup struct {
+	name        string
+	group       *app.Group
+	configFile  string   //the prifi.toml of the group
+	trusteesPks []string //the PriFiPublic of the trustees, pinned by the clients
+	standbyPk   string   //the PriFiPublic of the standby relay, announced by the relay
+	service     *prifi_service.ServiceState
+}
+
+// readCothorityGroupsConfig reads the default group and the [[groups]] of the group-file
+func readCothorityGroupsConfig(c *cli.Context) []*prifiGroup {
+	gfile := c.GlobalString("group")
+	groups := make([]*prifiGroup, 0)
+
+	groupsConfig := &groupsToml{}
+	if _, err := toml.DecodeFile(gfile, groupsConfig); err != nil {
+		log.Error("Could not parse toml file \"", gfile, "\"")
+		log.Fatal(err)
+	}
+
+	if len(groupsConfig.Servers) > 0 {
+		group := readCothorityGroupConfig(c)
+		if group == nil {
+			os.Exit(1)
+		}
+		groups = append(groups, &prifiGroup{
+			name:        prifi_service.DefaultGroupName,
+			group:       group,
+			configFile:  c.GlobalString("prifi_config"),
+			trusteesPks: trusteesPriFiPublic(groupsConfig.Servers),
+			standbyPk:   standbyRelayPriFiPublic(groupsConfig.Servers),
+		})
+	}
+
+	for _, g := range groupsConfig.Groups {
+		if g.Name == prifi_service.DefaultGroupName {
+			log.Fatal("A group of \"", gfile, "\" has no name")
+		}
+
+		// re-encode the servers of the group as a group-file, to let onet parse them
+		buf := new(bytes.Buffer)
+		servers := struct {
+			Servers []*serverToml `toml:"servers"`
+		}{g.Servers}
+		if err := toml.NewEncoder(buf).Encode(servers); err != nil {
+			log.Fatal("Could not encode the servers of group \"", g.Name, "\"", err)
+		}
+		group, err := app.ReadGroupDescToml(buf)
+		if err != nil || group == nil || group.Roster == nil || len(group.Roster.List) == 0 {
+			log.Fatal("No servers found in group \"", g.Name, "\" of", gfile, err)
+		}
+
+		configFile := c.GlobalString("prifi_config")
+		if g.PriFiConfig != "" {
+			configFile = g.PriFiConfig
+			if !filepath.IsAbs(configFile) {
+				configFile = filepath.Join(filepath.Dir(gfile), configFile)
+			}
+		}
+
+		groups = append(groups, &prifiGroup{
+			name:        g.Name,
+			group:       group,
+			configFile:  configFile,
+			trusteesPks: trusteesPriFiPublic(g.Servers),
+			standbyPk:   standbyRelayPriFiPublic(g.Servers),
+		})
+	}
+
+	if len(groups) == 0 {
+		log.Error("No groups found in", gfile)
+		os.Exit(1)
+	}
+	return groups
+}
+
+// joinGroups makes the service part of the groups in which we are listed with the given description (the group given
+// by --prifi_group for clients), and returns them
+func joinGroups(c *cli.Context, host *onet.Server, service *prifi_service.Service, groups []*prifiGroup, description string) []*prifiGroup {
+	joined := make([]*prifiGroup, 0)
+
+	for _, g := range groups {
+		if description == "client" {
+			if g.name != c.GlobalString("prifi_group") {
+				continue
+			}
+		} else if !isListedAs(host, g.group, description) {
+			continue
+		}
+
+		config, err := readPriFiConfigFile(c, g.configFile)
+		if err != nil {
+			log.Error("Could not read the prifi config of group \"", g.name, "\":", err)
+			os.Exit(1)
+		}
+		setProtocolVersion(config)
+
+		if description == "client" {
+			pinTrustees(config, g)
+		}
+		if description == "relay" && config.RelayStandbyPriFiPublic == "" {
+			config.RelayStandbyPriFiPublic = g.standbyPk
+		}
+
+		g.service, err = service.AddGroup(g.name, config)
+		if err != nil {
+			log.Error("Could not join group \"", g.name, "\":", err)
+			os.Exit(1)
+		}
+		joined = append(joined, g)
+	}
+
+	if len(joined) == 0 {
+		log.Error("We are not part of any group as", description)
+		os.Exit(1)
+	}
+	return joined
+}
+
+// trusteesPriFiPublic returns the PriFiPublic of the trustees among the servers
+func trusteesPriFiPublic(servers []*serverToml) []string {
+	pks := make([]string, 0)
+	for _, s := range servers {
+		if s.Description == "trustee" && s.PriFiPublic != "" {
+			pks = append(pks, s.PriFiPublic)
+		}
+	}
+	return pks
+}
+
+// standbyRelayPriFiPublic returns the PriFiPublic of the standby relay among the servers, or "" if there is none
+func standbyRelayPriFiPublic(servers []*serverToml) string {
+	for _, s := range servers {
+		if s.Description == "relay-standby" {
+			return s.PriFiPublic
+		}
+	}
+	return ""
+}
+
+// pinTrustees adds the PriFiPublic of the trustees of the group to the pinned trustees of the client, and exits if
+// the client requires more pinned trustees than it knows
+func pinTrustees(config *prifi_protocol.PrifiTomlConfig, g *prifiGroup) {
+	config.ClientPinnedTrustees = append(config.ClientPinnedTrustees, g.trusteesPks...)
+
+	pinned, err := config.PinnedTrusteesPks()
+	if err != nil {
+		log.Error("Could not read the pinned trustees of group \"", g.name, "\":", err)
+		os.Exit(1)
+	}
+	//a key pinned twice is counted twice here; the client counts it once, and refuses to start if it has too few
+	if config.ClientMinPinnedTrustees > len(pinned) {
+		log.Error("ClientMinPinnedTrustees is", config.ClientMinPinnedTrustees, "but only", len(pinned),
+			"trustees are pinned (in ClientPinnedTrustees, ClientPinnedTrusteesFile and the PriFiPublic of group \"", g.name, "\")")
+		os.Exit(1)
+	}
+	if len(pinned) > 0 {
+		log.Lvl1("Pinned", len(pinned), "trustees, at least", config.ClientMinPinnedTrustees, "of them must be part of the protocol")
+	}
+}
+
+// isListedAs returns true if our server is in the group, with the given description
+func isListedAs(host *onet.Server, group *app.Group, description string) bool {
+	for _, si := range group.Roster.List {
+		if si.Public.Equal(host.ServerIdentity.Public) && group.GetDescription(si) == description {
+			return true
+		}
+	}
+	return false
+}
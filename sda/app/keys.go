@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"gopkg.in/dedis/kyber.v2/util/encoding"
+	"gopkg.in/dedis/kyber.v2/util/key"
+	"gopkg.in/dedis/onet.v2/app"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+/*
+ * All the nodes keep the same long-term PriFi key pair across restarts, so that the clients can pin the keys of the
+ * trustees (see groups.go), the audit log of the relay can be verified against its published key, and the audit log
+ * and the blames refer to the same participants.
+ * The key pair is read from the file given by --prifi_key (by default, prifi_key.toml next to the cothority_config),
+ * which gen-id writes; if there is no such file, the key pair is derived from the private key of the cothority_config.
+ * The ephemeral keys of the shuffle are still generated for each run of the protocol; the DC-net pads are seeded with
+ * them too (see prifi-lib/dcnet), as the secrets shared by the long-term keys are the same in every run.
+ */
+
+// Default name of the file with the long-term PriFi key pair
+const DefaultPriFiKeyFile = "prifi_key.toml"
+
+// prifiKeyToml is the content of the PriFi key file
+type prifiKeyToml struct {
+	Public  string
+	Private string
+}
+
+// priFiKeyFile returns the file given by --prifi_key, or prifi_key.toml next to the cothority_config
+func priFiKeyFile(c *cli.Context) string {
+	if c.GlobalIsSet("prifi_key") {
+		return c.GlobalString("prifi_key")
+	}
+	return filepath.Join(filepath.Dir(c.GlobalString("cothority_config")), DefaultPriFiKeyFile)
+}
+
+// readPriFiKeyPair returns our long-term PriFi key pair, read from the PriFi key file or derived from the
+// cothority_config, and exits if it cannot
+func readPriFiKeyPair(c *cli.Context) *key.Pair {
+	var pair *key.Pair
+	var err error
+
+	file := priFiKeyFile(c)
+	if _, statErr := os.Stat(file); statErr == nil {
+		pair, err = readPriFiKeyFile(file)
+		if err != nil {
+			log.Error("Could not read the PriFi key file \"", file, "\":", err)
+			os.Exit(1)
+		}
+		log.Lvl1("Using the PriFi key pair of", file)
+	} else if c.GlobalIsSet("prifi_key") {
+		log.Error("Could not open file \"", file, "\" (specified by flag prifi_key)")
+		os.Exit(1)
+	} else {
+		cfile := c.GlobalString("cothority_config")
+		pair, err = derivePriFiKeyPair(cfile)
+		if err != nil {
+			log.Error("Could not derive the PriFi key pair from \"", cfile, "\":", err)
+			os.Exit(1)
+		}
+		log.Lvl1("Using the PriFi key pair derived from", cfile)
+	}
+
+	pubStr, err := encoding.PointToStringHex(config.CryptoSuite, pair.Public)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Lvl1("Our PriFi public key is", pubStr)
+	return pair
+}
+
+// readPriFiKeyFile reads a key pair written by writePriFiKeyFile
+func readPriFiKeyFile(file string) (*key.Pair, error) {
+	keyToml := &prifiKeyToml{}
+	if _, err := toml.DecodeFile(file, keyToml); err != nil {
+		return nil, err
+	}
+	pub, err := encoding.StringHexToPoint(config.CryptoSuite, keyToml.Public)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := encoding.StringHexToScalar(config.CryptoSuite, keyToml.Private)
+	if err != nil {
+		return nil, err
+	}
+	if !crypto.IsKeyPair(pub, priv) {
+		return nil, errors.New("the public key does not match the private key")
+	}
+	return &key.Pair{Public: pub, Private: priv}, nil
+}
+
+// derivePriFiKeyPair derives a key pair from the private key of the cothority_config
+func derivePriFiKeyPair(cfile string) (*key.Pair, error) {
+	identity := &app.CothorityConfig{}
+	if _, err := toml.DecodeFile(cfile, identity); err != nil {
+		return nil, err
+	}
+	private, err := encoding.StringHexToScalar(config.CryptoSuite, identity.Private)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := private.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	pub, priv := crypto.DeriveKeyPair(seed)
+	return &key.Pair{Public: pub, Private: priv}, nil
+}
+
+// writePriFiKeyFile generates a new key pair, writes it to file, and returns the public key in hex
+func writePriFiKeyFile(file string) (string, error) {
+	pub, priv := crypto.NewKeyPair()
+	pubStr, err := encoding.PointToStringHex(config.CryptoSuite, pub)
+	if err != nil {
+		return "", err
+	}
+	privStr, err := encoding.ScalarToStringHex(config.CryptoSuite, priv)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := toml.NewEncoder(f).Encode(&prifiKeyToml{Public: pubStr, Private: privStr}); err != nil {
+		return "", err
+	}
+	return pubStr, nil
+}
@@ -25,7 +25,9 @@ import (
 	"gopkg.in/urfave/cli.v1"
 	"net"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -56,7 +58,7 @@ func main() {
 		{
 			Name:    "gen-id",
 			Aliases: []string{"gen"},
-			Usage:   "creates a new identity.toml",
+			Usage:   "creates a new identity.toml, and the prifi_key.toml of the node",
 			Action:  createNewIdentityToml,
 		},
 		{
@@ -72,12 +74,33 @@ func main() {
 			Aliases:   []string{"r"},
 			Action:    startRelay,
 		},
+		{
+			Name:      "relay-standby",
+			Usage:     "start as the standby relay, which takes over if the relay fails",
+			ArgsUsage: "group [id-name]",
+			Aliases:   []string{"rs"},
+			Action:    startStandbyRelay,
+		},
 		{
 			Name:    "client",
 			Usage:   "start in client mode",
 			Aliases: []string{"c"},
 			Action:  startClient,
 		},
+		{
+			Name:      "client-status",
+			Usage:     "shows the status of the running client, and pauses or resumes its upstream transmission",
+			ArgsUsage: "[pause|resume]",
+			Aliases:   []string{"cs"},
+			Action:    clientStatus,
+		},
+		{
+			Name:      "audit-verify",
+			Usage:     "replays the audit log of a relay, and checks its hash chain and signatures",
+			ArgsUsage: "audit-log relay-public-key",
+			Aliases:   []string{"av"},
+			Action:    verifyAuditLog,
+		},
 		{
 			Name:    "sockstest",
 			Usage:   "only starts the socks server and the socks clients without prifi",
@@ -116,6 +139,15 @@ func main() {
 			Value: getDefaultFilePathForName(DefaultCothorityGroupConfigFile),
 			Usage: "Group file",
 		},
+		cli.StringFlag{
+			Name:  "prifi_group, pg",
+			Value: prifi_service.DefaultGroupName,
+			Usage: "the PriFi group (in the group file) to join as a client; the default group if empty",
+		},
+		cli.StringFlag{
+			Name:  "prifi_key, pk",
+			Usage: "the long-term PriFi key pair of the node (default: prifi_key.toml next to the cothority_config if it exists, else derived from the cothority_config)",
+		},
 		cli.StringFlag{
 			Name:  "default_path",
 			Value: ".",
@@ -136,9 +168,14 @@ func main() {
 /**
  * Every "app" require reading config files and starting cothority beforehand
  */
-func readConfigAndStartCothority(c *cli.Context) (*onet.Server, *app.Group, *prifi_service.ServiceState) {
+func readConfigAndStartCothority(c *cli.Context) (*onet.Server, []*prifiGroup, *prifi_service.Service) {
 	//parse PriFi parameters
-	prifiTomlConfig, err := readPriFiConfigFile(c)
+	prifiTomlConfig, err := readPriFiConfigFile(c, c.GlobalString("prifi_config"))
+
+	if err != nil {
+		log.Error("Could not read prifi config:", err)
+		os.Exit(1)
+	}
 
 	//override log level and color
 	if prifiTomlConfig.OverrideLogLevel > 0 {
@@ -150,11 +187,6 @@ func readConfigAndStartCothority(c *cli.Context) (*onet.Server, *app.Group, *pri
 		log.SetUseColors(true)
 	}
 
-	if err != nil {
-		log.Error("Could not read prifi config:", err)
-		os.Exit(1)
-	}
-
 	//start cothority server
 	host, err := startCothorityNode(c)
 	if err != nil {
@@ -163,25 +195,21 @@ func readConfigAndStartCothority(c *cli.Context) (*onet.Server, *app.Group, *pri
 	}
 
 	//finds the PriFi service
-	service := host.Service(prifi_service.ServiceName).(*prifi_service.ServiceState)
+	service := host.Service(prifi_service.ServiceName).(*prifi_service.Service)
 
-	//set the config from the .toml file
-	service.SetConfigFromToml(prifiTomlConfig)
+	//reads the group description; the PriFi config of each group is read when joining it
+	groups := readCothorityGroupsConfig(c)
 
-	//reads the group description
-	group := readCothorityGroupConfig(c)
-	if err != nil {
-		log.Error("Could not read the group description:", err)
-		os.Exit(1)
-	}
+	return host, groups, service
+}
 
+// setProtocolVersion sets the ProtocolVersion, checked by the relay when a node connects
+func setProtocolVersion(prifiTomlConfig *prifi_protocol.PrifiTomlConfig) {
 	if prifiTomlConfig.EnforceSameVersionOnNodes {
 		prifiTomlConfig.ProtocolVersion = getGitCommitID()
 	} else {
 		prifiTomlConfig.ProtocolVersion = "v1" // standard string for all nodes
 	}
-
-	return host, group, service
 }
 
 // This folder's git commit ID is used as a Protocol Version field to avoid mismatched version between nodes
@@ -207,11 +235,14 @@ func getGitCommitID() string {
 func startTrustee(c *cli.Context) error {
 	log.Info("Starting trustee")
 
-	host, group, service := readConfigAndStartCothority(c)
+	host, groups, service := readConfigAndStartCothority(c)
+	service.SetKeyPair(readPriFiKeyPair(c))
 
-	if err := service.StartTrustee(group); err != nil {
-		log.Error("Could not start the prifi service:", err)
-		os.Exit(1)
+	for _, g := range joinGroups(c, host, service, groups, "trustee") {
+		if err := g.service.StartTrustee(g.group); err != nil {
+			log.Error("Could not start the prifi service:", err)
+			os.Exit(1)
+		}
 	}
 
 	host.Router.AddErrorHandler(service.NetworkErrorHappened)
@@ -223,28 +254,78 @@ func startTrustee(c *cli.Context) error {
 func startRelay(c *cli.Context) error {
 	log.Info("Starting relay")
 
-	host, group, service := readConfigAndStartCothority(c)
+	host, groups, service := readConfigAndStartCothority(c)
+	service.SetKeyPair(readPriFiKeyPair(c))
 
-	service.AutoStart = true
-	if err := service.StartRelay(group); err != nil {
-		log.Error("Could not start the prifi service:", err)
-		os.Exit(1)
+	groups = joinGroups(c, host, service, groups, "relay")
+	for _, g := range groups {
+		g.service.AutoStart = true
+		if err := g.service.StartRelay(g.group); err != nil {
+			log.Error("Could not start the prifi service:", err)
+			os.Exit(1)
+		}
 	}
+	go resyncOnSIGHUP(c, groups)
 
 	host.Router.AddErrorHandler(service.NetworkErrorHappened)
 	host.Start()
 	return nil
 }
 
+// standbyRelay starts the cothority in standby-relay-mode using the already stored configuration.
+func startStandbyRelay(c *cli.Context) error {
+	log.Info("Starting standby relay")
+
+	host, groups, service := readConfigAndStartCothority(c)
+	service.SetKeyPair(readPriFiKeyPair(c))
+
+	groups = joinGroups(c, host, service, groups, "relay-standby")
+	for _, g := range groups {
+		g.service.AutoStart = true
+		if err := g.service.StartStandbyRelay(g.group); err != nil {
+			log.Error("Could not start the prifi service:", err)
+			os.Exit(1)
+		}
+	}
+	go resyncOnSIGHUP(c, groups)
+
+	host.Router.AddErrorHandler(service.NetworkErrorHappened)
+	host.Start()
+	return nil
+}
+
+// resyncOnSIGHUP re-reads the prifi config file of each group on each SIGHUP, and applies the live-changeable parameters
+// (PayloadSize, CellSizeDown, RelayWindowSize, RelayUseOpenClosedSlots) to the running protocol of the group
+func resyncOnSIGHUP(c *cli.Context, groups []*prifiGroup) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		for _, g := range groups {
+			log.Info("Received SIGHUP, reloading the prifi config of group \"", g.name, "\"")
+			config, err := readPriFiConfigFile(c, g.configFile)
+			if err != nil {
+				log.Error("Could not reload the prifi config:", err)
+				continue
+			}
+			if err := g.service.ResyncPriFiProtocol(config, 0, 0); err != nil {
+				log.Error("Could not resync the prifi protocol:", err)
+			}
+		}
+	}
+}
+
 // client starts the cothority in client-mode using the already stored configuration.
 func startClient(c *cli.Context) error {
 	log.Info("Starting client")
 
-	host, group, service := readConfigAndStartCothority(c)
+	host, groups, service := readConfigAndStartCothority(c)
+	service.SetKeyPair(readPriFiKeyPair(c))
 
-	if err := service.StartClient(group, time.Duration(0)); err != nil {
-		log.Error("Could not start the prifi service:", err)
-		os.Exit(1)
+	for _, g := range joinGroups(c, host, service, groups, "client") {
+		if err := g.service.StartClient(g.group, time.Duration(0)); err != nil {
+			log.Error("Could not start the prifi service:", err)
+			os.Exit(1)
+		}
 	}
 
 	host.Router.AddErrorHandler(service.NetworkErrorHappened)
@@ -258,7 +339,18 @@ func startSocksTunnelOnly(c *cli.Context) error {
 
 	host, _, service := readConfigAndStartCothority(c)
 
-	if err := service.StartSocksTunnelOnly(); err != nil {
+	config, err := readPriFiConfigFile(c, c.GlobalString("prifi_config"))
+	if err != nil {
+		log.Error("Could not read prifi config:", err)
+		os.Exit(1)
+	}
+	tunnel, err := service.AddGroup(prifi_service.DefaultGroupName, config)
+	if err != nil {
+		log.Error("Could not start the prifi service:", err)
+		os.Exit(1)
+	}
+
+	if err := tunnel.StartSocksTunnelOnly(); err != nil {
 		log.Error("Could not start the prifi service:", err)
 		os.Exit(1)
 	}
@@ -283,8 +375,6 @@ func checkOverwrite(file string) bool {
 
 func createNewIdentityToml(c *cli.Context) error {
 
-	log.Fatal("Not implemented")
-
 	log.Print("Generating public/private keys...")
 
 	suite := suites.MustFind("Ed25519") //TODO Nikko wants to change this
@@ -360,6 +450,16 @@ func createNewIdentityToml(c *cli.Context) error {
 
 	log.Info("Identity file saved.")
 
+	// the long-term PriFi key pair
+	keyFilePath := path.Join(folderPath, DefaultPriFiKeyFile)
+	if checkOverwrite(keyFilePath) {
+		prifiPubStr, err := writePriFiKeyFile(keyFilePath)
+		if err != nil {
+			log.Fatal("Unable to write the PriFi key pair to file:", err)
+		}
+		log.Info("PriFi key file saved. If this node is a trustee or a (standby) relay, its PriFiPublic (in group.toml) is", prifiPubStr)
+	}
+
 	return nil
 }
 
@@ -385,18 +485,16 @@ func startCothorityNode(c *cli.Context) (*onet.Server, error) {
  * CONFIG
  */
 
-func readPriFiConfigFile(c *cli.Context) (*prifi_protocol.PrifiTomlConfig, error) {
-
-	cfile := c.GlobalString("prifi_config")
+func readPriFiConfigFile(c *cli.Context, cfile string) (*prifi_protocol.PrifiTomlConfig, error) {
 
 	if _, err := os.Stat(cfile); os.IsNotExist(err) {
-		log.Error("Could not open file \"", cfile, "\" (specified by flag prifi_config)")
+		log.Error("Could not open file \"", cfile, "\" (specified by flag prifi_config, or in the group file)")
 		return nil, err
 	}
 
 	tomlRawData, err := ioutil.ReadFile(cfile)
 	if err != nil {
-		log.Error("Could not read file \"", cfile, "\" (specified by flag prifi_config)")
+		log.Error("Could not read file \"", cfile, "\" (specified by flag prifi_config, or in the group file)")
 	}
 
 	tomlConfig := &prifi_protocol.PrifiTomlConfig{}
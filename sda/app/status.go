@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	prifi_service "github.com/dedis/prifi/sda/services"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// clientStatus asks a running client its status, via the local status API (see sda/services/status.go) on the
+// ClientStatusAPIPort of the prifi config, with the token the client wrote in its ClientStatusAPITokenFile. With
+// "pause" or "resume", it first pauses or resumes the upstream transmission.
+func clientStatus(c *cli.Context) error {
+	config, err := readPriFiConfigFile(c, c.GlobalString("prifi_config"))
+	if err != nil {
+		log.Error("Could not read prifi config:", err)
+		os.Exit(1)
+	}
+	if config.ClientStatusAPIPort <= 0 {
+		log.Error("The client status API is disabled, set ClientStatusAPIPort in", c.GlobalString("prifi_config"))
+		os.Exit(1)
+	}
+	tokenFile := prifi_service.StatusAPITokenFile(config)
+	token, err := prifi_service.ReadStatusAPIToken(tokenFile)
+	if err != nil {
+		log.Error("Could not read the token of the client (is it running ?):", err)
+		os.Exit(1)
+	}
+	url := "http://127.0.0.1:" + strconv.Itoa(config.ClientStatusAPIPort)
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+
+	var req *http.Request
+	switch c.Args().First() {
+	case "":
+		req, err = http.NewRequest(http.MethodGet, url+"/status", nil)
+	case "pause", "resume":
+		req, err = http.NewRequest(http.MethodPost, url+"/"+c.Args().First(), nil)
+	default:
+		log.Error("Unknown action \"", c.Args().First(), "\", use pause or resume")
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Error("Could not create the request:", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Error("Could not reach the client (is it running ?):", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Error("The client answered", resp.Status)
+		os.Exit(1)
+	}
+
+	status := prifi_service.ClientAPIStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		log.Error("Could not parse the status of the client:", err)
+		os.Exit(1)
+	}
+	printClientStatus(status)
+	return nil
+}
+
+// printClientStatus prints "status" for humans
+func printClientStatus(status prifi_service.ClientAPIStatus) {
+	if status.Group != prifi_service.DefaultGroupName {
+		fmt.Println("Group:          ", status.Group)
+	}
+	if status.Client == nil {
+		fmt.Println("State:           not running")
+	} else {
+		fmt.Println("State:          ", status.Client.State)
+		fmt.Println("Client ID:      ", status.Client.ID)
+		fmt.Println("Slot:           ", status.Client.Slot)
+		fmt.Println("Round:          ", status.Client.Round)
+		fmt.Println("Bytes sent:     ", status.Client.BytesSent)
+		fmt.Println("Bytes received: ", status.Client.BytesReceived)
+		if status.Client.LatencyMs >= 0 {
+			fmt.Printf("Latency:         %.1f ms\n", status.Client.LatencyMs)
+		} else {
+			fmt.Println("Latency:         unknown")
+		}
+	}
+	fmt.Println("Upstream paused:", status.UpstreamPaused)
+	fmt.Println("SOCKS streams:  ", status.ActiveStreams, "open,", status.SocksBytesUp, "bytes up,", status.SocksBytesDown, "bytes down")
+}
@@ -0,0 +1,95 @@
+package protocols
+
+import (
+	"context"
+	"sync"
+
+	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+/*
+ * When the relay fails, the clients and trustees fail over to the standby relay (see sda/services/failover.go), but
+ * keep their PriFi-lib (keys, slot, DC-net). Their SDA protocol with the failed relay is detached, and the PriFi-lib
+ * is given to the protocol started by the standby relay (PriFiSDAWrapperConfig.ResumeFrom). Since the lib keeps the
+ * MessageSender it was created with, we give it a failoverMessageSender, which we point to the new protocol.
+ */
+
+//failoverMessageSender is a net.MessageSender which forwards to the MessageSender of the current SDA protocol
+type failoverMessageSender struct {
+	sync.RWMutex
+	current MessageSender
+}
+
+func newFailoverMessageSender(ms MessageSender) *failoverMessageSender {
+	return &failoverMessageSender{current: ms}
+}
+
+//set makes "ms" the MessageSender used from now on
+func (f *failoverMessageSender) set(ms MessageSender) {
+	f.Lock()
+	defer f.Unlock()
+	f.current = ms
+}
+
+func (f *failoverMessageSender) get() MessageSender {
+	f.RLock()
+	defer f.RUnlock()
+	return f.current
+}
+
+//SendToClient sends a message to client i via the current protocol
+func (f *failoverMessageSender) SendToClient(i int, msg interface{}) error {
+	return f.get().SendToClient(i, msg)
+}
+
+//SendToTrustee sends a message to trustee i via the current protocol
+func (f *failoverMessageSender) SendToTrustee(i int, msg interface{}) error {
+	return f.get().SendToTrustee(i, msg)
+}
+
+//SendToRelay sends a message to the current relay
+func (f *failoverMessageSender) SendToRelay(msg interface{}) error {
+	return f.get().SendToRelay(msg)
+}
+
+//BroadcastToAllClients broadcasts a message to all clients using UDP
+func (f *failoverMessageSender) BroadcastToAllClients(msg interface{}) error {
+	return f.get().BroadcastToAllClients(msg)
+}
+
+//ClientSubscribeToBroadcast allows a client to subscribe to UDP broadcast
+func (f *failoverMessageSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+	return f.get().ClientSubscribeToBroadcast(ctx, clientID, messageReceived, startStopChan)
+}
+
+// Detach stops this protocol instance without stopping its PriFi-lib, which can be resumed by the next protocol
+// instance (see PriFiSDAWrapperConfig.ResumeFrom). It is used by the clients and trustees when their relay fails.
+func (p *PriFiSDAProtocol) Detach() {
+	p.setStopped()
+	p.Shutdown()
+}
+
+// SetReplicationHandler sets the function which sends the state of the relay to the standby relay, with the
+// identities of the clients and trustees indexed by their PriFi ID. Relay only; it must be called after
+// SetConfigFromPriFiService.
+func (p *PriFiSDAProtocol) SetReplicationHandler(handler func(state *net.RELAY_FAILOVER_STATE, clients, trustees []*network.ServerIdentity) bool) {
+	lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance)
+	if !ok || p.role != Relay {
+		return
+	}
+
+	clients := make([]*network.ServerIdentity, len(p.ms.clients))
+	for i, v := range p.ms.clients {
+		clients[i] = v.ServerIdentity
+	}
+	trustees := make([]*network.ServerIdentity, len(p.ms.trustees))
+	for i, v := range p.ms.trustees {
+		trustees[i] = v.ServerIdentity
+	}
+
+	lib.SetReplicationHandler(func(state *net.RELAY_FAILOVER_STATE) bool {
+		return handler(state, clients, trustees)
+	})
+}
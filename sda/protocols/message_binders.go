@@ -1,113 +1,67 @@
 package protocols
 
-//Received_ALL_ALL_SHUTDOWN shuts down the PriFi-lib if it is running
-func (p *PriFiSDAProtocol) Received_ALL_ALL_SHUTDOWN(msg Struct_ALL_ALL_SHUTDOWN) error {
-	p.Stop()
-	err := p.prifiLibInstance.ReceivedMessage(msg.ALL_ALL_SHUTDOWN)
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+//Received_AuthenticatedMessage forwards an authenticated message to PriFi's lib, which checks its sender, once we
+//checked that it comes from the node of this sender. If it is an ALL_ALL_SHUTDOWN accepted by the lib, it shuts down
+//the PriFi-lib
+func (p *PriFiSDAProtocol) Received_AuthenticatedMessage(msg Struct_AuthenticatedMessage) error {
+	authenticated, err := fromNetworkMessage(msg.AuthenticatedMessage, p.Suite())
+	if err != nil {
+		log.Error("Could not decode a message from", msg.TreeNode.Name(), ", error is", err)
+		return err
+	}
+	if err := p.checkSender(msg.TreeNode, authenticated.Msg); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	err = p.prifiLibInstance.ReceivedMessage(authenticated)
+	if _, isShutdown := authenticated.Msg.(net.ALL_ALL_SHUTDOWN); isShutdown && err == nil {
+		p.Stop()
+	}
 	return err
 }
 
-//Received_ALL_ALL_PARAMETERS forwards an ALL_ALL_PARAMETERS message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_ALL_ALL_PARAMETERS_NEW(msg Struct_ALL_ALL_PARAMETERS) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.ALL_ALL_PARAMETERS)
-}
-
-//Received_REL_CLI_DOWNSTREAM_DATA forwards an REL_CLI_DOWNSTREAM_DATA message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_CLI_DOWNSTREAM_DATA(msg Struct_REL_CLI_DOWNSTREAM_DATA) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_DOWNSTREAM_DATA)
-}
-
-//Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG forwards an REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(msg Struct_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
-}
-
-//Received_CLI_REL_TELL_PK_AND_EPH_PK forwards an CLI_REL_TELL_PK_AND_EPH_PK message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_CLI_REL_TELL_PK_AND_EPH_PK(msg Struct_CLI_REL_TELL_PK_AND_EPH_PK) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_TELL_PK_AND_EPH_PK)
-}
-
-//Received_CLI_REL_UPSTREAM_DATA forwards an CLI_REL_UPSTREAM_DATA message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_CLI_REL_UPSTREAM_DATA(msg Struct_CLI_REL_UPSTREAM_DATA) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_UPSTREAM_DATA)
-}
-
-//Received_CLI_REL_UPSTREAM_DATA forwards an CLI_REL_UPSTREAM_DATA message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_CLI_REL_CLI_REL_OPENCLOSED_DATA(msg Struct_CLI_REL_OPENCLOSED_DATA) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_OPENCLOSED_DATA)
-}
-
-//Received_TRU_REL_DC_CIPHER forwards an TRU_REL_DC_CIPHER message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_TRU_REL_DC_CIPHER(msg Struct_TRU_REL_DC_CIPHER) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_DC_CIPHER)
-}
-
-//Received_TRU_REL_SHUFFLE_SIG forwards an TRU_REL_SHUFFLE_SIG message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_TRU_REL_SHUFFLE_SIG(msg Struct_TRU_REL_SHUFFLE_SIG) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_SHUFFLE_SIG)
-}
-
-//Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS forwards an TRU_REL_TELL_NEW_BASE_AND_EPH_PKS message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg Struct_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
-}
-
-//Received_TRU_REL_TELL_PK forward an ALL_ALL_PARAMETERS message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_TRU_REL_TELL_PK(msg Struct_TRU_REL_TELL_PK) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_TELL_PK)
-}
-
-//Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE forward an ALL_ALL_PARAMETERS message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE(msg Struct_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
-}
-
-//Received_REL_TRU_TELL_TRANSCRIPT forward an ALL_ALL_PARAMETERS message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_TRU_TELL_TRANSCRIPT(msg Struct_REL_TRU_TELL_TRANSCRIPT) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_TRU_TELL_TRANSCRIPT)
-}
-
-//Received_REL_TRU_TELL_RATE_CHANGE forward an ALL_ALL_PARAMETERS message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_TRU_TELL_RATE_CHANGE(msg Struct_REL_TRU_TELL_RATE_CHANGE) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_TRU_TELL_RATE_CHANGE)
-}
-
-// Received_REL_CLI_DISRUPTED_ROUND forward an REL_CLI_DISRUPTED_ROUND message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_CLI_DISRUPTED_ROUND(msg Struct_REL_CLI_DISRUPTED_ROUND) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_DISRUPTED_ROUND)
-}
-
-// Received_CLI_REL_DISRUPTION_BLAME forward an CLI_REL_DISRUPTION_BLAME message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_CLI_REL_DISRUPTION_BLAME(msg Struct_CLI_REL_DISRUPTION_BLAME) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_DISRUPTION_BLAME)
-}
-
-// Received_REL_ALL_DISRUPTION_REVEAL forward an REL_ALL_DISRUPTION_REVEAL message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_ALL_DISRUPTION_REVEAL(msg Struct_REL_ALL_DISRUPTION_REVEAL) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_DISRUPTION_REVEAL)
-}
-
-// Received_CLI_REL_DISRUPTION_REVEAL forward an CLI_REL_DISRUPTION_REVEAL message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_CLI_REL_DISRUPTION_REVEAL(msg Struct_CLI_REL_DISRUPTION_REVEAL) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_DISRUPTION_REVEAL)
-}
-
-// Received_TRU_REL_DISRUPTION_REVEAL forward an TRU_REL_DISRUPTION_REVEAL message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_TRU_REL_DISRUPTION_REVEAL(msg Struct_TRU_REL_DISRUPTION_REVEAL) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_DISRUPTION_REVEAL)
-}
-
-// Received_REL_ALL_DISRUPTION_SECRET forward an REL_ALL_DISRUPTION_SECRET message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_REL_ALL_DISRUPTION_SECRET(msg Struct_REL_ALL_DISRUPTION_SECRET) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_DISRUPTION_SECRET)
-}
-
-// Received_CLI_REL_DISRUPTION_SECRET forward an CLI_REL_DISRUPTION_SECRET message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_CLI_REL_DISRUPTION_SECRET(msg Struct_CLI_REL_DISRUPTION_SECRET) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_DISRUPTION_SECRET)
-}
-
-// Received_TRU_REL_DISRUPTION_SECRET forward an TRU_REL_DISRUPTION_SECRET message to PriFi's lib
-func (p *PriFiSDAProtocol) Received_TRU_REL_DISRUPTION_SECRET(msg Struct_TRU_REL_DISRUPTION_SECRET) error {
-	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_DISRUPTION_SECRET)
+//checkSender returns an error if "sender" is not the node of the participant the message comes from : the client or
+//trustee of the ID it carries, one of the clients or trustees for the relay's other messages, and the relay for
+//everyone else. The lib binds the keys to the IDs; this binds the IDs to the nodes
+func (p *PriFiSDAProtocol) checkSender(sender *onet.TreeNode, msg interface{}) error {
+	if p.role != Relay {
+		if p.ms.relay == nil || !sender.ServerIdentity.Equal(p.ms.relay.ServerIdentity) {
+			return errors.New("Received a message from " + sender.Name() + ", which is not the relay")
+		}
+		return nil
+	}
+
+	role, id, ok := net.Sender(msg)
+	if !ok {
+		for _, node := range p.ms.clients {
+			if sender.ServerIdentity.Equal(node.ServerIdentity) {
+				return nil
+			}
+		}
+		for _, node := range p.ms.trustees {
+			if sender.ServerIdentity.Equal(node.ServerIdentity) {
+				return nil
+			}
+		}
+		return errors.New("Received a message from " + sender.Name() + ", which is not a participant")
+	}
+
+	nodes, name := p.ms.clients, "client "
+	if role == net.PEER_TRUSTEE {
+		nodes, name = p.ms.trustees, "trustee "
+	}
+	if node, found := nodes[id]; !found || !sender.ServerIdentity.Equal(node.ServerIdentity) {
+		return errors.New("Received a message from " + sender.Name() + " in the name of " + name + strconv.Itoa(id))
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package protocols
 
 import (
+	"context"
 	"errors"
 	"strconv"
 
@@ -43,9 +44,17 @@ func (p *PriFiSDAProtocol) buildMessageSender(identities map[string]PriFiIdentit
 		}
 		switch id.Role {
 		case Client:
+			if p.config.ResumeState != nil {
+				clients[id.ID] = nodes[i] //the participants keep the IDs they had with the failed relay
+				continue
+			}
 			clients[clientID] = nodes[i] //TODO : wrong
 			clientID++
 		case Trustee:
+			if p.config.ResumeState != nil {
+				trustees[id.ID] = nodes[i]
+				continue
+			}
 			trustees[trusteeID] = nodes[i]
 			trusteeID++
 		case Relay:
@@ -84,7 +93,11 @@ func (ms MessageSender) SendToClient(i int, msg interface{}) error {
 
 	if client, ok := ms.clients[i]; ok {
 		log.Lvl5("Sending a message to client ", i, " (", client.Name(), ") - ", msg)
-		return ms.tree.SendTo(client, msg)
+		toSend, err := toNetworkMessage(msg)
+		if err != nil {
+			return err
+		}
+		return ms.tree.SendTo(client, toSend)
 	}
 
 	e := "Client " + strconv.Itoa(i) + " is unknown !"
@@ -97,7 +110,11 @@ func (ms MessageSender) SendToTrustee(i int, msg interface{}) error {
 
 	if trustee, ok := ms.trustees[i]; ok {
 		log.Lvl5("Sending a message to trustee ", i, " (", trustee.Name(), ") - ", msg)
-		return ms.tree.SendTo(trustee, msg)
+		toSend, err := toNetworkMessage(msg)
+		if err != nil {
+			return err
+		}
+		return ms.tree.SendTo(trustee, toSend)
 	}
 
 	e := "Trustee " + strconv.Itoa(i) + " is unknown !"
@@ -108,7 +125,11 @@ func (ms MessageSender) SendToTrustee(i int, msg interface{}) error {
 //SendToRelay sends a message to the unique relay
 func (ms MessageSender) SendToRelay(msg interface{}) error {
 	log.Lvl5("Sending a message to relay ", " - ", msg)
-	return ms.tree.SendTo(ms.relay, msg)
+	toSend, err := toNetworkMessage(msg)
+	if err != nil {
+		return err
+	}
+	return ms.tree.SendTo(ms.relay, toSend)
 }
 
 //BroadcastToAllClients broadcasts a message (must be a REL_CLI_DOWNSTREAM_DATA_UDP) to all clients using UDP
@@ -123,8 +144,9 @@ func (ms MessageSender) BroadcastToAllClients(msg interface{}) error {
 	return nil
 }
 
-//ClientSubscribeToBroadcast allows a client to subscribe to UDP broadcast
-func (ms MessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+//ClientSubscribeToBroadcast allows a client to subscribe to UDP broadcast. It returns when ctx is cancelled (which
+//also unblocks the UDP socket), or when it receives false on startStopChan
+func (ms MessageSender) ClientSubscribeToBroadcast(ctx context.Context, clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
 
 	clientName := "client-" + strconv.Itoa(clientID)
 	log.Lvl3(clientName, " started UDP-listener helper.")
@@ -132,37 +154,49 @@ func (ms MessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived
 	lastSeenMessage := 0 //the first real message has ID 1; this means that we saw the empty struct.
 
 	for {
+		//until we listen, we wait for the start
+		if !listening {
+			select {
+			case <-ctx.Done():
+				log.Lvl3("client", clientName, " stopped broadcast-listening.")
+				return nil
+			case val := <-startStopChan:
+				if !val {
+					log.Lvl3("client", clientName, " killed broadcast-listening.")
+					return nil
+				}
+				listening = true
+				log.Lvl3("client", clientName, " switched on broadcast-listening")
+			}
+			continue
+		}
+
 		select {
 		case val := <-startStopChan:
-			if val {
-				listening = true //either we listen or we stop
-				log.Lvl3("client", clientName, " switched on broadcast-listening")
-			} else {
+			if !val {
 				log.Lvl3("client", clientName, " killed broadcast-listening.")
 				return nil
 			}
 		default:
 		}
 
-		if listening {
-			emptyMessage := net.REL_CLI_DOWNSTREAM_DATA_UDP{}
-			//listen and decode
-			log.Lvl4("client", clientName, " calling listen and block...")
-			filledMessage, err := ms.udpChannel.ListenAndBlock(&emptyMessage, lastSeenMessage, clientName)
-			lastSeenMessage++
-
-			if err != nil {
-				log.Error(clientName, " an error occurred : ", err)
-			}
-
-			log.Lvl4(clientName, " Received an UDP message n°"+strconv.Itoa(lastSeenMessage))
+		emptyMessage := net.REL_CLI_DOWNSTREAM_DATA_UDP{}
+		//listen and decode
+		log.Lvl4("client", clientName, " calling listen and block...")
+		filledMessage, err := ms.udpChannel.ListenAndBlock(ctx, &emptyMessage, lastSeenMessage, clientName)
+		if ctx.Err() != nil {
+			log.Lvl3("client", clientName, " stopped broadcast-listening.")
+			return nil
+		}
+		lastSeenMessage++
 
-			if err != nil {
-				log.Error(clientName, " an error occurred : ", err)
-			}
+		if err != nil {
+			log.Error(clientName, " an error occurred : ", err)
+			continue
+		}
 
-			messageReceived(filledMessage)
+		log.Lvl4(clientName, " Received an UDP message n°"+strconv.Itoa(lastSeenMessage))
 
-		}
+		messageReceived(filledMessage)
 	}
 }
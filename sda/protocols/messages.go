@@ -1,138 +1,65 @@
 package protocols
 
 import (
+	"errors"
+	"reflect"
+
 	"github.com/dedis/prifi/prifi-lib/net"
 	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
-//Struct_ALL_ALL_SHUTDOWN is a wrapper for ALL_ALL_SHUTDOWN (but also contains a *onet.TreeNode)
-type Struct_ALL_ALL_SHUTDOWN struct {
-	*onet.TreeNode
-	net.ALL_ALL_SHUTDOWN
-}
-
-//Struct_ALL_ALL_PARAMETERS is a wrapper for ALL_ALL_PARAMETERS (but also contains a *onet.TreeNode)
-type Struct_ALL_ALL_PARAMETERS struct {
-	*onet.TreeNode
-	net.ALL_ALL_PARAMETERS
-}
-
-//Struct_CLI_REL_TELL_PK_AND_EPH_PK is a wrapper for CLI_REL_TELL_PK_AND_EPH_PK (but also contains a *onet.TreeNode)
-type Struct_CLI_REL_TELL_PK_AND_EPH_PK struct {
-	*onet.TreeNode
-	net.CLI_REL_TELL_PK_AND_EPH_PK
-}
-
-//Struct_CLI_REL_UPSTREAM_DATA is a wrapper for CLI_REL_UPSTREAM_DATA (but also contains a *onet.TreeNode)
-type Struct_CLI_REL_UPSTREAM_DATA struct {
-	*onet.TreeNode
-	net.CLI_REL_UPSTREAM_DATA
-}
-
-//Struct_CLI_REL_UPSTREAM_DATA is a wrapper for CLI_REL_OPENCLOSED_DATA (but also contains a *onet.TreeNode)
-type Struct_CLI_REL_OPENCLOSED_DATA struct {
-	*onet.TreeNode
-	net.CLI_REL_OPENCLOSED_DATA
-}
-
-//Struct_REL_CLI_DOWNSTREAM_DATA is a wrapper for REL_CLI_DOWNSTREAM_DATA (but also contains a *onet.TreeNode)
-type Struct_REL_CLI_DOWNSTREAM_DATA struct {
-	*onet.TreeNode
-	net.REL_CLI_DOWNSTREAM_DATA
-}
-
-//Struct_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG is a wrapper for REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG (but also contains a *onet.TreeNode)
-type Struct_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG struct {
-	*onet.TreeNode
-	net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG
-}
-
-//Struct_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE is a wrapper for REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE (but also contains a *onet.TreeNode)
-type Struct_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE struct {
-	*onet.TreeNode
-	net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE
-}
-
-//Struct_REL_TRU_TELL_TRANSCRIPT is a wrapper for REL_TRU_TELL_TRANSCRIPT (but also contains a *onet.TreeNode)
-type Struct_REL_TRU_TELL_TRANSCRIPT struct {
-	*onet.TreeNode
-	net.REL_TRU_TELL_TRANSCRIPT
-}
-
-//Struct_TRU_REL_DC_CIPHER is a wrapper for TRU_REL_DC_CIPHER (but also contains a *onet.TreeNode)
-type Struct_TRU_REL_DC_CIPHER struct {
-	*onet.TreeNode
-	net.TRU_REL_DC_CIPHER
-}
-
-//Struct_TRU_REL_SHUFFLE_SIG is a wrapper for TRU_REL_SHUFFLE_SIG (but also contains a *onet.TreeNode)
-type Struct_TRU_REL_SHUFFLE_SIG struct {
-	*onet.TreeNode
-	net.TRU_REL_SHUFFLE_SIG
-}
-
-//Struct_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS is a wrapper for TRU_REL_TELL_NEW_BASE_AND_EPH_PKS (but also contains a *onet.TreeNode)
-type Struct_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS struct {
-	*onet.TreeNode
-	net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS
-}
-
-//Struct_TRU_REL_TELL_PK is a wrapper for TRU_REL_TELL_PK (but also contains a *onet.TreeNode)
-type Struct_TRU_REL_TELL_PK struct {
-	*onet.TreeNode
-	net.TRU_REL_TELL_PK
-}
-
-//Struct_REL_TRU_TELL_RATE_CHANGE is a wrapper for REL_TRU_TELL_RATE_CHANGE (but also contains a *onet.TreeNode)
-type Struct_REL_TRU_TELL_RATE_CHANGE struct {
-	*onet.TreeNode
-	net.REL_TRU_TELL_RATE_CHANGE
-}
-
-//Struct_REL_CLI_DISRUPTED_ROUND is a wrapper for REL_CLI_DISRUPTED_ROUND (but also contains a *onet.TreeNode)
-type Struct_REL_CLI_DISRUPTED_ROUND struct {
-	*onet.TreeNode
-	net.REL_CLI_DISRUPTED_ROUND
-}
-
-//Struct_CLI_REL_DISRUPTION_BLAME is a wrapper for CLI_REL_DISRUPTION_BLAME (but also contains a *onet.TreeNode)
-type Struct_CLI_REL_DISRUPTION_BLAME struct {
-	*onet.TreeNode
-	net.CLI_REL_DISRUPTION_BLAME
-}
-
-//Struct_REL_ALL_DISRUPTION_REVEAL is a wrapper for REL_ALL_DISRUPTION_REVEAL (but also contains a *onet.TreeNode)
-type Struct_REL_ALL_DISRUPTION_REVEAL struct {
-	*onet.TreeNode
-	net.REL_ALL_DISRUPTION_REVEAL
-}
-
-//Struct_CLI_REL_DISRUPTION_REVEAL is a wrapper for CLI_REL_DISRUPTION_REVEAL (but also contains a *onet.TreeNode)
-type Struct_CLI_REL_DISRUPTION_REVEAL struct {
-	*onet.TreeNode
-	net.CLI_REL_DISRUPTION_REVEAL
-}
-
-//Struct_TRU_REL_DISRUPTION_REVEAL is a wrapper for TRU_REL_DISRUPTION_REVEAL (but also contains a *onet.TreeNode)
-type Struct_TRU_REL_DISRUPTION_REVEAL struct {
-	*onet.TreeNode
-	net.TRU_REL_DISRUPTION_REVEAL
-}
-
-//Struct_REL_ALL_DISRUPTION_SECRET is a wrapper for REL_ALL_DISRUPTION_SECRET (but also contains a *onet.TreeNode)
-type Struct_REL_ALL_DISRUPTION_SECRET struct {
-	*onet.TreeNode
-	net.REL_ALL_DISRUPTION_SECRET
-}
-
-//Struct_CLI_REL_DISRUPTION_SECRET is a wrapper for CLI_REL_DISRUPTION_SECRET (but also contains a *onet.TreeNode)
-type Struct_CLI_REL_DISRUPTION_SECRET struct {
-	*onet.TreeNode
-	net.CLI_REL_DISRUPTION_SECRET
-}
-
-//Struct_TRU_REL_DISRUPTION_SECRET is a wrapper for TRU_REL_DISRUPTION_SECRET (but also contains a *onet.TreeNode)
-type Struct_TRU_REL_DISRUPTION_SECRET struct {
-	*onet.TreeNode
-	net.TRU_REL_DISRUPTION_SECRET
+/*
+ * All the messages of PriFi-lib are authenticated by their sender (see prifi-lib/net/authenticator.go), hence we only
+ * transport net.AUTHENTICATED_MESSAGE. The inner message is encoded by the network lib, so all the messages of
+ * PriFi-lib must still be registered (see init() in protocol.go).
+ */
+
+//AuthenticatedMessage is a net.AUTHENTICATED_MESSAGE, with its inner message encoded by the network lib
+type AuthenticatedMessage struct {
+	Msg       []byte
+	Counter   uint64
+	MAC       []byte
+	Signature []byte
+}
+
+//Struct_AuthenticatedMessage is a wrapper for AuthenticatedMessage (but also contains a *onet.TreeNode)
+type Struct_AuthenticatedMessage struct {
+	*onet.TreeNode
+	AuthenticatedMessage
+}
+
+//toNetworkMessage encodes the messages authenticated by PriFi-lib; the others are returned as they are
+func toNetworkMessage(msg interface{}) (interface{}, error) {
+	authenticated, ok := msg.(*net.AUTHENTICATED_MESSAGE)
+	if !ok {
+		return msg, nil
+	}
+
+	//the network lib encodes a pointer to the message
+	inner := reflect.ValueOf(authenticated.Msg)
+	if inner.Kind() != reflect.Ptr {
+		ptr := reflect.New(inner.Type())
+		ptr.Elem().Set(inner)
+		inner = ptr
+	}
+	b, err := network.Marshal(inner.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return &AuthenticatedMessage{Msg: b, Counter: authenticated.Counter, MAC: authenticated.MAC, Signature: authenticated.Signature}, nil
+}
+
+//fromNetworkMessage decodes an AuthenticatedMessage into the net.AUTHENTICATED_MESSAGE given to PriFi-lib
+func fromNetworkMessage(msg AuthenticatedMessage, suite network.Suite) (net.AUTHENTICATED_MESSAGE, error) {
+	_, inner, err := network.Unmarshal(msg.Msg, suite)
+	if err != nil {
+		return net.AUTHENTICATED_MESSAGE{}, err
+	}
+	v := reflect.ValueOf(inner)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return net.AUTHENTICATED_MESSAGE{}, errors.New("could not decode the authenticated message")
+	}
+	//PriFi-lib handles the messages, not pointers to them
+	return net.AUTHENTICATED_MESSAGE{Msg: v.Elem().Interface(), Counter: msg.Counter, MAC: msg.MAC, Signature: msg.Signature}, nil
 }
@@ -1,7 +1,20 @@
 package protocols
 
 import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
 	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/client"
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/utils"
+	"gopkg.in/dedis/kyber.v2"
+	"gopkg.in/dedis/kyber.v2/util/encoding"
+	"gopkg.in/dedis/kyber.v2/util/key"
 	"gopkg.in/dedis/onet.v2/log"
 	"gopkg.in/dedis/onet.v2/network"
 )
@@ -47,12 +60,20 @@ type PrifiTomlConfig struct {
 	RelayReportingLimit                     int
 	UseUDP                                  bool
 	DoLatencyTests                          bool
+	LatencyTestsInterval                    int   // ms
+	LatencyTestsClients                     []int // the clients which send latency tests, and reveal their slot; if empty, client 0
 	SocksServerPort                         int
 	SocksClientPort                         int
 	ProtocolVersion                         string
 	DCNetType                               string
 	ReplayPCAP                              bool
 	PCAPFolder                              string
+	PCAPReplayPayloads                      bool
+	PCAPTimeScale                           float64
+	PCAPRandomSeed                          int64
+	PCAPFilter                              string
+	RelayReplayPCAP                         bool   // the relay replays PCAPFolder/relay.pcap(ng) downstream
+	RelayPCAPFilter                         string // the packets of the relay's capture it replays, e.g. "dst=10.0.0.2"
 	TrusteeSleepTimeBetweenMessages         int
 	TrusteeAlwaysSlowDown                   bool
 	TrusteeNeverSlowDown                    bool
@@ -60,12 +81,67 @@ type PrifiTomlConfig struct {
 	DisruptionProtectionEnabled             bool
 	EquivocationProtectionEnabled           bool // not linked in the back
 	OpenClosedSlotsMinDelayBetweenRequests  int
+	OpenClosedSlotsMaxDelayBetweenRequests  int
+	OpenClosedSlotsPolicy                   string
 	RelayMaxNumberOfConsecutiveFailedRounds int
 	RelayProcessingLoopSleepTime            int
 	RelayRoundTimeOut                       int
 	RelayTrusteeCacheLowBound               int
 	RelayTrusteeCacheHighBound              int
 	VerboseIngressEgressServers             bool
+	UDPFECGroupSize                         int
+	RelayAdaptiveWindow                     bool
+	RelayDownstreamQoSWeights               string
+	EgressQoSBulkThreshold                  int
+	RelayDownstreamFanOutQueueSize          int
+	RelayAuditLogFile                       string
+	RelayStandbyPriFiPublic                 string   // the public key (hex) of the standby relay, the only relay which may resume the session
+	ClientPinnedTrustees                    []string // the public keys (hex) of the trustees the client trusts
+	ClientPinnedTrusteesFile                string   // a file with more such keys, one per line
+	ClientMinPinnedTrustees                 int
+	ClientTransmissionPolicy                string // when the client reserves slots, see prifi-lib/client/transmission_policy.go
+	ClientTransmissionPolicyPeriod          int
+	ClientTransmissionPolicyBurst           int
+	ClientPadPrecomputationRounds           int    // if > 0, the clients compute their pads this number of rounds in advance
+	ClientStatusAPIPort                     int    // if > 0, the client serves its status on 127.0.0.1:port, see sda/services/status.go
+	ClientStatusAPITokenFile                string // the token of the status API is written there
+}
+
+// PinnedTrusteesPks parses the keys of ClientPinnedTrustees and of ClientPinnedTrusteesFile (in which empty lines and
+// lines starting with # are ignored). A trustee pinned several times (e.g., in prifi.toml and in group.toml) is listed
+// several times; the client counts it once (see prifi-lib/client/pinning.go)
+func (t *PrifiTomlConfig) PinnedTrusteesPks() ([]kyber.Point, error) {
+	hexKeys := append([]string{}, t.ClientPinnedTrustees...)
+
+	if t.ClientPinnedTrusteesFile != "" {
+		f, err := os.Open(t.ClientPinnedTrusteesFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			hexKeys = append(hexKeys, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	pks := make([]kyber.Point, 0)
+	for _, hexKey := range hexKeys {
+		pk, err := encoding.StringHexToPoint(config.CryptoSuite, hexKey)
+		if err != nil {
+			return nil, errors.New("Could not parse the pinned trustee key \"" + hexKey + "\": " + err.Error())
+		}
+		pks = append(pks, pk)
+	}
+	return pks, nil
 }
 
 //PriFiSDAWrapperConfig is all the information the SDA-Protocols needs. It contains the network map of identities, our role, and the socks parameters if we are the corresponding role
@@ -76,6 +152,17 @@ type PriFiSDAWrapperConfig struct {
 	ClientSideSocksConfig *SOCKSConfig
 	RelaySideSocksConfig  *SOCKSConfig
 	udpChan               UDPChannel
+
+	//the long-term PriFi key pair of this node; if nil, the PriFi-lib generates a fresh one
+	KeyPair *key.Pair
+
+	//set on the clients and trustees after a failover : the protocol (of the failed relay) whose PriFi-lib we continue
+	ResumeFrom *PriFiSDAProtocol
+	//set on a standby relay taking over : the replicated state, and the Identities contain the PriFi IDs of the participants
+	ResumeState *net.RELAY_FAILOVER_STATE
+
+	//on a client, true if the user paused the upstream transmission (in a previous run of the protocol)
+	UpstreamPaused bool
 }
 
 // SetConfig configures the PriFi node.
@@ -106,6 +193,17 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 		}
 	}
 
+	//the clients and trustees continue the PriFi-lib of the failed relay's protocol, which now sends via us
+	if config.ResumeFrom != nil && config.Role != Relay {
+		p.sender = config.ResumeFrom.sender
+		p.sender.set(ms)
+		p.prifiLibInstance = config.ResumeFrom.prifiLibInstance
+		p.registerHandlers()
+		p.configSet = true
+		return
+	}
+	p.sender = newFailoverMessageSender(ms)
+
 	experimentResultChan := p.ResultChannel
 
 	switch config.Role {
@@ -116,12 +214,19 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 			config.RelaySideSocksConfig.UpstreamChannel,
 			experimentResultChan,
 			p.handleTimeout,
-			ms)
+			p.sender)
+		p.setKeyPair(config.KeyPair)
+		if config.Toml.RelayAuditLogFile != "" {
+			p.startAuditLog(config.Toml.RelayAuditLogFile)
+		}
+		p.setRelayPCAPReplay(config.Toml)
+		p.setStandbyRelayKey(config.Toml)
 	case Trustee:
 		p.prifiLibInstance = prifi_lib.NewPriFiTrustee(config.Toml.TrusteeNeverSlowDown,
 			config.Toml.TrusteeAlwaysSlowDown,
 			config.Toml.TrusteeSleepTimeBetweenMessages,
-			ms)
+			p.sender)
+		p.setKeyPair(config.KeyPair)
 
 	case Client:
 		doLatencyTests := config.Toml.DoLatencyTests
@@ -132,7 +237,14 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 			config.ClientSideSocksConfig.DownstreamChannel,
 			config.Toml.ReplayPCAP,
 			config.Toml.PCAPFolder,
-			ms)
+			p.sender)
+		p.setKeyPair(config.KeyPair)
+		p.pinTrustees(config.Toml)
+		p.setTransmissionPolicy(config.Toml)
+		p.setLatencyTests(config.Toml)
+		p.setPadPrecomputation(config.Toml)
+		p.setPCAPReplayOptions(config.Toml)
+		p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).PauseUpstream(config.UpstreamPaused)
 	}
 
 	p.registerHandlers()
@@ -140,6 +252,129 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 	p.configSet = true
 }
 
+// startAuditLog appends the audit log of the relay to the given file; if it cannot, the relay runs without audit log
+func (p *PriFiSDAProtocol) startAuditLog(file string) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error("Could not open the audit log", file, ", error is", err)
+		return
+	}
+	if err := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetAuditLog(f); err != nil {
+		log.Error("Could not start the audit log", file, ", error is", err)
+		f.Close()
+	}
+}
+
+// setKeyPair gives our long-term key pair, if any, to the PriFi-lib
+func (p *PriFiSDAProtocol) setKeyPair(keyPair *key.Pair) {
+	if keyPair == nil {
+		return
+	}
+	if err := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetKeyPair(keyPair.Public, keyPair.Private); err != nil {
+		log.Fatal("Could not set the PriFi key pair, error is", err)
+	}
+}
+
+// setStandbyRelayKey gives the key of the standby relay, if any, to the relay, which announces it to the clients and
+// trustees; if it is invalid, the relay must not run
+func (p *PriFiSDAProtocol) setStandbyRelayKey(toml *PrifiTomlConfig) {
+	if toml.RelayStandbyPriFiPublic == "" {
+		return
+	}
+	pk, err := encoding.StringHexToPoint(config.CryptoSuite, toml.RelayStandbyPriFiPublic)
+	if err != nil {
+		log.Fatal("Could not parse the key of the standby relay, error is", err)
+	}
+	p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetStandbyRelayKey(pk)
+}
+
+// pinTrustees gives the pinned trustees to the client; if they are invalid, the client must not run
+func (p *PriFiSDAProtocol) pinTrustees(toml *PrifiTomlConfig) {
+	pinned, err := toml.PinnedTrusteesPks()
+	if err != nil {
+		log.Fatal("Could not read the pinned trustees, error is", err)
+	}
+	if err := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetPinnedTrustees(pinned, toml.ClientMinPinnedTrustees); err != nil {
+		log.Fatal("Could not pin the trustees, error is", err)
+	}
+}
+
+// setLatencyTests gives the interval and the probing clients of prifi.toml, if any, to the client
+func (p *PriFiSDAProtocol) setLatencyTests(toml *PrifiTomlConfig) {
+	if toml.LatencyTestsInterval == 0 && len(toml.LatencyTestsClients) == 0 {
+		return
+	}
+	interval := client.DEFAULT_LATENCY_TESTS_INTERVAL
+	if toml.LatencyTestsInterval != 0 {
+		interval = time.Duration(toml.LatencyTestsInterval) * time.Millisecond
+	}
+	if err := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetLatencyTests(interval, toml.LatencyTestsClients); err != nil {
+		log.Fatal("Could not set the latency tests, error is", err)
+	}
+}
+
+// setPadPrecomputation gives the number of rounds whose pads are computed in advance, if any, to the client
+func (p *PriFiSDAProtocol) setPadPrecomputation(toml *PrifiTomlConfig) {
+	if toml.ClientPadPrecomputationRounds == 0 {
+		return
+	}
+	if err := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetPadPrecomputation(toml.ClientPadPrecomputationRounds); err != nil {
+		log.Fatal("Could not set the pad precomputation, error is", err)
+	}
+}
+
+// setPCAPReplayOptions gives the options of the PCAP replay, if enabled, to the client
+func (p *PriFiSDAProtocol) setPCAPReplayOptions(toml *PrifiTomlConfig) {
+	if !toml.ReplayPCAP {
+		return
+	}
+	filter, err := utils.ParsePCAPFilter(toml.PCAPFilter)
+	if err != nil {
+		log.Fatal("Could not parse the PCAP filter, error is", err)
+	}
+	options := utils.PCAPReplayOptions{
+		RealPayloads: toml.PCAPReplayPayloads,
+		TimeScale:    toml.PCAPTimeScale,
+		Seed:         toml.PCAPRandomSeed,
+		Filter:       filter,
+	}
+	if err := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetPCAPReplayOptions(options); err != nil {
+		log.Fatal("Could not set the PCAP replay options, error is", err)
+	}
+}
+
+// setRelayPCAPReplay makes the relay replay its capture downstream, if enabled, with the options of the clients
+func (p *PriFiSDAProtocol) setRelayPCAPReplay(toml *PrifiTomlConfig) {
+	if !toml.RelayReplayPCAP {
+		return
+	}
+	filter, err := utils.ParsePCAPFilter(toml.RelayPCAPFilter)
+	if err != nil {
+		log.Fatal("Could not parse the relay PCAP filter, error is", err)
+	}
+	options := utils.PCAPReplayOptions{
+		RealPayloads: toml.PCAPReplayPayloads,
+		TimeScale:    toml.PCAPTimeScale,
+		Seed:         toml.PCAPRandomSeed,
+		Filter:       filter,
+	}
+	if err := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetPCAPReplay(toml.PCAPFolder, options); err != nil {
+		log.Fatal("Could not set the downstream PCAP replay, error is", err)
+	}
+}
+
+// setTransmissionPolicy gives the transmission policy of prifi.toml, if any, to the client
+func (p *PriFiSDAProtocol) setTransmissionPolicy(toml *PrifiTomlConfig) {
+	if toml.ClientTransmissionPolicy == "" {
+		return
+	}
+	policy, err := client.NewTransmissionPolicy(toml.ClientTransmissionPolicy, toml.ClientTransmissionPolicyPeriod, toml.ClientTransmissionPolicyBurst)
+	if err != nil {
+		log.Fatal("Could not create the transmission policy, error is", err)
+	}
+	p.prifiLibInstance.(*prifi_lib.PriFiLibInstance).SetTransmissionPolicy(policy)
+}
+
 // SetTimeoutHandler sets the function that will be called on round timeout
 // if the protocol runs as the relay.
 func (p *PriFiSDAProtocol) SetTimeoutHandler(handler func([]string, []string)) {
@@ -24,8 +24,11 @@ package protocols
 
 import (
 	"errors"
+	"strconv"
+	"sync"
 
 	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/client"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"gopkg.in/dedis/onet.v2"
 	"gopkg.in/dedis/onet.v2/log"
@@ -47,7 +50,23 @@ type PriFiSDAProtocol struct {
 
 	//this is the actual "PriFi" (DC-net) protocol/library, defined in prifi-lib/prifi.go
 	prifiLibInstance prifi_lib.SpecializedLibInstance
-	HasStopped       bool //when set to true, the protocol has been stopped by PriFi-lib and should be destroyed
+	sender           *failoverMessageSender //the MessageSender given to PriFi-lib; it follows the lib if it is resumed
+	HasStopped       bool                   //when set to true, the protocol has been stopped by PriFi-lib and should be destroyed
+	stoppedMutex     sync.Mutex             //protects HasStopped, which the service reads from other goroutines (see IsRunning)
+}
+
+// IsRunning returns false once the protocol is stopped (or detached)
+func (p *PriFiSDAProtocol) IsRunning() bool {
+	p.stoppedMutex.Lock()
+	defer p.stoppedMutex.Unlock()
+	return !p.HasStopped
+}
+
+// setStopped marks the protocol as stopped
+func (p *PriFiSDAProtocol) setStopped() {
+	p.stoppedMutex.Lock()
+	defer p.stoppedMutex.Unlock()
+	p.HasStopped = true
 }
 
 //Start is called on the Relay by the service when ChurnHandler decides so
@@ -61,6 +80,11 @@ func (p *PriFiSDAProtocol) Start() error {
 
 	log.Lvl3("Starting PriFi-SDA-Wrapper Protocol")
 
+	//we are a standby relay taking over the session of the failed relay
+	if p.config.ResumeState != nil {
+		return p.prifiLibInstance.ReceivedMessage(net.ALL_REL_RESUME{State: *p.config.ResumeState})
+	}
+
 	//emulate the reception of a ALL_ALL_PARAMETERS with StartNow=true
 	msg := new(net.ALL_ALL_PARAMETERS)
 	msg.Add("StartNow", true)
@@ -76,17 +100,22 @@ func (p *PriFiSDAProtocol) Start() error {
 	msg.Add("DCNetType", p.config.Toml.DCNetType)
 	msg.Add("DisruptionProtectionEnabled", p.config.Toml.DisruptionProtectionEnabled)
 	msg.Add("OpenClosedSlotsMinDelayBetweenRequests", p.config.Toml.OpenClosedSlotsMinDelayBetweenRequests)
+	msg.Add("OpenClosedSlotsMaxDelayBetweenRequests", p.config.Toml.OpenClosedSlotsMaxDelayBetweenRequests)
+	msg.Add("OpenClosedSlotsPolicy", p.config.Toml.OpenClosedSlotsPolicy)
 	msg.Add("RelayMaxNumberOfConsecutiveFailedRounds", p.config.Toml.RelayMaxNumberOfConsecutiveFailedRounds)
 	msg.Add("RelayProcessingLoopSleepTime", p.config.Toml.RelayProcessingLoopSleepTime)
 	msg.Add("RelayRoundTimeOut", p.config.Toml.RelayRoundTimeOut)
 	msg.Add("RelayTrusteeCacheLowBound", p.config.Toml.RelayTrusteeCacheLowBound)
 	msg.Add("RelayTrusteeCacheHighBound", p.config.Toml.RelayTrusteeCacheHighBound)
 	msg.Add("EquivocationProtectionEnabled", p.config.Toml.EquivocationProtectionEnabled)
+	msg.Add("UDPFECGroupSize", p.config.Toml.UDPFECGroupSize)
+	msg.Add("AdaptiveWindow", p.config.Toml.RelayAdaptiveWindow)
+	msg.Add("DownstreamQoSWeights", p.config.Toml.RelayDownstreamQoSWeights)
+	msg.Add("DownstreamFanOutQueueSize", p.config.Toml.RelayDownstreamFanOutQueueSize)
 	msg.ForceParams = true
 
-	p.SendTo(p.TreeNode(), msg)
-
-	return nil
+	//this is a local call, not a message from the network (which must be authenticated)
+	return p.prifiLibInstance.ReceivedMessage(*msg)
 }
 
 // Stop aborts the current execution of the protocol.
@@ -101,12 +130,69 @@ func (p *PriFiSDAProtocol) Stop() {
 		case Client:
 			p.prifiLibInstance.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
 		}
+		//releases the goroutines and timers of the lib, even if it refused the shutdown message
+		p.prifiLibInstance.Stop()
 	}
 
-	p.HasStopped = true
+	p.setStopped()
 
 	p.Shutdown()
-	//TODO : sureley we're missing some allocated resources here...
+}
+
+// Resync changes some parameters of the running protocol, without restarting it (see prifi-lib/relay/resync.go).
+// Only PayloadSize, CellSizeDown, RelayWindowSize and RelayUseOpenClosedSlots are taken from "toml"; nTrustees <= 0
+// keeps the current trustees. The change happens at round "roundID", or as soon as possible. Relay only
+func (p *PriFiSDAProtocol) Resync(toml *PrifiTomlConfig, nTrustees int, roundID int32) error {
+
+	if p.role != Relay {
+		return errors.New("Only the relay can resync the protocol")
+	}
+	if p.prifiLibInstance == nil || !p.IsRunning() {
+		return errors.New("Cannot resync, the protocol is not running")
+	}
+	if nTrustees <= 0 {
+		nTrustees = len(p.ms.trustees)
+	}
+	if nTrustees > len(p.ms.trustees) {
+		return errors.New("Cannot resync with " + strconv.Itoa(nTrustees) + " trustees, only " + strconv.Itoa(len(p.ms.trustees)) + " are part of the protocol")
+	}
+
+	msg := net.ALL_REL_RESYNC{RoundID: roundID}
+	msg.Params.Add("NTrustees", nTrustees)
+	msg.Params.Add("PayloadSize", toml.PayloadSize)
+	msg.Params.Add("DownstreamCellSize", toml.CellSizeDown)
+	msg.Params.Add("WindowSize", toml.RelayWindowSize)
+	msg.Params.Add("UseOpenClosedSlots", toml.RelayUseOpenClosedSlots)
+
+	if err := p.prifiLibInstance.ReceivedMessage(msg); err != nil {
+		return err
+	}
+
+	p.config.Toml.PayloadSize = toml.PayloadSize
+	p.config.Toml.CellSizeDown = toml.CellSizeDown
+	p.config.Toml.RelayWindowSize = toml.RelayWindowSize
+	p.config.Toml.RelayUseOpenClosedSlots = toml.RelayUseOpenClosedSlots
+	return nil
+}
+
+// ClientStatus returns the status of the PriFi-lib of the client, and false if we are not a client
+func (p *PriFiSDAProtocol) ClientStatus() (client.ClientStatus, bool) {
+	lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance)
+	if !ok || p.role != Client {
+		return client.ClientStatus{}, false
+	}
+	return lib.ClientStatus()
+}
+
+// PauseUpstream pauses (or resumes) the upstream transmission of the client, which then only sends cover traffic.
+// Client only
+func (p *PriFiSDAProtocol) PauseUpstream(paused bool) error {
+	lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance)
+	if !ok || p.role != Client {
+		return errors.New("Only a client can pause its upstream transmission")
+	}
+	lib.PauseUpstream(paused)
+	return nil
 }
 
 /**
@@ -117,10 +203,12 @@ func init() {
 
 	//register the prifi_lib's message with the network lib here
 	network.RegisterMessage(net.ALL_ALL_PARAMETERS{})
+	network.RegisterMessage(net.ALL_ALL_SHUTDOWN{})
 	network.RegisterMessage(net.CLI_REL_TELL_PK_AND_EPH_PK{})
 	network.RegisterMessage(net.CLI_REL_UPSTREAM_DATA{})
 	network.RegisterMessage(net.REL_CLI_DOWNSTREAM_DATA{})
 	network.RegisterMessage(net.CLI_REL_OPENCLOSED_DATA{})
+	network.RegisterMessage(net.CLI_REL_DOWNSTREAM_NACK{})
 	network.RegisterMessage(net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG{})
 	network.RegisterMessage(net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE{})
 	network.RegisterMessage(net.REL_TRU_TELL_TRANSCRIPT{})
@@ -137,6 +225,8 @@ func init() {
 	network.RegisterMessage(net.REL_ALL_DISRUPTION_SECRET{})
 	network.RegisterMessage(net.CLI_REL_DISRUPTION_SECRET{})
 	network.RegisterMessage(net.TRU_REL_DISRUPTION_SECRET{})
+	network.RegisterMessage(net.REL_ALL_RESUME{})
+	network.RegisterMessage(AuthenticatedMessage{})
 
 	onet.GlobalProtocolRegister(ProtocolName, NewPriFiSDAWrapperProtocol)
 }
@@ -170,103 +260,9 @@ func NewPriFiSDAWrapperProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance
 	return p, nil
 }
 
-// registerHandlers contains the verbose code
-// that registers handlers for all prifi messages.
+// registerHandlers registers the handler of the prifi messages, which are all authenticated.
 func (p *PriFiSDAProtocol) registerHandlers() error {
-	//register handlers
-	err := p.RegisterHandler(p.Received_ALL_ALL_PARAMETERS_NEW)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_ALL_ALL_SHUTDOWN)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-
-	//register client handlers
-	err = p.RegisterHandler(p.Received_REL_CLI_DOWNSTREAM_DATA)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-
-	//register relay handlers
-	err = p.RegisterHandler(p.Received_CLI_REL_TELL_PK_AND_EPH_PK)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_CLI_REL_UPSTREAM_DATA)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_TRU_REL_DC_CIPHER)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_TRU_REL_SHUFFLE_SIG)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_TRU_REL_TELL_PK)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_CLI_REL_CLI_REL_OPENCLOSED_DATA)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-
-	//register trustees handlers
-	err = p.RegisterHandler(p.Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_REL_TRU_TELL_TRANSCRIPT)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_REL_TRU_TELL_RATE_CHANGE)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-
-	//register blame procedure handlers
-	err = p.RegisterHandler(p.Received_REL_CLI_DISRUPTED_ROUND)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_CLI_REL_DISRUPTION_BLAME)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_REL_ALL_DISRUPTION_REVEAL)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_CLI_REL_DISRUPTION_REVEAL)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_TRU_REL_DISRUPTION_REVEAL)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_REL_ALL_DISRUPTION_SECRET)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_CLI_REL_DISRUPTION_SECRET)
-	if err != nil {
-		return errors.New("couldn't register handler: " + err.Error())
-	}
-	err = p.RegisterHandler(p.Received_TRU_REL_DISRUPTION_SECRET)
+	err := p.RegisterHandler(p.Received_AuthenticatedMessage)
 	if err != nil {
 		return errors.New("couldn't register handler: " + err.Error())
 	}
@@ -8,6 +8,8 @@ package protocols
  */
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 	"net"
 	"strconv"
@@ -45,8 +47,9 @@ type MarshallableMessage interface {
 type UDPChannel interface {
 	Broadcast(msg MarshallableMessage) error
 
-	//we take an empty MarshallableMessage as input, because the method does know how to parse the message
-	ListenAndBlock(msg MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error)
+	//we take an empty MarshallableMessage as input, because the method does know how to parse the message. It returns
+	//ctx.Err() if ctx is cancelled before a message arrives
+	ListenAndBlock(ctx context.Context, msg MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error)
 }
 
 /**
@@ -104,7 +107,7 @@ func (lc *LocalhostChannel) Broadcast(msg MarshallableMessage) error {
 }
 
 //ListenAndBlock of LocalhostChannel is the implementation of message reception for the fake localhost channel
-func (lc *LocalhostChannel) ListenAndBlock(emptyMessage MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error) {
+func (lc *LocalhostChannel) ListenAndBlock(ctx context.Context, emptyMessage MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error) {
 
 	//we wait until there is a new message
 	lc.RLock()
@@ -129,7 +132,12 @@ func (lc *LocalhostChannel) ListenAndBlock(emptyMessage MarshallableMessage, las
 		lc.RUnlock()
 
 		log.Lvl5("ListenAndBlock - last message is ", (lc.lastMessageID + 1), ", waiting.")
-		time.Sleep(5 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			lc.RLock()
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
 		lc.RLock()
 	}
 
@@ -180,7 +188,7 @@ func (c *RealUDPChannel) Broadcast(msg MarshallableMessage) error {
 }
 
 // ListenAndBlock of RealUDPChannel is the implementation of message reception for the real UDP channel
-func (c *RealUDPChannel) ListenAndBlock(emptyMessage MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error) {
+func (c *RealUDPChannel) ListenAndBlock(ctx context.Context, emptyMessage MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error) {
 
 	//if we're not ready with the connection yet
 	if c.localConn == nil {
@@ -199,22 +207,40 @@ func (c *RealUDPChannel) ListenAndBlock(emptyMessage MarshallableMessage, lastSe
 		c.localConn.SetReadBuffer(MAX_UDP_SIZE)
 	}
 
+	//if ctx is cancelled, we close the socket, which unblocks the read
+	conn := c.localConn
+	readDone := make(chan bool)
+	defer close(readDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-readDone:
+		}
+	}()
+
 	buf := make([]byte, MAX_UDP_SIZE)
-	n, addr, err := c.localConn.ReadFromUDP(buf)
+	n, addr, err := conn.ReadFromUDP(buf)
+	if ctx.Err() != nil {
+		c.localConn = nil
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		log.Error("ListenAndBlock(", identityListening, "): could not receive message, error is", err.Error())
+		return nil, err
+	}
 
 	log.Lvl4("ListenAndBlock(", identityListening, "): Received a UDP message of length", n, "from", addr)
 	sizeAdvertised := int(binary.BigEndian.Uint32(buf[0:4]))
 
-	if sizeAdvertised+4 != n {
-		log.Error("ListenAndBlock(", identityListening, "): could not receive read the ", string(sizeAdvertised+4), ", only", n, ", error is", err.Error())
+	if n < 4 || sizeAdvertised+4 != n {
+		e := "ListenAndBlock(" + identityListening + "): could not read the " + strconv.Itoa(sizeAdvertised+4) + " bytes advertised, only " + strconv.Itoa(n)
+		log.Error(e)
+		return nil, errors.New(e)
 	}
 	message := make([]byte, sizeAdvertised)
 	copy(message[:], buf[4:sizeAdvertised+4])
 
-	if err != nil {
-		log.Error("ListenAndBlock(", identityListening, "): could not receive message, error is", err.Error())
-	}
-
 	newMessage, err3 := emptyMessage.FromBytes(message)
 	if err3 != nil {
 		log.Error("ListenAndBlock(", identityListening, "): could not unmarshall message, error3 is", err3.Error())
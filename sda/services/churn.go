@@ -145,6 +145,13 @@ func (c *churnHandler) isATrustee(ID *network.ServerIdentity) bool {
 	return false
 }
 
+/**
+ * Tests if the given serverIdentity is a trustee of the group, or a waiting node
+ */
+func (c *churnHandler) isParticipant(ID *network.ServerIdentity) bool {
+	return c.isATrustee(ID) || c.waitQueue.contains(idFromServerIdentity(ID), false)
+}
+
 /**
  * Creates an IdentityMap from the waiting nodes, used by PriFi-lib
  */
@@ -179,6 +186,41 @@ func (c *churnHandler) createIdentitiesMap() map[string]protocols.PriFiIdentity
 	return res
 }
 
+/**
+ * Gives the waiting nodes the PriFi IDs they had in the session of a failed relay (see failover.go). Returns
+ * complete=true if all the participants of this session are waiting, and valid=false if a waiting node was not part of it
+ */
+func (c *churnHandler) assignReplicatedIDs(clients, trustees []*network.ServerIdentity) (bool, bool) {
+	clientIDs := make(map[string]int)
+	for i, v := range clients {
+		clientIDs[idFromServerIdentity(v)] = i
+	}
+	trusteeIDs := make(map[string]int)
+	for i, v := range trustees {
+		trusteeIDs[idFromServerIdentity(v)] = i
+	}
+
+	for k, v := range c.waitQueue.clients {
+		id, ok := clientIDs[k]
+		if !ok {
+			return false, false
+		}
+		v.numericID = id
+	}
+	for k, v := range c.waitQueue.trustees {
+		id, ok := trusteeIDs[k]
+		if !ok {
+			return false, false
+		}
+		v.numericID = id
+	}
+	c.nextFreeClientID = len(clients)
+	c.nextFreeTrusteeID = len(trustees)
+
+	nClients, nTrustees := c.waitQueue.count()
+	return nClients == len(clients) && nTrustees == len(trustees), true
+}
+
 func (c *churnHandler) getClientsIdentities() []*network.ServerIdentity {
 	nClients := len(c.waitQueue.clients)
 	clients := make([]*network.ServerIdentity, nClients)
@@ -5,15 +5,13 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/dedis/prifi/prifi-lib/net"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	"gopkg.in/dedis/onet.v2/app"
 	"gopkg.in/dedis/onet.v2/log"
 	"gopkg.in/dedis/onet.v2/network"
 )
 
-var socksClientConfig *prifi_protocol.SOCKSConfig
-var socksServerConfig *prifi_protocol.SOCKSConfig
-
 //Set the config, from the prifi.toml. Is called by sda/app.
 func (s *ServiceState) SetConfigFromToml(config *prifi_protocol.PrifiTomlConfig) {
 	log.Lvl3("Setting PriFi configuration...")
@@ -23,7 +21,7 @@ func (s *ServiceState) SetConfigFromToml(config *prifi_protocol.PrifiTomlConfig)
 
 // tryLoad tries to load the configuration and updates if a configuration
 // is found, else it returns an error.
-func (s *ServiceState) tryLoad() error {
+func (s *Service) tryLoad() error {
 	configFile := s.path + "/identity.bin"
 	b, err := ioutil.ReadFile(configFile)
 	if err != nil && !os.IsNotExist(err) {
@@ -62,7 +60,19 @@ func mapIdentities(group *app.Group) (*network.ServerIdentity, []*network.Server
 
 	return relay, trustees
 }
-func (s *ServiceState) setConfigToPriFiProtocol(wrapper *prifi_protocol.PriFiSDAProtocol) {
+
+// mapStandbyRelay returns the server identity of the standby relay in the group configuration, or nil if there is none
+func mapStandbyRelay(group *app.Group) *network.ServerIdentity {
+	for _, si := range group.Roster.List {
+		if group.GetDescription(si) == "relay-standby" {
+			return si
+		}
+	}
+	return nil
+}
+
+// setConfigToPriFiProtocol configures the protocol; "resumeState" is given by a standby relay taking over
+func (s *ServiceState) setConfigToPriFiProtocol(wrapper *prifi_protocol.PriFiSDAProtocol, resumeState *net.RELAY_FAILOVER_STATE) {
 
 	//normal nodes only needs the relay in their identity map
 	identitiesMap := make(map[string]prifi_protocol.PriFiIdentity)
@@ -80,12 +90,33 @@ func (s *ServiceState) setConfigToPriFiProtocol(wrapper *prifi_protocol.PriFiSDA
 		Toml:       s.prifiTomlConfig,
 		Identities: identitiesMap,
 		Role:       s.role,
-		ClientSideSocksConfig: socksClientConfig,
-		RelaySideSocksConfig:  socksServerConfig,
+		ClientSideSocksConfig: s.socksClientConfig,
+		RelaySideSocksConfig:  s.socksServerConfig,
+		KeyPair:               s.keyPair,
+		ResumeState:           resumeState,
+	}
+	s.statusMutex.Lock()
+	configMsg.UpstreamPaused = s.upstreamPaused
+	s.statusMutex.Unlock()
+
+	//after a failover, the clients and trustees continue with the PriFi-lib of the failed relay's protocol
+	if s.role != prifi_protocol.Relay {
+		s.failoverMutex.Lock()
+		configMsg.ResumeFrom = s.detachedProtocol
+		s.detachedProtocol = nil
+		s.failoverMutex.Unlock()
 	}
 
 	wrapper.SetConfigFromPriFiService(configMsg)
 
 	//when PriFi-protocol (via PriFi-lib) detects a slow client, call "handleTimeout"
 	wrapper.SetTimeoutHandler(s.handleTimeout)
+
+	//the relay replicates its state to the standby relay, if any
+	if s.role == prifi_protocol.Relay && s.standbyRelayIdentity != nil {
+		wrapper.SetReplicationHandler(s.replicateToStandbyRelay)
+		if s.prifiTomlConfig.RelayStandbyPriFiPublic == "" {
+			log.Error("The standby relay has no PriFiPublic in group.toml : the clients and trustees will not resume with it")
+		}
+	}
 }
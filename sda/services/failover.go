@@ -0,0 +1,297 @@
+package services
+
+// This file contains the logic to fail over to a standby relay.
+
+import (
+	"context"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	"gopkg.in/dedis/onet.v2/app"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+/*
+ * If group.toml contains a node with the description "relay-standby" :
+ *
+ * The relay :
+ * sends a heartbeat to the standby relay every RELAY_HEARTBEAT_INTERVAL
+ * replicates its state (see prifi-lib/relay/failover.go) to the standby relay, with the identities of the participants
+ *
+ * The standby relay :
+ * ignores everything but the heartbeats and the replicated state, until it has no heartbeat for RELAY_FAILOVER_TIMEOUT
+ * then, it takes over : it becomes the relay, and waits for the participants of the replicated state to connect
+ * when they all did, it resumes their session, without a new shuffle; after RELAY_RESUME_TIMEOUT, it gives up and
+ * starts a new session with the participants which are there
+ *
+ * The clients and trustees :
+ * when the connection with the relay breaks, they detach their protocol (but keep their PriFi-lib) and connect to
+ * the standby relay; the PriFi-lib is resumed by the protocol started by the standby relay
+ */
+
+// RelayHeartbeat messages are sent by the relay to the standby relay
+type RelayHeartbeat struct {
+	Group string
+}
+
+// RelayReplication messages contain the state of the relay, sent to the standby relay
+type RelayReplication struct {
+	Group    string
+	State    net.RELAY_FAILOVER_STATE
+	Clients  []*network.ServerIdentity //indexed by their PriFi ID
+	Trustees []*network.ServerIdentity //indexed by their PriFi ID
+}
+
+//Delay between two heartbeats of the relay
+const RELAY_HEARTBEAT_INTERVAL = 1 * time.Second
+
+//Delay without heartbeat after which the standby relay takes over
+const RELAY_FAILOVER_TIMEOUT = 5 * time.Second
+
+//Delay after which the standby relay which took over stops waiting for the participants of the session to resume
+const RELAY_RESUME_TIMEOUT = 30 * time.Second
+
+// StartStandbyRelay starts the standby-relay-mode : we take over if the relay fails.
+func (s *ServiceState) StartStandbyRelay(group *app.Group) error {
+	log.Info("Service", s, "running in standby relay mode")
+
+	relayID, _ := mapIdentities(group)
+	s.role = prifi_protocol.Relay
+	s.relayIdentity = relayID
+	s.isStandbyRelay = true
+
+	go s.watchRelayHeartbeats(group)
+
+	return nil
+}
+
+// isStandby returns true if we are a standby relay which did not take over
+func (s *ServiceState) isStandby() bool {
+	s.failoverMutex.Lock()
+	defer s.failoverMutex.Unlock()
+	return s.isStandbyRelay
+}
+
+// HandleRelayHeartbeat is called on the standby relay when the relay sends a heartbeat
+func (s *ServiceState) HandleRelayHeartbeat(msg *network.Envelope) {
+	s.failoverMutex.Lock()
+	defer s.failoverMutex.Unlock()
+
+	if !s.isStandbyRelay || !msg.ServerIdentity.Equal(s.relayIdentity) {
+		log.Lvl3("Ignored a heartbeat from", msg.ServerIdentity)
+		return
+	}
+	s.lastRelayHeartbeat = time.Now()
+}
+
+// HandleRelayReplication is called on the standby relay when the relay replicates its state
+func (s *ServiceState) HandleRelayReplication(msg *network.Envelope) {
+	s.failoverMutex.Lock()
+	defer s.failoverMutex.Unlock()
+
+	if !s.isStandbyRelay || !msg.ServerIdentity.Equal(s.relayIdentity) {
+		log.Lvl3("Ignored a replicated state from", msg.ServerIdentity)
+		return
+	}
+	s.replication = msg.Msg.(*RelayReplication)
+	s.lastRelayHeartbeat = time.Now()
+	log.Lvl2("Received the state of the relay, we would resume at round", s.replication.State.ResumeRoundID)
+}
+
+// sendHeartbeats sends a heartbeat to the standby relay every RELAY_HEARTBEAT_INTERVAL, until the group is closed
+func (s *ServiceState) sendHeartbeats() {
+	ticker := time.NewTicker(RELAY_HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.SendRaw(s.standbyRelayIdentity, &RelayHeartbeat{Group: s.name}); err != nil {
+			log.Lvl3("Heartbeat failed,", s.standbyRelayIdentity, "isn't online.")
+		}
+	}
+}
+
+// replicateToStandbyRelay is the replication handler given to the relay's protocol
+func (s *ServiceState) replicateToStandbyRelay(state *net.RELAY_FAILOVER_STATE, clients, trustees []*network.ServerIdentity) bool {
+	msg := &RelayReplication{
+		Group:    s.name,
+		State:    *state,
+		Clients:  clients,
+		Trustees: trustees,
+	}
+	if err := s.SendRaw(s.standbyRelayIdentity, msg); err != nil {
+		log.Error("Could not replicate our state to the standby relay", s.standbyRelayIdentity, ", error is", err)
+		return false
+	}
+	return true
+}
+
+// watchRelayHeartbeats takes over when the relay did not send a heartbeat for RELAY_FAILOVER_TIMEOUT. We wait for a
+// first heartbeat, so that we do not take over when the relay is simply slower to boot than us
+func (s *ServiceState) watchRelayHeartbeats(group *app.Group) {
+	ticker := time.NewTicker(RELAY_HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.failoverMutex.Lock()
+		last := s.lastRelayHeartbeat
+		s.failoverMutex.Unlock()
+
+		if !last.IsZero() && time.Since(last) > RELAY_FAILOVER_TIMEOUT {
+			s.takeOverAsRelay(group)
+			return
+		}
+	}
+}
+
+// takeOverAsRelay makes us the relay. If we have the state of the relay, we wait for its participants to resume
+// their session; otherwise, we start from scratch
+func (s *ServiceState) takeOverAsRelay(group *app.Group) {
+	log.Lvl1("No heartbeat from the relay", s.relayIdentity, "for", RELAY_FAILOVER_TIMEOUT, ", taking over.")
+
+	s.failoverMutex.Lock()
+	s.isStandbyRelay = false
+	resuming := s.replication != nil
+	s.failoverMutex.Unlock()
+
+	_, trusteesIDs := mapIdentities(group)
+	if err := s.startRelay(s.ServerIdentity(), trusteesIDs); err != nil {
+		log.Error("Could not take over as the relay, error is", err)
+		return
+	}
+
+	if resuming {
+		s.churnHandler.startProtocol = s.resumeOrStartPriFiProtocol
+		go s.stopWaitingForResume(s.ctx)
+	}
+}
+
+// resumeOrStartPriFiProtocol is the startProtocol of the churnHandler, on a standby relay which took over. It waits
+// until all the participants of the replicated state are connected, then resumes their session. Once resumed (or if
+// other participants connect), the protocol is started normally
+func (s *ServiceState) resumeOrStartPriFiProtocol() {
+
+	s.failoverMutex.Lock()
+	replication := s.replication
+	s.failoverMutex.Unlock()
+
+	if replication == nil {
+		if s.AutoStart {
+			s.StartPriFiCommunicateProtocol()
+		}
+		return
+	}
+
+	complete, valid := s.churnHandler.assignReplicatedIDs(replication.Clients, replication.Trustees)
+	if !valid {
+		log.Lvl1("Some participants were not part of the session of the relay, starting a new session.")
+		s.dropReplication()
+		if s.AutoStart {
+			s.StartPriFiCommunicateProtocol()
+		}
+		return
+	}
+	if !complete {
+		log.Lvl2("Waiting for the participants of the session of the relay to resume it...")
+		return
+	}
+
+	s.dropReplication()
+	log.Lvl1("All the participants of the session of the relay are connected, resuming it at round", replication.State.ResumeRoundID)
+	s.startPriFiProtocol(&replication.State)
+}
+
+// stopWaitingForResume gives up resuming the session after RELAY_RESUME_TIMEOUT, and starts a new one, unless "ctx"
+// is cancelled first
+func (s *ServiceState) stopWaitingForResume(ctx context.Context) {
+	timer := time.NewTimer(RELAY_RESUME_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+
+	s.failoverMutex.Lock()
+	stillWaiting := s.replication != nil
+	s.failoverMutex.Unlock()
+	if !stillWaiting {
+		return
+	}
+
+	log.Lvl1("Some participants of the session of the relay did not connect in time, starting a new session.")
+	s.dropReplication()
+	s.churnHandler.waitQueue.writeMutex.Lock()
+	defer s.churnHandler.waitQueue.writeMutex.Unlock()
+	s.churnHandler.tryStartProtocol()
+}
+
+// dropReplication forgets the replicated state; the next sessions are started normally
+func (s *ServiceState) dropReplication() {
+	s.failoverMutex.Lock()
+	defer s.failoverMutex.Unlock()
+	s.replication = nil
+}
+
+// handleRelayFailure is called on a network error. On clients and trustees, if it is our relay and we know a standby
+// relay, we detach our protocol and connect to the standby relay. It returns true if the error was handled
+func (s *ServiceState) handleRelayFailure(si *network.ServerIdentity) bool {
+	if si == nil {
+		return false
+	}
+
+	s.failoverMutex.Lock()
+	defer s.failoverMutex.Unlock()
+
+	if s.role == prifi_protocol.Relay {
+		//the standby relay does not take part in the protocol, losing it should not restart it
+		if s.standbyRelayIdentity != nil && si.Equal(s.standbyRelayIdentity) {
+			log.Lvl2("A network error occurred with the standby relay", si, ", nothing to do.")
+			return true
+		}
+		return false
+	}
+	if s.failedRelayIdentity != nil && si.Equal(s.failedRelayIdentity) {
+		log.Lvl3("A network error occurred with the relay", si, "we already failed over from, ignoring.")
+		return true
+	}
+	if s.standbyRelayIdentity == nil || !si.Equal(s.relayIdentity) {
+		return false
+	}
+
+	log.Error("Lost the connection with the relay", si, ", failing over to the standby relay", s.standbyRelayIdentity)
+
+	//keep our PriFi-lib, the standby relay will resume our session
+	if s.IsPriFiProtocolRunning() {
+		s.PriFiSDAProtocol.Detach()
+		s.detachedProtocol = s.PriFiSDAProtocol
+	}
+
+	s.failedRelayIdentity = s.relayIdentity
+	s.relayIdentity = s.standbyRelayIdentity
+	s.standbyRelayIdentity = nil
+
+	//stop pinging the failed relay, and ping the standby relay
+	go func(stopChan chan bool) {
+		stopChan <- true
+	}(s.connectToRelayStopChan)
+	if s.connectToRelay2StopChan != nil {
+		select {
+		case s.connectToRelay2StopChan <- true:
+		default:
+		}
+	}
+	s.connectToRelayStopChan = make(chan bool)
+	go s.connectToRelay(s.relayIdentity, s.connectToRelayStopChan)
+
+	return true
+}
@@ -0,0 +1,145 @@
+package services
+
+// This file contains the logic to host several PriFi groups in one service.
+
+import (
+	"context"
+	"errors"
+
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	"gopkg.in/dedis/kyber.v2/util/key"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+/*
+ * A node can take part in several independent PriFi groups, e.g., one relay serving several anonymity sets with
+ * different parameters. Each group has a name, and its own ServiceState (hence its own configuration, trustees,
+ * churnHandler, protocol and SOCKS server/egress).
+ *
+ * The messages of the service carry the name of their group, and are given to the ServiceState of this group.
+ * The relay gives the name of the group to the other nodes of the protocol in its GenericConfig (see NewProtocol).
+ * The group named DefaultGroupName is the one of a group.toml without [[groups]], as before.
+ *
+ * Only one group per node can use UDP, since the UDP broadcast uses a fixed port.
+ */
+
+// DefaultGroupName is the name of the default PriFi group
+const DefaultGroupName = ""
+
+// AddGroup makes us part of the PriFi group "name", with the given configuration, and returns its state
+func (s *Service) AddGroup(name string, config *prifi_protocol.PrifiTomlConfig) (*ServiceState, error) {
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+
+	if _, exists := s.groups[name]; exists {
+		return nil, errors.New("We are already part of the PriFi group \"" + name + "\"")
+	}
+	if config.UseUDP {
+		for _, g := range s.groups {
+			if g.prifiTomlConfig.UseUDP {
+				return nil, errors.New("Cannot use UDP in the PriFi group \"" + name + "\", the group \"" + g.name + "\" already does")
+			}
+		}
+	}
+
+	g := &ServiceState{
+		ServiceProcessor: s.ServiceProcessor,
+		name:             name,
+		keyPair:          s.keyPair,
+	}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.SetConfigFromToml(config)
+	s.groups[name] = g
+
+	return g, nil
+}
+
+// SetKeyPair sets our long-term PriFi key pair, used in the groups joined afterwards (as any role).
+// Without it, each run of the protocol uses a fresh key pair.
+func (s *Service) SetKeyPair(keyPair *key.Pair) {
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+
+	s.keyPair = keyPair
+}
+
+// Group returns the state of the PriFi group "name", or nil if we are not part of it
+func (s *Service) Group(name string) *ServiceState {
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+
+	return s.groups[name]
+}
+
+// Groups returns the states of all the PriFi groups we are part of
+func (s *Service) Groups() []*ServiceState {
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+
+	groups := make([]*ServiceState, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// dispatch returns a processor function which gives the messages to the handler of their group
+func (s *Service) dispatch(handler func(*ServiceState, *network.Envelope)) func(*network.Envelope) {
+	return func(msg *network.Envelope) {
+		name := groupNameOf(msg)
+		g := s.Group(name)
+		if g == nil {
+			log.Lvl2("Received a message for the PriFi group \"", name, "\" from", msg.ServerIdentity, ", but we are not part of it, ignoring.")
+			return
+		}
+		handler(g, msg)
+	}
+}
+
+// groupNameOf returns the name of the group of a message of the service
+func groupNameOf(msg *network.Envelope) string {
+	switch typedMsg := msg.Msg.(type) {
+	case *HelloMsg:
+		return typedMsg.Group
+	case *StopProtocol:
+		return typedMsg.Group
+	case *StopSOCKS:
+		return typedMsg.Group
+	case *ConnectionRequest:
+		return typedMsg.Group
+	case *DisconnectionRequest:
+		return typedMsg.Group
+	case *RelayHeartbeat:
+		return typedMsg.Group
+	case *RelayReplication:
+		return typedMsg.Group
+	}
+	return DefaultGroupName
+}
+
+// NetworkErrorHappened is the handler passed to the SDA (see ServiceState.NetworkErrorHappened). The error is given
+// to the groups the node "si" is part of
+func (s *Service) NetworkErrorHappened(si *network.ServerIdentity) {
+	for _, g := range s.Groups() {
+		if si == nil || g.involves(si) {
+			g.NetworkErrorHappened(si)
+		}
+	}
+}
+
+// involves returns true if the node "si" takes part in this group, as far as we know
+func (s *ServiceState) involves(si *network.ServerIdentity) bool {
+	s.failoverMutex.Lock()
+	defer s.failoverMutex.Unlock()
+
+	for _, v := range []*network.ServerIdentity{s.relayIdentity, s.standbyRelayIdentity, s.failedRelayIdentity} {
+		if v != nil && v.Equal(si) {
+			return true
+		}
+	}
+	if s.role == prifi_protocol.Relay && s.churnHandler != nil {
+		return s.churnHandler.isParticipant(si)
+	}
+	return false
+}
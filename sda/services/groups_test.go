@@ -0,0 +1,85 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/sda/protocols"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+func TestGroups(t *testing.T) {
+
+	s := &Service{
+		groups: make(map[string]*ServiceState),
+	}
+
+	config := &protocols.PrifiTomlConfig{PayloadSize: 10}
+	udpConfig := &protocols.PrifiTomlConfig{PayloadSize: 20, UseUDP: true}
+
+	def, err := s.AddGroup(DefaultGroupName, config)
+	if err != nil {
+		t.Error("Should be able to add the default group,", err)
+	}
+	if _, err := s.AddGroup(DefaultGroupName, config); err == nil {
+		t.Error("Should not be able to add the same group twice")
+	}
+	a, err := s.AddGroup("a", udpConfig)
+	if err != nil {
+		t.Error("Should be able to add group a,", err)
+	}
+	if _, err := s.AddGroup("b", udpConfig); err == nil {
+		t.Error("Should not be able to add a second group using UDP")
+	}
+
+	if s.Group(DefaultGroupName) != def || s.Group("a") != a || s.Group("b") != nil {
+		t.Error("Group returns the wrong groups")
+	}
+	if len(s.Groups()) != 2 {
+		t.Error("Groups should return 2 groups")
+	}
+	if a.name != "a" || a.prifiTomlConfig.PayloadSize != 20 || def.prifiTomlConfig.PayloadSize != 10 {
+		t.Error("The groups have the wrong name or config")
+	}
+
+	//the messages go to the handler of their group
+	var handled *ServiceState
+	handler := s.dispatch(func(g *ServiceState, msg *network.Envelope) {
+		handled = g
+	})
+
+	si := genSI("127.0.0.1:1")
+	handler(&network.Envelope{ServerIdentity: si, Msg: &ConnectionRequest{Group: "a"}})
+	if handled != a {
+		t.Error("The message of group a was not given to group a")
+	}
+	handler(&network.Envelope{ServerIdentity: si, Msg: &HelloMsg{}})
+	if handled != def {
+		t.Error("The message without group was not given to the default group")
+	}
+	handled = nil
+	handler(&network.Envelope{ServerIdentity: si, Msg: &StopProtocol{Group: "b"}})
+	if handled != nil {
+		t.Error("The message of group b should have been ignored")
+	}
+
+	//a group is only concerned by the nodes taking part in it
+	relay := genSI("127.0.0.1:2")
+	a.role = protocols.Client
+	a.relayIdentity = relay
+	if !a.involves(relay) || a.involves(si) {
+		t.Error("A client group should only involve its relay")
+	}
+
+	trustee := genSI("127.0.0.1:3")
+	def.role = protocols.Relay
+	def.relayIdentity = relay
+	def.churnHandler = new(churnHandler)
+	def.churnHandler.init(relay, []*network.ServerIdentity{trustee})
+	if !def.involves(trustee) || def.involves(si) {
+		t.Error("A relay group should involve its trustees, and not unknown nodes")
+	}
+	def.churnHandler.waitQueue.clients[idFromServerIdentity(si)] = &waitQueueEntry{serverID: si, role: protocols.Client}
+	if !def.involves(si) {
+		t.Error("A relay group should involve its waiting clients")
+	}
+}
@@ -1,32 +1,44 @@
 package services
 
 import (
+	"errors"
+	"github.com/dedis/prifi/prifi-lib/net"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	"github.com/dedis/prifi/utils"
+	"gopkg.in/dedis/onet.v2"
 	"gopkg.in/dedis/onet.v2/log"
 	"gopkg.in/dedis/onet.v2/network"
 	"time"
 )
 
 // Packet send by relay when some node disconnected
-type StopProtocol struct{}
+type StopProtocol struct {
+	Group string
+}
 
 // Packet send by relay doing simulations to stop the SOCKS stuff
-type StopSOCKS struct{}
+type StopSOCKS struct {
+	Group string
+}
 
 // ConnectionRequest messages are sent to the relay
 // by nodes that want to join the protocol.
 type ConnectionRequest struct {
 	ProtocolVersion string
+	Group           string
 }
 
 // HelloMsg messages are sent by the relay to the trustee;
 // if they are up, they answer with a ConnectionRequest
-type HelloMsg struct{}
+type HelloMsg struct {
+	Group string
+}
 
 // DisconnectionRequest messages are sent to the relay
 // by nodes that want to leave the protocol.
-type DisconnectionRequest struct{}
+type DisconnectionRequest struct {
+	Group string
+}
 
 //Delay before each host re-tried to connect to the relay
 const DELAY_BEFORE_CONNECT_TO_RELAY = 5 * time.Second
@@ -37,7 +49,7 @@ const DELAY_BEFORE_CONNECT_TO_TRUSTEES = 30 * time.Second
 // returns true if the PriFi SDA protocol is running (in any state : init, communicate, etc)
 func (s *ServiceState) IsPriFiProtocolRunning() bool {
 	if s.PriFiSDAProtocol != nil {
-		return !s.PriFiSDAProtocol.HasStopped
+		return s.PriFiSDAProtocol.IsRunning()
 	}
 	return false
 }
@@ -67,6 +79,10 @@ func (s *ServiceState) HandleHelloMsg(msg *network.Envelope) {
 
 // Packet received by relay when some node connects
 func (s *ServiceState) HandleConnection(msg *network.Envelope) {
+	if s.isStandby() {
+		log.Lvl3("Received a connection request, but we are a standby relay which did not take over, ignoring.")
+		return
+	}
 	if s.churnHandler == nil {
 		log.Fatal("Can't handle a connection without a churnHandler")
 	}
@@ -105,6 +121,18 @@ func (s *ServiceState) handleTimeout(lateClients []string, lateTrustees []string
 // remain in some weird state)
 func (s *ServiceState) NetworkErrorHappened(si *network.ServerIdentity) {
 
+	if s.ctx.Err() != nil {
+		log.Lvl3("A network error occurred with node", si, ", but the group is closed, nothing to do.")
+		return
+	}
+	if s.isStandby() {
+		log.Lvl3("A network error occurred with node", si, ", but we are a standby relay, nothing to do.")
+		return
+	}
+	if s.handleRelayFailure(si) {
+		return
+	}
+
 	if s.role != prifi_protocol.Relay {
 		log.Lvl3("A network error occurred with node", si, ", but we're not the relay, nothing to do.")
 		s.connectToRelayStopChan <- true //"nothing" except stop this goroutine
@@ -134,6 +162,11 @@ func (s *ServiceState) CountParticipants() (int, int) {
 // by the relay as soon as enough participants are
 // ready (one trustee and two clients).
 func (s *ServiceState) StartPriFiCommunicateProtocol() {
+	s.startPriFiProtocol(nil)
+}
+
+// startPriFiProtocol starts a PriFi protocol; if "resumeState" is not nil, it resumes the session of a failed relay
+func (s *ServiceState) startPriFiProtocol(resumeState *net.RELAY_FAILOVER_STATE) {
 	log.Lvl1("Starting PriFi protocol")
 
 	if s.role != prifi_protocol.Relay {
@@ -158,12 +191,20 @@ func (s *ServiceState) StartPriFiCommunicateProtocol() {
 	// Assert that pi has type PriFiSDAWrapper
 	wrapper = pi.(*prifi_protocol.PriFiSDAProtocol)
 
+	// the other nodes find the group of the protocol in its config, see Service.NewProtocol
+	if err := wrapper.SetConfig(&onet.GenericConfig{Data: []byte(s.name)}); err != nil {
+		log.Fatal("Unable to give the group to the Prifi protocol:", err)
+	}
+
 	//assign and start the protocol
-	s.PriFiSDAProtocol = wrapper
+	s.setPriFiSDAProtocol(wrapper)
 
-	s.setConfigToPriFiProtocol(wrapper)
+	s.setConfigToPriFiProtocol(wrapper, resumeState)
 
-	wrapper.Start()
+	if err := wrapper.Start(); err != nil {
+		log.Error("Could not start the PriFi protocol, restarting it. Error is", err)
+		go s.NetworkErrorHappened(nil)
+	}
 }
 
 // stopPriFi stops the PriFi protocol currently running.
@@ -178,7 +219,23 @@ func (s *ServiceState) StopPriFiCommunicateProtocol() {
 	if s.PriFiSDAProtocol != nil {
 		s.PriFiSDAProtocol.Stop()
 	}
-	s.PriFiSDAProtocol = nil
+	s.setPriFiSDAProtocol(nil)
+}
+
+// ResyncPriFiProtocol changes the PayloadSize, CellSizeDown, RelayWindowSize, RelayUseOpenClosedSlots and the number
+// of trustees (0 to keep them) of the running protocol, without restarting it. Relay only
+func (s *ServiceState) ResyncPriFiProtocol(config *prifi_protocol.PrifiTomlConfig, nTrustees int, roundID int32) error {
+	log.Lvl1("Resyncing PriFi protocol")
+
+	if s.role != prifi_protocol.Relay {
+		return errors.New("Trying to resync PriFi protocol from a non-relay node.")
+	}
+	if !s.IsPriFiProtocolRunning() {
+		return errors.New("Would resync PriFi protocol, but it's not running.")
+	}
+
+	//the protocol shares our config, hence the next protocol instance (e.g., after a churn) keeps the new parameters
+	return s.PriFiSDAProtocol.Resync(config, nTrustees, roundID)
 }
 
 // TODO : change function comment
@@ -190,19 +247,22 @@ func (s *ServiceState) connectToTrustees(trusteesIDs []*network.ServerIdentity,
 		s.sendHelloMessage(v)
 	}
 
-	tick := time.Tick(DELAY_BEFORE_CONNECT_TO_TRUSTEES)
-	for range tick {
-		if !s.IsPriFiProtocolRunning() {
-			for _, v := range trusteesIDs {
-				s.sendHelloMessage(v)
-			}
-		}
-
+	ticker := time.NewTicker(DELAY_BEFORE_CONNECT_TO_TRUSTEES)
+	defer ticker.Stop()
+	for {
 		select {
 		case <-stopChan:
 			log.Lvl3("Stopping connectToTrustees subroutine.")
 			return
-		default:
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !s.IsPriFiProtocolRunning() {
+			for _, v := range trusteesIDs {
+				s.sendHelloMessage(v)
+			}
 		}
 	}
 }
@@ -213,18 +273,21 @@ func (s *ServiceState) connectToTrustees(trusteesIDs []*network.ServerIdentity,
 func (s *ServiceState) connectToRelay(relayID *network.ServerIdentity, stopChan chan bool) {
 	s.sendConnectionRequest(relayID)
 
-	tick := time.Tick(DELAY_BEFORE_CONNECT_TO_RELAY)
-	for range tick {
-		//log.Info("Service", s, ": Still pinging relay", !s.IsPriFiProtocolRunning())
-		if !s.IsPriFiProtocolRunning() {
-			s.sendConnectionRequest(relayID)
-		}
-
+	ticker := time.NewTicker(DELAY_BEFORE_CONNECT_TO_RELAY)
+	defer ticker.Stop()
+	for {
 		select {
 		case <-stopChan:
 			log.Lvl3("Stopping connectToRelay subroutine.")
 			return
-		default:
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		//log.Info("Service", s, ": Still pinging relay", !s.IsPriFiProtocolRunning())
+		if !s.IsPriFiProtocolRunning() {
+			s.sendConnectionRequest(relayID)
 		}
 	}
 }
@@ -234,7 +297,7 @@ func (s *ServiceState) connectToRelay(relayID *network.ServerIdentity, stopChan
 // announce themselves to the relay.
 func (s *ServiceState) sendConnectionRequest(relayID *network.ServerIdentity) {
 	log.Lvl4("Sending connection request", s.role, s)
-	err := s.SendRaw(relayID, &ConnectionRequest{ProtocolVersion: s.prifiTomlConfig.ProtocolVersion})
+	err := s.SendRaw(relayID, &ConnectionRequest{ProtocolVersion: s.prifiTomlConfig.ProtocolVersion, Group: s.name})
 
 	if err != nil {
 		if s.role == prifi_protocol.Trustee {
@@ -251,7 +314,7 @@ func (s *ServiceState) sendConnectionRequest(relayID *network.ServerIdentity) {
 // announce themselves to the trustees.
 func (s *ServiceState) sendHelloMessage(trusteeID *network.ServerIdentity) {
 	log.Lvl4("Sending hello request", s.role, s)
-	err := s.SendRaw(trusteeID, &HelloMsg{})
+	err := s.SendRaw(trusteeID, &HelloMsg{Group: s.name})
 
 	if err != nil {
 		log.Lvl3("Hello failed, ", trusteeID, " isn't online.", s.role, s)
@@ -9,15 +9,19 @@ package services
  */
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"strconv"
 
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+	"gopkg.in/dedis/kyber.v2/util/key"
 	"gopkg.in/dedis/onet.v2"
 	"gopkg.in/dedis/onet.v2/app"
 	"gopkg.in/dedis/onet.v2/log"
 	"gopkg.in/dedis/onet.v2/network"
+	"sync"
 	"time"
 )
 
@@ -32,14 +36,28 @@ func init() {
 	serviceID = onet.ServiceFactory.ServiceID(ServiceName)
 }
 
-//Service contains the state of the service
-type ServiceState struct {
+//Service is the PriFi service; it can take part in several PriFi groups (see groups.go), each with its own ServiceState
+type Service struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
 	// are correctly handled.
 	*onet.ServiceProcessor
+	Storage *Storage
+	path    string
+
+	groupsMutex sync.Mutex
+	groups      map[string]*ServiceState
+
+	//the long-term PriFi key pair of this node, given to the groups we join
+	keyPair *key.Pair
+}
+
+//ServiceState contains the state of the service in one PriFi group
+type ServiceState struct {
+	// The ServiceProcessor of the Service, shared by all groups
+	*onet.ServiceProcessor
+	name                      string //the name of the group, DefaultGroupName for the default one
 	prifiTomlConfig           *prifi_protocol.PrifiTomlConfig
-	Storage                   *Storage
-	path                      string
+	keyPair                   *key.Pair //our long-term PriFi key pair, if any
 	role                      prifi_protocol.PriFiRole
 	relayIdentity             *network.ServerIdentity
 	trusteeIDs                []*network.ServerIdentity
@@ -57,11 +75,34 @@ type ServiceState struct {
 	//this hold the running protocol (when it runs)
 	PriFiSDAProtocol *prifi_protocol.PriFiSDAProtocol
 
+	//the SOCKS configuration of the client (resp. the relay) of this group
+	socksClientConfig *prifi_protocol.SOCKSConfig
+	socksServerConfig *prifi_protocol.SOCKSConfig
+
 	//used to hold "stoppers" for go-routines; send "true" to kill
 	socksStopChan []chan bool
 
 	hasSocksClientGoRoutine bool
 	hasSocksServerGoRoutine bool
+
+	//relay failover, see failover.go
+	failoverMutex        sync.Mutex
+	standbyRelayIdentity *network.ServerIdentity          //the relay taking over if ours fails, if any
+	failedRelayIdentity  *network.ServerIdentity          //the relay we failed over from
+	isStandbyRelay       bool                             //true while we are a standby relay which did not take over
+	lastRelayHeartbeat   time.Time                        //on the standby relay
+	replication          *RelayReplication                //on the standby relay, the last state received from the relay
+	detachedProtocol     *prifi_protocol.PriFiSDAProtocol //on clients and trustees, the protocol with the failed relay
+
+	//the local status API of a client, see status.go
+	statusMutex    sync.Mutex                        //protects upstreamPaused, and the writes of PriFiSDAProtocol (read by the API)
+	upstreamPaused bool                              //true if the user paused the upstream transmission
+	ingressStatus  *stream_multiplexer.IngressStatus //the counters of our SOCKS server
+	hasStatusAPI   bool
+
+	//cancelled by Close, stops the goroutines of the group
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // Storage will be saved, on the contrary of the 'Service'-structure
@@ -74,20 +115,25 @@ type Storage struct {
 // configuration, if desired. As we don't know when the service will exit,
 // we need to save the configuration on our own from time to time.
 func newService(c *onet.Context) (onet.Service, error) {
-	s := &ServiceState{
+	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		groups:           make(map[string]*ServiceState),
 	}
 	helloMsg := network.RegisterMessage(HelloMsg{})
 	stopSOCKSMsg := network.RegisterMessage(StopSOCKS{})
 	stopMsg := network.RegisterMessage(StopProtocol{})
 	connMsg := network.RegisterMessage(ConnectionRequest{})
 	disconnectMsg := network.RegisterMessage(DisconnectionRequest{})
+	heartbeatMsg := network.RegisterMessage(RelayHeartbeat{})
+	replicationMsg := network.RegisterMessage(RelayReplication{})
 
-	c.RegisterProcessorFunc(helloMsg, s.HandleHelloMsg)
-	c.RegisterProcessorFunc(stopMsg, s.HandleStop)
-	c.RegisterProcessorFunc(stopSOCKSMsg, s.HandleStopSOCKS)
-	c.RegisterProcessorFunc(connMsg, s.HandleConnection)
-	c.RegisterProcessorFunc(disconnectMsg, s.HandleDisconnection)
+	c.RegisterProcessorFunc(helloMsg, s.dispatch((*ServiceState).HandleHelloMsg))
+	c.RegisterProcessorFunc(stopMsg, s.dispatch((*ServiceState).HandleStop))
+	c.RegisterProcessorFunc(stopSOCKSMsg, s.dispatch((*ServiceState).HandleStopSOCKS))
+	c.RegisterProcessorFunc(connMsg, s.dispatch((*ServiceState).HandleConnection))
+	c.RegisterProcessorFunc(disconnectMsg, s.dispatch((*ServiceState).HandleDisconnection))
+	c.RegisterProcessorFunc(heartbeatMsg, s.dispatch((*ServiceState).HandleRelayHeartbeat))
+	c.RegisterProcessorFunc(replicationMsg, s.dispatch((*ServiceState).HandleRelayReplication))
 
 	if err := s.tryLoad(); err != nil {
 		log.Fatal(err)
@@ -103,7 +149,22 @@ func newService(c *onet.Context) (onet.Service, error) {
 // instantiate the protocol on its own. If you need more control at the
 // instantiation of the protocol, use CreateProtocolService, and you can
 // give some extra-configuration to your protocol in here.
-func (s *ServiceState) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfig) (onet.ProtocolInstance, error) {
+// The relay gives the name of the group in the GenericConfig; no config means the default group.
+func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfig) (onet.ProtocolInstance, error) {
+
+	name := DefaultGroupName
+	if conf != nil {
+		name = string(conf.Data)
+	}
+	g := s.Group(name)
+	if g == nil {
+		return nil, errors.New("Received a PriFi protocol for the group \"" + name + "\", but we are not part of it")
+	}
+	return g.newProtocol(tn)
+}
+
+// newProtocol instantiates the PriFi protocol of this group on a node which is not the relay
+func (s *ServiceState) newProtocol(tn *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 
 	pi, err := prifi_protocol.NewPriFiSDAWrapperProtocol(tn)
 	if err != nil {
@@ -111,8 +172,8 @@ func (s *ServiceState) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.Generic
 	}
 
 	wrapper := pi.(*prifi_protocol.PriFiSDAProtocol)
-	s.PriFiSDAProtocol = wrapper
-	s.setConfigToPriFiProtocol(wrapper)
+	s.setPriFiSDAProtocol(wrapper)
+	s.setConfigToPriFiProtocol(wrapper, nil)
 
 	return wrapper, nil
 }
@@ -132,9 +193,20 @@ func (s *ServiceState) RelayAllowAutoStart() {
 func (s *ServiceState) StartRelay(group *app.Group) error {
 	log.Info("Service", s, "running in relay mode")
 
+	relayID, trusteesIDs := mapIdentities(group)
+	s.standbyRelayIdentity = mapStandbyRelay(group)
+	if s.standbyRelayIdentity != nil {
+		go s.sendHeartbeats()
+	}
+
+	return s.startRelay(relayID, trusteesIDs)
+}
+
+// startRelay starts the relay-mode with the given relay identity (ours)
+func (s *ServiceState) startRelay(relayID *network.ServerIdentity, trusteesIDs []*network.ServerIdentity) error {
+
 	//set state to the correct info, parse .toml
 	s.role = prifi_protocol.Relay
-	relayID, trusteesIDs := mapIdentities(group)
 	s.relayIdentity = relayID //should not be used in the case of the relay
 
 	//creates the ChurnHandler, part of the Relay's Service, that will start/stop the protocol
@@ -148,7 +220,7 @@ func (s *ServiceState) StartRelay(group *app.Group) error {
 	}
 	s.churnHandler.stopProtocol = s.StopPriFiCommunicateProtocol
 
-	socksServerConfig = &prifi_protocol.SOCKSConfig{
+	s.socksServerConfig = &prifi_protocol.SOCKSConfig{
 		ListeningAddr:     "127.0.0.1:" + strconv.Itoa(s.prifiTomlConfig.SocksClientPort),
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
 		UpstreamChannel:   make(chan []byte),
@@ -159,8 +231,15 @@ func (s *ServiceState) StartRelay(group *app.Group) error {
 	if !s.hasSocksClientGoRoutine {
 		stopChan := make(chan bool, 1)
 		log.Lvl1("Starting EGRESS", s.prifiTomlConfig.VerboseIngressEgressServers)
-		go stream_multiplexer.StartEgressHandler(socksServerConfig.ListeningAddr, socksServerConfig.PayloadSize,
-			socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
+		if s.prifiTomlConfig.RelayDownstreamQoSWeights != "" {
+			//the relay schedules the downstream frames according to their QoS class
+			classifier := stream_multiplexer.NewStreamClassifier(s.prifiTomlConfig.EgressQoSBulkThreshold)
+			go stream_multiplexer.StartEgressHandlerWithQoS(s.socksServerConfig.ListeningAddr, s.socksServerConfig.PayloadSize,
+				s.socksServerConfig.UpstreamChannel, s.socksServerConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers, classifier)
+		} else {
+			go stream_multiplexer.StartEgressHandler(s.socksServerConfig.ListeningAddr, s.socksServerConfig.PayloadSize,
+				s.socksServerConfig.UpstreamChannel, s.socksServerConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
+		}
 		s.socksStopChan = append(s.socksStopChan, stopChan)
 		s.hasSocksClientGoRoutine = true
 	}
@@ -179,8 +258,9 @@ func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error
 
 	relayID, trusteeIDs := mapIdentities(group)
 	s.relayIdentity = relayID
+	s.standbyRelayIdentity = mapStandbyRelay(group)
 
-	socksClientConfig = &prifi_protocol.SOCKSConfig{
+	s.socksClientConfig = &prifi_protocol.SOCKSConfig{
 		Port:              s.prifiTomlConfig.SocksServerPort,
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
 		UpstreamChannel:   make(chan []byte),
@@ -189,14 +269,24 @@ func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error
 
 	//the client has a socks server
 	if !s.hasSocksServerGoRoutine {
-		log.Lvl1("Starting SOCKS server on port", socksClientConfig.Port)
+		log.Lvl1("Starting SOCKS server on port", s.socksClientConfig.Port)
 		stopChan := make(chan bool, 1)
-		go stream_multiplexer.StartIngressServer(socksClientConfig.Port, socksClientConfig.PayloadSize,
-			socksClientConfig.UpstreamChannel, socksClientConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
+		s.ingressStatus = new(stream_multiplexer.IngressStatus)
+		go stream_multiplexer.StartIngressServerWithStatus(s.socksClientConfig.Port, s.socksClientConfig.PayloadSize,
+			s.socksClientConfig.UpstreamChannel, s.socksClientConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers,
+			s.ingressStatus)
 		s.socksStopChan = append(s.socksStopChan, stopChan)
 		s.hasSocksServerGoRoutine = true
 	}
 
+	//the client serves its status locally, if enabled
+	if s.prifiTomlConfig.ClientStatusAPIPort > 0 && !s.hasStatusAPI {
+		if err := s.startStatusAPI(s.prifiTomlConfig.ClientStatusAPIPort, StatusAPITokenFile(s.prifiTomlConfig)); err != nil {
+			return errors.New("Could not start the client status API : " + err.Error())
+		}
+		s.hasStatusAPI = true
+	}
+
 	s.connectToRelayStopChan = make(chan bool)
 	s.trusteeIDs = trusteeIDs
 
@@ -217,23 +307,23 @@ func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error
 func (s *ServiceState) StartSocksTunnelOnly() error {
 	log.Info("Service", s, "running in socks-tunnel-only mode")
 
-	socksClientConfig = &prifi_protocol.SOCKSConfig{
+	s.socksClientConfig = &prifi_protocol.SOCKSConfig{
 		Port:              s.prifiTomlConfig.SocksServerPort,
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
 		UpstreamChannel:   make(chan []byte),
 		DownstreamChannel: make(chan []byte),
 	}
 
-	socksServerConfig = &prifi_protocol.SOCKSConfig{
+	s.socksServerConfig = &prifi_protocol.SOCKSConfig{
 		ListeningAddr:     "127.0.0.1:" + strconv.Itoa(s.prifiTomlConfig.SocksClientPort),
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
-		UpstreamChannel:   socksClientConfig.UpstreamChannel,
-		DownstreamChannel: socksClientConfig.DownstreamChannel,
+		UpstreamChannel:   s.socksClientConfig.UpstreamChannel,
+		DownstreamChannel: s.socksClientConfig.DownstreamChannel,
 	}
 	stopChan1 := make(chan bool, 1)
 	stopChan2 := make(chan bool, 1)
-	go stream_multiplexer.StartIngressServer(socksClientConfig.Port, socksClientConfig.PayloadSize, socksClientConfig.UpstreamChannel, socksClientConfig.DownstreamChannel, stopChan1, s.prifiTomlConfig.VerboseIngressEgressServers)
-	go stream_multiplexer.StartEgressHandler(socksServerConfig.ListeningAddr, socksClientConfig.PayloadSize, socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan2, s.prifiTomlConfig.VerboseIngressEgressServers)
+	go stream_multiplexer.StartIngressServer(s.socksClientConfig.Port, s.socksClientConfig.PayloadSize, s.socksClientConfig.UpstreamChannel, s.socksClientConfig.DownstreamChannel, stopChan1, s.prifiTomlConfig.VerboseIngressEgressServers)
+	go stream_multiplexer.StartEgressHandler(s.socksServerConfig.ListeningAddr, s.socksClientConfig.PayloadSize, s.socksServerConfig.UpstreamChannel, s.socksServerConfig.DownstreamChannel, stopChan2, s.prifiTomlConfig.VerboseIngressEgressServers)
 	s.socksStopChan = append(s.socksStopChan, stopChan1)
 	s.socksStopChan = append(s.socksStopChan, stopChan2)
 
@@ -249,6 +339,7 @@ func (s *ServiceState) StartTrustee(group *app.Group) error {
 	//the this might fail if the relay is behind a firewall. The HelloMsg is to fix this
 	relayID, _ := mapIdentities(group)
 	s.relayIdentity = relayID
+	s.standbyRelayIdentity = mapStandbyRelay(group)
 
 	s.connectToRelayStopChan = make(chan bool)
 	go s.connectToRelay(relayID, s.connectToRelayStopChan)
@@ -256,6 +347,16 @@ func (s *ServiceState) StartTrustee(group *app.Group) error {
 	return nil
 }
 
+// Close stops the protocol, the SOCKS goroutines, and the goroutines which connect to the other nodes or watch the
+// relay; the group cannot be started again
+func (s *ServiceState) Close() {
+	log.Lvl2("Closing the PriFi group", s.name)
+
+	s.cancel()
+	s.StopPriFiCommunicateProtocol()
+	s.ShutdownSocks()
+}
+
 // CleanResources kill all goroutines related to SOCKS on this service
 func (s *ServiceState) ShutdownSocks() error {
 	log.Lvl2("Stopping service's SOCKS goroutines.")
@@ -273,7 +374,7 @@ func (s *ServiceState) GlobalShutDownSocks() error {
 
 	//contact the clients
 	for _, v := range s.churnHandler.getClientsIdentities() {
-		s.SendRaw(v, &StopSOCKS{})
+		s.SendRaw(v, &StopSOCKS{Group: s.name})
 	}
 
 	//shut down the relay's SOCKS
@@ -283,7 +384,7 @@ func (s *ServiceState) GlobalShutDownSocks() error {
 }
 
 // save saves the actual identity
-func (s *ServiceState) save() {
+func (s *Service) save() {
 	log.Lvl3("Saving service")
 	b, err := network.Marshal(s.Storage)
 	if err != nil {
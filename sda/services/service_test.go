@@ -2,8 +2,18 @@ package services
 
 import (
 	"testing"
+	"time"
 
+	"github.com/dedis/prifi/prifi-lib/config"
+	prifi_relay "github.com/dedis/prifi/prifi-lib/relay"
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	"gopkg.in/dedis/kyber.v2/suites"
+	"gopkg.in/dedis/kyber.v2/util/encoding"
+	"gopkg.in/dedis/kyber.v2/util/key"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/app"
 	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
 func TestMain(m *testing.M) {
@@ -31,3 +41,153 @@ func TestServiceTemplate(t *testing.T) {
 		services[4].StartClient()
 	*/
 }
+
+//a small configuration, as in config/prifi.toml
+func failoverTestConfig() *prifi_protocol.PrifiTomlConfig {
+	return &prifi_protocol.PrifiTomlConfig{
+		PayloadSize:                             5000,
+		CellSizeDown:                            17500,
+		RelayWindowSize:                         1,
+		DCNetType:                               "Simple",
+		RelayUseOpenClosedSlots:                 true,
+		RelayReportingLimit:                     -1,
+		SocksServerPort:                         17080,
+		SocksClientPort:                         17090,
+		OpenClosedSlotsMinDelayBetweenRequests:  100,
+		OpenClosedSlotsMaxDelayBetweenRequests:  1600,
+		OpenClosedSlotsPolicy:                   "Fixed",
+		TrusteeSleepTimeBetweenMessages:         100,
+		RelayMaxNumberOfConsecutiveFailedRounds: 3,
+		RelayRoundTimeOut:                       1000,
+		RelayTrusteeCacheLowBound:               10,
+		RelayTrusteeCacheHighBound:              15,
+	}
+}
+
+//waitFor polls "cond" until it holds, or fails the test after "timeout"
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout while waiting for", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//clientResumedOn tells if the client runs the protocol with "relay", in the rounds leased after a resume
+func clientResumedOn(s *ServiceState, relay *network.ServerIdentity) bool {
+	s.failoverMutex.Lock()
+	relayID := s.relayIdentity
+	s.failoverMutex.Unlock()
+
+	status := s.ClientAPIStatus()
+	return relay.Equal(relayID) && status.Client != nil && status.Client.State == "READY" &&
+		status.Client.Round >= prifi_relay.FAILOVER_ROUND_LEASE
+}
+
+func TestServiceRelayFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a PriFi group, and waits for the failover of its relay")
+	}
+
+	local := onet.NewTCPTest(suites.MustFind("Ed25519"))
+	servers := local.GenServers(5)
+	ids := make([]*network.ServerIdentity, len(servers))
+	for i := range servers {
+		ids[i] = servers[i].ServerIdentity
+	}
+	roles := []string{"relay", "relay-standby", "trustee", "client", "client"}
+	group := &app.Group{Roster: onet.NewRoster(ids), Description: make(map[*network.ServerIdentity]string)}
+	for i, si := range ids {
+		group.Description[si] = roles[i]
+	}
+
+	states := make([]*ServiceState, len(servers))
+	keyPairs := make([]*key.Pair, len(servers))
+	for i := range servers {
+		keyPairs[i] = key.NewKeyPair(config.CryptoSuite)
+	}
+	standbyPk, err := encoding.PointToStringHex(config.CryptoSuite, keyPairs[1].Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, server := range servers {
+		service := server.Service(ServiceName).(*Service)
+		service.SetKeyPair(keyPairs[i])
+		server.Router.AddErrorHandler(service.NetworkErrorHappened)
+
+		conf := failoverTestConfig()
+		conf.SocksServerPort += i
+		if roles[i] == "relay" {
+			conf.RelayStandbyPriFiPublic = standbyPk
+		}
+		if states[i], err = service.AddGroup(DefaultGroupName, conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	killed := false
+	defer func() {
+		for _, s := range states {
+			s.Close()
+		}
+		if killed {
+			delete(local.Servers, servers[0].ServerIdentity.ID)
+		}
+		local.CloseAll()
+		time.Sleep(2 * time.Second) //the SOCKS servers check their stop channel every second
+	}()
+
+	relay, standby, trustee, clients := states[0], states[1], states[2], states[3:]
+	relay.AutoStart = true
+	standby.AutoStart = true
+	if err := relay.StartRelay(group); err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.StartStandbyRelay(group); err != nil {
+		t.Fatal(err)
+	}
+	if err := trustee.StartTrustee(group); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		if err := c.StartClient(group, time.Duration(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "the clients to be ready, and the relay to replicate its state", 30*time.Second, func() bool {
+		for _, c := range clients {
+			if status := c.ClientAPIStatus(); status.Client == nil || status.Client.State != "READY" {
+				return false
+			}
+		}
+		standby.failoverMutex.Lock()
+		defer standby.failoverMutex.Unlock()
+		return standby.replication != nil
+	})
+
+	log.Lvl1("Killing the relay")
+	servers[0].Close()
+	killed = true
+
+	waitFor(t, "the clients to resume on the standby relay", 30*time.Second, func() bool {
+		for _, c := range clients {
+			if !clientResumedOn(c, servers[1].ServerIdentity) {
+				return false
+			}
+		}
+		return true
+	})
+
+	standby.failoverMutex.Lock()
+	stillWaiting := standby.replication != nil
+	standby.failoverMutex.Unlock()
+	if stillWaiting {
+		t.Error("The standby relay should have dropped its replicated state after the resume")
+	}
+	if !standby.IsPriFiProtocolRunning() {
+		t.Error("The standby relay should run the protocol")
+	}
+}
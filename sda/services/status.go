@@ -0,0 +1,223 @@
+package services
+
+// This file contains the local status API of a client.
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dedis/prifi/prifi-lib/client"
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+/*
+ * A client serves its status on 127.0.0.1:ClientStatusAPIPort (0 disables it), e.g., for a tray app or for
+ * "prifi client-status". It only listens on the loopback interface, and only answers the requests :
+ *  - with "Host: 127.0.0.1:ClientStatusAPIPort" : a web page could reach us via a domain resolving to 127.0.0.1 (DNS
+ *    rebinding), but not with this Host;
+ *  - without an Origin header : the browsers send one with the cross-site requests, not the local tools;
+ *  - with "Authorization: Bearer <token>", where the token is random, and written at each start in the file
+ *    ClientStatusAPITokenFile (mode 0600), which only the user of the client can read.
+ * The API is served until the group is closed (see ServiceState.Close), which also removes the token file.
+ * The API is :
+ *
+ *  GET  /status : the ClientAPIStatus of the group, in JSON
+ *  POST /pause  : the client only sends cover traffic, and the data of the SOCKS server waits
+ *  POST /resume : the client sends the data of the SOCKS server again
+ *
+ * POST /pause and /resume answer with the new ClientAPIStatus. The pause is kept across the runs of the protocol
+ * (e.g., after a churn or a failover), until /resume.
+ */
+
+// ClientAPIStatus is the status of a client in a PriFi group, as served by the status API
+type ClientAPIStatus struct {
+	Group          string
+	Running        bool                 // true if the PriFi protocol runs
+	Client         *client.ClientStatus `json:",omitempty"` // the status of the PriFi-lib, if the protocol runs
+	UpstreamPaused bool                 // true if the user paused the upstream transmission
+	ActiveStreams  int64                // the connections open on the SOCKS server
+	SocksBytesUp   int64                // the bytes read from the SOCKS connections
+	SocksBytesDown int64                // the bytes written to the SOCKS connections
+}
+
+// StatusAPITokenFile returns the file holding the token of the status API : ClientStatusAPITokenFile, or by default
+// client-status-<port>.token in the working directory
+func StatusAPITokenFile(config *prifi_protocol.PrifiTomlConfig) string {
+	if config.ClientStatusAPITokenFile != "" {
+		return config.ClientStatusAPITokenFile
+	}
+	return "client-status-" + strconv.Itoa(config.ClientStatusAPIPort) + ".token"
+}
+
+// ReadStatusAPIToken reads the token of the status API in "file"
+func ReadStatusAPIToken(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeStatusAPIToken writes a new random token in "file", readable by us only, and returns it
+func writeStatusAPIToken(file string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	//re-create the file, so that no one else owns it or can open it
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// startStatusAPI serves the status API of this group on 127.0.0.1:port, with a new token in tokenFile, until the
+// group is closed
+func (s *ServiceState) startStatusAPI(port int, tokenFile string) error {
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	token, err := writeStatusAPIToken(tokenFile)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	log.Lvl1("Serving the client status on", addr, ", the token is in", tokenFile)
+
+	server := &http.Server{Handler: s.statusAPIHandler(addr, token)}
+	go func() {
+		<-s.ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Error("Could not close the client status API :", err)
+		}
+		if err := os.Remove(tokenFile); err != nil && !os.IsNotExist(err) {
+			log.Error("Could not remove the token of the client status API :", err)
+		}
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("The client status API stopped :", err)
+		}
+	}()
+	return nil
+}
+
+// statusAPIHandler returns the handler of the status API served on addr, which requires the given token
+func (s *ServiceState) statusAPIHandler(addr, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		writeStatus(w, s.ClientAPIStatus())
+	})
+	setPaused := func(paused bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			s.PauseUpstream(paused)
+			writeStatus(w, s.ClientAPIStatus())
+		}
+	}
+	mux.HandleFunc("/pause", setPaused(true))
+	mux.HandleFunc("/resume", setPaused(false))
+
+	expectedAuthorization := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != addr || r.Header.Get("Origin") != "" {
+			http.Error(w, "only local tools may use this API", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expectedAuthorization) != 1 {
+			http.Error(w, "wrong or missing token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// writeStatus writes "status" in JSON
+func writeStatus(w http.ResponseWriter, status ClientAPIStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Error("Could not write the client status :", err)
+	}
+}
+
+// ClientAPIStatus returns the status of our client in this group
+func (s *ServiceState) ClientAPIStatus() ClientAPIStatus {
+	s.statusMutex.Lock()
+	status := ClientAPIStatus{
+		Group:          s.name,
+		UpstreamPaused: s.upstreamPaused,
+	}
+	s.statusMutex.Unlock()
+
+	if protocol := s.runningProtocol(); protocol != nil {
+		status.Running = true
+		if c, ok := protocol.ClientStatus(); ok {
+			status.Client = &c
+		}
+	}
+	if s.ingressStatus != nil {
+		status.ActiveStreams = s.ingressStatus.ActiveStreams()
+		status.SocksBytesUp = s.ingressStatus.BytesUpstream()
+		status.SocksBytesDown = s.ingressStatus.BytesDownstream()
+	}
+	return status
+}
+
+// PauseUpstream pauses (or resumes) the upstream transmission of our client in this group, now and in the next runs
+// of the protocol
+func (s *ServiceState) PauseUpstream(paused bool) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	s.upstreamPaused = paused
+	if protocol := s.PriFiSDAProtocol; protocol != nil && protocol.IsRunning() {
+		if err := protocol.PauseUpstream(paused); err != nil {
+			log.Error("Could not pause the upstream transmission :", err)
+		}
+	}
+}
+
+// setPriFiSDAProtocol sets the protocol of this group (nil when it stops); the status API reads it concurrently
+func (s *ServiceState) setPriFiSDAProtocol(protocol *prifi_protocol.PriFiSDAProtocol) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	s.PriFiSDAProtocol = protocol
+}
+
+// runningProtocol returns the protocol of this group, or nil if it does not run
+func (s *ServiceState) runningProtocol() *prifi_protocol.PriFiSDAProtocol {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	if s.PriFiSDAProtocol == nil || !s.PriFiSDAProtocol.IsRunning() {
+		return nil
+	}
+	return s.PriFiSDAProtocol
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+)
+
+func TestStatusAPI(t *testing.T) {
+
+	s := &ServiceState{name: "test", ingressStatus: new(stream_multiplexer.IngressStatus)}
+	server := httptest.NewUnstartedServer(nil)
+	addr := server.Listener.Addr().String()
+	server.Config.Handler = s.statusAPIHandler(addr, "secret")
+	server.Start()
+	defer server.Close()
+
+	send := func(req *http.Request) (ClientAPIStatus, int) {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		status := ClientAPIStatus{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Error("Could not decode the status:", err)
+			}
+		}
+		return status, resp.StatusCode
+	}
+	newRequest := func(method, path string) *http.Request {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		return req
+	}
+	request := func(method, path string) (ClientAPIStatus, int) {
+		return send(newRequest(method, path))
+	}
+
+	//without protocol, the client is not running
+	status, code := request("GET", "/status")
+	if code != http.StatusOK || status.Group != "test" || status.Running || status.Client != nil || status.UpstreamPaused {
+		t.Error("Wrong status", code, status)
+	}
+
+	//only the local tools with the token are served
+	req := newRequest("POST", "/pause")
+	req.Header.Del("Authorization")
+	if _, code := send(req); code != http.StatusUnauthorized {
+		t.Error("Should not answer without token, answered", code)
+	}
+	req = newRequest("POST", "/pause")
+	req.Header.Set("Authorization", "Bearer wrong")
+	if _, code := send(req); code != http.StatusUnauthorized {
+		t.Error("Should not answer with a wrong token, answered", code)
+	}
+	req = newRequest("POST", "/pause")
+	req.Host = "rebound.example.com"
+	if _, code := send(req); code != http.StatusForbidden {
+		t.Error("Should not answer a request for another host, answered", code)
+	}
+	req = newRequest("POST", "/pause")
+	req.Header.Set("Origin", "http://example.com")
+	if _, code := send(req); code != http.StatusForbidden {
+		t.Error("Should not answer a cross-site request, answered", code)
+	}
+	if status, _ := request("GET", "/status"); status.UpstreamPaused {
+		t.Error("The rejected requests should not have paused the client")
+	}
+
+	//pausing needs a POST, and is kept for the next protocol
+	if _, code := request("GET", "/pause"); code != http.StatusMethodNotAllowed {
+		t.Error("Should not pause on a GET, answered", code)
+	}
+	if status, code := request("POST", "/pause"); code != http.StatusOK || !status.UpstreamPaused {
+		t.Error("Should have paused, answered", code, status)
+	}
+	if status, _ := request("GET", "/status"); !status.UpstreamPaused {
+		t.Error("Should still be paused", status)
+	}
+	if status, code := request("POST", "/resume"); code != http.StatusOK || status.UpstreamPaused {
+		t.Error("Should have resumed, answered", code, status)
+	}
+}
+
+func TestStatusAPIToken(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "prifi-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "client-status.token")
+
+	//someone else's file is replaced
+	if err := ioutil.WriteFile(file, []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	token, err := writeStatusAPIToken(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Error("Only the user should be able to read the token, the mode is", info.Mode().Perm())
+	}
+	if read, err := ReadStatusAPIToken(file); err != nil || read != token || len(token) != 64 {
+		t.Error("Could not read the token back", read, token, err)
+	}
+
+	//each start has a new token
+	if token2, _ := writeStatusAPIToken(file); token2 == token {
+		t.Error("The token should be random")
+	}
+}
+
+func TestStatusAPIClose(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "prifi-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "client-status.token")
+
+	//a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	s := &ServiceState{name: "test"}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if err := s.startStatusAPI(port, file); err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	if conn, err := net.Dial("tcp", addr); err != nil {
+		t.Fatal("The status API should be served,", err)
+	} else {
+		conn.Close()
+	}
+
+	//closing the group stops the API, and removes its token
+	s.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("The status API should be closed with the group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The token of the status API should be removed with the group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -120,7 +120,7 @@ func (s *SimulationService) Node(config *onet.SimulationConfig) error {
 	group := &app.Group{Roster: config.Roster, Description: roles}
 
 	//finds the PriFi service
-	service := config.GetService(prifi_service.ServiceName).(*prifi_service.ServiceState)
+	prifiService := config.GetService(prifi_service.ServiceName).(*prifi_service.Service)
 
 	//override log level, maybe
 	if s.OverrideLogLevel > 0 {
@@ -137,11 +137,13 @@ func (s *SimulationService) Node(config *onet.SimulationConfig) error {
 		log.Fatal("There is a bug that needs to be fixed, you can't replay pcaps with disruption and equivocation!")
 	}
 
-	//set the config from the .toml file
-	service.SetConfigFromToml(&s.PrifiTomlConfig)
+	//the simulation uses the default group, with the config from the .toml file
+	service, err := prifiService.AddGroup(prifi_service.DefaultGroupName, &s.PrifiTomlConfig)
+	if err != nil {
+		log.Fatal("Error instantiating this node, ", err)
+	}
 
 	//start this node in the correct setup
-	var err error
 	if index == 0 {
 		log.Lvl1("Initiating this node (index ", index, ") as relay")
 		err = service.StartRelay(group)
@@ -179,8 +181,8 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	}
 	simulationID := string(simulationIDBytes)
 
-	//finds the PriFi service
-	service := config.GetService(prifi_service.ServiceName).(*prifi_service.ServiceState)
+	//finds the PriFi service, in the default group
+	service := config.GetService(prifi_service.ServiceName).(*prifi_service.Service).Group(prifi_service.DefaultGroupName)
 
 	//give time to the nodes to initialize
 	log.Info("Sleeping 15 seconds before starting the experiment...")
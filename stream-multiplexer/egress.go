@@ -19,11 +19,19 @@ type EgressServer struct {
 	downstreamChan    chan []byte
 	stopChan          chan bool
 	verbose           bool
+	classifier        *StreamClassifier // if non-nil, frames sent downstream are tagged with their QoS class
 }
 
 // StartEgressHandler creates (and block) an Egress Server
 func StartEgressHandler(serverAddress string, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	StartEgressHandlerWithQoS(serverAddress, maxMessageSize, upstreamChan, downstreamChan, stopChan, verbose, nil)
+}
+
+// StartEgressHandlerWithQoS creates (and block) an Egress Server, which tags the frames sent on "downstreamChan" with
+// the QoS class given by "classifier" (see TagFrame). The receiver must untag them before giving them to an Ingress Server.
+func StartEgressHandlerWithQoS(serverAddress string, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool, classifier *StreamClassifier) {
 	eg := new(EgressServer)
+	eg.classifier = classifier
 	eg.maxMessageSize = maxMessageSize
 	eg.maxPayloadSize = maxMessageSize - MULTIPLEXER_HEADER_SIZE //we use 8 bytes for the multiplexing
 	eg.upstreamChan = upstreamChan
@@ -134,6 +142,9 @@ func (eg *EgressServer) egressConnectionReader(mc *MultiplexedConnection) {
 		copy(slice[0:4], mc.ID_bytes[:])
 		binary.BigEndian.PutUint32(slice[4:8], uint32(n))
 		copy(slice[MULTIPLEXER_HEADER_SIZE:], buffer[:n])
+		if eg.classifier != nil {
+			slice = TagFrame(eg.classifier.Classify(mc.ID, n), slice)
+		}
 		eg.downstreamChan <- slice
 
 		if eg.verbose {
@@ -12,6 +12,7 @@ import (
 	"gopkg.in/dedis/onet.v2/log"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,12 +42,41 @@ type IngressServer struct {
 	downstreamChan        chan []byte
 	stopChan              chan bool
 	verbose               bool
+	status                *IngressStatus
+}
+
+// IngressStatus counts the streams and the bytes of an Ingress Server; it can be read while the server runs
+type IngressStatus struct {
+	activeStreams   int64
+	bytesUpstream   int64
+	bytesDownstream int64
+}
+
+// ActiveStreams returns the number of connections currently open on the Ingress Server
+func (s *IngressStatus) ActiveStreams() int64 {
+	return atomic.LoadInt64(&s.activeStreams)
+}
+
+// BytesUpstream returns the number of bytes read from the connections, towards the DC-net
+func (s *IngressStatus) BytesUpstream() int64 {
+	return atomic.LoadInt64(&s.bytesUpstream)
+}
+
+// BytesDownstream returns the number of bytes written to the connections, from the DC-net
+func (s *IngressStatus) BytesDownstream() int64 {
+	return atomic.LoadInt64(&s.bytesDownstream)
 }
 
 // StartIngressServer creates (and block) an Ingress Server
 func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	StartIngressServerWithStatus(port, maxMessageSize, upstreamChan, downstreamChan, stopChan, verbose, new(IngressStatus))
+}
+
+// StartIngressServerWithStatus creates (and block) an Ingress Server, which counts its streams and bytes in "status"
+func StartIngressServerWithStatus(port int, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool, status *IngressStatus) {
 
 	ig := new(IngressServer)
+	ig.status = status
 	ig.maxMessageSize = maxMessageSize
 	ig.upstreamChan = upstreamChan
 	ig.downstreamChan = downstreamChan
@@ -153,7 +183,8 @@ func (ig *IngressServer) multiplexedChannelReader() {
 		ig.activeConnectionsLock.Lock()
 		for _, v := range ig.activeConnections {
 			if bytes.Equal(v.ID_bytes, ID) {
-				v.conn.Write(data)
+				n, _ := v.conn.Write(data)
+				atomic.AddInt64(&ig.status.bytesDownstream, int64(n))
 				break
 			}
 		}
@@ -163,6 +194,9 @@ func (ig *IngressServer) multiplexedChannelReader() {
 }
 
 func (ig *IngressServer) ingressConnectionReader(mc *MultiplexedConnection) {
+	atomic.AddInt64(&ig.status.activeStreams, 1)
+	defer atomic.AddInt64(&ig.status.activeStreams, -1)
+
 	for {
 		// Check if we need to stop
 		select {
@@ -202,6 +236,7 @@ func (ig *IngressServer) ingressConnectionReader(mc *MultiplexedConnection) {
 			log.Lvl1("Ingress Server -> DCNet:\n", hex.Dump(slice))
 		}
 
+		atomic.AddInt64(&ig.status.bytesUpstream, int64(n))
 		ig.upstreamChan <- slice
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"os"
@@ -331,3 +332,67 @@ func TestDownstreamIngressMultiplexer(t *testing.T) {
 	stopChan <- true
 	time.Sleep(2 * time.Second)
 }
+
+// Checks that the Ingress Server counts its streams and bytes
+func TestIngressStatus(t *testing.T) {
+
+	port := 3001
+	payloadLength := 20
+	upstreamChan := make(chan []byte)
+	downstreamChan := make(chan []byte)
+	stopChan := make(chan bool, 1)
+	status := new(IngressStatus)
+
+	go StartIngressServerWithStatus(port, payloadLength, upstreamChan, downstreamChan, stopChan, false, status)
+
+	time.Sleep(2 * time.Second)
+
+	if status.ActiveStreams() != 0 {
+		t.Error("Should have no active stream, has", status.ActiveStreams())
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("Could not connect client", err)
+	}
+
+	// the client sends "hello"
+	conn.Write([]byte("hello"))
+	var id []byte
+	select {
+	case data := <-upstreamChan:
+		id = data[0:4]
+	case <-time.After(1 * time.Second):
+		t.Fatal("No data written on the upstreamchannel")
+	}
+	if status.ActiveStreams() != 1 || status.BytesUpstream() != 5 {
+		t.Error("Should have 1 active stream and 5 bytes upstream, has", status.ActiveStreams(), "and", status.BytesUpstream())
+	}
+
+	// the client receives "answer"
+	slice := make([]byte, MULTIPLEXER_HEADER_SIZE+6)
+	copy(slice[0:4], id)
+	binary.BigEndian.PutUint32(slice[4:8], 6)
+	copy(slice[MULTIPLEXER_HEADER_SIZE:], "answer")
+	downstreamChan <- slice
+
+	buffer := make([]byte, 6)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "answer" {
+		t.Error("Client should have received \"answer\", received", string(buffer), err)
+	}
+	time.Sleep(100 * time.Millisecond) //the server counts the bytes once written
+	if status.BytesDownstream() != 6 {
+		t.Error("Should have 6 bytes downstream, has", status.BytesDownstream())
+	}
+
+	// the stream ends when the client closes the connection
+	conn.Close()
+	time.Sleep(2 * time.Second)
+	if status.ActiveStreams() != 0 {
+		t.Error("Should have no active stream after the connection closed, has", status.ActiveStreams())
+	}
+
+	stopChan <- true
+	time.Sleep(2 * time.Second)
+}
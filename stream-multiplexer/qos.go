@@ -0,0 +1,70 @@
+package stream_multiplexer
+
+import (
+	"sync"
+	"time"
+)
+
+// QoS classes used to tag the frames going towards the clients (lower is more urgent)
+const (
+	QOS_CLASS_INTERACTIVE byte = iota
+	QOS_CLASS_BULK
+)
+
+// QOS_TAG_SIZE is the size of the tag prepended to a multiplexed frame, currently 1 byte for the class
+const QOS_TAG_SIZE = 1
+
+// QOS_CLASSIFIER_PERIOD is the period over which the throughput of a stream is measured
+const QOS_CLASSIFIER_PERIOD = time.Second
+
+// StreamClassifier assigns a QoS class to each stream : a stream which sends more than BulkThreshold
+// bytes per QOS_CLASSIFIER_PERIOD is bulk, otherwise it is interactive
+type StreamClassifier struct {
+	sync.Mutex
+	BulkThreshold int
+	periodStart   time.Time
+	bytesInPeriod map[string]int
+}
+
+// NewStreamClassifier creates a StreamClassifier with the given threshold (in bytes per second)
+func NewStreamClassifier(bulkThreshold int) *StreamClassifier {
+	return &StreamClassifier{
+		BulkThreshold: bulkThreshold,
+		periodStart:   time.Now(),
+		bytesInPeriod: make(map[string]int),
+	}
+}
+
+// Classify accounts for nBytes sent on stream ID, and returns the class of the stream
+func (c *StreamClassifier) Classify(ID string, nBytes int) byte {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Since(c.periodStart) > QOS_CLASSIFIER_PERIOD {
+		c.periodStart = time.Now()
+		c.bytesInPeriod = make(map[string]int)
+	}
+	c.bytesInPeriod[ID] += nBytes
+
+	if c.bytesInPeriod[ID] > c.BulkThreshold {
+		return QOS_CLASS_BULK
+	}
+	return QOS_CLASS_INTERACTIVE
+}
+
+// TagFrame returns [class][frame]
+func TagFrame(class byte, frame []byte) []byte {
+	tagged := make([]byte, QOS_TAG_SIZE+len(frame))
+	tagged[0] = class
+	copy(tagged[QOS_TAG_SIZE:], frame)
+	return tagged
+}
+
+// UntagFrame returns the class and the multiplexed frame contained in a tagged frame. Frames too short to contain
+// a tag are considered interactive
+func UntagFrame(tagged []byte) (byte, []byte) {
+	if len(tagged) < QOS_TAG_SIZE {
+		return QOS_CLASS_INTERACTIVE, tagged
+	}
+	return tagged[0], tagged[QOS_TAG_SIZE:]
+}
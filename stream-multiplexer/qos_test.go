@@ -0,0 +1,34 @@
+package stream_multiplexer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestQoSTagging(t *testing.T) {
+
+	c := NewStreamClassifier(1000)
+
+	if c.Classify("ssh0", 100) != QOS_CLASS_INTERACTIVE {
+		t.Error("A small stream should be interactive")
+	}
+	if c.Classify("bulk", 800) != QOS_CLASS_INTERACTIVE {
+		t.Error("A stream below the threshold should be interactive")
+	}
+	if c.Classify("bulk", 800) != QOS_CLASS_BULK {
+		t.Error("A stream above the threshold should be bulk")
+	}
+	if c.Classify("ssh0", 100) != QOS_CLASS_INTERACTIVE {
+		t.Error("Streams should be classified independently")
+	}
+
+	frame := []byte{1, 2, 3, 4, 0, 0, 0, 1, 42}
+	class, untagged := UntagFrame(TagFrame(QOS_CLASS_BULK, frame))
+	if class != QOS_CLASS_BULK || !bytes.Equal(untagged, frame) {
+		t.Error("UntagFrame(TagFrame()) should be the identity")
+	}
+	class, _ = UntagFrame([]byte{})
+	if class != QOS_CLASS_INTERACTIVE {
+		t.Error("An empty frame should be interactive")
+	}
+}